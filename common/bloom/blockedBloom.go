@@ -0,0 +1,103 @@
+package bloom
+
+import (
+	"math"
+	"github.com/pister/yfs/common/bitset"
+	"github.com/pister/yfs/common/hashutil/murmur3"
+)
+
+const (
+	// all the bits of one key are in one block, the size of a cache line
+	blockBitLength   = 512
+	maxHashCount     = 30
+	blockedBloomSeed = 7
+)
+
+// BitsPerKeyForFalsePositiveRate returns the bits per key which makes the false positive rate
+// to be the rate with the optimal hash count.
+func BitsPerKeyForFalsePositiveRate(rate float64) float64 {
+	if rate <= 0 || rate >= 1 {
+		return 0
+	}
+	return -math.Log(rate) / (math.Ln2 * math.Ln2)
+}
+
+// OptimalHashCount returns the hash count which makes the minimal false positive rate.
+func OptimalHashCount(bitsPerKey float64) uint32 {
+	k := uint32(math.Floor(bitsPerKey*math.Ln2 + 0.5))
+	if k < 1 {
+		return 1
+	}
+	if k > maxHashCount {
+		return maxHashCount
+	}
+	return k
+}
+
+// BlockedBloomFilter selects one block of 512 bits by the hash of the key, and sets
+// the bits in the block by double hashing, so only one cache line is touched by a key.
+type BlockedBloomFilter struct {
+	bits      *bitset.BitSet
+	blocks    uint32
+	hashCount uint32
+}
+
+// NewBlockedBloomFilter makes a filter for keyCount keys with bitsPerKey bits for each key.
+func NewBlockedBloomFilter(keyCount int, bitsPerKey float64) *BlockedBloomFilter {
+	bitLength := uint64(math.Ceil(float64(keyCount) * bitsPerKey))
+	blocks := (bitLength + blockBitLength - 1) / blockBitLength
+	if blocks < 1 {
+		blocks = 1
+	}
+	if blocks > math.MaxUint32/blockBitLength {
+		blocks = math.MaxUint32 / blockBitLength
+	}
+	return NewBlockedBloomFilterWithBitSet(bitset.NewBitSet(uint32(blocks*blockBitLength)), OptimalHashCount(bitsPerKey))
+}
+
+func NewBlockedBloomFilterWithBitSet(bs *bitset.BitSet, hashCount uint32) *BlockedBloomFilter {
+	filter := new(BlockedBloomFilter)
+	filter.bits = bs
+	filter.blocks = bs.Length() / blockBitLength
+	if filter.blocks == 0 {
+		filter.blocks = 1
+	}
+	filter.hashCount = hashCount
+	return filter
+}
+
+func (filter *BlockedBloomFilter) positions(data []byte, callback func(pos uint32) bool) {
+	h1, h2 := murmur3.Sum128WithSeed(data, blockedBloomSeed)
+	base := uint32(h1%uint64(filter.blocks)) * blockBitLength
+	a := uint32(h2)
+	b := uint32(h2>>32) | 1
+	for i := uint32(0); i < filter.hashCount; i++ {
+		if !callback(base + (a+i*b)%blockBitLength) {
+			return
+		}
+	}
+}
+
+func (filter *BlockedBloomFilter) Add(data []byte) {
+	filter.positions(data, func(pos uint32) bool {
+		filter.bits.Set(pos, true)
+		return true
+	})
+}
+
+func (filter *BlockedBloomFilter) Hit(data []byte) bool {
+	hit := true
+	filter.positions(data, func(pos uint32) bool {
+		hit = filter.bits.Get(pos)
+		return hit
+	})
+	return hit
+}
+
+func (filter *BlockedBloomFilter) GetBitData() ([]byte, uint32) {
+	return filter.bits.GetRawData(), filter.bits.Length()
+}
+
+func (filter *BlockedBloomFilter) GetHashCount() uint32 {
+	return filter.hashCount
+}
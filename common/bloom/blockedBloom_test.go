@@ -0,0 +1,45 @@
+package bloom
+
+import (
+	"testing"
+	"fmt"
+	"github.com/pister/yfs/common/bitset"
+)
+
+func TestBlockedBloomFilter(t *testing.T) {
+	count := 10000
+	filter := NewBlockedBloomFilter(count, BitsPerKeyForFalsePositiveRate(0.01))
+	for i := 0; i < count; i++ {
+		filter.Add([]byte(fmt.Sprintf("hello-%d", i)))
+	}
+	for i := 0; i < count; i++ {
+		if !filter.Hit([]byte(fmt.Sprintf("hello-%d", i))) {
+			t.Fatal("added key not hit", i)
+		}
+	}
+	falsePositive := 0
+	for i := 0; i < count; i++ {
+		if filter.Hit([]byte(fmt.Sprintf("world-%d", i))) {
+			falsePositive++
+		}
+	}
+	if falsePositive > count*3/100 {
+		t.Fatal("too many false positive", falsePositive)
+	}
+	data, bitLength := filter.GetBitData()
+	loaded := NewBlockedBloomFilterWithBitSet(bitset.NewBitSetWithInitData(bitLength, data), filter.GetHashCount())
+	for i := 0; i < count; i++ {
+		if !loaded.Hit([]byte(fmt.Sprintf("hello-%d", i))) {
+			t.Fatal("loaded filter not hit", i)
+		}
+	}
+}
+
+func TestOptimalHashCount(t *testing.T) {
+	if OptimalHashCount(10) != 7 {
+		t.Fatal("hash count not match", OptimalHashCount(10))
+	}
+	if OptimalHashCount(0) != 1 {
+		t.Fatal("hash count not match for 0")
+	}
+}
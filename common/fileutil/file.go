@@ -4,10 +4,16 @@ import (
 	"os"
 	"io/ioutil"
 	"fmt"
+	"io"
+	"github.com/pister/yfs/common/vfs"
 )
 
 func PathExists(path string) (bool, error) {
-	_, err := os.Stat(path)
+	return PathExistsWithFS(vfs.Default, path)
+}
+
+func PathExistsWithFS(fs vfs.FS, path string) (bool, error) {
+	_, err := fs.Stat(path)
 	if err == nil {
 		return true, nil
 	}
@@ -22,24 +28,82 @@ func WriteDataToFile(path string, data []byte) error {
 }
 
 func DeleteFile(path string) error {
-	exist, err := PathExists(path)
+	return DeleteFileWithFS(vfs.Default, path)
+}
+
+func DeleteFileWithFS(fs vfs.FS, path string) error {
+	exist, err := PathExistsWithFS(fs, path)
 	if err != nil {
 		return err
 	}
 	if !exist {
 		return nil
 	}
-	return os.Remove(path)
+	return fs.Remove(path)
 }
 
 
 func MkDirs(dir string) error {
-	fi, err := os.Stat(dir)
+	return MkDirsWithFS(vfs.Default, dir)
+}
+
+func MkDirsWithFS(fs vfs.FS, dir string) error {
+	fi, err := fs.Stat(dir)
 	if err == nil || !os.IsNotExist(err) {
 		if fi.IsDir() {
 			return nil
 		}
 		return fmt.Errorf("%s is a normal file", dir)
 	}
-	return os.MkdirAll(dir, os.ModeDir|os.ModePerm)
+	return fs.MkdirAll(dir, os.ModeDir|os.ModePerm)
+}
+
+func CopyFile(src, dest string) error {
+	return CopyFileWithLength(src, dest, -1)
+}
+
+func CopyFileWithFS(fs vfs.FS, src, dest string) error {
+	return CopyFileWithLengthWithFS(fs, src, dest, -1)
+}
+
+// copy the first length bytes of src to dest, the whole file will be copied if length < 0
+func CopyFileWithLength(src, dest string, length int64) error {
+	return CopyFileWithLengthWithFS(vfs.Default, src, dest, length)
+}
+
+func CopyFileWithLengthWithFS(fs vfs.FS, src, dest string, length int64) error {
+	srcFile, err := fs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	destFile, err := fs.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer destFile.Close()
+	var reader io.Reader = srcFile
+	if length >= 0 {
+		reader = io.LimitReader(srcFile, length)
+	}
+	n, err := io.Copy(destFile, reader)
+	if err != nil {
+		return err
+	}
+	if length >= 0 && n != length {
+		return fmt.Errorf("copy %s fail, need %d bytes but %d", src, length, n)
+	}
+	return destFile.Sync()
+}
+
+// hard link src to dest, if it fails, such as they are not in the same device, copy it.
+func LinkOrCopyFile(src, dest string) error {
+	return LinkOrCopyFileWithFS(vfs.Default, src, dest)
+}
+
+func LinkOrCopyFileWithFS(fs vfs.FS, src, dest string) error {
+	if err := fs.Link(src, dest); err == nil {
+		return nil
+	}
+	return CopyFileWithFS(fs, src, dest)
 }
@@ -5,28 +5,33 @@ import (
 	"sync/atomic"
 	"fmt"
 	"io"
+	"github.com/pister/yfs/common/vfs"
 )
 
 type ConcurrentReadFile struct {
-	fileChan       chan *os.File
+	fileChan       chan vfs.File
 	concurrentSize int
 	initFileSize   int64
 }
 
 type PositionWriteFile struct {
-	fileChan        chan *os.File
+	fileChan        chan vfs.File
 	writingPosition int64
 }
 
 func OpenAsConcurrentReadFile(path string, concurrentSize int) (*ConcurrentReadFile, error) {
+	return OpenAsConcurrentReadFileWithFS(vfs.Default, path, concurrentSize)
+}
+
+func OpenAsConcurrentReadFileWithFS(fs vfs.FS, path string, concurrentSize int) (*ConcurrentReadFile, error) {
 	cfReader := new(ConcurrentReadFile)
 	cfReader.concurrentSize = concurrentSize
-	cfReader.fileChan = make(chan *os.File, concurrentSize)
-	tempFiles := make([]*os.File, 0, concurrentSize)
+	cfReader.fileChan = make(chan vfs.File, concurrentSize)
+	tempFiles := make([]vfs.File, 0, concurrentSize)
 	var err error = nil
 	for i := 0; i < concurrentSize; i++ {
-		var fp *os.File = nil
-		fp, err = os.OpenFile(path, os.O_RDONLY, 0666)
+		var fp vfs.File = nil
+		fp, err = fs.Open(path)
 		if err != nil {
 			break
 		}
@@ -109,10 +114,14 @@ func (cfReader *ConcurrentReadFile) Close() error {
 }
 
 func OpenAsPositionWriteFile(path string) (*PositionWriteFile, error) {
+	return OpenAsPositionWriteFileWithFS(vfs.Default, path)
+}
+
+func OpenAsPositionWriteFileWithFS(fs vfs.FS, path string) (*PositionWriteFile, error) {
 	pfWriter := new(PositionWriteFile)
-	pfWriter.fileChan = make(chan *os.File, 1)
+	pfWriter.fileChan = make(chan vfs.File, 1)
 	// here does not use O_APPEND flag because of if it is used, Seek function will be not work.
-	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	file, err := fs.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
 		return nil, err
 	}
@@ -195,13 +204,17 @@ type ReadWriteFile struct {
 }
 
 func OpenReadWriteFile(path string, concurrentSize int) (*ReadWriteFile, error) {
+	return OpenReadWriteFileWithFS(vfs.Default, path, concurrentSize)
+}
+
+func OpenReadWriteFileWithFS(fs vfs.FS, path string, concurrentSize int) (*ReadWriteFile, error) {
 	readWriteFile := new(ReadWriteFile)
 	readWriteFile.path = path
-	writer, err := OpenAsPositionWriteFile(path)
+	writer, err := OpenAsPositionWriteFileWithFS(fs, path)
 	if err != nil {
 		return nil, err
 	}
-	reader, err := OpenAsConcurrentReadFile(path, concurrentSize)
+	reader, err := OpenAsConcurrentReadFileWithFS(fs, path, concurrentSize)
 	if err != nil {
 		writer.Close()
 		return nil, err
@@ -32,7 +32,8 @@ func (list *CopyOnWriteList) AddFirst(items ... interface{}) {
 		return
 	}
 	for {
-		oldList := *(*[]interface{})(atomic.LoadPointer(&list.innerList))
+		oldListPtr := atomic.LoadPointer(&list.innerList)
+		oldList := *(*[]interface{})(oldListPtr)
 		oldLen := len(oldList)
 		newLen := oldLen + itemsLen
 		newList := make([]interface{}, newLen, newLen)
@@ -40,7 +41,7 @@ func (list *CopyOnWriteList) AddFirst(items ... interface{}) {
 		copy(newList, items)
 		copy(newList[itemsLen:], oldList)
 		newListPtr := unsafe.Pointer(&newList)
-		if atomic.CompareAndSwapPointer(&list.innerList, list.innerList, newListPtr) {
+		if atomic.CompareAndSwapPointer(&list.innerList, oldListPtr, newListPtr) {
 			return
 		}
 	}
@@ -54,7 +55,8 @@ func (list *CopyOnWriteList) AddLast(items ... interface{}) {
 		return
 	}
 	for {
-		oldList := *(*[]interface{})(atomic.LoadPointer(&list.innerList))
+		oldListPtr := atomic.LoadPointer(&list.innerList)
+		oldList := *(*[]interface{})(oldListPtr)
 		oldLen := len(oldList)
 		newLen := oldLen + itemsLen
 		newList := make([]interface{}, newLen, newLen)
@@ -62,7 +64,7 @@ func (list *CopyOnWriteList) AddLast(items ... interface{}) {
 		copy(newList, oldList)
 		copy(newList[oldLen:], items)
 		newListPtr := unsafe.Pointer(&newList)
-		if atomic.CompareAndSwapPointer(&list.innerList, list.innerList, newListPtr) {
+		if atomic.CompareAndSwapPointer(&list.innerList, oldListPtr, newListPtr) {
 			return
 		}
 	}
@@ -79,7 +81,8 @@ func (list *CopyOnWriteList) Delete(items ... interface{}) {
 		deletingItemsMap[item] = 1
 	}
 	for {
-		oldList := *(*[]interface{})(atomic.LoadPointer(&list.innerList))
+		oldListPtr := atomic.LoadPointer(&list.innerList)
+		oldList := *(*[]interface{})(oldListPtr)
 		oldLen := len(oldList)
 		if oldLen == 0 {
 			return
@@ -96,7 +99,38 @@ func (list *CopyOnWriteList) Delete(items ... interface{}) {
 			}
 		}
 		newListPtr := unsafe.Pointer(&newList)
-		if atomic.CompareAndSwapPointer(&list.innerList, list.innerList, newListPtr) {
+		if atomic.CompareAndSwapPointer(&list.innerList, oldListPtr, newListPtr) {
+			return
+		}
+	}
+}
+
+// the new item takes the place of the first one of the old items in the list, and the
+// other old items are deleted. The new item is added at the last if none of the old items exist.
+func (list *CopyOnWriteList) Replace(newItem interface{}, oldItems ... interface{}) {
+	deletingItemsMap := make(map[interface{}]int)
+	for _, item := range oldItems {
+		deletingItemsMap[item] = 1
+	}
+	for {
+		oldListPtr := atomic.LoadPointer(&list.innerList)
+		oldList := *(*[]interface{})(oldListPtr)
+		newList := make([]interface{}, 0, len(oldList)+1)
+		replaced := false
+		for _, existItem := range oldList {
+			_, deleting := deletingItemsMap[existItem]
+			if !deleting {
+				newList = append(newList, existItem)
+			} else if !replaced {
+				newList = append(newList, newItem)
+				replaced = true
+			}
+		}
+		if !replaced {
+			newList = append(newList, newItem)
+		}
+		newListPtr := unsafe.Pointer(&newList)
+		if atomic.CompareAndSwapPointer(&list.innerList, oldListPtr, newListPtr) {
 			return
 		}
 	}
@@ -3,6 +3,7 @@ package listutil
 import (
 	"testing"
 	"fmt"
+	"sync"
 )
 
 func TestCopyOnWriteList_Add(t *testing.T) {
@@ -60,3 +61,48 @@ func TestCopyOnWriteList_Delete(t *testing.T) {
 		return false, nil
 	})
 }
+
+func TestCopyOnWriteList_Replace(t *testing.T) {
+	list := NewCopyOnWriteList()
+	list.AddLast("a", "b", "c", "d")
+	list.Replace("x", "b", "c")
+	result := make([]string, 0, 3)
+	list.Foreach(func(item interface{}) (bool, error) {
+		result = append(result, item.(string))
+		return false, nil
+	})
+	if fmt.Sprint(result) != "[a x d]" {
+		t.Fatal("replace not match", result)
+	}
+}
+
+func TestCopyOnWriteList_ConcurrentReplace(t *testing.T) {
+	list := NewCopyOnWriteList()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				list.AddLast(fmt.Sprintf("old-%d-%d", g, i))
+				list.Replace(fmt.Sprintf("new-%d-%d", g, i), fmt.Sprintf("old-%d-%d", g, i))
+			}
+		}(g)
+	}
+	wg.Wait()
+	items := make(map[string]bool)
+	list.Foreach(func(item interface{}) (bool, error) {
+		items[item.(string)] = true
+		return false, nil
+	})
+	if list.Length() != 8*500 || len(items) != 8*500 {
+		t.Fatal("items lost", list.Length(), len(items))
+	}
+	for g := 0; g < 8; g++ {
+		for i := 0; i < 500; i++ {
+			if !items[fmt.Sprintf("new-%d-%d", g, i)] {
+				t.Fatal("item not replaced", g, i)
+			}
+		}
+	}
+}
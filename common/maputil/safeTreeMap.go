@@ -1,6 +1,9 @@
 package maputil
 
-import "sync"
+import (
+	"sync"
+	rbt "github.com/pister/yfs/common/maputil/redblacktree"
+)
 
 // thread-safe tree map
 
@@ -65,8 +68,12 @@ func (m *SafeTreeMap) Foreach(callback func(key []byte, value interface{}) bool
 	return nil
 }
 
-func NewSafeTreeMap() *SafeTreeMap {
+func (m *SafeTreeMap) GetComparator() rbt.Comparator {
+	return m.treeMap.GetComparator()
+}
+
+func NewSafeTreeMap(comparator ...rbt.Comparator) *SafeTreeMap {
 	m := new(SafeTreeMap)
-	m.treeMap = NewTreeMap()
+	m.treeMap = NewTreeMap(comparator...)
 	return m
 }
@@ -34,7 +34,8 @@ func (sm *SwitchingMap) getSwitching() *maputil.SafeTreeMap {
 func (sm *SwitchingMap) SwitchNew() *maputil.SafeTreeMap  {
 	oldMain := sm.getMain()
 	atomic.StorePointer(&sm.switchingPtr, unsafe.Pointer(oldMain))
-	atomic.StorePointer(&sm.mainPtr, unsafe.Pointer(maputil.NewSafeTreeMap()))
+	// the new main data is ordered as the old one
+	atomic.StorePointer(&sm.mainPtr, unsafe.Pointer(maputil.NewSafeTreeMap(oldMain.GetComparator())))
 	return oldMain
 }
 
@@ -76,3 +77,33 @@ func (sm *SwitchingMap) Get(key []byte) (interface{}, bool) {
 func (sm *SwitchingMap) ForeachMain(callback func(key []byte, value interface{}) bool) {
 	sm.getMain().Foreach(callback)
 }
+
+// it does nothing when not switching
+func (sm *SwitchingMap) ForeachSwitching(callback func(key []byte, value interface{}) bool) {
+	w := sm.getSwitching()
+	if w == nil {
+		return
+	}
+	w.Foreach(callback)
+}
+
+func (sm *SwitchingMap) IsEmpty() bool {
+	if sm.getMain().Length() > 0 {
+		return false
+	}
+	w := sm.getSwitching()
+	return w == nil || w.Length() == 0
+}
+
+func (sm *SwitchingMap) MainLength() int {
+	return sm.getMain().Length()
+}
+
+// the length of the switching data, it is 0 when not switching
+func (sm *SwitchingMap) SwitchingLength() int {
+	w := sm.getSwitching()
+	if w == nil {
+		return 0
+	}
+	return w.Length()
+}
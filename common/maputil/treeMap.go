@@ -17,8 +17,13 @@ type TreeMap struct {
 	tree *rbt.Tree
 }
 
-func NewTreeMap() *TreeMap {
-	return &TreeMap{tree: rbt.NewTree()}
+// the keys are ordered by the comparator if it is given, or by bytes
+func NewTreeMap(comparator ...rbt.Comparator) *TreeMap {
+	return &TreeMap{tree: rbt.NewTree(comparator...)}
+}
+
+func (m *TreeMap) GetComparator() rbt.Comparator {
+	return m.tree.Comparator
 }
 
 func (m *TreeMap) Put(key []byte, value interface{}) {
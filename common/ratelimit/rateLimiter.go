@@ -0,0 +1,121 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+type Priority int
+
+const (
+	// the high priority requests never wait, such as the foreground writes,
+	// the bytes of them are counted when the tokens are available, so the low priority ones wait longer.
+	PriorityHigh Priority = iota
+	PriorityLow
+)
+
+// the max time of waiting once, the rest of the waiting is computed again by the current rate,
+// so the changing of rate takes effect soon
+const maxWaitPeriod = 100 * time.Millisecond
+
+// RateLimiter is a token bucket of bytes, the bucket is refilled by bytesPerSecond
+// and can hold the tokens of one second at most.
+type RateLimiter struct {
+	mutex          sync.Mutex
+	bytesPerSecond int64
+	available      int64
+	lastRefill     time.Time
+}
+
+// bytesPerSecond <= 0 means no limit
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	limiter := new(RateLimiter)
+	limiter.bytesPerSecond = bytesPerSecond
+	limiter.available = bytesPerSecond
+	limiter.lastRefill = time.Now()
+	return limiter
+}
+
+// it can be changed at runtime, bytesPerSecond <= 0 means no limit
+func (limiter *RateLimiter) SetBytesPerSecond(bytesPerSecond int64) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.refill()
+	limiter.bytesPerSecond = bytesPerSecond
+	if limiter.available > bytesPerSecond {
+		limiter.available = bytesPerSecond
+	}
+}
+
+func (limiter *RateLimiter) GetBytesPerSecond() int64 {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	return limiter.bytesPerSecond
+}
+
+// must be called with mutex locked
+func (limiter *RateLimiter) refill() {
+	now := time.Now()
+	elapsed := now.Sub(limiter.lastRefill)
+	limiter.lastRefill = now
+	if limiter.bytesPerSecond <= 0 {
+		return
+	}
+	limiter.available += int64(float64(limiter.bytesPerSecond) * elapsed.Seconds())
+	if limiter.available > limiter.bytesPerSecond {
+		limiter.available = limiter.bytesPerSecond
+	}
+}
+
+// Request waits until the bytes can be used, the requests bigger than the bucket
+// wait for a full bucket and then take the tokens in advance.
+func (limiter *RateLimiter) Request(bytes int64, priority Priority) {
+	if limiter == nil || bytes <= 0 {
+		return
+	}
+	limiter.mutex.Lock()
+	limiter.refill()
+	if limiter.bytesPerSecond <= 0 {
+		limiter.mutex.Unlock()
+		return
+	}
+	if priority == PriorityHigh {
+		// the high priority only takes the available tokens and never runs into debt,
+		// so the tokens reserved by the low priority ones are not taken.
+		if limiter.available > 0 {
+			limiter.available -= bytes
+			if limiter.available < 0 {
+				limiter.available = 0
+			}
+		}
+		limiter.mutex.Unlock()
+		return
+	}
+	need := bytes
+	if need > limiter.bytesPerSecond {
+		need = limiter.bytesPerSecond
+	}
+	// the tokens which are still missing, they are refilled by the current rate while waiting
+	owed := float64(need - limiter.available)
+	// the tokens are reserved before waiting, so the requests are served in order
+	limiter.available -= bytes
+	bytesPerSecond := limiter.bytesPerSecond
+	limiter.mutex.Unlock()
+
+	last := time.Now()
+	for owed > 0 {
+		wait := time.Duration(owed / float64(bytesPerSecond) * float64(time.Second))
+		if wait > maxWaitPeriod {
+			wait = maxWaitPeriod
+		}
+		time.Sleep(wait)
+		// the rate may be changed while sleeping, the rest is waited by the new one
+		bytesPerSecond = limiter.GetBytesPerSecond()
+		if bytesPerSecond <= 0 {
+			return
+		}
+		now := time.Now()
+		owed -= float64(bytesPerSecond) * now.Sub(last).Seconds()
+		last = now
+	}
+}
@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(100 * 1024)
+	start := time.Now()
+	limiter.Request(100*1024, PriorityLow)
+	if time.Since(start) > 50*time.Millisecond {
+		t.Fatal("the full bucket should not wait")
+	}
+	start = time.Now()
+	limiter.Request(50*1024, PriorityLow)
+	elapsed := time.Since(start)
+	if elapsed < 400*time.Millisecond || elapsed > time.Second {
+		t.Fatal("wait time not match", elapsed)
+	}
+
+	// the high priority never waits
+	start = time.Now()
+	limiter.Request(200*1024, PriorityHigh)
+	if time.Since(start) > 50*time.Millisecond {
+		t.Fatal("the high priority should not wait")
+	}
+
+	// no limit
+	limiter.SetBytesPerSecond(0)
+	start = time.Now()
+	limiter.Request(10*1024*1024, PriorityLow)
+	if time.Since(start) > 50*time.Millisecond {
+		t.Fatal("should not wait without limit")
+	}
+}
+
+func TestRateLimiterLowPriorityNotStarved(t *testing.T) {
+	limiter := NewRateLimiter(100 * 1024)
+	stop := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		// the high priority traffic runs over the limit
+		for {
+			select {
+			case <-stop:
+				close(done)
+				return
+			default:
+				limiter.Request(2048, PriorityHigh)
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	}()
+	finished := make(chan bool)
+	go func() {
+		for i := 0; i < 3; i++ {
+			limiter.Request(60*1024, PriorityLow)
+		}
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the low priority request is starved")
+	}
+	close(stop)
+	<-done
+}
+
+func TestRateLimiterSetRateWhileWaiting(t *testing.T) {
+	limiter := NewRateLimiter(1024)
+	limiter.Request(1024, PriorityLow)
+	done := make(chan bool)
+	start := time.Now()
+	go func() {
+		// it waits about one second by the old rate
+		limiter.Request(1024, PriorityLow)
+		done <- true
+	}()
+	time.Sleep(50 * time.Millisecond)
+	limiter.SetBytesPerSecond(1024 * 1024)
+	<-done
+	if time.Since(start) > 500*time.Millisecond {
+		t.Fatal("the new rate must be used while waiting", time.Since(start))
+	}
+}
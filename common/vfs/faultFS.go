@@ -0,0 +1,252 @@
+package vfs
+
+import (
+	"os"
+	"io"
+	"sync"
+	"strings"
+	"fmt"
+)
+
+type Op int
+
+const (
+	// OpenFile, Open and Create
+	OpOpen Op = iota
+	OpRead
+	OpWrite
+	// Sync of files and SyncDir
+	OpSync
+	OpRename
+	OpRemove
+	OpLink
+	OpList
+	OpLock
+)
+
+var ErrInjected = fmt.Errorf("injected fault")
+
+// Fault fails the operations which match it
+type Fault struct {
+	Op Op
+	// only the paths contain it are matched, empty matches all
+	PathContains string
+	// fail the nth matched operation, from 1. 0 is the same as 1
+	Nth int
+	// all the matched operations after the nth one fail too
+	Sticky bool
+	// for OpWrite, the first half of the data is written before failing
+	Torn bool
+	// the returned error, nil means ErrInjected
+	Err error
+}
+
+type faultState struct {
+	fault   Fault
+	matched int
+}
+
+// FaultFS wraps a FS, and fails or tears the operations at the chosen points by the injected faults.
+type FaultFS struct {
+	fs     FS
+	mutex  sync.Mutex
+	faults []*faultState
+	fired  int
+}
+
+func NewFaultFS(fs FS) *FaultFS {
+	faultFS := new(FaultFS)
+	faultFS.fs = fs
+	return faultFS
+}
+
+func (fs *FaultFS) Inject(fault Fault) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.faults = append(fs.faults, &faultState{fault: fault})
+}
+
+// remove all the faults
+func (fs *FaultFS) Reset() {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.faults = nil
+}
+
+// the count of the failed operations
+func (fs *FaultFS) Fired() int {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return fs.fired
+}
+
+// returns the fault if the operation must fail
+func (fs *FaultFS) check(op Op, names ...string) *Fault {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	for _, state := range fs.faults {
+		if state.fault.Op != op || !matchPath(state.fault.PathContains, names) {
+			continue
+		}
+		state.matched++
+		nth := state.fault.Nth
+		if nth <= 0 {
+			nth = 1
+		}
+		if state.matched == nth || (state.fault.Sticky && state.matched > nth) {
+			fs.fired++
+			return &state.fault
+		}
+	}
+	return nil
+}
+
+func matchPath(pathContains string, names []string) bool {
+	if len(pathContains) == 0 {
+		return true
+	}
+	for _, name := range names {
+		if strings.Contains(name, pathContains) {
+			return true
+		}
+	}
+	return false
+}
+
+func (fault *Fault) error(op string, name string) error {
+	err := fault.Err
+	if err == nil {
+		err = ErrInjected
+	}
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+func (fs *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if fault := fs.check(OpOpen, name); fault != nil {
+		return nil, fault.error("open", name)
+	}
+	file, err := fs.fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: file, fs: fs}, nil
+}
+
+func (fs *FaultFS) Open(name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fs *FaultFS) Create(name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (fs *FaultFS) Rename(oldName, newName string) error {
+	if fault := fs.check(OpRename, oldName, newName); fault != nil {
+		return fault.error("rename", oldName)
+	}
+	return fs.fs.Rename(oldName, newName)
+}
+
+func (fs *FaultFS) Remove(name string) error {
+	if fault := fs.check(OpRemove, name); fault != nil {
+		return fault.error("remove", name)
+	}
+	return fs.fs.Remove(name)
+}
+
+func (fs *FaultFS) RemoveAll(name string) error {
+	if fault := fs.check(OpRemove, name); fault != nil {
+		return fault.error("remove", name)
+	}
+	return fs.fs.RemoveAll(name)
+}
+
+func (fs *FaultFS) Link(oldName, newName string) error {
+	if fault := fs.check(OpLink, oldName, newName); fault != nil {
+		return fault.error("link", oldName)
+	}
+	return fs.fs.Link(oldName, newName)
+}
+
+func (fs *FaultFS) Stat(name string) (os.FileInfo, error) {
+	return fs.fs.Stat(name)
+}
+
+func (fs *FaultFS) MkdirAll(dir string, perm os.FileMode) error {
+	return fs.fs.MkdirAll(dir, perm)
+}
+
+func (fs *FaultFS) List(dir string) ([]string, error) {
+	if fault := fs.check(OpList, dir); fault != nil {
+		return nil, fault.error("open", dir)
+	}
+	return fs.fs.List(dir)
+}
+
+func (fs *FaultFS) SyncDir(dir string) error {
+	if fault := fs.check(OpSync, dir); fault != nil {
+		return fault.error("sync", dir)
+	}
+	return fs.fs.SyncDir(dir)
+}
+
+func (fs *FaultFS) Lock(name string) (io.Closer, error) {
+	if fault := fs.check(OpLock, name); fault != nil {
+		return nil, fault.error("lock", name)
+	}
+	return fs.fs.Lock(name)
+}
+
+type faultFile struct {
+	File
+	fs *FaultFS
+}
+
+func (file *faultFile) Read(p []byte) (int, error) {
+	if fault := file.fs.check(OpRead, file.Name()); fault != nil {
+		return 0, fault.error("read", file.Name())
+	}
+	return file.File.Read(p)
+}
+
+func (file *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	if fault := file.fs.check(OpRead, file.Name()); fault != nil {
+		return 0, fault.error("read", file.Name())
+	}
+	return file.File.ReadAt(p, off)
+}
+
+func (file *faultFile) Write(p []byte) (int, error) {
+	if fault := file.fs.check(OpWrite, file.Name()); fault != nil {
+		if !fault.Torn {
+			return 0, fault.error("write", file.Name())
+		}
+		n, err := file.File.Write(p[:len(p)/2])
+		if err != nil {
+			return n, err
+		}
+		return n, fault.error("write", file.Name())
+	}
+	return file.File.Write(p)
+}
+
+func (file *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	if fault := file.fs.check(OpWrite, file.Name()); fault != nil {
+		if !fault.Torn {
+			return 0, fault.error("write", file.Name())
+		}
+		n, err := file.File.WriteAt(p[:len(p)/2], off)
+		if err != nil {
+			return n, err
+		}
+		return n, fault.error("write", file.Name())
+	}
+	return file.File.WriteAt(p, off)
+}
+
+func (file *faultFile) Sync() error {
+	if fault := file.fs.check(OpSync, file.Name()); fault != nil {
+		return fault.error("sync", file.Name())
+	}
+	return file.File.Sync()
+}
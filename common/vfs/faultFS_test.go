@@ -0,0 +1,55 @@
+package vfs
+
+import (
+	"testing"
+	"os"
+)
+
+func TestFaultFS(t *testing.T) {
+	fs := NewFaultFS(NewMemFS())
+	fs.Inject(Fault{Op: OpWrite, PathContains: "wal", Nth: 2, Torn: true})
+	file, err := fs.Create("/wal_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte("1234")); err != nil {
+		t.Fatal(err)
+	}
+	n, err := file.Write([]byte("5678"))
+	if err == nil || n != 2 {
+		t.Fatal("the write should be torn", n, err)
+	}
+	if _, err := file.Write([]byte("9")); err != nil {
+		t.Fatal("only the nth write fails", err)
+	}
+	file.Close()
+	info, _ := fs.Stat("/wal_1")
+	if info.Size() != 7 {
+		t.Fatal("size not match", info.Size())
+	}
+
+	// the other paths are not matched
+	file, _ = fs.Create("/sst_1")
+	if _, err := file.Write([]byte("1234")); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	fs.Inject(Fault{Op: OpRename, Sticky: true})
+	if err := fs.Rename("/sst_1", "/sst_2"); err == nil {
+		t.Fatal("rename should fail")
+	}
+	if err := fs.Rename("/sst_1", "/sst_2"); err == nil {
+		t.Fatal("the sticky fault should fail again")
+	}
+	if fs.Fired() != 3 {
+		t.Fatal("fired count not match", fs.Fired())
+	}
+	fs.Reset()
+	if err := fs.Rename("/sst_1", "/sst_2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("/sst_1"); !os.IsNotExist(err) {
+		t.Fatal("should be renamed")
+	}
+}
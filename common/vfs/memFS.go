@@ -0,0 +1,543 @@
+package vfs
+
+import (
+	"os"
+	"io"
+	"sync"
+	"time"
+	"sort"
+	"strings"
+	"syscall"
+	"fmt"
+	"path/filepath"
+	"errors"
+)
+
+// syscall.ENOTEMPTY and syscall.EBADF are not defined on all the platforms
+var errDirNotEmpty = errors.New("directory not empty")
+var errBadFileMode = errors.New("bad file descriptor")
+
+// MemFS keeps all the files in memory, it is used for the fast tests.
+// The hard links share the data as the real ones, and the lock only works in the same MemFS.
+type MemFS struct {
+	mutex sync.Mutex
+	// the files and dirs by the cleaned path
+	nodes map[string]*memNode
+	locks map[string]bool
+}
+
+type memNode struct {
+	mutex   sync.RWMutex
+	isDir   bool
+	data    []byte
+	modTime time.Time
+}
+
+func NewMemFS() *MemFS {
+	fs := new(MemFS)
+	fs.nodes = make(map[string]*memNode)
+	fs.locks = make(map[string]bool)
+	fs.nodes[string(filepath.Separator)] = newMemDirNode()
+	fs.nodes["."] = newMemDirNode()
+	return fs
+}
+
+func newMemDirNode() *memNode {
+	node := new(memNode)
+	node.isDir = true
+	node.modTime = time.Now()
+	return node
+}
+
+func childPrefix(dir string) string {
+	if strings.HasSuffix(dir, string(filepath.Separator)) {
+		return dir
+	}
+	return dir + string(filepath.Separator)
+}
+
+// must be called with the mutex
+func (fs *MemFS) checkParent(op string, name string) error {
+	node, exist := fs.nodes[filepath.Dir(name)]
+	if !exist {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	if !node.isDir {
+		return &os.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+	}
+	return nil
+}
+
+// must be called with the mutex
+func (fs *MemFS) hasChildren(dir string) bool {
+	prefix := childPrefix(dir)
+	for name := range fs.nodes {
+		if name != dir && strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (fs *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	name = filepath.Clean(name)
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	accessMode := flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR)
+	writable := accessMode != os.O_RDONLY
+	node, exist := fs.nodes[name]
+	if !exist {
+		if flag&os.O_CREATE == 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		if err := fs.checkParent("open", name); err != nil {
+			return nil, err
+		}
+		node = new(memNode)
+		node.modTime = time.Now()
+		fs.nodes[name] = node
+	} else {
+		if flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+		}
+		if node.isDir && writable {
+			return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+		}
+		if flag&os.O_TRUNC != 0 && writable {
+			node.mutex.Lock()
+			node.data = nil
+			node.modTime = time.Now()
+			node.mutex.Unlock()
+		}
+	}
+	file := new(memFile)
+	file.name = name
+	file.node = node
+	file.readable = accessMode != os.O_WRONLY
+	file.writable = writable
+	file.append = flag&os.O_APPEND != 0
+	return file, nil
+}
+
+func (fs *MemFS) Open(name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fs *MemFS) Create(name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (fs *MemFS) Rename(oldName, newName string) error {
+	oldName = filepath.Clean(oldName)
+	newName = filepath.Clean(newName)
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	node, exist := fs.nodes[oldName]
+	if !exist {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: os.ErrNotExist}
+	}
+	if err := fs.checkParent("rename", newName); err != nil {
+		return err
+	}
+	if target, exist := fs.nodes[newName]; exist && target.isDir {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: syscall.EEXIST}
+	}
+	if oldName == newName {
+		return nil
+	}
+	if node.isDir {
+		prefix := childPrefix(oldName)
+		for name, child := range fs.nodes {
+			if strings.HasPrefix(name, prefix) {
+				delete(fs.nodes, name)
+				fs.nodes[childPrefix(newName)+name[len(prefix):]] = child
+			}
+		}
+	}
+	delete(fs.nodes, oldName)
+	fs.nodes[newName] = node
+	return nil
+}
+
+func (fs *MemFS) Remove(name string) error {
+	name = filepath.Clean(name)
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	node, exist := fs.nodes[name]
+	if !exist {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if node.isDir && fs.hasChildren(name) {
+		return &os.PathError{Op: "remove", Path: name, Err: errDirNotEmpty}
+	}
+	delete(fs.nodes, name)
+	return nil
+}
+
+func (fs *MemFS) RemoveAll(name string) error {
+	name = filepath.Clean(name)
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	prefix := childPrefix(name)
+	for n := range fs.nodes {
+		if strings.HasPrefix(n, prefix) {
+			delete(fs.nodes, n)
+		}
+	}
+	delete(fs.nodes, name)
+	return nil
+}
+
+func (fs *MemFS) Link(oldName, newName string) error {
+	oldName = filepath.Clean(oldName)
+	newName = filepath.Clean(newName)
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	node, exist := fs.nodes[oldName]
+	if !exist {
+		return &os.LinkError{Op: "link", Old: oldName, New: newName, Err: os.ErrNotExist}
+	}
+	if node.isDir {
+		return &os.LinkError{Op: "link", Old: oldName, New: newName, Err: syscall.EPERM}
+	}
+	if _, exist := fs.nodes[newName]; exist {
+		return &os.LinkError{Op: "link", Old: oldName, New: newName, Err: os.ErrExist}
+	}
+	if err := fs.checkParent("link", newName); err != nil {
+		return err
+	}
+	fs.nodes[newName] = node
+	return nil
+}
+
+func (fs *MemFS) Stat(name string) (os.FileInfo, error) {
+	name = filepath.Clean(name)
+	fs.mutex.Lock()
+	node, exist := fs.nodes[name]
+	fs.mutex.Unlock()
+	if !exist {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return node.stat(name), nil
+}
+
+func (fs *MemFS) MkdirAll(dir string, perm os.FileMode) error {
+	dir = filepath.Clean(dir)
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	// the dirs from the top to the bottom
+	var dirs []string
+	for d := dir; ; d = filepath.Dir(d) {
+		dirs = append(dirs, d)
+		if d == filepath.Dir(d) {
+			break
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		node, exist := fs.nodes[dirs[i]]
+		if !exist {
+			fs.nodes[dirs[i]] = newMemDirNode()
+		} else if !node.isDir {
+			return &os.PathError{Op: "mkdir", Path: dirs[i], Err: syscall.ENOTDIR}
+		}
+	}
+	return nil
+}
+
+func (fs *MemFS) List(dir string) ([]string, error) {
+	dir = filepath.Clean(dir)
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	node, exist := fs.nodes[dir]
+	if !exist {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: os.ErrNotExist}
+	}
+	if !node.isDir {
+		return nil, &os.PathError{Op: "readdirent", Path: dir, Err: syscall.ENOTDIR}
+	}
+	names := make([]string, 0, 16)
+	for name := range fs.nodes {
+		if name != dir && filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// the entries are always durable in memory, it only checks the dir exists
+func (fs *MemFS) SyncDir(dir string) error {
+	dir = filepath.Clean(dir)
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	node, exist := fs.nodes[dir]
+	if !exist {
+		return &os.PathError{Op: "open", Path: dir, Err: os.ErrNotExist}
+	}
+	if !node.isDir {
+		return &os.PathError{Op: "sync", Path: dir, Err: syscall.ENOTDIR}
+	}
+	return nil
+}
+
+type memLock struct {
+	fs   *MemFS
+	name string
+}
+
+func (fs *MemFS) Lock(name string) (io.Closer, error) {
+	file, err := fs.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+	name = filepath.Clean(name)
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if fs.locks[name] {
+		return nil, fmt.Errorf("lock %s fail: it is locked", name)
+	}
+	fs.locks[name] = true
+	return &memLock{fs: fs, name: name}, nil
+}
+
+func (lock *memLock) Close() error {
+	lock.fs.mutex.Lock()
+	defer lock.fs.mutex.Unlock()
+	delete(lock.fs.locks, lock.name)
+	return nil
+}
+
+func (node *memNode) stat(name string) os.FileInfo {
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+	info := new(memFileInfo)
+	info.name = filepath.Base(name)
+	info.size = int64(len(node.data))
+	info.modTime = node.modTime
+	info.isDir = node.isDir
+	return info
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+func (info *memFileInfo) Name() string {
+	return info.name
+}
+
+func (info *memFileInfo) Size() int64 {
+	return info.size
+}
+
+func (info *memFileInfo) Mode() os.FileMode {
+	if info.isDir {
+		return os.ModeDir | 0777
+	}
+	return 0666
+}
+
+func (info *memFileInfo) ModTime() time.Time {
+	return info.modTime
+}
+
+func (info *memFileInfo) IsDir() bool {
+	return info.isDir
+}
+
+func (info *memFileInfo) Sys() interface{} {
+	return nil
+}
+
+type memFile struct {
+	name     string
+	node     *memNode
+	mutex    sync.Mutex
+	position int64
+	readable bool
+	writable bool
+	append   bool
+	closed   bool
+}
+
+func (file *memFile) check(op string, write bool) error {
+	if file.closed {
+		return &os.PathError{Op: op, Path: file.name, Err: os.ErrClosed}
+	}
+	if (write && !file.writable) || (!write && !file.readable) {
+		return &os.PathError{Op: op, Path: file.name, Err: errBadFileMode}
+	}
+	return nil
+}
+
+func (file *memFile) Name() string {
+	return file.name
+}
+
+func (file *memFile) Read(p []byte) (int, error) {
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+	if err := file.check("read", false); err != nil {
+		return 0, err
+	}
+	n, err := file.node.readAt(p, file.position)
+	file.position += int64(n)
+	if n > 0 {
+		// as os.File, EOF is returned at the next reading
+		return n, nil
+	}
+	return n, err
+}
+
+func (file *memFile) ReadAt(p []byte, off int64) (int, error) {
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+	if err := file.check("read", false); err != nil {
+		return 0, err
+	}
+	return file.node.readAt(p, off)
+}
+
+func (file *memFile) Write(p []byte) (int, error) {
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+	if err := file.check("write", true); err != nil {
+		return 0, err
+	}
+	var n int
+	if file.append {
+		n, file.position = file.node.appendData(p)
+	} else {
+		n = file.node.writeAt(p, file.position)
+		file.position += int64(n)
+	}
+	return n, nil
+}
+
+func (file *memFile) WriteAt(p []byte, off int64) (int, error) {
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+	if err := file.check("write", true); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "write", Path: file.name, Err: syscall.EINVAL}
+	}
+	return file.node.writeAt(p, off), nil
+}
+
+func (file *memFile) Seek(offset int64, whence int) (int64, error) {
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+	if file.closed {
+		return 0, &os.PathError{Op: "seek", Path: file.name, Err: os.ErrClosed}
+	}
+	var position int64
+	switch whence {
+	case io.SeekStart:
+		position = offset
+	case io.SeekCurrent:
+		position = file.position + offset
+	case io.SeekEnd:
+		file.node.mutex.RLock()
+		position = int64(len(file.node.data)) + offset
+		file.node.mutex.RUnlock()
+	default:
+		return 0, &os.PathError{Op: "seek", Path: file.name, Err: syscall.EINVAL}
+	}
+	if position < 0 {
+		return 0, &os.PathError{Op: "seek", Path: file.name, Err: syscall.EINVAL}
+	}
+	file.position = position
+	return position, nil
+}
+
+func (file *memFile) Sync() error {
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+	if file.closed {
+		return &os.PathError{Op: "sync", Path: file.name, Err: os.ErrClosed}
+	}
+	return nil
+}
+
+func (file *memFile) Stat() (os.FileInfo, error) {
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+	if file.closed {
+		return nil, &os.PathError{Op: "stat", Path: file.name, Err: os.ErrClosed}
+	}
+	return file.node.stat(file.name), nil
+}
+
+func (file *memFile) Truncate(size int64) error {
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+	if err := file.check("truncate", true); err != nil {
+		return err
+	}
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: file.name, Err: syscall.EINVAL}
+	}
+	file.node.truncate(size)
+	return nil
+}
+
+func (file *memFile) Close() error {
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+	if file.closed {
+		return &os.PathError{Op: "close", Path: file.name, Err: os.ErrClosed}
+	}
+	file.closed = true
+	return nil
+}
+
+func (node *memNode) readAt(p []byte, off int64) (int, error) {
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+	if off >= int64(len(node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (node *memNode) writeAt(p []byte, off int64) int {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	end := off + int64(len(p))
+	if end > int64(len(node.data)) {
+		node.data = append(node.data, make([]byte, end-int64(len(node.data)))...)
+	}
+	copy(node.data[off:], p)
+	node.modTime = time.Now()
+	return len(p)
+}
+
+// returns the written count and the end position
+func (node *memNode) appendData(p []byte) (int, int64) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	node.data = append(node.data, p...)
+	node.modTime = time.Now()
+	return len(p), int64(len(node.data))
+}
+
+func (node *memNode) truncate(size int64) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	if size <= int64(len(node.data)) {
+		node.data = node.data[:size:size]
+	} else {
+		node.data = append(node.data, make([]byte, size-int64(len(node.data)))...)
+	}
+	node.modTime = time.Now()
+}
@@ -0,0 +1,113 @@
+package vfs
+
+import (
+	"testing"
+	"os"
+	"io/ioutil"
+	"io"
+)
+
+func TestMemFS(t *testing.T) {
+	fs := NewMemFS()
+	if _, err := fs.Create("/a/b/c"); !os.IsNotExist(err) {
+		t.Fatal("the parent should not exist", err)
+	}
+	if err := fs.MkdirAll("/a/b", 0777); err != nil {
+		t.Fatal(err)
+	}
+	file, err := fs.Create("/a/b/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("hello"))
+	file.WriteAt([]byte("HE"), 0)
+	file.Seek(0, io.SeekStart)
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "HEllo" {
+		t.Fatal("data not match", string(data))
+	}
+	file.Close()
+	if _, err := file.Write([]byte("x")); err == nil {
+		t.Fatal("should fail after closing")
+	}
+
+	file, _ = fs.OpenFile("/a/b/c", os.O_WRONLY|os.O_APPEND, 0666)
+	file.Write([]byte(" world"))
+	file.Close()
+	info, err := fs.Stat("/a/b/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 11 || info.IsDir() {
+		t.Fatal("stat not match", info.Size())
+	}
+
+	// the link shares the data
+	if err := fs.Link("/a/b/c", "/a/d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Link("/a/b/c", "/a/d"); !os.IsExist(err) {
+		t.Fatal("the link should exist", err)
+	}
+	if err := fs.Rename("/a/b/c", "/a/b/e"); err != nil {
+		t.Fatal(err)
+	}
+	names, err := fs.List("/a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != "e" {
+		t.Fatal("list not match", names)
+	}
+	names, _ = fs.List("/a")
+	if len(names) != 2 || names[0] != "b" || names[1] != "d" {
+		t.Fatal("list not match", names)
+	}
+	if err := fs.Remove("/a/b"); err == nil {
+		t.Fatal("the dir is not empty")
+	}
+	if err := fs.Remove("/a/b/e"); err != nil {
+		t.Fatal(err)
+	}
+	file, err = fs.Open("/a/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := file.ReadAt(buf, 6); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "world" {
+		t.Fatal("data not match", string(buf))
+	}
+	if _, err := file.Write([]byte("x")); err == nil {
+		t.Fatal("should not write a read only file")
+	}
+	file.Close()
+	if err := fs.RemoveAll("/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("/a/d"); !os.IsNotExist(err) {
+		t.Fatal("should be removed", err)
+	}
+}
+
+func TestMemFSLock(t *testing.T) {
+	fs := NewMemFS()
+	lock, err := fs.Lock("/lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Lock("/lock"); err == nil {
+		t.Fatal("should be locked")
+	}
+	lock.Close()
+	lock, err = fs.Lock("/lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock.Close()
+}
@@ -0,0 +1,57 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package vfs
+
+import (
+	"io"
+	"os"
+	"sync"
+	"fmt"
+	"path/filepath"
+)
+
+func (fs *osFS) SyncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+var osLockMutex sync.Mutex
+
+// the locked names of this process
+var osLockedNames = make(map[string]bool)
+
+type osLock struct {
+	name string
+}
+
+// no file lock is supported on the platform, the file is only locked in this process
+func (fs *osFS) Lock(name string) (io.Closer, error) {
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+	name, err = filepath.Abs(name)
+	if err != nil {
+		return nil, err
+	}
+	osLockMutex.Lock()
+	defer osLockMutex.Unlock()
+	if osLockedNames[name] {
+		return nil, fmt.Errorf("lock %s fail: locked by others", name)
+	}
+	osLockedNames[name] = true
+	return &osLock{name: name}, nil
+}
+
+func (lock *osLock) Close() error {
+	osLockMutex.Lock()
+	defer osLockMutex.Unlock()
+	delete(osLockedNames, lock.name)
+	return nil
+}
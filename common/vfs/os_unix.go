@@ -0,0 +1,42 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package vfs
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"fmt"
+)
+
+func (fs *osFS) SyncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+type osLock struct {
+	file *os.File
+}
+
+// the lock is released by the os when the process exits
+func (fs *osFS) Lock(name string) (io.Closer, error) {
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("lock %s fail: %s", name, err)
+	}
+	return &osLock{file: file}, nil
+}
+
+func (lock *osLock) Close() error {
+	defer lock.file.Close()
+	return syscall.Flock(int(lock.file.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,38 @@
+//go:build windows
+// +build windows
+
+package vfs
+
+import (
+	"io"
+	"syscall"
+	"fmt"
+)
+
+// the dirs can not be synced on windows, the entries are durable after the files are synced
+func (fs *osFS) SyncDir(dir string) error {
+	return nil
+}
+
+type osLock struct {
+	handle syscall.Handle
+}
+
+// the file is opened without sharing, so the others can not open it until it is closed,
+// it is closed by the os when the process exits
+func (fs *osFS) Lock(name string) (io.Closer, error) {
+	path, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	handle, err := syscall.CreateFile(path, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil,
+		syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		return nil, fmt.Errorf("lock %s fail: %s", name, err)
+	}
+	return &osLock{handle: handle}, nil
+}
+
+func (lock *osLock) Close() error {
+	return syscall.CloseHandle(lock.handle)
+}
@@ -0,0 +1,109 @@
+package vfs
+
+import (
+	"io"
+	"os"
+	"sort"
+)
+
+// File is the opened file of FS, *os.File implements it.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	Name() string
+	Sync() error
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+}
+
+// FS is the file system used by the storage, so it can be replaced by the memory one
+// in tests, or wrapped to inject faults.
+// The errors of not existing files must be checked by os.IsNotExist.
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	// open for reading
+	Open(name string) (File, error)
+	// create or truncate for reading and writing
+	Create(name string) (File, error)
+	Rename(oldName, newName string) error
+	Remove(name string) error
+	RemoveAll(name string) error
+	// hard link, it fails if newName exists
+	Link(oldName, newName string) error
+	Stat(name string) (os.FileInfo, error)
+	MkdirAll(dir string, perm os.FileMode) error
+	// the names of the entries in the dir, they are sorted
+	List(dir string) ([]string, error)
+	// sync the entries of the dir, so the files created or renamed in it are durable
+	SyncDir(dir string) error
+	// lock the file exclusively, it is created if not exists.
+	// It fails if the file is locked by others, close the result to unlock.
+	Lock(name string) (io.Closer, error)
+}
+
+type osFS struct {
+}
+
+// OS is the FS of the operating system
+var OS FS = new(osFS)
+
+// Default is used when no FS is given
+var Default = OS
+
+func (fs *osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (fs *osFS) Open(name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fs *osFS) Create(name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (fs *osFS) Rename(oldName, newName string) error {
+	return os.Rename(oldName, newName)
+}
+
+func (fs *osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (fs *osFS) RemoveAll(name string) error {
+	return os.RemoveAll(name)
+}
+
+func (fs *osFS) Link(oldName, newName string) error {
+	return os.Link(oldName, newName)
+}
+
+func (fs *osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (fs *osFS) MkdirAll(dir string, perm os.FileMode) error {
+	return os.MkdirAll(dir, perm)
+}
+
+func (fs *osFS) List(dir string) ([]string, error) {
+	file, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	names, err := file.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
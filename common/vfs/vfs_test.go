@@ -0,0 +1,33 @@
+package vfs
+
+import (
+	"testing"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+func TestOSLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vfs_lock_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "lock")
+	lock, err := OS.Lock(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OS.Lock(name); err == nil {
+		t.Fatal("should be locked")
+	}
+	lock.Close()
+	lock, err = OS.Lock(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock.Close()
+	if err := OS.SyncDir(dir); err != nil {
+		t.Fatal(err)
+	}
+}
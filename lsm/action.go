@@ -28,7 +28,7 @@ type Action struct {
 
 func ActionFromReader(reader io.Reader) (*Action, error) {
 	headerBuf := make([]byte, 20)
-	_, err := reader.Read(headerBuf)
+	_, err := io.ReadFull(reader, headerBuf)
 	if err != nil {
 		return nil, err
 	}
@@ -46,7 +46,7 @@ func ActionFromReader(reader io.Reader) (*Action, error) {
 		return nil, fmt.Errorf("too big value length: %d", valueLen)
 	}
 	keyValueDataBuf := make([]byte, keyLen + valueLen)
-	_, err = reader.Read(keyValueDataBuf)
+	_, err = io.ReadFull(reader, keyValueDataBuf)
 	if err != nil {
 		return nil, err
 	}
@@ -59,8 +59,29 @@ func ActionFromReader(reader io.Reader) (*Action, error) {
 	return action, nil
 }
 
+func (action *Action) GetKey() []byte {
+	return action.key
+}
+
+func (action *Action) GetValue() []byte {
+	return action.value
+}
+
+func (action *Action) GetTs() uint64 {
+	return action.ts
+}
+
+func (action *Action) IsDelete() bool {
+	return action.op == actionTypeDelete
+}
+
+// the length of the action in the wal
+func (action *Action) encodedLen() int {
+	return 20 + len(action.key) + len(action.value)
+}
+
 func (action *Action) WriteTo(writer io.Writer) (int, error) {
-	writtenLen := 20+len(action.key)+len(action.value)
+	writtenLen := action.encodedLen()
 	buf := make([]byte, writtenLen)
 	buf[0] = action.version
 	buf[1] = byte(action.op)
@@ -54,16 +54,27 @@ const (
 	MaxMemData = 2 * 1024 * 1024
 )
 
+// the type of the value in block data
+type ValueType byte
+
+const (
+	ValueTypeNormal  ValueType = 0
+	// the value is a reference to the blob file
+	ValueTypeBlobRef           = 1
+)
+
 type BlockData struct {
-	Deleted DeletedFlag
-	Ts      uint64
-	Value   []byte
+	Deleted   DeletedFlag
+	ValueType ValueType
+	Ts        uint64
+	Value     []byte
 }
 
 type BlockDataHeader struct {
 	MagicCode1  byte
 	MagicCode2  byte
 	Deleted     DeletedFlag
+	ValueType   ValueType
 	BlockType   byte
 	DataSum     uint32
 	ValueLength uint32
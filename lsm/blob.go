@@ -0,0 +1,428 @@
+package lsm
+
+import (
+	"io"
+	"bufio"
+	"fmt"
+	"sync"
+	"regexp"
+	"path/filepath"
+	"github.com/pister/yfs/common/bytesutil"
+	"github.com/pister/yfs/common/hashutil"
+	"github.com/pister/yfs/common/fileutil"
+	"github.com/pister/yfs/lsm/base"
+	"github.com/pister/yfs/lsm/sst"
+	"github.com/pister/yfs/common/ratelimit"
+	"github.com/pister/yfs/common/vfs"
+)
+
+// blob file format summary
+/*
+	the big values are written to the blob files when flushing, and the sst only keeps the blob reference of them,
+	so the big values are not rewritten by compacting.
+
+blob-record layout:
+2 - bytes magic code
+1 - byte not used
+1 - byte not used
+4 - bytes value sum
+4 - bytes key length
+4 - bytes value length
+...bytes for key
+...bytes for value
+
+blob-reference layout, it is the value of sst data:
+8 - bytes blob file ts
+8 - bytes blob-record position
+4 - bytes value length
+*/
+
+const (
+	blobMagicCode1      = 'B'
+	blobMagicCode2      = 'L'
+	blobRecordHeaderLen = 16
+	blobRefLen          = 20
+	blobReadConcurrent  = 3
+)
+
+var blobNamePattern *regexp.Regexp
+
+func init() {
+	p, err := regexp.Compile(`^blob_\d+$`)
+	if err != nil {
+		panic(err)
+	}
+	blobNamePattern = p
+}
+
+func blobFileName(ts int64) string {
+	return fmt.Sprintf("blob_%d", ts)
+}
+
+type blobRef struct {
+	fileTs      int64
+	position    int64
+	valueLength uint32
+}
+
+func (ref blobRef) encode() []byte {
+	buf := make([]byte, blobRefLen)
+	bytesutil.CopyUint64ToBytes(uint64(ref.fileTs), buf, 0)
+	bytesutil.CopyUint64ToBytes(uint64(ref.position), buf, 8)
+	bytesutil.CopyUint32ToBytes(ref.valueLength, buf, 16)
+	return buf
+}
+
+func (ref blobRef) fileName() string {
+	return blobFileName(ref.fileTs)
+}
+
+// the size of the record in the blob file
+func (ref blobRef) recordSize(key []byte) int64 {
+	return int64(blobRecordHeaderLen + len(key) + int(ref.valueLength))
+}
+
+func decodeBlobRef(data []byte) (blobRef, error) {
+	if len(data) != blobRefLen {
+		return blobRef{}, fmt.Errorf("bad blob reference length: %d", len(data))
+	}
+	ref := blobRef{}
+	ref.fileTs = int64(bytesutil.GetUint64FromBytes(data, 0))
+	ref.position = int64(bytesutil.GetUint64FromBytes(data, 8))
+	ref.valueLength = bytesutil.GetUint32FromBytes(data, 16)
+	return ref, nil
+}
+
+type blobWriter struct {
+	fs           vfs.FS
+	file         vfs.File
+	fileName     string
+	tempFileName string
+	ts           int64
+	position     int64
+	limiter      *ratelimit.RateLimiter
+}
+
+func newBlobWriter(fs vfs.FS, dir string, ts int64) (*blobWriter, error) {
+	fileName := filepath.Join(dir, blobFileName(ts))
+	tempFileName := fileName + "_tmp"
+	file, err := fs.Create(tempFileName)
+	if err != nil {
+		return nil, err
+	}
+	writer := new(blobWriter)
+	writer.fs = fs
+	writer.file = file
+	writer.fileName = fileName
+	writer.tempFileName = tempFileName
+	writer.ts = ts
+	return writer, nil
+}
+
+func (writer *blobWriter) add(key []byte, value []byte) (blobRef, error) {
+	buf := make([]byte, blobRecordHeaderLen+len(key)+len(value))
+	buf[0] = blobMagicCode1
+	buf[1] = blobMagicCode2
+	bytesutil.CopyUint32ToBytes(hashutil.SumHash32(value), buf, 4)
+	bytesutil.CopyUint32ToBytes(uint32(len(key)), buf, 8)
+	bytesutil.CopyUint32ToBytes(uint32(len(value)), buf, 12)
+	copy(buf[blobRecordHeaderLen:], key)
+	copy(buf[blobRecordHeaderLen+len(key):], value)
+	writer.limiter.Request(int64(len(buf)), ratelimit.PriorityLow)
+	if _, err := writer.file.Write(buf); err != nil {
+		return blobRef{}, err
+	}
+	ref := blobRef{fileTs: writer.ts, position: writer.position, valueLength: uint32(len(value))}
+	writer.position += int64(len(buf))
+	return ref, nil
+}
+
+func (writer *blobWriter) commit() error {
+	if err := writer.file.Sync(); err != nil {
+		writer.file.Close()
+		return err
+	}
+	if err := writer.file.Close(); err != nil {
+		return err
+	}
+	return writer.fs.Rename(writer.tempFileName, writer.fileName)
+}
+
+func (writer *blobWriter) abort() {
+	writer.file.Close()
+	writer.fs.Remove(writer.tempFileName)
+}
+
+// it replaces the big values by blob references while writing the sst
+type blobSeparatingMap struct {
+	fs        vfs.FS
+	target    sst.ForeachAble
+	threshold int
+	dir       string
+	ts        int64
+	writer    *blobWriter
+	limiter   *ratelimit.RateLimiter
+}
+
+func newBlobSeparatingMap(fs vfs.FS, target sst.ForeachAble, threshold int, dir string, ts int64) *blobSeparatingMap {
+	m := new(blobSeparatingMap)
+	m.fs = fs
+	m.target = target
+	m.threshold = threshold
+	m.dir = dir
+	m.ts = ts
+	return m
+}
+
+func (m *blobSeparatingMap) Foreach(callback func(key []byte, value interface{}) bool) error {
+	var err error
+	m.target.Foreach(func(key []byte, value interface{}) bool {
+		data := value.(*base.BlockData)
+		if data.Deleted == base.Deleted || data.ValueType != base.ValueTypeNormal || len(data.Value) <= m.threshold {
+			return callback(key, data)
+		}
+		if m.writer == nil {
+			m.writer, err = newBlobWriter(m.fs, m.dir, m.ts)
+			if err == nil {
+				m.writer.limiter = m.limiter
+			}
+			if err != nil {
+				return true
+			}
+		}
+		ref, e := m.writer.add(key, data.Value)
+		if e != nil {
+			err = e
+			return true
+		}
+		refData := new(base.BlockData)
+		refData.Deleted = data.Deleted
+		refData.ValueType = base.ValueTypeBlobRef
+		refData.Ts = data.Ts
+		refData.Value = ref.encode()
+		return callback(key, refData)
+	})
+	return err
+}
+
+// the blob file written, it is empty if no blob file
+func (m *blobSeparatingMap) blobFile() (string, int64) {
+	if m.writer == nil {
+		return "", 0
+	}
+	return m.writer.fileName, m.writer.position
+}
+
+func (m *blobSeparatingMap) commit() error {
+	if m.writer == nil {
+		return nil
+	}
+	return m.writer.commit()
+}
+
+func (m *blobSeparatingMap) abort() {
+	if m.writer != nil {
+		m.writer.abort()
+	}
+}
+
+// the opened blob files for reading
+type blobReaders struct {
+	fs      vfs.FS
+	dir     string
+	readers map[string]*fileutil.ConcurrentReadFile
+	mutex   sync.Mutex
+}
+
+func newBlobReaders(fs vfs.FS, dir string) *blobReaders {
+	br := new(blobReaders)
+	br.fs = fs
+	br.dir = dir
+	br.readers = make(map[string]*fileutil.ConcurrentReadFile)
+	return br
+}
+
+func (br *blobReaders) getReader(name string) (*fileutil.ConcurrentReadFile, error) {
+	br.mutex.Lock()
+	defer br.mutex.Unlock()
+	if reader, exist := br.readers[name]; exist {
+		return reader, nil
+	}
+	reader, err := fileutil.OpenAsConcurrentReadFileWithFS(br.fs, filepath.Join(br.dir, name), blobReadConcurrent)
+	if err != nil {
+		return nil, err
+	}
+	br.readers[name] = reader
+	return reader, nil
+}
+
+func (br *blobReaders) read(key []byte, refData []byte) ([]byte, error) {
+	ref, err := decodeBlobRef(refData)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := br.getReader(ref.fileName())
+	if err != nil {
+		return nil, err
+	}
+	var value []byte
+	openSuccess, err := reader.SeekForReading(ref.position, func(reader io.Reader) error {
+		recordKey, recordValue, err := readBlobRecord(reader)
+		if err != nil {
+			return err
+		}
+		if sst.KeyCompare(recordKey, key) != sst.Equals || uint32(len(recordValue)) != ref.valueLength {
+			return fmt.Errorf("blob record not match the reference")
+		}
+		value = recordValue
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !openSuccess {
+		return nil, fmt.Errorf("blob file %s has been closed", ref.fileName())
+	}
+	return value, nil
+}
+
+func (br *blobReaders) close(name string) {
+	br.mutex.Lock()
+	reader, exist := br.readers[name]
+	delete(br.readers, name)
+	br.mutex.Unlock()
+	if exist {
+		reader.Close()
+	}
+}
+
+func (br *blobReaders) closeAll() {
+	br.mutex.Lock()
+	defer br.mutex.Unlock()
+	for _, reader := range br.readers {
+		reader.Close()
+	}
+	br.readers = make(map[string]*fileutil.ConcurrentReadFile)
+}
+
+// remove the blob files whose data are all garbage, and put the live data of the blob files
+// whose live rate is low again, so they will be written to the new blob files when flushing.
+func (lsm *Lsm) collectBlobGarbage() error {
+	if err := lsm.checkWritable(); err != nil {
+		return err
+	}
+	if !lsm.compaction.beginExclusive(false) {
+		return nil
+	}
+	defer lsm.compaction.endExclusive()
+	for name, stat := range lsm.manifest.getBlobFiles() {
+		if stat.garbageSize >= stat.totalSize {
+			if err := lsm.removeBlobFile(name); err != nil {
+				return err
+			}
+			continue
+		}
+		if lsm.relocatedBlobs[name] || stat.liveRate() >= lsm.options.BlobGCLiveRate {
+			continue
+		}
+		if err := lsm.relocateBlobFile(name); err != nil {
+			return err
+		}
+		lsm.relocatedBlobs[name] = true
+	}
+	return nil
+}
+
+func (lsm *Lsm) removeBlobFile(name string) error {
+	lsm.fileMutex.Lock()
+	err := lsm.manifest.logEdit([]versionEdit{{editType: editTypeRemoveBlob, name: name}})
+	lsm.fileMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	lsm.blobReaders.close(name)
+	delete(lsm.relocatedBlobs, name)
+	log.Info("remove blob file: %s", name)
+	return lsm.deleteFile(filepath.Join(lsm.dir, name))
+}
+
+func (lsm *Lsm) relocateBlobFile(name string) error {
+	file, err := lsm.fs.Open(filepath.Join(lsm.dir, name))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	var position int64
+	relocated := 0
+	for {
+		key, value, err := readBlobRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		ok, err := lsm.relocateBlobRecord(key, value, name, position)
+		if err != nil {
+			return err
+		}
+		if ok {
+			relocated++
+		}
+		position += int64(blobRecordHeaderLen + len(key) + len(value))
+	}
+	log.Info("relocate blob file: %s, records: %d", name, relocated)
+	return nil
+}
+
+// the value is put again only if the newest data of the key still refers to this record
+func (lsm *Lsm) relocateBlobRecord(key []byte, value []byte, name string, position int64) (bool, error) {
+	lsm.mutex.Lock()
+	defer lsm.mutex.Unlock()
+	if _, found := lsm.memMap.Get(key); found {
+		return false, nil
+	}
+	bd, _, err := lsm.findBlockDataFromSSTables(key, nil)
+	if err != nil {
+		return false, err
+	}
+	if bd == nil || bd.Deleted == base.Deleted || bd.ValueType != base.ValueTypeBlobRef {
+		return false, nil
+	}
+	ref, err := decodeBlobRef(bd.Value)
+	if err != nil {
+		return false, err
+	}
+	if ref.fileName() != name || ref.position != position {
+		return false, nil
+	}
+	return true, lsm.put(key, value)
+}
+
+func readBlobRecord(reader io.Reader) ([]byte, []byte, error) {
+	header := make([]byte, blobRecordHeaderLen)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, nil, err
+	}
+	if header[0] != blobMagicCode1 || header[1] != blobMagicCode2 {
+		return nil, nil, fmt.Errorf("blob magic code not match")
+	}
+	sum := bytesutil.GetUint32FromBytes(header, 4)
+	keyLen := bytesutil.GetUint32FromBytes(header, 8)
+	valueLen := bytesutil.GetUint32FromBytes(header, 12)
+	if keyLen > base.MaxKeyLen {
+		return nil, nil, fmt.Errorf("too big key length: %d", keyLen)
+	}
+	if valueLen > base.MaxValueLen {
+		return nil, nil, fmt.Errorf("too big value length: %d", valueLen)
+	}
+	buf := make([]byte, keyLen+valueLen)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return nil, nil, err
+	}
+	if hashutil.SumHash32(buf[keyLen:]) != sum {
+		return nil, nil, fmt.Errorf("blob sum not match")
+	}
+	return buf[:keyLen], buf[keyLen:], nil
+}
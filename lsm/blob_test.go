@@ -0,0 +1,133 @@
+package lsm
+
+import (
+	"testing"
+	"os"
+	"fmt"
+	"strings"
+	"path/filepath"
+	"github.com/pister/yfs/common/fileutil"
+)
+
+func bigValue(i int, n int) []byte {
+	return []byte(fmt.Sprintf("value-%d-%d-%s", i, n, strings.Repeat("x", 200)))
+}
+
+func openBlobLsm(t *testing.T, dir string) *Lsm {
+	options := DefaultOptions()
+	options.BlobValueThreshold = 100
+	lsm, err := OpenLsmWithOptions(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lsm
+}
+
+func TestBlobSeparateAndRemove(t *testing.T) {
+	tempDir := "/Users/songlihuang/temp/temp3/lsm_blob_test"
+	os.RemoveAll(tempDir)
+	fileutil.MkDirs(tempDir)
+	defer os.RemoveAll(tempDir)
+	lsm := openBlobLsm(t, tempDir)
+	for n := 0; n < compactThreshold; n++ {
+		for i := 0; i < 10; i++ {
+			lsm.Put([]byte(fmt.Sprintf("name-%d", i)), bigValue(i, n))
+		}
+		lsm.Put([]byte("small"), []byte("small-value"))
+		lsm.Flush()
+		lsm.flushLocker.Lock()
+		lsm.flushLocker.Unlock()
+	}
+	blobFiles := lsm.manifest.getBlobFiles()
+	if len(blobFiles) != compactThreshold {
+		t.Fatal("blob files not match", blobFiles)
+	}
+	data, err := lsm.Get([]byte("name-3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(bigValue(3, compactThreshold-1)) {
+		t.Fatal("value not match")
+	}
+	if err := lsm.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	// all the records of the older blob in the compacted files are garbage
+	if err := lsm.collectBlobGarbage(); err != nil {
+		t.Fatal(err)
+	}
+	removed := ""
+	for name := range blobFiles {
+		exist, _ := fileutil.PathExists(filepath.Join(tempDir, name))
+		if !exist {
+			removed = name
+		}
+	}
+	if len(removed) == 0 || len(lsm.manifest.getBlobFiles()) != compactThreshold-1 {
+		t.Fatal("garbage blob file not removed", lsm.manifest.getBlobFiles())
+	}
+	lsm.Close()
+
+	lsm = openBlobLsm(t, tempDir)
+	defer lsm.Close()
+	if len(lsm.manifest.getBlobFiles()) != compactThreshold-1 {
+		t.Fatal("blob files not match after reopen")
+	}
+	for i := 0; i < 10; i++ {
+		data, err := lsm.Get([]byte(fmt.Sprintf("name-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(data), fmt.Sprintf("value-%d-", i)) {
+			t.Fatal("value not match", string(data))
+		}
+	}
+	data, err = lsm.Get([]byte("small"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "small-value" {
+		t.Fatal("small value not match")
+	}
+}
+
+func TestBlobRelocate(t *testing.T) {
+	tempDir := "/Users/songlihuang/temp/temp3/lsm_blob_relocate_test"
+	os.RemoveAll(tempDir)
+	fileutil.MkDirs(tempDir)
+	defer os.RemoveAll(tempDir)
+	lsm := openBlobLsm(t, tempDir)
+	defer lsm.Close()
+	for i := 0; i < 10; i++ {
+		lsm.Put([]byte(fmt.Sprintf("name-%d", i)), bigValue(i, 0))
+	}
+	lsm.Flush()
+	lsm.flushLocker.Lock()
+	lsm.flushLocker.Unlock()
+	// the newer data are in mem
+	for i := 0; i < 5; i++ {
+		lsm.Put([]byte(fmt.Sprintf("name-%d", i)), bigValue(i, 1))
+	}
+	for name := range lsm.manifest.getBlobFiles() {
+		if err := lsm.relocateBlobFile(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprintf("name-%d", i))
+		if _, found := lsm.memMap.Get(key); !found {
+			t.Fatal("not relocated", i)
+		}
+		n := 0
+		if i < 5 {
+			n = 1
+		}
+		data, err := lsm.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != string(bigValue(i, n)) {
+			t.Fatal("value not match", i)
+		}
+	}
+}
@@ -0,0 +1,477 @@
+package lsm
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"sync"
+	"sort"
+	"bufio"
+	"regexp"
+	"strings"
+	"strconv"
+	"path/filepath"
+	"github.com/pister/yfs/common/fileutil"
+	"github.com/pister/yfs/common/vfs"
+)
+
+// change data capture
+/*
+	the subscribers read the actions from the wal files, the flushed wal files are kept as
+	archive_wal_<ts> until all the subscribers have acked the positions after them.
+	the acked positions are saved in the CDC_SUBSCRIPTIONS file, one subscriber per line:
+	name wal-ts offset
+*/
+
+const cdcSubscriptionsFileName = "CDC_SUBSCRIPTIONS"
+
+var archiveWalNamePattern *regexp.Regexp
+var subscriberNamePattern *regexp.Regexp
+
+func init() {
+	p, err := regexp.Compile(`^archive_wal_\d+$`)
+	if err != nil {
+		panic(err)
+	}
+	archiveWalNamePattern = p
+	p, err = regexp.Compile(`^[\w\-]+$`)
+	if err != nil {
+		panic(err)
+	}
+	subscriberNamePattern = p
+}
+
+// CDCPosition is the position of an action in the wal files, the zero position means not specified.
+type CDCPosition struct {
+	WalTs  int64
+	Offset int64
+}
+
+func (pos CDCPosition) IsZero() bool {
+	return pos.WalTs == 0 && pos.Offset == 0
+}
+
+func (pos CDCPosition) before(other CDCPosition) bool {
+	if pos.WalTs != other.WalTs {
+		return pos.WalTs < other.WalTs
+	}
+	return pos.Offset < other.Offset
+}
+
+func (pos CDCPosition) String() string {
+	return fmt.Sprintf("%d:%d", pos.WalTs, pos.Offset)
+}
+
+type cdcState struct {
+	fs      vfs.FS
+	dir     string
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	version int64
+	closed  bool
+	acked   map[string]CDCPosition
+}
+
+func openCdcState(fs vfs.FS, dir string) (*cdcState, error) {
+	cdc := new(cdcState)
+	cdc.fs = fs
+	cdc.dir = dir
+	cdc.cond = sync.NewCond(&cdc.mutex)
+	cdc.acked = make(map[string]CDCPosition)
+	file, err := fs.Open(filepath.Join(dir, cdcSubscriptionsFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cdc, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.Fields(scanner.Text())
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("bad cdc subscription line: %s", scanner.Text())
+		}
+		walTs, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		offset, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		cdc.acked[parts[0]] = CDCPosition{WalTs: walTs, Offset: offset}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return cdc, nil
+}
+
+// must be called with cdc.mutex locked
+func (cdc *cdcState) save() error {
+	fileName := filepath.Join(cdc.dir, cdcSubscriptionsFileName)
+	if len(cdc.acked) == 0 {
+		err := fileutil.DeleteFileWithFS(cdc.fs, fileName)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	tempFileName := fileName + "_tmp"
+	file, err := cdc.fs.Create(tempFileName)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for name, pos := range cdc.acked {
+		fmt.Fprintf(writer, "%s %d %d\n", name, pos.WalTs, pos.Offset)
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return cdc.fs.Rename(tempFileName, fileName)
+}
+
+// the minimal acked position of all the subscribers
+func (cdc *cdcState) minAcked() (CDCPosition, bool) {
+	cdc.mutex.Lock()
+	defer cdc.mutex.Unlock()
+	var min CDCPosition
+	found := false
+	for _, pos := range cdc.acked {
+		if !found || pos.before(min) {
+			min = pos
+			found = true
+		}
+	}
+	return min, found
+}
+
+// wake up the waiting subscribers, it is called after the wal changed
+func (cdc *cdcState) notify() {
+	cdc.mutex.Lock()
+	defer cdc.mutex.Unlock()
+	cdc.version++
+	cdc.cond.Broadcast()
+}
+
+func (cdc *cdcState) close() {
+	cdc.mutex.Lock()
+	defer cdc.mutex.Unlock()
+	cdc.closed = true
+	cdc.cond.Broadcast()
+}
+
+// the wal is not flushed yet or it has been archived, the flushed wal waiting
+// for the paused deletion is not retained
+func (lsm *Lsm) isWalRetained(ts int64) (bool, error) {
+	walFile := filepath.Join(lsm.dir, fmt.Sprintf("wal_%d", ts))
+	exist, err := fileutil.PathExistsWithFS(lsm.fs, walFile)
+	if err != nil || (exist && !lsm.isPendingDelete(walFile)) {
+		return exist, err
+	}
+	return fileutil.PathExistsWithFS(lsm.fs, archiveWalFileName(lsm.dir, ts))
+}
+
+func archiveWalFileName(dir string, ts int64) string {
+	return filepath.Join(dir, fmt.Sprintf("archive_wal_%d", ts))
+}
+
+// the ts of the wal and archived wal files in increasing order
+func getCdcWalTsList(fs vfs.FS, dir string) ([]int64, error) {
+	names, err := fs.List(dir)
+	if err != nil {
+		return nil, err
+	}
+	tsList := make([]int64, 0, 4)
+	for _, name := range names {
+		if !walNamePattern.MatchString(name) && !archiveWalNamePattern.MatchString(name) {
+			continue
+		}
+		post := strings.LastIndex(name, "_")
+		ts, err := strconv.ParseInt(name[post+1:], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		tsList = append(tsList, ts)
+	}
+	sort.Slice(tsList, func(i, j int) bool {
+		return tsList[i] < tsList[j]
+	})
+	return tsList, nil
+}
+
+// the flushed wal is archived if there are subscribers, and then deleted by deleteFile.
+// The cdc is locked until it is deleted, so no subscriber starts from the wal being deleted.
+func retireWalFile(cdc *cdcState, file string, ts int64, deleteFile func(file string) error) error {
+	cdc.mutex.Lock()
+	defer cdc.mutex.Unlock()
+	if len(cdc.acked) > 0 {
+		if err := cdc.fs.Link(file, archiveWalFileName(filepath.Dir(file), ts)); err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	return deleteFile(file)
+}
+
+// delete the archived wal files which have been acked by all the subscribers
+func purgeArchivedWalFiles(cdc *cdcState) error {
+	tsList, err := getCdcWalTsList(cdc.fs, cdc.dir)
+	if err != nil {
+		return err
+	}
+	min, found := cdc.minAcked()
+	for _, ts := range tsList {
+		if found && ts >= min.WalTs {
+			break
+		}
+		archiveFile := archiveWalFileName(cdc.dir, ts)
+		exist, err := fileutil.PathExistsWithFS(cdc.fs, archiveFile)
+		if err != nil {
+			return err
+		}
+		if !exist {
+			continue
+		}
+		log.Info("purge archived wal: %s", archiveFile)
+		if err := fileutil.DeleteFileWithFS(cdc.fs, archiveFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (lsm *Lsm) retireWal(aheadLog *AheadLog, ts int64) error {
+	if err := retireWalFile(lsm.cdc, aheadLog.filename, ts, lsm.deleteFile); err != nil {
+		return err
+	}
+	lsm.cdc.notify()
+	return nil
+}
+
+// the ts and data size of the wal which is appending
+func (lsm *Lsm) currentWal() (int64, int64) {
+	lsm.mutex.Lock()
+	defer lsm.mutex.Unlock()
+	return lsm.ts, lsm.aheadLog.GetDataSize()
+}
+
+// CurrentCDCPosition returns the position after the last action written.
+func (lsm *Lsm) CurrentCDCPosition() CDCPosition {
+	ts, size := lsm.currentWal()
+	return CDCPosition{WalTs: ts, Offset: size}
+}
+
+// Subscribe starts reading the actions from the position, the wal files after the acked position of
+// the subscriber are kept until it is acked or unsubscribed. If from is zero, it starts from the acked
+// position of the subscriber, or the current position for a new subscriber.
+func (lsm *Lsm) Subscribe(name string, from CDCPosition) (*Subscription, error) {
+	if err := lsm.checkWritable(); err != nil {
+		return nil, err
+	}
+	if !subscriberNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("bad subscriber name: %s", name)
+	}
+	// hold the wal to make sure the file of the position not be retired
+	lsm.mutex.Lock()
+	defer lsm.mutex.Unlock()
+	lsm.cdc.mutex.Lock()
+	defer lsm.cdc.mutex.Unlock()
+	acked, registered := lsm.cdc.acked[name]
+	if from.IsZero() {
+		if registered {
+			from = acked
+		} else {
+			from = CDCPosition{WalTs: lsm.ts, Offset: lsm.aheadLog.GetDataSize()}
+		}
+	}
+	if from.WalTs != lsm.ts {
+		retained, err := lsm.isWalRetained(from.WalTs)
+		if err != nil {
+			return nil, err
+		}
+		if !retained {
+			return nil, fmt.Errorf("the position %s is not retained", from)
+		}
+	}
+	if !registered || from.before(acked) {
+		lsm.cdc.acked[name] = from
+		if err := lsm.cdc.save(); err != nil {
+			return nil, err
+		}
+	}
+	sub := new(Subscription)
+	sub.lsm = lsm
+	sub.name = name
+	sub.position = from
+	return sub, nil
+}
+
+// Unsubscribe removes the subscriber, the wal files kept for it will be purged.
+func (lsm *Lsm) Unsubscribe(name string) error {
+	if err := lsm.checkWritable(); err != nil {
+		return err
+	}
+	lsm.cdc.mutex.Lock()
+	delete(lsm.cdc.acked, name)
+	err := lsm.cdc.save()
+	lsm.cdc.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return purgeArchivedWalFiles(lsm.cdc)
+}
+
+// Subscription reads the actions in order, it must be used in one goroutine except Close.
+type Subscription struct {
+	lsm      *Lsm
+	name     string
+	mutex    sync.Mutex
+	closed   bool
+	position CDCPosition
+	file     vfs.File
+}
+
+// Next returns the next action and the position after it, it blocks until there is a new action.
+func (sub *Subscription) Next() (*Action, CDCPosition, error) {
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+	cdc := sub.lsm.cdc
+	for {
+		cdc.mutex.Lock()
+		version := cdc.version
+		closed := cdc.closed || sub.closed
+		cdc.mutex.Unlock()
+		if closed {
+			sub.closeFile()
+			return nil, sub.position, fmt.Errorf("subscription %s closed", sub.name)
+		}
+		action, err := sub.readNext()
+		if err != nil {
+			return nil, sub.position, err
+		}
+		if action != nil {
+			return action, sub.position, nil
+		}
+		cdc.mutex.Lock()
+		for cdc.version == version && !cdc.closed && !sub.closed {
+			cdc.cond.Wait()
+		}
+		cdc.mutex.Unlock()
+	}
+}
+
+// read the action at the position, nil if there is no more action now
+func (sub *Subscription) readNext() (*Action, error) {
+	for {
+		currentTs, currentSize := sub.lsm.currentWal()
+		if sub.file == nil {
+			if err := sub.openFile(); err != nil {
+				return nil, err
+			}
+		}
+		limit := currentSize
+		if sub.position.WalTs != currentTs {
+			fi, err := sub.file.Stat()
+			if err != nil {
+				return nil, err
+			}
+			limit = fi.Size()
+		}
+		if sub.position.Offset < limit {
+			reader := io.NewSectionReader(sub.file, sub.position.Offset, limit-sub.position.Offset)
+			action, err := ActionFromReader(reader)
+			if err != nil {
+				return nil, err
+			}
+			sub.position.Offset += int64(action.encodedLen())
+			return action, nil
+		}
+		if sub.position.WalTs == currentTs {
+			return nil, nil
+		}
+		// the wal has been finished, go to the next one
+		tsList, err := getCdcWalTsList(sub.lsm.fs, sub.lsm.dir)
+		if err != nil {
+			return nil, err
+		}
+		next := currentTs
+		for _, ts := range tsList {
+			if ts > sub.position.WalTs {
+				next = ts
+				break
+			}
+		}
+		sub.closeFile()
+		sub.position = CDCPosition{WalTs: next, Offset: 0}
+	}
+}
+
+func (sub *Subscription) openFile() error {
+	walFile := filepath.Join(sub.lsm.dir, fmt.Sprintf("wal_%d", sub.position.WalTs))
+	file, err := sub.lsm.fs.Open(walFile)
+	if err != nil && os.IsNotExist(err) {
+		file, err = sub.lsm.fs.Open(archiveWalFileName(sub.lsm.dir, sub.position.WalTs))
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("the position %s is not retained", sub.position)
+		}
+		return err
+	}
+	sub.file = file
+	return nil
+}
+
+func (sub *Subscription) closeFile() {
+	if sub.file != nil {
+		sub.file.Close()
+		sub.file = nil
+	}
+}
+
+// Ack saves the position which has been consumed, the wal files before it can be purged.
+func (sub *Subscription) Ack(pos CDCPosition) error {
+	cdc := sub.lsm.cdc
+	cdc.mutex.Lock()
+	acked, registered := cdc.acked[sub.name]
+	if !registered {
+		cdc.mutex.Unlock()
+		return fmt.Errorf("subscriber %s has been unsubscribed", sub.name)
+	}
+	if !acked.before(pos) {
+		cdc.mutex.Unlock()
+		return nil
+	}
+	cdc.acked[sub.name] = pos
+	err := cdc.save()
+	cdc.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if pos.WalTs == acked.WalTs {
+		return nil
+	}
+	return purgeArchivedWalFiles(cdc)
+}
+
+// Close stops the subscription, the acked position is kept.
+func (sub *Subscription) Close() {
+	cdc := sub.lsm.cdc
+	cdc.mutex.Lock()
+	sub.closed = true
+	cdc.cond.Broadcast()
+	cdc.mutex.Unlock()
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+	sub.closeFile()
+}
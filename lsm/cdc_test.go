@@ -0,0 +1,149 @@
+package lsm
+
+import (
+	"testing"
+	"os"
+	"fmt"
+	"path/filepath"
+	"github.com/pister/yfs/common/fileutil"
+	"github.com/pister/yfs/common/vfs"
+)
+
+func nextActions(t *testing.T, sub *Subscription, count int) ([]*Action, CDCPosition) {
+	actions := make([]*Action, 0, count)
+	var pos CDCPosition
+	for i := 0; i < count; i++ {
+		action, p, err := sub.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		actions = append(actions, action)
+		pos = p
+	}
+	return actions, pos
+}
+
+func TestSubscribe(t *testing.T) {
+	tempDir := "/Users/songlihuang/temp/temp3/lsm_cdc_test"
+	os.RemoveAll(tempDir)
+	fileutil.MkDirs(tempDir)
+	defer os.RemoveAll(tempDir)
+	lsm, err := OpenLsm(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := lsm.Subscribe("index", CDCPosition{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		lsm.Put([]byte(fmt.Sprintf("name-%d", i)), []byte(fmt.Sprintf("value-%d", i)))
+	}
+	lsm.Delete([]byte("name-1"))
+	actions, _ := nextActions(t, sub, 4)
+	for i := 0; i < 3; i++ {
+		if string(actions[i].GetKey()) != fmt.Sprintf("name-%d", i) || string(actions[i].GetValue()) != fmt.Sprintf("value-%d", i) {
+			t.Fatal("action not match", i)
+		}
+	}
+	if !actions[3].IsDelete() || string(actions[3].GetKey()) != "name-1" {
+		t.Fatal("delete action not match")
+	}
+	flushedTs := lsm.ts
+	lsm.Flush()
+	lsm.flushLocker.Lock()
+	lsm.flushLocker.Unlock()
+	// the flushed wal is kept for the subscriber
+	archiveFile := archiveWalFileName(tempDir, flushedTs)
+	if exist, _ := fileutil.PathExists(archiveFile); !exist {
+		t.Fatal("wal not archived")
+	}
+	lsm.Put([]byte("name-3"), []byte("value-3"))
+	actions, pos := nextActions(t, sub, 1)
+	if string(actions[0].GetKey()) != "name-3" {
+		t.Fatal("action after flushing not match")
+	}
+	if err := sub.Ack(pos); err != nil {
+		t.Fatal(err)
+	}
+	if exist, _ := fileutil.PathExists(archiveFile); exist {
+		t.Fatal("acked wal not purged")
+	}
+	sub.Close()
+	lsm.Put([]byte("name-4"), []byte("value-4"))
+	lsm.Close()
+
+	lsm, err = OpenLsm(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	sub, err = lsm.Subscribe("index", CDCPosition{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	actions, _ = nextActions(t, sub, 1)
+	if string(actions[0].GetKey()) != "name-4" {
+		t.Fatal("resumed action not match")
+	}
+	if err := lsm.Unsubscribe("index"); err != nil {
+		t.Fatal(err)
+	}
+	if exist, _ := fileutil.PathExists(filepath.Join(tempDir, cdcSubscriptionsFileName)); exist {
+		t.Fatal("subscriptions not removed")
+	}
+}
+
+func TestSubscribeWhileRollingWal(t *testing.T) {
+	options := DefaultOptions()
+	options.FS = vfs.NewMemFS()
+	lsm, err := OpenLsmWithOptions("/cdc_roll_test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	for i := 0; i < 200; i++ {
+		pos := lsm.CurrentCDCPosition()
+		lsm.Put([]byte(fmt.Sprintf("name-%d", i)), []byte(fmt.Sprintf("value-%d", i)))
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			lsm.Flush()
+			lsm.flushLocker.Lock()
+			lsm.flushLocker.Unlock()
+		}()
+		sub, err := lsm.Subscribe("roll", pos)
+		<-done
+		if err == nil {
+			// the wal of the position is kept for the subscriber
+			retained, err := lsm.isWalRetained(pos.WalTs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !retained {
+				t.Fatal("the wal of the subscriber is deleted", i)
+			}
+			actions, _ := nextActions(t, sub, 1)
+			if string(actions[0].GetKey()) != fmt.Sprintf("name-%d", i) {
+				t.Fatal("action not match", i)
+			}
+			sub.Close()
+		}
+		if err := lsm.Unsubscribe("roll"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the wal retired while the deletion is paused is deleted after resuming
+	pos := lsm.CurrentCDCPosition()
+	lsm.Put([]byte("name-paused"), []byte("value-paused"))
+	lsm.pauseFileDeletion()
+	lsm.Flush()
+	lsm.flushLocker.Lock()
+	lsm.flushLocker.Unlock()
+	if _, err := lsm.Subscribe("roll", pos); err == nil {
+		t.Fatal("the position in the retired wal is not retained")
+	}
+	lsm.resumeFileDeletion()
+}
@@ -0,0 +1,251 @@
+package lsm
+
+import (
+	"fmt"
+	"bufio"
+	"strings"
+	"strconv"
+	"path/filepath"
+	"github.com/pister/yfs/common/fileutil"
+	"github.com/pister/yfs/common/vfs"
+)
+
+const checkpointFileName = "CHECKPOINT"
+
+// the files of the lsm at one moment
+type checkpointFile struct {
+	name string
+	size int64
+}
+
+type checkpointFiles struct {
+	sstFiles  []checkpointFile
+	walFiles  []checkpointFile
+	blobFiles []checkpointFile
+	blobStats map[string]blobFileStat
+}
+
+// Checkpoint makes a consistent copy of the running lsm to targetDir, the sst files are hard-linked
+// if possible, and a manifest of them is written, so the target can be opened by OpenLsm as a normal lsm dir.
+func (lsm *Lsm) Checkpoint(targetDir string) error {
+	return lsm.checkpoint(targetDir, "", fileutil.LinkOrCopyFileWithFS)
+}
+
+// Backup copies the running lsm to backupDir, the sst files which have been in previousBackupDir
+// are linked from there instead of copying from the lsm again. A full backup is made if
+// previousBackupDir is empty.
+func (lsm *Lsm) Backup(backupDir string, previousBackupDir string) error {
+	return lsm.checkpoint(backupDir, previousBackupDir, fileutil.CopyFileWithFS)
+}
+
+func (lsm *Lsm) checkpoint(targetDir string, previousDir string, sstCopier func(fs vfs.FS, src, dest string) error) error {
+	if err := lsm.checkWritable(); err != nil {
+		return err
+	}
+	if err := prepareCheckpointDir(lsm.fs, targetDir); err != nil {
+		return err
+	}
+	var previousFiles map[string]int64
+	if len(previousDir) > 0 {
+		files, err := readCheckpointFile(lsm.fs, previousDir)
+		if err != nil {
+			return err
+		}
+		previousFiles = make(map[string]int64)
+		for _, f := range files.sstFiles {
+			previousFiles[f.name] = f.size
+		}
+		for _, f := range files.blobFiles {
+			previousFiles[f.name] = f.size
+		}
+	}
+
+	// the files in the snapshot will not be deleted until the copying finished
+	lsm.pauseFileDeletion()
+	defer lsm.resumeFileDeletion()
+
+	files, err := lsm.snapshotFiles()
+	if err != nil {
+		return err
+	}
+	copiedFromPrevious := 0
+	// the sst and blob files are immutable
+	immutableFiles := append(append([]checkpointFile{}, files.sstFiles...), files.blobFiles...)
+	for _, f := range immutableFiles {
+		target := filepath.Join(targetDir, f.name)
+		if size, exist := previousFiles[f.name]; exist && size == f.size {
+			if err := fileutil.LinkOrCopyFileWithFS(lsm.fs, filepath.Join(previousDir, f.name), target); err != nil {
+				return err
+			}
+			copiedFromPrevious++
+			continue
+		}
+		if err := sstCopier(lsm.fs, filepath.Join(lsm.dir, f.name), target); err != nil {
+			return err
+		}
+	}
+	for _, f := range files.walFiles {
+		// the wal may be appending, only the data in the snapshot is copied
+		if err := fileutil.CopyFileWithLengthWithFS(lsm.fs, filepath.Join(lsm.dir, f.name), filepath.Join(targetDir, f.name), f.size); err != nil {
+			return err
+		}
+	}
+	state := newManifestState()
+	for _, f := range files.sstFiles {
+		state.liveFiles[f.name] = true
+	}
+	for name, stat := range files.blobStats {
+		s := stat
+		state.blobFiles[name] = &s
+	}
+	if err := writeManifestSnapshot(lsm.fs, targetDir, state.snapshotEdits()); err != nil {
+		return err
+	}
+	if err := writeCheckpointFile(lsm.fs, targetDir, files); err != nil {
+		return err
+	}
+	log.Info("checkpoint to %s finish, sst and blob: %d(%d from previous), wal: %d", targetDir, len(immutableFiles), copiedFromPrevious, len(files.walFiles))
+	return nil
+}
+
+func prepareCheckpointDir(fs vfs.FS, targetDir string) error {
+	exist, err := fileutil.PathExistsWithFS(fs, targetDir)
+	if err != nil {
+		return err
+	}
+	if exist {
+		names, err := fs.List(targetDir)
+		if err != nil || len(names) > 0 {
+			return fmt.Errorf("the checkpoint dir: %s is not an empty dir", targetDir)
+		}
+		return nil
+	}
+	return fileutil.MkDirsWithFS(fs, targetDir)
+}
+
+// get the sst and wal files with their sizes at this moment, they must not be deleted
+// before the copying finished.
+func (lsm *Lsm) snapshotFiles() (*checkpointFiles, error) {
+	// stop the writing of wal
+	lsm.mutex.Lock()
+	defer lsm.mutex.Unlock()
+	// stop the changing of sst files
+	lsm.fileMutex.Lock()
+	defer lsm.fileMutex.Unlock()
+
+	files := new(checkpointFiles)
+	for _, reader := range lsm.getReaders() {
+		f, err := newCheckpointFile(lsm.fs, reader.GetFileName())
+		if err != nil {
+			return nil, err
+		}
+		files.sstFiles = append(files.sstFiles, f)
+	}
+	files.blobStats = lsm.manifest.getBlobFiles()
+	for name := range files.blobStats {
+		f, err := newCheckpointFile(lsm.fs, filepath.Join(lsm.dir, name))
+		if err != nil {
+			return nil, err
+		}
+		files.blobFiles = append(files.blobFiles, f)
+	}
+	walFiles, err := getWalFileNames(lsm.fs, lsm.dir)
+	if err != nil {
+		return nil, err
+	}
+	_, currentWal := filepath.Split(lsm.aheadLog.filename)
+	for _, walFile := range walFiles {
+		if lsm.isPendingDelete(walFile.PathName) {
+			// it has been flushed to sst
+			continue
+		}
+		f, err := newCheckpointFile(lsm.fs, walFile.PathName)
+		if err != nil {
+			return nil, err
+		}
+		if f.name == currentWal {
+			f.size = lsm.aheadLog.GetDataSize()
+		}
+		files.walFiles = append(files.walFiles, f)
+	}
+	return files, nil
+}
+
+func newCheckpointFile(fs vfs.FS, file string) (checkpointFile, error) {
+	fi, err := fs.Stat(file)
+	if err != nil {
+		return checkpointFile{}, err
+	}
+	_, name := filepath.Split(file)
+	return checkpointFile{name: name, size: fi.Size()}, nil
+}
+
+func writeCheckpointFile(fs vfs.FS, dir string, files *checkpointFiles) error {
+	/*
+	one file per line:
+	sst|wal|blob name size
+	*/
+	fileName := filepath.Join(dir, checkpointFileName)
+	tempFileName := fileName + "_tmp"
+	file, err := fs.Create(tempFileName)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for _, f := range files.sstFiles {
+		fmt.Fprintf(writer, "sst %s %d\n", f.name, f.size)
+	}
+	for _, f := range files.walFiles {
+		fmt.Fprintf(writer, "wal %s %d\n", f.name, f.size)
+	}
+	for _, f := range files.blobFiles {
+		fmt.Fprintf(writer, "blob %s %d\n", f.name, f.size)
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return fs.Rename(tempFileName, fileName)
+}
+
+func readCheckpointFile(fs vfs.FS, dir string) (*checkpointFiles, error) {
+	file, err := fs.Open(filepath.Join(dir, checkpointFileName))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	files := new(checkpointFiles)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.Fields(scanner.Text())
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("bad checkpoint line: %s", scanner.Text())
+		}
+		size, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		f := checkpointFile{name: parts[1], size: size}
+		switch parts[0] {
+		case "sst":
+			files.sstFiles = append(files.sstFiles, f)
+		case "wal":
+			files.walFiles = append(files.walFiles, f)
+		case "blob":
+			files.blobFiles = append(files.blobFiles, f)
+		default:
+			return nil, fmt.Errorf("bad checkpoint line: %s", scanner.Text())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
@@ -0,0 +1,67 @@
+package lsm
+
+import (
+	"testing"
+	"fmt"
+	"os"
+	"github.com/pister/yfs/common/fileutil"
+)
+
+func TestCheckpointAndBackup(t *testing.T) {
+	tempDir := "/Users/songlihuang/temp/temp3/lsm_checkpoint_test"
+	checkpointDir := "/Users/songlihuang/temp/temp3/lsm_checkpoint_test_cp"
+	backupDir1 := "/Users/songlihuang/temp/temp3/lsm_checkpoint_test_bk1"
+	backupDir2 := "/Users/songlihuang/temp/temp3/lsm_checkpoint_test_bk2"
+	for _, dir := range []string{tempDir, checkpointDir, backupDir1, backupDir2} {
+		os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+	}
+	fileutil.MkDirs(tempDir)
+	lsm, err := OpenLsm(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		lsm.Put([]byte(fmt.Sprintf("name-%d", i)), []byte(fmt.Sprintf("value-%d", i)))
+	}
+	lsm.Flush()
+	lsm.flushLocker.Lock()
+	lsm.flushLocker.Unlock()
+	lsm.Put([]byte("name-1"), []byte("value-1-11"))
+	if err := lsm.Checkpoint(checkpointDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.Backup(backupDir1, ""); err != nil {
+		t.Fatal(err)
+	}
+	lsm.Put([]byte("name-2"), []byte("value-2-22"))
+	if err := lsm.Backup(backupDir2, backupDir1); err != nil {
+		t.Fatal(err)
+	}
+	lsm.Close()
+
+	for _, c := range []struct {
+		dir   string
+		name2 string
+	}{{checkpointDir, "value-2"}, {backupDir1, "value-2"}, {backupDir2, "value-2-22"}} {
+		cp, err := OpenLsm(c.dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := cp.Get([]byte("name-1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "value-1-11" {
+			t.Fatal("value not match")
+		}
+		data, err = cp.Get([]byte("name-2"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != c.name2 {
+			t.Fatal("value not match")
+		}
+		cp.Close()
+	}
+}
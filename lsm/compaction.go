@@ -0,0 +1,211 @@
+package lsm
+
+import (
+	"sync"
+	"github.com/pister/yfs/lsm/sst"
+)
+
+// compactionState schedules the compactions. The compactions of different sst files can
+// run at the same time, the blob gc and the range compaction run exclusively.
+type compactionState struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	threads int
+	running int
+	// true when the blob gc or the range compaction is running
+	exclusive bool
+	// the background compactions are not started when it is greater than 0
+	paused int
+	closed bool
+	// the readers which are compacting
+	compacting map[*sst.SSTableReader]bool
+}
+
+func newCompactionState(threads int) *compactionState {
+	cs := new(compactionState)
+	cs.cond = sync.NewCond(&cs.mutex)
+	if threads <= 0 {
+		threads = defaultCompactionThreads
+	}
+	cs.threads = threads
+	cs.compacting = make(map[*sst.SSTableReader]bool)
+	return cs
+}
+
+// select the readers to compact from the ones which are not compacting,
+// nil if there are not enough readers or no more compaction can run now.
+func (cs *compactionState) begin(readers []*sst.SSTableReader) []*sst.SSTableReader {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	if cs.closed || cs.exclusive || cs.running >= cs.threads {
+		return nil
+	}
+	free := make([]*sst.SSTableReader, 0, len(readers))
+	for _, reader := range readers {
+		if !cs.compacting[reader] {
+			free = append(free, reader)
+		}
+	}
+	selected := selectReadersToCompact(free)
+	if len(selected) == 0 {
+		return nil
+	}
+	for _, reader := range selected {
+		cs.compacting[reader] = true
+	}
+	cs.running++
+	return selected
+}
+
+func (cs *compactionState) end(readers []*sst.SSTableReader) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	for _, reader := range readers {
+		delete(cs.compacting, reader)
+	}
+	cs.running--
+	cs.cond.Broadcast()
+}
+
+// wait for the running compactions if wait is true, or return false if there are any
+func (cs *compactionState) beginExclusive(wait bool) bool {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	for cs.exclusive || cs.running > 0 {
+		if !wait || cs.closed {
+			return false
+		}
+		cs.cond.Wait()
+	}
+	if cs.closed {
+		return false
+	}
+	cs.exclusive = true
+	return true
+}
+
+func (cs *compactionState) endExclusive() {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	cs.exclusive = false
+	cs.cond.Broadcast()
+}
+
+func (cs *compactionState) isPaused() bool {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	return cs.paused > 0
+}
+
+// no more compactions can be started, and wait for the running ones
+func (cs *compactionState) close() {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	cs.closed = true
+	for cs.exclusive || cs.running > 0 {
+		cs.cond.Wait()
+	}
+}
+
+// PauseCompaction stops starting the background compactions until ResumeCompaction,
+// the running ones are not stopped. It can be called many times.
+// The manual compactions are not affected.
+func (lsm *Lsm) PauseCompaction() {
+	lsm.compaction.mutex.Lock()
+	defer lsm.compaction.mutex.Unlock()
+	lsm.compaction.paused++
+}
+
+func (lsm *Lsm) ResumeCompaction() {
+	lsm.compaction.mutex.Lock()
+	defer lsm.compaction.mutex.Unlock()
+	if lsm.compaction.paused > 0 {
+		lsm.compaction.paused--
+	}
+}
+
+// start the background compactions as many as possible
+func (lsm *Lsm) scheduleCompactions() {
+	if lsm.compaction.isPaused() {
+		return
+	}
+	for {
+		readers := lsm.compaction.begin(lsm.getReaders())
+		if readers == nil {
+			return
+		}
+		log.Info("start compact...")
+		go func() {
+			defer lsm.compaction.end(readers)
+			if err := lsm.compactReaders(readers, nil); err != nil {
+				lsm.fireBackgroundError("compaction", err)
+			}
+		}()
+	}
+}
+
+// the range of a manual compaction, nil means unbounded
+type compactRange struct {
+	start      []byte
+	end        []byte
+	comparator sst.Comparator
+	// the level of the output file
+	outputLevel uint32
+}
+
+func (cr *compactRange) contains(key []byte) bool {
+	return (cr.start == nil || cr.comparator.Compare(key, cr.start) != sst.Less) &&
+		(cr.end == nil || cr.comparator.Compare(key, cr.end) != sst.Greater)
+}
+
+func (cr *compactRange) overlaps(minKey, maxKey []byte) bool {
+	return (cr.start == nil || cr.comparator.Compare(maxKey, cr.start) != sst.Less) &&
+		(cr.end == nil || cr.comparator.Compare(minKey, cr.end) != sst.Greater)
+}
+
+// CompactRange flushes the memory data, and compacts all the sst files which contain the keys
+// in [start, end] into one file of the bottom level. The deleted data in the range are dropped,
+// so the space of them is reclaimed. nil of start or end means unbounded.
+// It waits for the running compactions.
+func (lsm *Lsm) CompactRange(start, end []byte) error {
+	if err := lsm.checkWritable(); err != nil {
+		return err
+	}
+	lsm.mutex.Lock()
+	err := lsm.flushAndWait()
+	lsm.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if !lsm.compaction.beginExclusive(true) {
+		return nil
+	}
+	defer lsm.compaction.endExclusive()
+
+	cr := &compactRange{start: start, end: end, comparator: lsm.options.comparator()}
+	readers := lsm.getReaders()
+	// the compacted readers must be adjacent, so the output can take the place of them
+	// without changing the order of data in other readers.
+	first, last := -1, -1
+	for i, reader := range readers {
+		if reader.GetLevel() >= cr.outputLevel {
+			cr.outputLevel = reader.GetLevel() + 1
+		}
+		minKey, maxKey, err := reader.GetKeyRange()
+		if err != nil {
+			return err
+		}
+		if minKey == nil || !cr.overlaps(minKey, maxKey) {
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		last = i
+	}
+	if first < 0 {
+		return nil
+	}
+	log.Info("start compact range...")
+	return lsm.compactReaders(readers[first:last+1], cr)
+}
@@ -0,0 +1,129 @@
+package lsm
+
+import (
+	"time"
+)
+
+const (
+	SSTCreatedByFlush      = "flush"
+	SSTCreatedByCompaction = "compaction"
+	SSTCreatedByIngestion  = "ingestion"
+)
+
+type FlushInfo struct {
+	WalFile  string
+	SSTFile  string
+	BlobFile string
+	Entries  int
+	Bytes    int64
+	Duration time.Duration
+	Err      error
+}
+
+type CompactionInfo struct {
+	InputFiles  []string
+	OutputFile  string
+	InputBytes  int64
+	OutputBytes int64
+	Duration    time.Duration
+	Err         error
+}
+
+type SSTFileInfo struct {
+	FileName string
+	Size     int64
+	// the reason of creating, one of SSTCreatedByXXX, it is empty when deleted
+	Reason string
+}
+
+type WalRollInfo struct {
+	OldWalFile string
+	NewWalFile string
+}
+
+type BackgroundErrorInfo struct {
+	// the background job, such as flush, compaction
+	Job string
+	Err error
+}
+
+// EventListener is called in the goroutine of the event, it must not be blocked long
+// and must not write the lsm.
+type EventListener interface {
+	OnFlushBegin(info FlushInfo)
+	OnFlushEnd(info FlushInfo)
+	OnCompactionBegin(info CompactionInfo)
+	OnCompactionEnd(info CompactionInfo)
+	OnSSTFileCreated(info SSTFileInfo)
+	OnSSTFileDeleted(info SSTFileInfo)
+	OnWalRolled(info WalRollInfo)
+	OnWriteStallChanged(stalled bool)
+	OnBackgroundError(info BackgroundErrorInfo)
+}
+
+// BaseEventListener does nothing, it can be embedded to implement part of the events.
+type BaseEventListener struct {
+}
+
+func (l *BaseEventListener) OnFlushBegin(info FlushInfo) {
+}
+
+func (l *BaseEventListener) OnFlushEnd(info FlushInfo) {
+}
+
+func (l *BaseEventListener) OnCompactionBegin(info CompactionInfo) {
+}
+
+func (l *BaseEventListener) OnCompactionEnd(info CompactionInfo) {
+}
+
+func (l *BaseEventListener) OnSSTFileCreated(info SSTFileInfo) {
+}
+
+func (l *BaseEventListener) OnSSTFileDeleted(info SSTFileInfo) {
+}
+
+func (l *BaseEventListener) OnWalRolled(info WalRollInfo) {
+}
+
+func (l *BaseEventListener) OnWriteStallChanged(stalled bool) {
+}
+
+func (l *BaseEventListener) OnBackgroundError(info BackgroundErrorInfo) {
+}
+
+func (lsm *Lsm) AddEventListener(listener EventListener) {
+	lsm.listenerMutex.Lock()
+	defer lsm.listenerMutex.Unlock()
+	listeners := make([]EventListener, 0, len(lsm.listeners)+1)
+	listeners = append(listeners, lsm.listeners...)
+	lsm.listeners = append(listeners, listener)
+}
+
+func (lsm *Lsm) RemoveEventListener(listener EventListener) {
+	lsm.listenerMutex.Lock()
+	defer lsm.listenerMutex.Unlock()
+	listeners := make([]EventListener, 0, len(lsm.listeners))
+	for _, l := range lsm.listeners {
+		if l != listener {
+			listeners = append(listeners, l)
+		}
+	}
+	lsm.listeners = listeners
+}
+
+func (lsm *Lsm) fireEvent(callback func(listener EventListener)) {
+	lsm.listenerMutex.Lock()
+	listeners := lsm.listeners
+	lsm.listenerMutex.Unlock()
+	for _, listener := range listeners {
+		callback(listener)
+	}
+}
+
+func (lsm *Lsm) fireBackgroundError(job string, err error) {
+	log.Info("%s error: %s", job, err)
+	lsm.fireEvent(func(listener EventListener) {
+		listener.OnBackgroundError(BackgroundErrorInfo{Job: job, Err: err})
+	})
+}
@@ -0,0 +1,93 @@
+package lsm
+
+import (
+	"testing"
+	"os"
+	"fmt"
+	"sync"
+	"github.com/pister/yfs/common/fileutil"
+)
+
+type recordingListener struct {
+	BaseEventListener
+	mutex       sync.Mutex
+	flushEnds   []FlushInfo
+	compactions []CompactionInfo
+	created     []SSTFileInfo
+	deleted     []SSTFileInfo
+	walRolled   int
+}
+
+func (l *recordingListener) OnFlushEnd(info FlushInfo) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.flushEnds = append(l.flushEnds, info)
+}
+
+func (l *recordingListener) OnCompactionEnd(info CompactionInfo) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.compactions = append(l.compactions, info)
+}
+
+func (l *recordingListener) OnSSTFileCreated(info SSTFileInfo) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.created = append(l.created, info)
+}
+
+func (l *recordingListener) OnSSTFileDeleted(info SSTFileInfo) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.deleted = append(l.deleted, info)
+}
+
+func (l *recordingListener) OnWalRolled(info WalRollInfo) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.walRolled++
+}
+
+func TestEventListener(t *testing.T) {
+	tempDir := "/Users/songlihuang/temp/temp3/lsm_event_test"
+	os.RemoveAll(tempDir)
+	fileutil.MkDirs(tempDir)
+	defer os.RemoveAll(tempDir)
+	lsm, err := OpenLsm(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	listener := new(recordingListener)
+	lsm.AddEventListener(listener)
+	for n := 0; n < compactThreshold; n++ {
+		for i := 0; i < 10; i++ {
+			lsm.Put([]byte(fmt.Sprintf("name-%d-%d", i, n)), []byte(fmt.Sprintf("value-%d-%d", i, n)))
+		}
+		lsm.Flush()
+		lsm.flushLocker.Lock()
+		lsm.flushLocker.Unlock()
+	}
+	if err := lsm.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+	if len(listener.flushEnds) != compactThreshold || listener.walRolled != compactThreshold {
+		t.Fatal("flush events not match", listener.flushEnds)
+	}
+	for _, info := range listener.flushEnds {
+		if info.Err != nil || len(info.SSTFile) == 0 || info.Entries != 10 {
+			t.Fatal("flush info not match", info)
+		}
+	}
+	if len(listener.compactions) != 1 || listener.compactions[0].Err != nil || len(listener.compactions[0].InputFiles) != 2 {
+		t.Fatal("compaction events not match", listener.compactions)
+	}
+	if len(listener.created) != compactThreshold+1 || listener.created[compactThreshold].Reason != SSTCreatedByCompaction {
+		t.Fatal("created events not match", listener.created)
+	}
+	if len(listener.deleted) != 2 {
+		t.Fatal("deleted events not match", listener.deleted)
+	}
+}
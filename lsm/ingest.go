@@ -0,0 +1,276 @@
+package lsm
+
+import (
+	"fmt"
+	"time"
+	"github.com/pister/yfs/common/fileutil"
+	"github.com/pister/yfs/lsm/base"
+	"github.com/pister/yfs/lsm/merge"
+	"github.com/pister/yfs/lsm/sst"
+	"path/filepath"
+	"io"
+	"io/ioutil"
+	"github.com/pister/yfs/common/ratelimit"
+)
+
+const ingestFlushRetryTimes = 3
+
+// IngestFiles adds the sst files built by sst.SSTFileBuilder to the lsm, the data in them are newer than
+// all the data in the lsm, so they override the existing data of the same keys, but the key ranges of the
+// ingesting files must not overlap with each other. The files are checked and linked to the lsm dir before
+// locking the lsm, the ts of them are given by renaming after the data in mem are flushed, and then they are
+// added in one manifest edit. The source files must not be changed after ingesting, they may be hard linked.
+// The writing of the lsm is blocked only while flushing and adding the files.
+func (lsm *Lsm) IngestFiles(paths []string) error {
+	if err := lsm.checkWritable(); err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	for _, path := range paths {
+		if err := sst.CheckSSTFile(lsm.fs, path, lsm.options.comparator()); err != nil {
+			return fmt.Errorf("check sst %s error: %s", path, err)
+		}
+	}
+
+	comparator := lsm.options.comparator()
+	ranges := make([][2][]byte, 0, len(paths))
+	// the temp files are renamed to the sst files when committing, the temp files left by a crash
+	// are deleted by the garbage collecting of the manifest when opening.
+	tempFileNames := make([]string, 0, len(paths))
+	fileNames := make([]string, 0, len(paths))
+	abort := func() {
+		for _, fileName := range fileNames {
+			fileutil.DeleteFileWithFS(lsm.fs, fileName)
+		}
+		for _, tempFileName := range tempFileNames[len(fileNames):] {
+			fileutil.DeleteFileWithFS(lsm.fs, tempFileName)
+		}
+	}
+	for _, path := range paths {
+		minKey, maxKey, fileDataTs, err := scanIngestingFile(path, lsm.options)
+		if err != nil {
+			abort()
+			return err
+		}
+		for _, r := range ranges {
+			if comparator.Compare(minKey, r[1]) != sst.Greater && comparator.Compare(maxKey, r[0]) != sst.Less {
+				abort()
+				return fmt.Errorf("the key range of %s overlaps with other ingesting files", path)
+			}
+		}
+		ranges = append(ranges, [2][]byte{minKey, maxKey})
+		tempFileName, err := prepareIngestingFile(lsm.dir, path, fileDataTs, lsm.options)
+		if err != nil {
+			abort()
+			return err
+		}
+		tempFileNames = append(tempFileNames, tempFileName)
+	}
+
+	lsm.mutex.Lock()
+	defer lsm.mutex.Unlock()
+
+	// the data in mem must be older than the ingested data
+	if err := lsm.flushAndWait(); err != nil {
+		abort()
+		return err
+	}
+
+	ingestTs := base.GetCurrentTs()
+	for i, tempFileName := range tempFileNames {
+		fileName := filepath.Join(lsm.dir, fmt.Sprintf("%s_%d_%d", "sst", 0, ingestTs+int64(i)))
+		if err := lsm.fs.Rename(tempFileName, fileName); err != nil {
+			abort()
+			return err
+		}
+		fileNames = append(fileNames, fileName)
+	}
+
+	readers := make([]interface{}, 0, len(fileNames))
+	for _, fileName := range fileNames {
+		reader, err := sst.OpenSSTableReaderWithFS(lsm.fs, fileName, nil, comparator)
+		if err != nil {
+			closeSSTableReaders(readers)
+			abort()
+			return err
+		}
+		readers = append(readers, reader)
+	}
+
+	lsm.fileMutex.Lock()
+	if err := lsm.manifest.logEdit(newAddFileEdits(fileNames...)); err != nil {
+		lsm.fileMutex.Unlock()
+		closeSSTableReaders(readers)
+		abort()
+		return err
+	}
+	lsm.sstReaders.AddFirst(readers...)
+	lsm.fileMutex.Unlock()
+	for _, reader := range readers {
+		r := reader.(*sst.SSTableReader)
+		lsm.fireEvent(func(listener EventListener) {
+			listener.OnSSTFileCreated(SSTFileInfo{FileName: r.GetFileName(), Size: r.GetFileSize(), Reason: SSTCreatedByIngestion})
+		})
+	}
+
+	// the wal must be newer than the ingested files, so the flushed data
+	// of it will be ordered before them when opening the lsm again.
+	if err := lsm.rollEmptyWal(ingestTs + int64(len(paths))); err != nil {
+		return err
+	}
+	log.Info("ingested %d files: %v", len(fileNames), fileNames)
+	return nil
+}
+
+// must be called with lsm.mutex locked
+func (lsm *Lsm) flushAndWait() error {
+	for i := 0; i < ingestFlushRetryTimes; i++ {
+		if lsm.aheadLog.GetDataSize() == 0 && lsm.memMap.IsEmpty() {
+			return nil
+		}
+		// wait for the running flush, and flush the current data
+		lsm.flushLocker.Lock()
+		lsm.flushLocker.Unlock()
+		if err := lsm.Flush(); err != nil {
+			return err
+		}
+		lsm.flushLocker.Lock()
+		lsm.flushLocker.Unlock()
+	}
+	if lsm.aheadLog.GetDataSize() != 0 || !lsm.memMap.IsEmpty() {
+		return fmt.Errorf("flush data in mem fail")
+	}
+	return nil
+}
+
+// replace the current empty wal by a new one whose ts is greater than minTs,
+// must be called with lsm.mutex locked
+func (lsm *Lsm) rollEmptyWal(minTs int64) error {
+	if lsm.aheadLog.GetDataSize() != 0 {
+		return fmt.Errorf("the wal is not empty")
+	}
+	for base.GetCurrentTs() <= minTs {
+		time.Sleep(time.Microsecond)
+	}
+	ww, err := newWalWrapper(lsm.fs, lsm.dir)
+	if err != nil {
+		return err
+	}
+	oldAheadLog := lsm.aheadLog
+	oldTs := lsm.ts
+	lsm.aheadLog = ww.aheadLog
+	lsm.ts = ww.ts
+	oldAheadLog.Close()
+	lsm.fireEvent(func(listener EventListener) {
+		listener.OnWalRolled(WalRollInfo{OldWalFile: oldAheadLog.filename, NewWalFile: ww.aheadLog.filename})
+	})
+	return lsm.retireWal(oldAheadLog, oldTs)
+}
+
+// checks the data of the source file, the keys must be in increasing order and there are no blob references.
+// It returns the min and max keys, and whether all the data take the ts of the file.
+func scanIngestingFile(path string, options *Options) ([]byte, []byte, bool, error) {
+	file, err := options.fs().Open(path)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	defer file.Close()
+	fileDataTs := true
+	var minKey, lastKey []byte
+	for {
+		header, err := sst.ReadDataHeader(file)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if header == nil {
+			break
+		}
+		if _, err := io.CopyN(ioutil.Discard, file, int64(header.ValueLength)); err != nil {
+			return nil, nil, false, err
+		}
+		options.RateLimiter.Request(int64(sst.DataHeaderLength+len(header.Key)+int(header.ValueLength)), ratelimit.PriorityLow)
+		if header.ValueType != base.ValueTypeNormal {
+			return nil, nil, false, fmt.Errorf("the blob reference in %s can not be ingested", path)
+		}
+		if lastKey != nil && options.comparator().Compare(header.Key, lastKey) != sst.Greater {
+			return nil, nil, false, fmt.Errorf("the keys in %s are not in increasing order", path)
+		}
+		if header.Ts != sst.FileDataTs {
+			fileDataTs = false
+		}
+		if minKey == nil {
+			minKey = header.Key
+		}
+		lastKey = header.Key
+	}
+	if minKey == nil {
+		return nil, nil, false, fmt.Errorf("no data in %s", path)
+	}
+	return minKey, lastKey, fileDataTs, nil
+}
+
+// makes a temp sst in dir with the data of the source file, it returns the name of the temp file.
+// If all the data take the ts of the file, the source file is hard linked, or copied if linking fails,
+// such as they are not in the same device. Otherwise the data are rewritten to take the ts of the file.
+func prepareIngestingFile(dir string, path string, fileDataTs bool, options *Options) (string, error) {
+	if !fileDataTs {
+		return rewriteIngestingFile(dir, path, options)
+	}
+	tempFileName := filepath.Join(dir, fmt.Sprintf("%s_%d_%d_tmp", "sst", 0, base.GetCurrentTs()))
+	if err := fileutil.LinkOrCopyFileWithFS(options.fs(), path, tempFileName); err != nil {
+		fileutil.DeleteFileWithFS(options.fs(), tempFileName)
+		return "", err
+	}
+	return tempFileName, nil
+}
+
+// copy the data of the source file to a temp sst in dir, the data take the ts of the file.
+// The source file is checked by scanIngestingFile before.
+func rewriteIngestingFile(dir string, path string, options *Options) (string, error) {
+	reader, err := merge.OpenSstFileDataBlockReaderWithFS(options.fs(), path)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	writer, err := sst.NewSSTableWriterWithFS(options.fs(), dir, 0, base.GetCurrentTs())
+	if err != nil {
+		return "", err
+	}
+	writer.SetBloomBitsPerKey(options.bloomBitsPerKey())
+	writer.SetPrefixExtractor(options.PrefixExtractor)
+	writer.SetComparator(options.comparator())
+	writer.SetRateLimiter(options.RateLimiter)
+	for {
+		rbd, err := reader.PopNextData()
+		if err != nil {
+			writer.Abort()
+			return "", err
+		}
+		if rbd == nil {
+			break
+		}
+		data := new(base.BlockData)
+		data.Deleted = rbd.Deleted()
+		data.Ts = sst.FileDataTs
+		data.Value = rbd.Value()
+		if err := writer.Append(rbd.Key(), data); err != nil {
+			writer.Abort()
+			return "", err
+		}
+	}
+	if _, err := writer.Finish(); err != nil {
+		writer.Abort()
+		return "", err
+	}
+	if err := writer.Sync(); err != nil {
+		writer.Abort()
+		return "", err
+	}
+	if err := writer.Close(); err != nil {
+		writer.Abort()
+		return "", err
+	}
+	return writer.GetTempFileName(), nil
+}
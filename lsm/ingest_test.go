@@ -0,0 +1,198 @@
+package lsm
+
+import (
+	"testing"
+	"fmt"
+	"os"
+	"github.com/pister/yfs/common/fileutil"
+	"github.com/pister/yfs/lsm/sst"
+	"github.com/pister/yfs/common/vfs"
+	"github.com/pister/yfs/lsm/base"
+)
+
+func TestIngestFiles(t *testing.T) {
+	tempDir := "/Users/songlihuang/temp/temp3/lsm_ingest_test"
+	buildDir := "/Users/songlihuang/temp/temp3/lsm_ingest_test_build"
+	os.RemoveAll(tempDir)
+	defer os.RemoveAll(tempDir)
+	defer os.RemoveAll(buildDir)
+	fileutil.MkDirs(tempDir)
+	fileutil.MkDirs(buildDir)
+
+	files := make([]string, 0, 2)
+	for n := 0; n < 2; n++ {
+		builder, err := sst.NewSSTFileBuilder(fmt.Sprintf("%s/bulk_%d", buildDir, n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			if err := builder.Put([]byte(fmt.Sprintf("name-%d-%03d", n, i)), []byte(fmt.Sprintf("bulk-%d-%d", n, i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := builder.Put([]byte("name-0-000"), []byte("bad order")); err == nil {
+			t.Fatal("the keys out of order must fail")
+		}
+		if err := builder.Finish(); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, builder.GetFileName())
+	}
+
+	lsm, err := OpenLsm(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lsm.Put([]byte("name-0-001"), []byte("old-value"))
+	lsm.Put([]byte("other"), []byte("other-value"))
+	if err := lsm.IngestFiles(files); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.IngestFiles([]string{files[0], files[0]}); err == nil {
+		t.Fatal("overlapped files must fail")
+	}
+	lsm.Put([]byte("name-1-001"), []byte("new-value"))
+	check := func(lsm *Lsm) {
+		for key, value := range map[string]string{
+			"name-0-001": "bulk-0-1",
+			"name-1-099": "bulk-1-99",
+			"name-1-001": "new-value",
+			"other":      "other-value",
+		} {
+			data, err := lsm.Get([]byte(key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != value {
+				t.Fatal("value not match", key, string(data))
+			}
+		}
+		// the data in the ingested files take the ts of the files
+		it, err := lsm.NewIterator()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer it.Close()
+		if err := it.Seek([]byte("name-0-001")); err != nil {
+			t.Fatal(err)
+		}
+		if !it.Valid() || string(it.Key()) != "name-0-001" || string(it.Value()) != "bulk-0-1" {
+			t.Fatal("iterator value not match", string(it.Key()), string(it.Value()))
+		}
+	}
+	check(lsm)
+	if err := lsm.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	check(lsm)
+	lsm.Flush()
+	lsm.flushLocker.Lock()
+	lsm.flushLocker.Unlock()
+	lsm.Close()
+
+	lsm, err = OpenLsm(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	check(lsm)
+}
+
+func TestIngestFilesWithMemFS(t *testing.T) {
+	fs := vfs.NewFaultFS(vfs.NewMemFS())
+	options := DefaultOptions()
+	options.FS = fs
+	dir := "/lsm_ingest_fs_test"
+	buildDir := "/lsm_ingest_fs_test_build"
+	fileutil.MkDirsWithFS(fs, buildDir)
+
+	files := make([]string, 0, 3)
+	for n := 0; n < 2; n++ {
+		builder, err := sst.NewSSTFileBuilderWithFS(fs, fmt.Sprintf("%s/bulk_%d", buildDir, n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			if err := builder.Put([]byte(fmt.Sprintf("name-%d-%03d", n, i)), []byte(fmt.Sprintf("bulk-%d-%d", n, i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := builder.Finish(); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, builder.GetFileName())
+	}
+	// the file whose data have their own ts is rewritten
+	writer, err := sst.NewSSTableWriterWithFS(fs, buildDir, 0, base.GetCurrentTs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		data := new(base.BlockData)
+		data.Ts = uint64(base.GetCurrentTs())
+		data.Value = []byte(fmt.Sprintf("bulk-2-%d", i))
+		if err := writer.Append([]byte(fmt.Sprintf("name-2-%03d", i)), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := writer.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	if err := writer.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	files = append(files, writer.GetFileName())
+
+	lsm, err := OpenLsmWithOptions(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lsm.Put([]byte("name-2-001"), []byte("old-value"))
+	// the first file is copied if linking fails
+	fs.Inject(vfs.Fault{Op: vfs.OpLink, PathContains: "bulk_0"})
+	if err := lsm.IngestFiles(files); err != nil {
+		t.Fatal(err)
+	}
+	if fs.Fired() != 1 {
+		t.Fatal("the fault should be fired")
+	}
+	fs.Reset()
+	check := func(lsm *Lsm) {
+		for key, value := range map[string]string{
+			"name-0-001": "bulk-0-1",
+			"name-1-099": "bulk-1-99",
+			"name-2-001": "bulk-2-1",
+		} {
+			data, err := lsm.Get([]byte(key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != value {
+				t.Fatal("value not match", key, string(data))
+			}
+		}
+	}
+	check(lsm)
+	for _, file := range files {
+		if exist, _ := fileutil.PathExistsWithFS(fs, file); !exist {
+			t.Fatal("the source file must be left", file)
+		}
+	}
+	lsm.Close()
+
+	// the temp file left by a crash while ingesting is deleted when opening
+	orphan := fmt.Sprintf("%s/sst_0_%d_tmp", dir, base.GetCurrentTs())
+	if err := fs.Link(files[0], orphan); err != nil {
+		t.Fatal(err)
+	}
+	lsm, err = OpenLsmWithOptions(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	if exist, _ := fileutil.PathExistsWithFS(fs, orphan); exist {
+		t.Fatal("the orphaned temp file must be deleted")
+	}
+	check(lsm)
+}
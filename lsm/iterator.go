@@ -0,0 +1,236 @@
+package lsm
+
+import (
+	"bytes"
+	"sort"
+	"github.com/pister/yfs/lsm/base"
+	"github.com/pister/yfs/lsm/sst"
+)
+
+// the sources of the iterator, such as memory data and sst files
+type internalIterator interface {
+	SeekToFirst() error
+	Seek(key []byte) error
+	Valid() bool
+	Key() []byte
+	Value() *base.BlockData
+	Next() error
+	Close() error
+}
+
+type memEntry struct {
+	key  []byte
+	data *base.BlockData
+}
+
+// memIterator iterates the copied memory data, it is sorted by key
+type memIterator struct {
+	entries    []memEntry
+	index      int
+	comparator sst.Comparator
+}
+
+func newMemIterator(foreach func(callback func(key []byte, value interface{}) bool), prefix []byte, comparator sst.Comparator) *memIterator {
+	it := new(memIterator)
+	it.comparator = comparator
+	foreach(func(key []byte, value interface{}) bool {
+		if bytes.HasPrefix(key, prefix) {
+			it.entries = append(it.entries, memEntry{key: key, data: value.(*base.BlockData)})
+		}
+		return false
+	})
+	it.index = len(it.entries)
+	return it
+}
+
+func (it *memIterator) SeekToFirst() error {
+	it.index = 0
+	return nil
+}
+
+func (it *memIterator) Seek(key []byte) error {
+	it.index = sort.Search(len(it.entries), func(i int) bool {
+		return it.comparator.Compare(it.entries[i].key, key) != sst.Less
+	})
+	return nil
+}
+
+func (it *memIterator) Valid() bool {
+	return it.index < len(it.entries)
+}
+
+func (it *memIterator) Key() []byte {
+	return it.entries[it.index].key
+}
+
+func (it *memIterator) Value() *base.BlockData {
+	return it.entries[it.index].data
+}
+
+func (it *memIterator) Next() error {
+	if it.index < len(it.entries) {
+		it.index++
+	}
+	return nil
+}
+
+func (it *memIterator) Close() error {
+	return nil
+}
+
+// Iterator walks the live keys of the lsm in the order of the comparator, it sees the data at the
+// moment it was created. It must be closed after using.
+type Iterator struct {
+	lsm        *Lsm
+	prefix     []byte
+	comparator sst.Comparator
+	sources    []internalIterator
+	key        []byte
+	value      []byte
+	// the count of sst files skipped by the prefix bloom filter
+	skippedFiles int
+}
+
+func (lsm *Lsm) NewIterator() (*Iterator, error) {
+	return lsm.NewPrefixIterator(nil)
+}
+
+// NewPrefixIterator walks the keys with the prefix only, the sst files which can not
+// contain the prefix are skipped if Options.PrefixExtractor is set.
+// The keys with the same prefix must be adjacent in the order of the comparator.
+func (lsm *Lsm) NewPrefixIterator(prefix []byte) (*Iterator, error) {
+	it := new(Iterator)
+	it.lsm = lsm
+	it.prefix = prefix
+	it.comparator = lsm.options.comparator()
+
+	// the memory data and the sst files must be got at the same moment, the data
+	// is moved from memory to sst when flushing.
+	lsm.mutex.Lock()
+	lsm.fileMutex.Lock()
+	it.sources = append(it.sources, newMemIterator(lsm.memMap.ForeachMain, prefix, it.comparator))
+	it.sources = append(it.sources, newMemIterator(lsm.memMap.ForeachSwitching, prefix, it.comparator))
+	readers := lsm.getReaders()
+	lsm.pauseFileDeletion()
+	lsm.fileMutex.Unlock()
+	lsm.mutex.Unlock()
+	defer lsm.resumeFileDeletion()
+
+	for _, reader := range readers {
+		if len(prefix) > 0 && !reader.MayContainPrefix(prefix, lsm.options.PrefixExtractor) {
+			it.skippedFiles++
+			continue
+		}
+		sstIterator, err := sst.OpenSSTableIterator(lsm.fs, reader.GetFileName(), it.comparator)
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+		it.sources = append(it.sources, sstIterator)
+	}
+	if err := it.SeekToFirst(); err != nil {
+		it.Close()
+		return nil, err
+	}
+	return it, nil
+}
+
+// SeekToFirst moves to the first key, or the first key with the prefix
+func (it *Iterator) SeekToFirst() error {
+	if len(it.prefix) > 0 {
+		return it.Seek(it.prefix)
+	}
+	for _, source := range it.sources {
+		if err := source.SeekToFirst(); err != nil {
+			return err
+		}
+	}
+	return it.findNext()
+}
+
+// Seek moves to the first key which is not less than the key
+func (it *Iterator) Seek(key []byte) error {
+	if len(it.prefix) > 0 && it.comparator.Compare(key, it.prefix) == sst.Less {
+		key = it.prefix
+	}
+	for _, source := range it.sources {
+		if err := source.Seek(key); err != nil {
+			return err
+		}
+	}
+	return it.findNext()
+}
+
+// find the next live key from the current positions of the sources
+func (it *Iterator) findNext() error {
+	for {
+		it.key = nil
+		it.value = nil
+		var minKey []byte
+		for _, source := range it.sources {
+			if !source.Valid() {
+				continue
+			}
+			if minKey == nil || it.comparator.Compare(source.Key(), minKey) == sst.Less {
+				minKey = source.Key()
+			}
+		}
+		if minKey == nil || !bytes.HasPrefix(minKey, it.prefix) {
+			return nil
+		}
+		// the newest data wins, the sources before are newer when ts are the same
+		var data *base.BlockData
+		for _, source := range it.sources {
+			if !source.Valid() || it.comparator.Compare(source.Key(), minKey) != sst.Equals {
+				continue
+			}
+			if data == nil || source.Value().Ts > data.Ts {
+				data = source.Value()
+			}
+			if err := source.Next(); err != nil {
+				return err
+			}
+		}
+		if data.Deleted == base.Deleted {
+			continue
+		}
+		it.key = minKey
+		if data.ValueType == base.ValueTypeBlobRef {
+			value, err := it.lsm.blobReaders.read(minKey, data.Value)
+			if err != nil {
+				return err
+			}
+			it.value = value
+		} else {
+			it.value = data.Value
+		}
+		return nil
+	}
+}
+
+func (it *Iterator) Valid() bool {
+	return it.key != nil
+}
+
+func (it *Iterator) Key() []byte {
+	return it.key
+}
+
+func (it *Iterator) Value() []byte {
+	return it.value
+}
+
+func (it *Iterator) Next() error {
+	if it.key == nil {
+		return nil
+	}
+	return it.findNext()
+}
+
+func (it *Iterator) Close() error {
+	for _, source := range it.sources {
+		source.Close()
+	}
+	it.sources = nil
+	return nil
+}
@@ -0,0 +1,81 @@
+package lsm
+
+import (
+	"testing"
+	"os"
+	"fmt"
+	"github.com/pister/yfs/common/fileutil"
+	"github.com/pister/yfs/lsm/sst"
+)
+
+func collectIterator(t *testing.T, it *Iterator) []string {
+	defer it.Close()
+	result := make([]string, 0, 8)
+	for ; it.Valid(); it.Next() {
+		result = append(result, fmt.Sprintf("%s=%s", it.Key(), it.Value()))
+	}
+	return result
+}
+
+func TestIteratorPrefix(t *testing.T) {
+	tempDir := "/Users/songlihuang/temp/temp3/lsm_iterator_test"
+	os.RemoveAll(tempDir)
+	fileutil.MkDirs(tempDir)
+	defer os.RemoveAll(tempDir)
+	options := DefaultOptions()
+	options.PrefixExtractor = sst.NewDelimiterPrefixExtractor('/')
+	lsm, err := OpenLsmWithOptions(tempDir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	for i := 0; i < 5; i++ {
+		lsm.Put([]byte(fmt.Sprintf("bucket-a/obj-%d", i)), []byte(fmt.Sprintf("a%d", i)))
+		lsm.Put([]byte(fmt.Sprintf("bucket-b/obj-%d", i)), []byte(fmt.Sprintf("b%d", i)))
+	}
+	lsm.Flush()
+	lsm.flushLocker.Lock()
+	lsm.flushLocker.Unlock()
+	for i := 0; i < 5; i++ {
+		lsm.Put([]byte(fmt.Sprintf("bucket-c/obj-%d", i)), []byte(fmt.Sprintf("c%d", i)))
+	}
+	lsm.Delete([]byte("bucket-a/obj-1"))
+	lsm.Flush()
+	lsm.flushLocker.Lock()
+	lsm.flushLocker.Unlock()
+	lsm.Put([]byte("bucket-a/obj-2"), []byte("a2-new"))
+	lsm.Put([]byte("bucket-a/obj-9"), []byte("a9"))
+
+	it, err := lsm.NewPrefixIterator([]byte("bucket-a/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := fmt.Sprint(collectIterator(t, it))
+	if result != "[bucket-a/obj-0=a0 bucket-a/obj-2=a2-new bucket-a/obj-3=a3 bucket-a/obj-4=a4 bucket-a/obj-9=a9]" {
+		t.Fatal("bucket-a not match", result)
+	}
+
+	it, err = lsm.NewPrefixIterator([]byte("bucket-b/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the file of bucket-c is skipped
+	if it.skippedFiles != 1 {
+		t.Fatal("skipped files not match", it.skippedFiles)
+	}
+	if err := it.Seek([]byte("bucket-b/obj-3")); err != nil {
+		t.Fatal(err)
+	}
+	result = fmt.Sprint(collectIterator(t, it))
+	if result != "[bucket-b/obj-3=b3 bucket-b/obj-4=b4]" {
+		t.Fatal("bucket-b not match", result)
+	}
+
+	it, err = lsm.NewIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(collectIterator(t, it)) != 15 {
+		t.Fatal("all keys not match")
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"path/filepath"
 	"strings"
 	"strconv"
-	"path"
 	"github.com/pister/yfs/common/listutil"
 	"sort"
 	lg "github.com/pister/yfs/log"
@@ -16,9 +15,11 @@ import (
 	"github.com/pister/yfs/common/fileutil"
 	"github.com/pister/yfs/lsm/sst"
 	"github.com/pister/yfs/lsm/base"
-	"github.com/pister/yfs/common/lockutil/process"
 	"time"
 	"github.com/pister/yfs/lsm/merge"
+	"github.com/pister/yfs/common/ratelimit"
+	"io"
+	"github.com/pister/yfs/common/vfs"
 )
 
 var log lg.Logger
@@ -33,42 +34,57 @@ func init() {
 
 const compactThreshold = 3
 
+// the writing is stalled when the mem data is bigger than it times of MaxMemData
+const stallMemDataFactor = 2
+
 type Lsm struct {
 	aheadLog      *AheadLog
 	memMap        *switching.SwitchingMap
 	sstReaders    *listutil.CopyOnWriteList // type of *SSTableReader
 	mutex         sync.Mutex
 	flushLocker   lockutil.TryLocker
-	compactLocker lockutil.TryLocker
-	dirLocker     lockutil.TryLocker
+	compaction    *compactionState
+	dirLocker     io.Closer
+	fs            vfs.FS
+	manifest      *manifest
 	dir           string
 	ts            int64
 	compactTicker *time.Ticker
+	readOnly      bool
+	options       *Options
+	blobReaders   *blobReaders
+	// the blob files which have been relocated, they will be removed after compacting
+	relocatedBlobs map[string]bool
+	cdc            *cdcState
+	stats          *lsmStats
+	listenerMutex  sync.Mutex
+	listeners      []EventListener
+	// guard the changing of sst files
+	fileMutex sync.Mutex
+	// the deleting of files can be paused, such as when making checkpoint
+	deletionMutex  sync.Mutex
+	deletionPaused int
+	pendingDeletes []string
 }
 
-func loadSSTableReaders(dir string) (*listutil.CopyOnWriteList, error) {
-	tsFiles := make([]base.TsFileName, 0, 32)
-	if err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
-		_, name := path.Split(file)
-		if base.SSTNamePattern.MatchString(name) {
-			post := strings.LastIndex(name, "_")
-			ts, err := strconv.ParseInt(name[post+1:], 10, 64)
-			if err != nil {
-				return err
-			}
-			tsFiles = append(tsFiles, base.TsFileName{file, ts})
+func loadSSTableReaders(fs vfs.FS, dir string, names []string, comparator sst.Comparator) (*listutil.CopyOnWriteList, error) {
+	tsFiles := make([]base.TsFileName, 0, len(names))
+	for _, name := range names {
+		post := strings.LastIndex(name, "_")
+		ts, err := strconv.ParseInt(name[post+1:], 10, 64)
+		if err != nil {
+			return nil, err
 		}
-		return nil
-	}); err != nil {
-		return nil, err
+		tsFiles = append(tsFiles, base.TsFileName{PathName: filepath.Join(dir, name), Ts: ts})
 	}
 	sort.Sort(base.SSTFileSlice(tsFiles))
 	sstables := make([]interface{}, 0, len(tsFiles))
 	for _, tsFile := range tsFiles {
 		log.Info("reading sst file: %s", tsFile.PathName)
 
-		sst, err := sst.OpenSSTableReader(tsFile.PathName)
+		sst, err := sst.OpenSSTableReaderWithFS(fs, tsFile.PathName, nil, comparator)
 		if err != nil {
+			closeSSTableReaders(sstables)
 			return nil, err
 		}
 		if sst == nil {
@@ -80,8 +96,15 @@ func loadSSTableReaders(dir string) (*listutil.CopyOnWriteList, error) {
 	return listutil.NewCopyOnWriteListWithInitData(sstables), nil
 }
 
-func prepareForOpenLsm(dir string) error {
-	tsFiles, err := getWalFileNames(dir)
+func closeSSTableReaders(readers []interface{}) {
+	for _, reader := range readers {
+		reader.(*sst.SSTableReader).Close()
+	}
+}
+
+func prepareForOpenLsm(dir string, manifest *manifest, cdc *cdcState, options *Options) error {
+	fs := options.fs()
+	tsFiles, err := getWalFileNames(fs, dir)
 	if err != nil {
 		return err
 	}
@@ -89,16 +112,27 @@ func prepareForOpenLsm(dir string) error {
 		return nil
 	}
 	for _, tsFile := range tsFiles[1:] {
-		ww, err := openWalWrapperByTsFile(tsFile)
+		ww, err := openWalWrapperByTsFile(fs, tsFile, options.comparator())
 		if err != nil {
 			return err
 		}
 		if ww.aheadLog.dataSize.Get() == 0 {
-			fileutil.DeleteFile(tsFile.PathName)
+			fileutil.DeleteFileWithFS(fs, tsFile.PathName)
 			log.Info("wal %s size is 0. just delete it", tsFile.PathName)
 			continue
 		}
-		_, _, err = WalFileToSSTable(dir, ww)
+		files, err := walFileToSSTableWithoutDelete(dir, ww, options)
+		if err != nil {
+			return err
+		}
+		if len(files.sstFile) > 0 {
+			if err := manifest.logEdit(files.edits()); err != nil {
+				return err
+			}
+		}
+		err = retireWalFile(cdc, tsFile.PathName, tsFile.Ts, func(file string) error {
+			return ww.aheadLog.DeleteFile()
+		})
 		if err != nil {
 			return err
 		}
@@ -108,31 +142,69 @@ func prepareForOpenLsm(dir string) error {
 }
 
 func OpenLsm(dir string) (*Lsm, error) {
-	fileutil.MkDirs(dir)
-	dirLocker := process.OpenLocker(fmt.Sprintf("%s/lsm_lock", dir))
-	if !dirLocker.TryLock() {
-		return nil, fmt.Errorf("the lsm dir: %s has opend by another proccess", dir)
+	return OpenLsmWithOptions(dir, DefaultOptions())
+}
+
+func OpenLsmWithOptions(dir string, options *Options) (*Lsm, error) {
+	fs := options.fs()
+	fileutil.MkDirsWithFS(fs, dir)
+	dirLocker, err := fs.Lock(filepath.Join(dir, "lsm_lock"))
+	if err != nil {
+		return nil, fmt.Errorf("the lsm dir: %s has opend by another proccess: %s", dir, err)
+	}
+	manifest, err := openManifest(fs, dir)
+	if err != nil {
+		dirLocker.Close()
+		return nil, err
+	}
+	cdc, err := openCdcState(fs, dir)
+	if err != nil {
+		manifest.close()
+		dirLocker.Close()
+		return nil, err
+	}
+	if err := prepareForOpenLsm(dir, manifest, cdc, options); err != nil {
+		manifest.close()
+		dirLocker.Close()
+		return nil, err
+	}
+	if err := purgeArchivedWalFiles(cdc); err != nil {
+		manifest.close()
+		dirLocker.Close()
+		return nil, err
 	}
-	if err := prepareForOpenLsm(dir); err != nil {
-		dirLocker.Unlock()
+	if err := manifest.collectGarbage(); err != nil {
+		manifest.close()
+		dirLocker.Close()
 		return nil, err
 	}
-	ww, err := createOrOpenFirstWalWrapper(dir)
+	ww, err := createOrOpenFirstWalWrapper(fs, dir, options.comparator())
 	if err != nil {
-		dirLocker.Unlock()
+		manifest.close()
+		dirLocker.Close()
 		return nil, err
 	}
 	lsm := new(Lsm)
 	lsm.dirLocker = dirLocker
+	lsm.fs = fs
+	lsm.manifest = manifest
 	lsm.aheadLog = ww.aheadLog
 	lsm.memMap = switching.NewSwitchingMapWithMainData(ww.memMap)
 	lsm.dir = dir
 	lsm.ts = ww.ts
+	lsm.options = options
+	lsm.blobReaders = newBlobReaders(fs, dir)
+	lsm.relocatedBlobs = make(map[string]bool)
+	lsm.cdc = cdc
+	lsm.stats = newLsmStats()
+	lsm.listeners = options.EventListeners
 	lsm.flushLocker = lockutil.NewTryLocker()
-	lsm.compactLocker = lockutil.NewTryLocker()
-	sstReaders, err := loadSSTableReaders(dir)
+	lsm.compaction = newCompactionState(options.CompactionThreads)
+	sstReaders, err := loadSSTableReaders(fs, dir, manifest.getLiveFiles(), options.comparator())
 	if err != nil {
-		dirLocker.Unlock()
+		ww.aheadLog.Close()
+		manifest.close()
+		dirLocker.Close()
 		return nil, err
 	}
 	lsm.sstReaders = sstReaders
@@ -141,15 +213,98 @@ func OpenLsm(dir string) (*Lsm, error) {
 	return lsm, nil
 }
 
+// OpenLsmReadOnly opens the lsm dir without the dir lock, the sst files are used as they are
+// and the wal files are only replayed in memory, nothing in the dir will be changed.
+// It can be used to inspect a dir which is opened by another process or copied from somewhere.
+func OpenLsmReadOnly(dir string) (*Lsm, error) {
+	return OpenLsmReadOnlyWithOptions(dir, DefaultOptions())
+}
+
+// the options must have the same comparator as the writer
+func OpenLsmReadOnlyWithOptions(dir string, options *Options) (*Lsm, error) {
+	fs := options.fs()
+	exist, err := fileutil.PathExistsWithFS(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	if !exist {
+		return nil, fmt.Errorf("the lsm dir: %s not exist", dir)
+	}
+	// the wal files must be loaded before the sst files, because of the writer
+	// commits the sst before deleting the wal when flushing.
+	memMap, err := loadWalFilesReadOnly(fs, dir, options.comparator())
+	if err != nil {
+		return nil, err
+	}
+	var sstReaders *listutil.CopyOnWriteList
+	// try 3 times, the sst files may be deleted by compacting of the writer
+	for i := 0; i < 3; i++ {
+		var names []string
+		names, err = listLiveSSTFilesReadOnly(fs, dir)
+		if err != nil {
+			return nil, err
+		}
+		sstReaders, err = loadSSTableReaders(fs, dir, names, options.comparator())
+		if err == nil || !os.IsNotExist(err) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	lsm := new(Lsm)
+	lsm.readOnly = true
+	lsm.fs = fs
+	lsm.memMap = switching.NewSwitchingMapWithMainData(memMap)
+	lsm.dir = dir
+	lsm.options = options
+	lsm.blobReaders = newBlobReaders(fs, dir)
+	lsm.stats = newLsmStats()
+	lsm.flushLocker = lockutil.NewTryLocker()
+	lsm.compaction = newCompactionState(options.CompactionThreads)
+	lsm.sstReaders = sstReaders
+	return lsm, nil
+}
+
+// the live sst files are from the manifest, if it not exists, all the sst files in the dir are used.
+func listLiveSSTFilesReadOnly(fs vfs.FS, dir string) ([]string, error) {
+	exist, err := manifestExists(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	if !exist {
+		return listSSTFiles(fs, dir)
+	}
+	state, _, _, err := readManifest(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(state.liveFiles))
+	for name := range state.liveFiles {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (lsm *Lsm) IsReadOnly() bool {
+	return lsm.readOnly
+}
+
+func (lsm *Lsm) checkWritable() error {
+	if lsm.readOnly {
+		return fmt.Errorf("the lsm dir: %s is opened read only", lsm.dir)
+	}
+	return nil
+}
+
 func (lsm *Lsm) startCompactTask() {
 	go func() {
 		for range lsm.compactTicker.C {
-			if !lsm.needCompact() {
-				continue
+			if lsm.needCompact() {
+				lsm.scheduleCompactions()
 			}
-			err := lsm.Compact()
-			if err != nil {
-				log.Info("compact error %s", err)
+			if err := lsm.collectBlobGarbage(); err != nil {
+				lsm.fireBackgroundError("blob gc", err)
 			}
 		}
 	}()
@@ -163,18 +318,26 @@ func (lsm *Lsm) Close() error {
 	lsm.flushLocker.Lock()
 	defer lsm.flushLocker.Unlock()
 
-	lsm.compactTicker.Stop()
+	if !lsm.readOnly {
+		lsm.compactTicker.Stop()
+		lsm.compaction.close()
+
+		lsm.cdc.close()
+
+		lsm.aheadLog.Close()
 
-	lsm.aheadLog.Close()
+		lsm.manifest.close()
 
-	// release the dir locker
-	lsm.dirLocker.Unlock()
+		// release the dir locker
+		lsm.dirLocker.Close()
+	}
 
 	lsm.sstReaders.Foreach(func(item interface{}) (bool, error) {
 		reader := item.(*sst.SSTableReader)
 		reader.Close()
 		return false, nil
 	})
+	lsm.blobReaders.closeAll()
 	lsm.sstReaders = nil
 	lsm.memMap = nil
 
@@ -185,8 +348,22 @@ func (lsm *Lsm) Put(key []byte, value []byte) error {
 	if value == nil {
 		return fmt.Errorf("value can not be nil")
 	}
+	if err := lsm.checkWritable(); err != nil {
+		return err
+	}
+	start := time.Now()
 	lsm.mutex.Lock()
-	defer lsm.mutex.Unlock()
+	defer func() {
+		lsm.mutex.Unlock()
+		lsm.stats.writeLatency.record(time.Since(start))
+	}()
+	lsm.stats.putCount.Increment()
+	return lsm.put(key, value)
+}
+
+// must be called with lsm.mutex locked
+func (lsm *Lsm) put(key []byte, value []byte) error {
+	lsm.stallIfNeeded()
 	// write wal
 	action := new(Action)
 	action.version = defaultVersion
@@ -194,8 +371,7 @@ func (lsm *Lsm) Put(key []byte, value []byte) error {
 	action.key = key
 	action.value = value
 	action.ts = uint64(base.GetCurrentTs())
-	err := lsm.aheadLog.Append(action)
-	if err != nil {
+	if err := lsm.appendWal(action); err != nil {
 		return err
 	}
 	// update mem
@@ -213,17 +389,55 @@ func (lsm *Lsm) Put(key []byte, value []byte) error {
 	return nil
 }
 
+// the writing of wal has the high priority of the rate limiter, must be called with lsm.mutex locked
+func (lsm *Lsm) appendWal(action *Action) error {
+	if err := lsm.aheadLog.Append(action); err != nil {
+		return err
+	}
+	lsm.options.RateLimiter.Request(int64(action.encodedLen()), ratelimit.PriorityHigh)
+	lsm.cdc.notify()
+	return nil
+}
+
+// wait for the flushing when the mem data is too big, must be called with lsm.mutex locked
+func (lsm *Lsm) stallIfNeeded() {
+	if lsm.aheadLog.GetDataSize() <= stallMemDataFactor*base.MaxMemData {
+		return
+	}
+	start := time.Now()
+	lsm.fireEvent(func(listener EventListener) {
+		listener.OnWriteStallChanged(true)
+	})
+	lsm.flushLocker.Lock()
+	lsm.flushLocker.Unlock()
+	lsm.stats.recordStall(time.Since(start))
+	lsm.fireEvent(func(listener EventListener) {
+		listener.OnWriteStallChanged(false)
+	})
+	log.Info("write stalled for %s", time.Since(start))
+	if err := lsm.Flush(); err != nil {
+		log.Info("start flush error", err)
+	}
+}
+
 func (lsm *Lsm) Delete(key []byte) error {
+	if err := lsm.checkWritable(); err != nil {
+		return err
+	}
+	start := time.Now()
 	lsm.mutex.Lock()
-	defer lsm.mutex.Unlock()
+	defer func() {
+		lsm.mutex.Unlock()
+		lsm.stats.writeLatency.record(time.Since(start))
+	}()
+	lsm.stats.deleteCount.Increment()
 	// write wal
 	action := new(Action)
 	action.version = defaultVersion
 	action.op = actionTypeDelete
 	action.key = key
 	action.ts = uint64(base.GetCurrentTs())
-	err := lsm.aheadLog.Append(action)
-	if err != nil {
+	if err := lsm.appendWal(action); err != nil {
 		return err
 	}
 	// update mem
@@ -248,6 +462,11 @@ func (lsm *Lsm) findBlockDataFromSSTables(key []byte, readerTrackers *[]base.Rea
 		if readerTrackers != nil {
 			*readerTrackers = append(*readerTrackers, tracker)
 		}
+		if tracker.BloomHit {
+			lsm.stats.bloomUseful.Increment()
+		} else if blockData == nil && resultOpenSuccess {
+			lsm.stats.bloomUseless.Increment()
+		}
 		if blockData != nil {
 			blockDataFound = blockData
 			return true, nil
@@ -267,6 +486,7 @@ func (lsm *Lsm) GetWithTracker(key []byte) ([]byte, *base.GetTrackInfo, error) {
 	ts := time.Now().UnixNano()
 	defer func() {
 		trackInfo.EscapeInMillisecond = (time.Now().UnixNano() - ts) / 1000000
+		lsm.stats.getLatency.record(time.Duration(time.Now().UnixNano() - ts))
 	}()
 	ds, found := lsm.memMap.Get(key)
 	if found {
@@ -298,6 +518,9 @@ func (lsm *Lsm) GetWithTracker(key []byte) ([]byte, *base.GetTrackInfo, error) {
 	if bd != nil {
 		if bd.Deleted == base.Deleted {
 			return nil, trackInfo, nil
+		} else if bd.ValueType == base.ValueTypeBlobRef {
+			value, err := lsm.blobReaders.read(key, bd.Value)
+			return value, trackInfo, err
 		} else {
 			return bd.Value, trackInfo, nil
 		}
@@ -312,11 +535,14 @@ func (lsm *Lsm) Get(key []byte) ([]byte, error) {
 }
 
 func (lsm *Lsm) Flush() error {
+	if err := lsm.checkWritable(); err != nil {
+		return err
+	}
 	if !lsm.flushLocker.TryLock() {
 		return nil
 	}
 
-	ww, err := newWalWrapper(lsm.dir)
+	ww, err := newWalWrapper(lsm.fs, lsm.dir)
 	if err != nil {
 		lsm.flushLocker.Unlock()
 		return err
@@ -329,28 +555,85 @@ func (lsm *Lsm) Flush() error {
 	oldWW.memMap = lsm.memMap.SwitchNew()
 	oldWW.ts = lsm.ts
 
+	lsm.stats.immutableMemBytes.Add(oldWW.aheadLog.GetDataSize())
 	lsm.aheadLog = ww.aheadLog
 	lsm.ts = ww.ts
+	lsm.cdc.notify()
+	lsm.fireEvent(func(listener EventListener) {
+		listener.OnWalRolled(WalRollInfo{OldWalFile: oldWW.aheadLog.filename, NewWalFile: ww.aheadLog.filename})
+	})
 
 	go func() {
 		defer lsm.flushLocker.Unlock()
-		sstFilePath, filter, err := WalFileToSSTable(lsm.dir, oldWW)
-		if err != nil {
+		defer lsm.stats.immutableMemBytes.Add(-oldWW.aheadLog.GetDataSize())
+		info := lsm.flushWalWrapper(oldWW)
+		if info.Err != nil {
 			lsm.memMap.MergeToMain()
-			log.Info("flush fail:", err)
+			lsm.fireBackgroundError("flush", info.Err)
 		} else {
-			reader, err := sst.OpenSSTableReaderWithBloomFilter(sstFilePath, filter)
-			if err != nil {
-				lsm.memMap.MergeToMain()
-				log.Info("open sst %s error:", sstFilePath)
-			} else {
-				lsm.sstReaders.AddFirst(reader)
-				lsm.memMap.CleanSwitch()
-				log.Info("flush finish.")
-			}
+			log.Info("flush finish.")
 		}
+		lsm.fireEvent(func(listener EventListener) {
+			listener.OnFlushEnd(info)
+		})
+	}()
+
+	return nil
+}
+
+// write the data of the wal to sst, and replace the wal by the sst
+func (lsm *Lsm) flushWalWrapper(ww *walWrapper) (info FlushInfo) {
+	start := time.Now()
+	info.WalFile = ww.aheadLog.filename
+	info.Entries = ww.memMap.Length()
+	info.Bytes = ww.aheadLog.GetDataSize()
+	lsm.fireEvent(func(listener EventListener) {
+		listener.OnFlushBegin(info)
+	})
+	defer func() {
+		info.Duration = time.Since(start)
 	}()
+	files, err := walFileToSSTableWithoutDelete(lsm.dir, ww, lsm.options)
+	if err != nil {
+		info.Err = err
+		return
+	}
+	if len(files.sstFile) > 0 {
+		reader, err := sst.OpenSSTableReaderWithFS(lsm.fs, files.sstFile, files.filter, lsm.options.comparator())
+		if err != nil {
+			info.Err = fmt.Errorf("open sst %s error: %s", files.sstFile, err)
+			return
+		}
+		if err := lsm.addFlushedReader(reader, files.edits()); err != nil {
+			reader.Close()
+			info.Err = fmt.Errorf("log manifest for %s error: %s", files.sstFile, err)
+			return
+		}
+		info.SSTFile = files.sstFile
+		info.BlobFile = files.blobFile
+		lsm.fireEvent(func(listener EventListener) {
+			listener.OnSSTFileCreated(SSTFileInfo{FileName: files.sstFile, Size: reader.GetFileSize(), Reason: SSTCreatedByFlush})
+		})
+		lsm.stats.flushBytes.Add(uint64(reader.GetFileSize() + files.blobSize))
+	} else {
+		lsm.memMap.CleanSwitch()
+	}
+	ww.aheadLog.Close()
+	if err := lsm.retireWal(ww.aheadLog, ww.ts); err != nil {
+		lsm.fireBackgroundError("retire wal", err)
+	}
+	lsm.stats.flushLatency.record(time.Since(start))
+	return
+}
 
+func (lsm *Lsm) addFlushedReader(reader *sst.SSTableReader, edits []versionEdit) error {
+	lsm.fileMutex.Lock()
+	defer lsm.fileMutex.Unlock()
+	if err := lsm.manifest.logEdit(edits); err != nil {
+		return err
+	}
+	lsm.sstReaders.AddFirst(reader)
+	lsm.memMap.CleanSwitch()
 	return nil
 }
 
@@ -381,48 +664,159 @@ func selectReadersToCompact(readers []*sst.SSTableReader) []*sst.SSTableReader {
 }
 
 func (lsm *Lsm) Compact() error {
-	if !lsm.compactLocker.TryLock() {
-		log.Info("need compact, but another compact is not finish.")
-		return nil
+	if err := lsm.checkWritable(); err != nil {
+		return err
 	}
-	defer lsm.compactLocker.Unlock()
-
-	readers := lsm.getReaders()
-
-	if len(readers) < compactThreshold {
+	readers := lsm.compaction.begin(lsm.getReaders())
+	if readers == nil {
+		log.Info("no sst files to compact or too many compactions are running.")
 		return nil
 	}
+	defer lsm.compaction.end(readers)
 
 	log.Info("start compact...")
-	readers = selectReadersToCompact(readers)
+	return lsm.compactReaders(readers, nil)
+}
 
+// merge the readers to one sst, the readers must be owned by the caller in lsm.compaction.
+// The output is added at the last for the regular compaction, or takes the place of the
+// readers for the range compaction, and the deleted data in the range are dropped.
+func (lsm *Lsm) compactReaders(readers []*sst.SSTableReader, cr *compactRange) (err error) {
+	start := time.Now()
 	compactingFiles := make([]string, 0, len(readers))
 	compactingReaders := make([]interface{}, 0, len(readers))
 	for _, reader := range readers {
 		compactingFiles = append(compactingFiles, reader.GetFileName())
 		compactingReaders = append(compactingReaders, reader)
 	}
+	info := CompactionInfo{InputFiles: compactingFiles, InputBytes: sumFileSize(readers)}
+	lsm.fireEvent(func(listener EventListener) {
+		listener.OnCompactionBegin(info)
+	})
+	defer func() {
+		info.Duration = time.Since(start)
+		info.Err = err
+		lsm.fireEvent(func(listener EventListener) {
+			listener.OnCompactionEnd(info)
+		})
+	}()
 
-	filter, sstFile, err := merge.CompactFiles(compactingFiles, false)
+	// the blob records referred by the discarded data become garbage
+	blobGarbage := make(map[string]int64)
+	compactOptions := new(merge.CompactOptions)
+	compactOptions.BloomBitsPerKey = lsm.options.bloomBitsPerKey()
+	compactOptions.PrefixExtractor = lsm.options.PrefixExtractor
+	compactOptions.Comparator = lsm.options.comparator()
+	compactOptions.RateLimiter = lsm.options.RateLimiter
+	compactOptions.FS = lsm.fs
+	if cr != nil {
+		compactOptions.OutputLevel = cr.outputLevel
+		compactOptions.DropDeleted = cr.contains
+	}
+	compactOptions.OnDiscard = func(key []byte, data *base.BlockData) {
+		if data.Deleted == base.Deleted || data.ValueType != base.ValueTypeBlobRef {
+			return
+		}
+		ref, err := decodeBlobRef(data.Value)
+		if err != nil {
+			log.Info("discard bad blob reference of key: %s", key)
+			return
+		}
+		blobGarbage[ref.fileName()] += ref.recordSize(key)
+	}
+	filter, sstFile, err := merge.CompactFilesWithOptions(compactingFiles, compactOptions)
 	if err != nil {
 		return err
 	}
-	reader, err := sst.OpenSSTableReaderWithBloomFilter(sstFile, filter)
+	reader, err := sst.OpenSSTableReaderWithFS(lsm.fs, sstFile, filter, lsm.options.comparator())
 	if err != nil {
 		// open error
 		return err
 	}
 
-	lsm.sstReaders.AddLast(reader)
-	lsm.sstReaders.Delete(compactingReaders...)
+	lsm.fileMutex.Lock()
+	// the compacted file and the old files are changed in one edit,
+	// so there are no duplicated data after crash.
+	edits := append(newAddFileEdits(sstFile), newRemoveFileEdits(compactingFiles...)...)
+	for name, size := range blobGarbage {
+		edits = append(edits, versionEdit{editType: editTypeBlobGarbage, name: name, size: size})
+	}
+	if err := lsm.manifest.logEdit(edits); err != nil {
+		lsm.fileMutex.Unlock()
+		reader.Close()
+		fileutil.DeleteFileWithFS(lsm.fs, sstFile)
+		return err
+	}
+	if cr != nil {
+		lsm.sstReaders.Replace(reader, compactingReaders...)
+	} else {
+		lsm.sstReaders.AddLast(reader)
+		lsm.sstReaders.Delete(compactingReaders...)
+	}
+	lsm.fileMutex.Unlock()
+	info.OutputFile = sstFile
+	info.OutputBytes = reader.GetFileSize()
+	lsm.fireEvent(func(listener EventListener) {
+		listener.OnSSTFileCreated(SSTFileInfo{FileName: sstFile, Size: reader.GetFileSize(), Reason: SSTCreatedByCompaction})
+	})
 
 	for _, reader := range compactingReaders {
 		r := reader.(*sst.SSTableReader)
 		r.Close()
-		fileutil.DeleteFile(r.GetFileName())
+		lsm.deleteFile(r.GetFileName())
+		lsm.fireEvent(func(listener EventListener) {
+			listener.OnSSTFileDeleted(SSTFileInfo{FileName: r.GetFileName(), Size: r.GetFileSize()})
+		})
 	}
 
+	lsm.stats.compactionInputBytes.Add(uint64(info.InputBytes))
+	lsm.stats.compactionOutputBytes.Add(uint64(info.OutputBytes))
+	lsm.stats.compactionLatency.record(time.Since(start))
 	log.Info("compact finish.")
 
 	return nil
 }
+
+// the files will not be deleted until resumeFileDeletion, it can be called many times.
+func (lsm *Lsm) pauseFileDeletion() {
+	lsm.deletionMutex.Lock()
+	defer lsm.deletionMutex.Unlock()
+	lsm.deletionPaused++
+}
+
+func (lsm *Lsm) resumeFileDeletion() {
+	lsm.deletionMutex.Lock()
+	defer lsm.deletionMutex.Unlock()
+	lsm.deletionPaused--
+	if lsm.deletionPaused > 0 {
+		return
+	}
+	for _, file := range lsm.pendingDeletes {
+		if err := fileutil.DeleteFileWithFS(lsm.fs, file); err != nil {
+			log.Info("delete file %s error: %s", file, err)
+		}
+	}
+	lsm.pendingDeletes = nil
+}
+
+func (lsm *Lsm) deleteFile(file string) error {
+	lsm.deletionMutex.Lock()
+	defer lsm.deletionMutex.Unlock()
+	if lsm.deletionPaused > 0 {
+		lsm.pendingDeletes = append(lsm.pendingDeletes, file)
+		return nil
+	}
+	return fileutil.DeleteFileWithFS(lsm.fs, file)
+}
+
+func (lsm *Lsm) isPendingDelete(file string) bool {
+	lsm.deletionMutex.Lock()
+	defer lsm.deletionMutex.Unlock()
+	_, name := filepath.Split(file)
+	for _, f := range lsm.pendingDeletes {
+		if _, pendingName := filepath.Split(f); pendingName == name {
+			return true
+		}
+	}
+	return false
+}
@@ -9,6 +9,10 @@ import (
 	"math/rand"
 	"time"
 	"github.com/pister/yfs/common/atomicutil"
+	"github.com/pister/yfs/lsm/sst"
+	"github.com/pister/yfs/common/vfs"
+	"strings"
+	"path/filepath"
 )
 
 func TestLsmPutAndGet(t *testing.T) {
@@ -415,3 +419,492 @@ func TestCompact(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestOpenLsmReadOnly(t *testing.T) {
+	tempDir := "/Users/songlihuang/temp/temp3/lsm_read_only_test"
+	fileutil.MkDirs(tempDir)
+	defer os.RemoveAll(tempDir)
+	lsm, err := OpenLsm(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	for i := 0; i < 10; i++ {
+		lsm.Put([]byte(fmt.Sprintf("name-%d", i)), []byte(fmt.Sprintf("value-%d", i)))
+	}
+	lsm.Flush()
+	lsm.flushLocker.Lock()
+	lsm.flushLocker.Unlock()
+	lsm.Put([]byte("name-1"), []byte("value-1-11"))
+	lsm.Delete([]byte("name-2"))
+
+	readOnlyLsm, err := OpenLsmReadOnly(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readOnlyLsm.Close()
+	data, err := readOnlyLsm.Get([]byte("name-0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "value-0" {
+		t.Fatal("value not match")
+	}
+	data, err = readOnlyLsm.Get([]byte("name-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "value-1-11" {
+		t.Fatal("value not match")
+	}
+	data, err = readOnlyLsm.Get([]byte("name-2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data != nil {
+		t.Fatal("delete fail")
+	}
+	if err := readOnlyLsm.Put([]byte("name-3"), []byte("value-3")); err == nil {
+		t.Fatal("put must fail in read only mode")
+	}
+}
+
+func TestManifestCollectGarbage(t *testing.T) {
+	tempDir := "/Users/songlihuang/temp/temp3/lsm_manifest_test"
+	os.RemoveAll(tempDir)
+	fileutil.MkDirs(tempDir)
+	defer os.RemoveAll(tempDir)
+	lsm, err := OpenLsm(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < compactThreshold; n++ {
+		for i := 0; i < 10; i++ {
+			lsm.Put([]byte(fmt.Sprintf("name-%d-%d", i, n)), []byte(fmt.Sprintf("value-%d-%d", i, n)))
+		}
+		lsm.Flush()
+		lsm.flushLocker.Lock()
+		lsm.flushLocker.Unlock()
+	}
+	if err := lsm.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	liveFiles := lsm.manifest.getLiveFiles()
+	lsm.Close()
+	if len(liveFiles) != 2 {
+		t.Fatal("live files not match", liveFiles)
+	}
+	// the orphaned files left by crash
+	fileutil.WriteDataToFile(tempDir+"/sst_0_100", []byte("orphaned"))
+	fileutil.WriteDataToFile(tempDir+"/sst_0_101_tmp", []byte("temp"))
+
+	lsm, err = OpenLsm(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	for _, name := range []string{"sst_0_100", "sst_0_101_tmp"} {
+		exist, _ := fileutil.PathExists(tempDir + "/" + name)
+		if exist {
+			t.Fatal("orphaned file not deleted:", name)
+		}
+	}
+	for n := 0; n < compactThreshold; n++ {
+		for i := 0; i < 10; i++ {
+			data, err := lsm.Get([]byte(fmt.Sprintf("name-%d-%d", i, n)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != fmt.Sprintf("value-%d-%d", i, n) {
+				t.Fatal("value not match")
+			}
+		}
+	}
+}
+
+func TestBloomFalsePositiveRate(t *testing.T) {
+	tempDir := "/Users/songlihuang/temp/temp3/lsm_bloom_test"
+	os.RemoveAll(tempDir)
+	fileutil.MkDirs(tempDir)
+	defer os.RemoveAll(tempDir)
+	options := DefaultOptions()
+	options.BloomFalsePositiveRate = 0.01
+	lsm, err := OpenLsmWithOptions(tempDir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	for i := 0; i < 1000; i++ {
+		lsm.Put([]byte(fmt.Sprintf("name-%d", i)), []byte(fmt.Sprintf("value-%d", i)))
+	}
+	lsm.Flush()
+	lsm.flushLocker.Lock()
+	lsm.flushLocker.Unlock()
+	for i := 0; i < 1000; i++ {
+		if data, _ := lsm.Get([]byte(fmt.Sprintf("missing-%d", i))); data != nil {
+			t.Fatal("missing key found")
+		}
+	}
+	stats := lsm.Stats()
+	// the filter is sized by the key count
+	if stats.SSTBytes > 64*1024 {
+		t.Fatal("sst too big", stats.SSTBytes)
+	}
+	if stats.BloomUseless > 30 {
+		t.Fatal("too many false positive", stats.BloomUseless)
+	}
+}
+
+func TestMultiGet(t *testing.T) {
+	tempDir := "/Users/songlihuang/temp/temp3/lsm_multi_get_test"
+	os.RemoveAll(tempDir)
+	fileutil.MkDirs(tempDir)
+	defer os.RemoveAll(tempDir)
+	lsm, err := OpenLsm(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	for n := 0; n < 2; n++ {
+		for i := 0; i < 100; i++ {
+			lsm.Put([]byte(fmt.Sprintf("meta-%03d", i*2+n)), []byte(fmt.Sprintf("value-%d", i*2+n)))
+		}
+		lsm.Flush()
+		lsm.flushLocker.Lock()
+		lsm.flushLocker.Unlock()
+	}
+	lsm.Delete([]byte("meta-010"))
+	lsm.Put([]byte("meta-011"), []byte("new-value"))
+	lsm.Put([]byte("meta-500"), []byte("value-500"))
+
+	keys := make([][]byte, 0, 210)
+	for i := 210; i >= 0; i-- {
+		keys = append(keys, []byte(fmt.Sprintf("meta-%03d", i)))
+	}
+	keys = append(keys, []byte("meta-500"))
+	values, errs := lsm.MultiGet(keys)
+	for i, key := range keys {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		expected, err := lsm.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(values[i]) != string(expected) {
+			t.Fatal("value not match", string(key), string(values[i]), string(expected))
+		}
+	}
+	if values[len(keys)-1] == nil || values[0] != nil || string(values[210-11]) != "new-value" || values[210-10] != nil {
+		t.Fatal("values not match")
+	}
+}
+
+func TestComparator(t *testing.T) {
+	tempDir := "/Users/songlihuang/temp/temp3/lsm_comparator_test"
+	os.RemoveAll(tempDir)
+	fileutil.MkDirs(tempDir)
+	defer os.RemoveAll(tempDir)
+	options := DefaultOptions()
+	options.Comparator = sst.NewReverseComparator(sst.BytewiseComparator)
+	lsm, err := OpenLsmWithOptions(tempDir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < compactThreshold; n++ {
+		for i := n; i < 30; i += compactThreshold {
+			lsm.Put([]byte(fmt.Sprintf("key-%02d", i)), []byte(fmt.Sprintf("value-%d", i)))
+		}
+		lsm.Flush()
+		lsm.flushLocker.Lock()
+		lsm.flushLocker.Unlock()
+	}
+	if err := lsm.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	lsm.Put([]byte("key-15"), []byte("new-value"))
+	data, err := lsm.Get([]byte("key-07"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "value-7" {
+		t.Fatal("value not match", string(data))
+	}
+	it, err := lsm.NewIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, 0, 30)
+	for ; it.Valid(); it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	it.Close()
+	if len(keys) != 30 || keys[0] != "key-29" || keys[29] != "key-00" {
+		t.Fatal("keys not in reverse order", keys)
+	}
+	lsm.Close()
+
+	// the sst files are checked by the comparator
+	_, err = OpenLsm(tempDir)
+	if err == nil {
+		t.Fatal("should be failed by the comparator")
+	}
+	lsm, err = OpenLsmWithOptions(tempDir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	data, err = lsm.Get([]byte("key-15"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "new-value" {
+		t.Fatal("value not match after reopen", string(data))
+	}
+}
+
+func TestCompactRange(t *testing.T) {
+	tempDir := "/Users/songlihuang/temp/temp3/lsm_compact_range_test"
+	os.RemoveAll(tempDir)
+	fileutil.MkDirs(tempDir)
+	defer os.RemoveAll(tempDir)
+	options := DefaultOptions()
+	options.CompactionThreads = 2
+	lsm, err := OpenLsmWithOptions(tempDir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	lsm.PauseCompaction()
+	flush := func() {
+		lsm.Flush()
+		lsm.flushLocker.Lock()
+		lsm.flushLocker.Unlock()
+	}
+	for i := 0; i < 100; i++ {
+		lsm.Put([]byte(fmt.Sprintf("a-%03d", i)), []byte(fmt.Sprintf("a-value-%d", i)))
+		lsm.Put([]byte(fmt.Sprintf("b-%03d", i)), []byte(fmt.Sprintf("b-value-%d", i)))
+	}
+	flush()
+	for i := 0; i < 100; i++ {
+		lsm.Delete([]byte(fmt.Sprintf("a-%03d", i)))
+	}
+	flush()
+	for i := 0; i < 100; i++ {
+		lsm.Put([]byte(fmt.Sprintf("c-%03d", i)), []byte(fmt.Sprintf("c-value-%d", i)))
+	}
+	flush()
+
+	// no background compaction when paused
+	lsm.scheduleCompactions()
+	if len(lsm.getReaders()) != 3 {
+		t.Fatal("should not be compacted when paused")
+	}
+
+	if err := lsm.CompactRange([]byte("a-"), []byte("a-999")); err != nil {
+		t.Fatal(err)
+	}
+	readers := lsm.getReaders()
+	if len(readers) != 2 {
+		t.Fatal("readers not match", len(readers))
+	}
+	// the deleted data in the range are dropped
+	minKey, maxKey, err := readers[1].GetKeyRange()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(minKey) != "b-000" || string(maxKey) != "b-099" {
+		t.Fatal("key range not match", string(minKey), string(maxKey))
+	}
+	data, err := lsm.Get([]byte("a-010"))
+	if err != nil || data != nil {
+		t.Fatal("a-010 should be deleted")
+	}
+	data, err = lsm.Get([]byte("b-010"))
+	if err != nil || string(data) != "b-value-10" {
+		t.Fatal("b-010 not match")
+	}
+	lsm.ResumeCompaction()
+	if lsm.compaction.isPaused() {
+		t.Fatal("should be resumed")
+	}
+}
+
+func TestLsmWithMemAndFaultFS(t *testing.T) {
+	fs := vfs.NewFaultFS(vfs.NewMemFS())
+	options := DefaultOptions()
+	options.FS = fs
+	dir := "/lsm_fs_test"
+	lsm, err := OpenLsmWithOptions(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenLsmWithOptions(dir, options); err == nil {
+		t.Fatal("the dir is locked")
+	}
+	for i := 0; i < 10; i++ {
+		lsm.Put([]byte(fmt.Sprintf("name-%d", i)), []byte(fmt.Sprintf("value-%d", i)))
+	}
+	// the committing of sst fails, the data is still in memory and wal
+	fs.Inject(vfs.Fault{Op: vfs.OpRename, PathContains: "sst_"})
+	lsm.Flush()
+	lsm.flushLocker.Lock()
+	lsm.flushLocker.Unlock()
+	if fs.Fired() != 1 {
+		t.Fatal("the fault should be fired")
+	}
+	data, err := lsm.Get([]byte("name-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "value-1" {
+		t.Fatal("value not match")
+	}
+	lsm.Close()
+	fs.Reset()
+
+	lsm, err = OpenLsmWithOptions(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	for i := 0; i < 10; i++ {
+		data, err := lsm.Get([]byte(fmt.Sprintf("name-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != fmt.Sprintf("value-%d", i) {
+			t.Fatal("value not match after reopen")
+		}
+	}
+	names, _ := fs.List(dir)
+	for _, name := range names {
+		if strings.HasSuffix(name, "_tmp") {
+			t.Fatal("the temp file should be collected", name)
+		}
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatal("nothing should be written to the disk")
+	}
+}
+
+func TestManifestBrokenTail(t *testing.T) {
+	fs := vfs.NewMemFS()
+	dir := "/lsm_manifest_tail_test"
+	if err := fileutil.MkDirsWithFS(fs, dir); err != nil {
+		t.Fatal(err)
+	}
+	m, err := openManifest(fs, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.logEdit(newAddFileEdits("sst_0_1")); err != nil {
+		t.Fatal(err)
+	}
+	// the tail record which is not completely written
+	if _, err := m.file.Write([]byte("MF-junk")); err != nil {
+		t.Fatal(err)
+	}
+	m.close()
+
+	m, err = openManifest(fs, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.logEdit(newAddFileEdits("sst_0_2")); err != nil {
+		t.Fatal(err)
+	}
+	m.close()
+
+	m, err = openManifest(fs, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.close()
+	liveFiles := m.getLiveFiles()
+	if len(liveFiles) != 2 || liveFiles[0] != "sst_0_1" || liveFiles[1] != "sst_0_2" {
+		t.Fatal("the edit after the broken tail is lost", liveFiles)
+	}
+}
+
+func TestManifestBrokenMiddle(t *testing.T) {
+	fs := vfs.NewMemFS()
+	options := DefaultOptions()
+	options.FS = fs
+	dir := "/lsm_manifest_middle_test"
+	lsm, err := OpenLsmWithOptions(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < 2; n++ {
+		lsm.Put([]byte(fmt.Sprintf("name-%d", n)), []byte(fmt.Sprintf("value-%d", n)))
+		lsm.Flush()
+		lsm.flushLocker.Lock()
+		lsm.flushLocker.Unlock()
+	}
+	lsm.Close()
+	sstFiles, err := listSSTFiles(fs, dir)
+	if err != nil || len(sstFiles) != 2 {
+		t.Fatal("sst files not match", sstFiles, err)
+	}
+
+	// the sum of the first record is broken, the records after it are good
+	file, err := fs.OpenFile(filepath.Join(dir, manifestFileName), os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteAt([]byte{0xff, 0xff}, 4); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if _, err := OpenLsmWithOptions(dir, options); err == nil {
+		t.Fatal("the broken manifest should fail the opening")
+	}
+	for _, name := range sstFiles {
+		if _, err := fs.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatal("the live sst should not be deleted", name, err)
+		}
+	}
+}
+
+func TestMultiGetWithFailedSST(t *testing.T) {
+	fs := vfs.NewFaultFS(vfs.NewMemFS())
+	options := DefaultOptions()
+	options.FS = fs
+	lsm, err := OpenLsmWithOptions("/lsm_multi_get_fault_test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	for _, prefix := range []string{"old", "new"} {
+		for i := 0; i < 50; i++ {
+			lsm.Put([]byte(fmt.Sprintf("%s-%02d", prefix, i)), []byte(fmt.Sprintf("%s-value-%d", prefix, i)))
+		}
+		lsm.Flush()
+		lsm.flushLocker.Lock()
+		lsm.flushLocker.Unlock()
+	}
+	var oldFile string
+	lsm.sstReaders.Foreach(func(item interface{}) (bool, error) {
+		oldFile = item.(*sst.SSTableReader).GetFileName()
+		return false, nil
+	})
+	fs.Inject(vfs.Fault{Op: vfs.OpRead, PathContains: oldFile, Sticky: true})
+
+	keys := [][]byte{[]byte("new-01"), []byte("old-01"), []byte("new-12"), []byte("old-12"), []byte("none")}
+	values, errs := lsm.MultiGet(keys)
+	for i, key := range keys {
+		if strings.HasPrefix(string(key), "new") {
+			var n int
+			fmt.Sscanf(string(key), "new-%d", &n)
+			if errs[i] != nil || string(values[i]) != fmt.Sprintf("new-value-%d", n) {
+				t.Fatal("the key in the newer sst should be found", string(key), errs[i], string(values[i]))
+			}
+		} else if errs[i] == nil {
+			t.Fatal("the key in the failed sst should fail", string(key))
+		}
+	}
+	if fs.Fired() == 0 {
+		t.Fatal("the fault should be fired")
+	}
+}
@@ -0,0 +1,452 @@
+package lsm
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"sync"
+	"sort"
+	"strings"
+	"path/filepath"
+	"github.com/pister/yfs/common/bytesutil"
+	"github.com/pister/yfs/common/hashutil"
+	"github.com/pister/yfs/common/fileutil"
+	"github.com/pister/yfs/lsm/base"
+	"github.com/pister/yfs/common/vfs"
+)
+
+// manifest format summary
+/*
+	the manifest is an append only log of version edits, one edit is one record,
+	so the files in one edit are added and removed atomically.
+
+record layout:
+2 - bytes magic code
+1 - byte not used
+1 - byte not used
+4 - bytes payload sum
+4 - bytes payload length
+...bytes for payload
+
+payload is a list of edit items:
+1 - byte edit type
+2 - bytes file name length
+...bytes for file name
+8 - bytes size, only for the edit types of blob file
+*/
+
+const (
+	manifestFileName         = "MANIFEST"
+	manifestMagicCode1       = 'M'
+	manifestMagicCode2       = 'F'
+	manifestRecordHeaderLen  = 12
+	manifestMaxRecordLen     = 64 * 1024 * 1024
+	manifestRewriteThreshold = 1000
+)
+
+const (
+	editTypeAddFile     = 1
+	editTypeRemoveFile  = 2
+	editTypeAddBlob     = 3
+	editTypeRemoveBlob  = 4
+	editTypeBlobGarbage = 5
+)
+
+type versionEdit struct {
+	editType byte
+	name     string
+	size     int64
+}
+
+func (edit versionEdit) hasSize() bool {
+	return edit.editType == editTypeAddBlob || edit.editType == editTypeBlobGarbage
+}
+
+func newAddFileEdits(files ...string) []versionEdit {
+	return newFileEdits(editTypeAddFile, files)
+}
+
+func newRemoveFileEdits(files ...string) []versionEdit {
+	return newFileEdits(editTypeRemoveFile, files)
+}
+
+func newFileEdits(editType byte, files []string) []versionEdit {
+	edits := make([]versionEdit, 0, len(files))
+	for _, file := range files {
+		_, name := filepath.Split(file)
+		edits = append(edits, versionEdit{editType: editType, name: name})
+	}
+	return edits
+}
+
+// the total size and garbage size of a blob file
+type blobFileStat struct {
+	totalSize   int64
+	garbageSize int64
+}
+
+func (stat *blobFileStat) liveRate() float64 {
+	if stat.totalSize <= 0 {
+		return 0
+	}
+	return float64(stat.totalSize-stat.garbageSize) / float64(stat.totalSize)
+}
+
+type manifestState struct {
+	liveFiles map[string]bool
+	blobFiles map[string]*blobFileStat
+}
+
+func newManifestState() *manifestState {
+	state := new(manifestState)
+	state.liveFiles = make(map[string]bool)
+	state.blobFiles = make(map[string]*blobFileStat)
+	return state
+}
+
+func (state *manifestState) apply(edits []versionEdit) {
+	for _, edit := range edits {
+		switch edit.editType {
+		case editTypeAddFile:
+			state.liveFiles[edit.name] = true
+		case editTypeRemoveFile:
+			delete(state.liveFiles, edit.name)
+		case editTypeAddBlob:
+			state.blobFiles[edit.name] = &blobFileStat{totalSize: edit.size}
+		case editTypeRemoveBlob:
+			delete(state.blobFiles, edit.name)
+		case editTypeBlobGarbage:
+			if stat, exist := state.blobFiles[edit.name]; exist {
+				stat.garbageSize += edit.size
+			}
+		}
+	}
+}
+
+// the edits which can build the state from empty
+func (state *manifestState) snapshotEdits() []versionEdit {
+	edits := make([]versionEdit, 0, len(state.liveFiles)+2*len(state.blobFiles))
+	for name := range state.liveFiles {
+		edits = append(edits, versionEdit{editType: editTypeAddFile, name: name})
+	}
+	for name, stat := range state.blobFiles {
+		edits = append(edits, versionEdit{editType: editTypeAddBlob, name: name, size: stat.totalSize})
+		if stat.garbageSize > 0 {
+			edits = append(edits, versionEdit{editType: editTypeBlobGarbage, name: name, size: stat.garbageSize})
+		}
+	}
+	return edits
+}
+
+type manifest struct {
+	fs          vfs.FS
+	dir         string
+	file        vfs.File
+	state       *manifestState
+	recordCount int
+	mutex       sync.Mutex
+}
+
+func manifestExists(fs vfs.FS, dir string) (bool, error) {
+	return fileutil.PathExistsWithFS(fs, filepath.Join(dir, manifestFileName))
+}
+
+// open the manifest of the dir, it will be created by the sst files in the dir if not exist.
+func openManifest(fs vfs.FS, dir string) (*manifest, error) {
+	exist, err := manifestExists(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	var state *manifestState
+	var recordCount int
+	var validLength int64 = -1
+	if exist {
+		state, recordCount, validLength, err = readManifest(fs, dir)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		names, err := listSSTFiles(fs, dir)
+		if err != nil {
+			return nil, err
+		}
+		log.Info("manifest not exist, create it by %d sst files", len(names))
+		state = newManifestState()
+		state.apply(newAddFileEdits(names...))
+		if err := writeManifestSnapshot(fs, dir, state.snapshotEdits()); err != nil {
+			return nil, err
+		}
+		recordCount = 1
+	}
+	file, err := fs.OpenFile(filepath.Join(dir, manifestFileName), os.O_RDWR|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if validLength >= 0 {
+		// the broken tail is removed, or the new edits are written after it and lost at the next open
+		if err := file.Truncate(validLength); err != nil {
+			file.Close()
+			return nil, err
+		}
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	m := new(manifest)
+	m.fs = fs
+	m.dir = dir
+	m.file = file
+	m.state = state
+	m.recordCount = recordCount
+	return m, nil
+}
+
+// the record is cut by the end of the file, it is the last write which is not finished
+var errManifestRecordNotComplete = fmt.Errorf("manifest record not complete")
+
+// read the live files from the manifest, the tail record which is not completely written is ignored,
+// and the other broken records fail the reading, as the edits after them are lost.
+// It returns the length of the good records if the tail is broken, or -1.
+func readManifest(fs vfs.FS, dir string) (*manifestState, int, int64, error) {
+	file, err := fs.Open(filepath.Join(dir, manifestFileName))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	state := newManifestState()
+	recordCount := 0
+	var length int64 = 0
+	for {
+		edits, recordLen, err := readManifestRecord(file)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			// the broken last record which ends at the end of the file may be written partly
+			if err == errManifestRecordNotComplete || (recordLen > 0 && length+recordLen == fi.Size()) {
+				log.Info("ignore the broken tail of manifest after %d bytes: %s", length, err)
+				return state, recordCount, length, nil
+			}
+			return nil, 0, 0, fmt.Errorf("manifest is broken at %d: %s", length, err)
+		}
+		state.apply(edits)
+		recordCount++
+		length += recordLen
+	}
+	return state, recordCount, -1, nil
+}
+
+// returns the edits and the length of the record, the length is returned for the broken
+// record too if its header is good, and it is 0 if the header is broken.
+func readManifestRecord(reader io.Reader) ([]versionEdit, int64, error) {
+	header := make([]byte, manifestRecordHeaderLen)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, 0, errManifestRecordNotComplete
+		}
+		return nil, 0, err
+	}
+	if header[0] != manifestMagicCode1 || header[1] != manifestMagicCode2 {
+		return nil, 0, fmt.Errorf("manifest magic code not match")
+	}
+	sum := bytesutil.GetUint32FromBytes(header, 4)
+	payloadLen := bytesutil.GetUint32FromBytes(header, 8)
+	if payloadLen > manifestMaxRecordLen {
+		return nil, 0, fmt.Errorf("too big manifest record length: %d", payloadLen)
+	}
+	recordLen := int64(manifestRecordHeaderLen) + int64(payloadLen)
+	payload := make([]byte, payloadLen)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, recordLen, errManifestRecordNotComplete
+		}
+		return nil, 0, err
+	}
+	if hashutil.SumHash32(payload) != sum {
+		return nil, recordLen, fmt.Errorf("manifest sum not match")
+	}
+	edits := make([]versionEdit, 0, 4)
+	for pos := 0; pos < len(payload); {
+		if pos+3 > len(payload) {
+			return nil, recordLen, fmt.Errorf("bad manifest edit")
+		}
+		editType := payload[pos]
+		nameLen := int(bytesutil.GetUint16FromBytes(payload, pos+1))
+		pos += 3
+		if pos+nameLen > len(payload) {
+			return nil, recordLen, fmt.Errorf("bad manifest edit")
+		}
+		edit := versionEdit{editType: editType, name: string(payload[pos:pos+nameLen])}
+		pos += nameLen
+		if edit.hasSize() {
+			if pos+8 > len(payload) {
+				return nil, recordLen, fmt.Errorf("bad manifest edit")
+			}
+			edit.size = int64(bytesutil.GetUint64FromBytes(payload, pos))
+			pos += 8
+		}
+		edits = append(edits, edit)
+	}
+	return edits, recordLen, nil
+}
+
+func encodeManifestRecord(edits []versionEdit) []byte {
+	payloadLen := 0
+	for _, edit := range edits {
+		payloadLen += 3 + len(edit.name)
+		if edit.hasSize() {
+			payloadLen += 8
+		}
+	}
+	buf := make([]byte, manifestRecordHeaderLen+payloadLen)
+	buf[0] = manifestMagicCode1
+	buf[1] = manifestMagicCode2
+	bytesutil.CopyUint32ToBytes(uint32(payloadLen), buf, 8)
+	pos := manifestRecordHeaderLen
+	for _, edit := range edits {
+		buf[pos] = edit.editType
+		bytesutil.CopyUint16ToBytes(uint16(len(edit.name)), buf, pos+1)
+		copy(buf[pos+3:], edit.name)
+		pos += 3 + len(edit.name)
+		if edit.hasSize() {
+			bytesutil.CopyUint64ToBytes(uint64(edit.size), buf, pos)
+			pos += 8
+		}
+	}
+	bytesutil.CopyUint32ToBytes(hashutil.SumHash32(buf[manifestRecordHeaderLen:]), buf, 4)
+	return buf
+}
+
+// write a new manifest which only has the edits in one record, it replaces the old one atomically.
+func writeManifestSnapshot(fs vfs.FS, dir string, edits []versionEdit) error {
+	fileName := filepath.Join(dir, manifestFileName)
+	tempFileName := fileName + "_tmp"
+	file, err := fs.Create(tempFileName)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(encodeManifestRecord(edits)); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := fs.Rename(tempFileName, fileName); err != nil {
+		return err
+	}
+	return fs.SyncDir(dir)
+}
+
+// the edits are logged in one record, so they are applied atomically
+func (m *manifest) logEdit(edits []versionEdit) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, err := m.file.Write(encodeManifestRecord(edits)); err != nil {
+		return err
+	}
+	if err := m.file.Sync(); err != nil {
+		return err
+	}
+	m.state.apply(edits)
+	m.recordCount++
+	if m.recordCount > manifestRewriteThreshold {
+		if err := m.rewrite(); err != nil {
+			// the edit has been logged, just try again next time
+			log.Info("rewrite manifest error: %s", err)
+		}
+	}
+	return nil
+}
+
+func (m *manifest) rewrite() error {
+	if err := writeManifestSnapshot(m.fs, m.dir, m.state.snapshotEdits()); err != nil {
+		return err
+	}
+	file, err := m.fs.OpenFile(filepath.Join(m.dir, manifestFileName), os.O_RDWR|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	m.file.Close()
+	m.file = file
+	m.recordCount = 1
+	return nil
+}
+
+func (m *manifest) getLiveFiles() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	names := make([]string, 0, len(m.state.liveFiles))
+	for name := range m.state.liveFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// the copy of the blob file stats
+func (m *manifest) getBlobFiles() map[string]blobFileStat {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	blobFiles := make(map[string]blobFileStat)
+	for name, stat := range m.state.blobFiles {
+		blobFiles[name] = *stat
+	}
+	return blobFiles
+}
+
+// delete the sst and blob files which are not in the manifest, and the temp files of writers.
+func (m *manifest) collectGarbage() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	names, err := m.fs.List(m.dir)
+	if err != nil {
+		return err
+	}
+	garbage := make([]string, 0, 4)
+	for _, name := range names {
+		if (strings.HasPrefix(name, "sst_") || strings.HasPrefix(name, "blob_")) && strings.HasSuffix(name, "_tmp") {
+			garbage = append(garbage, filepath.Join(m.dir, name))
+		} else if base.SSTNamePattern.MatchString(name) && !m.state.liveFiles[name] {
+			garbage = append(garbage, filepath.Join(m.dir, name))
+		} else if blobNamePattern.MatchString(name) && m.state.blobFiles[name] == nil {
+			garbage = append(garbage, filepath.Join(m.dir, name))
+		}
+	}
+	for _, file := range garbage {
+		log.Info("delete the orphaned file: %s", file)
+		if err := fileutil.DeleteFileWithFS(m.fs, file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *manifest) close() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.file.Close()
+}
+
+func listSSTFiles(fs vfs.FS, dir string) ([]string, error) {
+	allNames, err := fs.List(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, 32)
+	for _, name := range allNames {
+		if base.SSTNamePattern.MatchString(name) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
@@ -1,7 +1,6 @@
 package merge
 
 import (
-	"os"
 	"github.com/pister/yfs/lsm/base"
 	"github.com/pister/yfs/lsm/sst"
 	"path/filepath"
@@ -10,30 +9,73 @@ import (
 	"strconv"
 	"sort"
 	"github.com/pister/yfs/common/fileutil"
+	"github.com/pister/yfs/common/ratelimit"
+	"github.com/pister/yfs/common/vfs"
 )
 
 type RichBlockData struct {
-	deleted base.DeletedFlag
-	ts      uint64
-	key     []byte
-	value   []byte
+	deleted   base.DeletedFlag
+	valueType base.ValueType
+	ts        uint64
+	key       []byte
+	value     []byte
 }
 
+func (rbd *RichBlockData) Key() []byte {
+	return rbd.key
+}
+
+func (rbd *RichBlockData) Value() []byte {
+	return rbd.value
+}
+
+func (rbd *RichBlockData) Ts() uint64 {
+	return rbd.ts
+}
+
+func (rbd *RichBlockData) Deleted() base.DeletedFlag {
+	return rbd.deleted
+}
+
+func (rbd *RichBlockData) ValueType() base.ValueType {
+	return rbd.valueType
+}
+
+func (rbd *RichBlockData) toBlockData() *base.BlockData {
+	bd := new(base.BlockData)
+	bd.Ts = rbd.ts
+	bd.Deleted = rbd.deleted
+	bd.ValueType = rbd.valueType
+	bd.Value = rbd.value
+	return bd
+}
+
+// it is called when the older data of the same key is discarded while merging
+type DiscardFunc func(key []byte, data *base.BlockData)
+
 type sstFileDataBlockReader struct {
-	file        *os.File
+	file        vfs.File
 	fileName    string
+	ts          uint64
 	currentData *RichBlockData
 	hasNext     bool
+	// nil means no limit
+	limiter *ratelimit.RateLimiter
 }
 
 func OpenSstFileDataBlockReader(fileName string) (*sstFileDataBlockReader, error) {
-	file, err := os.Open(fileName)
+	return OpenSstFileDataBlockReaderWithFS(vfs.Default, fileName)
+}
+
+func OpenSstFileDataBlockReaderWithFS(fs vfs.FS, fileName string) (*sstFileDataBlockReader, error) {
+	file, err := fs.Open(fileName)
 	if err != nil {
 		return nil, err
 	}
 	reader := new(sstFileDataBlockReader)
 	reader.file = file
 	reader.fileName = fileName
+	reader.ts = sst.FileTs(fileName)
 	reader.hasNext = true
 	return reader, nil
 }
@@ -77,12 +119,14 @@ func (sstReader *sstFileDataBlockReader) readNext() (*RichBlockData, error) {
 	if err != nil {
 		return nil, err
 	}
+	sstReader.limiter.Request(int64(sst.DataHeaderLength+len(header.Key)+len(dataBuf)), ratelimit.PriorityLow)
 	if header.BlockType != sst.BlockTypeData {
 		return nil, nil
 	}
 	rbd := new(RichBlockData)
 	rbd.deleted = header.Deleted
-	rbd.ts = header.Ts
+	rbd.valueType = header.ValueType
+	rbd.ts = sst.DataTs(header.Ts, sstReader.ts)
 	rbd.key = header.Key
 	rbd.value = dataBuf
 	return rbd, nil
@@ -108,10 +152,10 @@ func (sstReader *sstFileDataBlockReader) PopNextData() (*RichBlockData, error) {
 	return rbd, nil
 }
 
-func initSSTReaders(sstFiles []string) ([]*sstFileDataBlockReader, error) {
+func initSSTReaders(fs vfs.FS, sstFiles []string) ([]*sstFileDataBlockReader, error) {
 	readers := make([]*sstFileDataBlockReader, 0, len(sstFiles))
 	for _, file := range sstFiles {
-		reader, err := OpenSstFileDataBlockReader(file)
+		reader, err := OpenSstFileDataBlockReaderWithFS(fs, file)
 		if err != nil {
 			for _, r := range readers {
 				r.Close()
@@ -128,7 +172,7 @@ type dataAndReader struct {
 	reader *sstFileDataBlockReader
 }
 
-func getToBeUseData(readers []*sstFileDataBlockReader) (*dataAndReader, error) {
+func getToBeUseData(readers []*sstFileDataBlockReader, onDiscard DiscardFunc, comparator sst.Comparator) (*dataAndReader, error) {
 	var retValue *dataAndReader = nil
 	for _, reader := range readers {
 		data, err := reader.PeekNextData()
@@ -142,16 +186,22 @@ func getToBeUseData(readers []*sstFileDataBlockReader) (*dataAndReader, error) {
 			retValue = &dataAndReader{data, reader}
 			continue
 		}
-		compareResult := sst.KeyCompare(retValue.data.key, data.key)
+		compareResult := comparator.Compare(retValue.data.key, data.key)
 		switch compareResult {
 		case sst.Equals:
 			if data.ts > retValue.data.ts {
 				// ignore the less one
 				retValue.reader.PopNextData()
+				if onDiscard != nil {
+					onDiscard(retValue.data.key, retValue.data.toBlockData())
+				}
 				retValue = &dataAndReader{data, reader}
 			} else {
 				// ignore the less one
 				reader.PopNextData()
+				if onDiscard != nil {
+					onDiscard(data.key, data.toBlockData())
+				}
 			}
 		case sst.Greater:
 			retValue = &dataAndReader{data, reader}
@@ -165,35 +215,78 @@ func getToBeUseData(readers []*sstFileDataBlockReader) (*dataAndReader, error) {
 }
 
 type fileDataBlockReaders struct {
-	readers []*sstFileDataBlockReader
+	readers     []*sstFileDataBlockReader
+	onDiscard   DiscardFunc
+	comparator  sst.Comparator
+	dropDeleted func(key []byte) bool
 }
 
 func (readers *fileDataBlockReaders) Foreach(callback func(key []byte, value interface{}) bool) error {
 	for {
-		da, err := getToBeUseData(readers.readers)
+		da, err := getToBeUseData(readers.readers, readers.onDiscard, readers.comparator)
 		if err != nil {
 			return err
 		}
 		if da == nil {
 			return nil
 		}
-		bd := new(base.BlockData)
-		bd.Ts = da.data.ts
-		bd.Deleted = da.data.deleted
-		bd.Value = da.data.value
+		bd := da.data.toBlockData()
 		da.reader.PopNextData()
+		if bd.Deleted == base.Deleted && readers.dropDeleted != nil && readers.dropDeleted(da.data.key) {
+			continue
+		}
 		callback(da.data.key, bd)
 	}
 	return nil
 }
 
-func merge(readers []*sstFileDataBlockReader, dir string, level uint32, ts int64, deleteOldFiles bool) (bloom.Filter, string, error) {
-	writer, err := sst.NewSSTableWriter(dir, level, ts)
+type CompactOptions struct {
+	DeleteOldFiles bool
+	// it is called for every data which is overwritten by the newer one
+	OnDiscard DiscardFunc
+	// 0 means sst.DefaultBloomBitsPerKey
+	BloomBitsPerKey float64
+	// write the prefix bloom filter if it is set
+	PrefixExtractor sst.PrefixExtractor
+	// nil means sst.BytewiseComparator, it must be the one which the files are written by
+	Comparator sst.Comparator
+	// 0 means the max level of the files + 1
+	OutputLevel uint32
+	// the deleted data of the key is dropped if it returns true, it is only safe when
+	// there are no older data of the key out of the files.
+	DropDeleted func(key []byte) bool
+	// it limits the reading and writing of the compaction, nil means no limit
+	RateLimiter *ratelimit.RateLimiter
+	// nil means vfs.Default
+	FS vfs.FS
+}
+
+func (options *CompactOptions) fs() vfs.FS {
+	if options.FS == nil {
+		return vfs.Default
+	}
+	return options.FS
+}
+
+func merge(readers []*sstFileDataBlockReader, dir string, level uint32, ts int64, options *CompactOptions) (bloom.Filter, string, error) {
+	writer, err := sst.NewSSTableWriterWithFS(options.fs(), dir, level, ts)
 	if err != nil {
 		return nil, "", err
 	}
-	fdbReaders := &fileDataBlockReaders{readers: readers}
+	writer.SetBloomBitsPerKey(options.BloomBitsPerKey)
+	writer.SetPrefixExtractor(options.PrefixExtractor)
+	comparator := options.Comparator
+	if comparator == nil {
+		comparator = sst.BytewiseComparator
+	}
+	writer.SetComparator(comparator)
+	writer.SetRateLimiter(options.RateLimiter)
+	fdbReaders := &fileDataBlockReaders{readers: readers, onDiscard: options.OnDiscard, comparator: comparator, dropDeleted: options.DropDeleted}
 	bloomFilter, err := writer.WriteFullData(level, fdbReaders)
+	if err != nil {
+		writer.Abort()
+		return nil, "", err
+	}
 	if err := writer.Close(); err != nil {
 		return nil, "", err
 	}
@@ -201,15 +294,19 @@ func merge(readers []*sstFileDataBlockReader, dir string, level uint32, ts int64
 	if err := writer.Commit(); err != nil {
 		return nil, "", err
 	}
-	if deleteOldFiles {
+	if options.DeleteOldFiles {
 		for _, reader := range readers {
-			fileutil.DeleteFile(reader.fileName)
+			fileutil.DeleteFileWithFS(options.fs(), reader.fileName)
 		}
 	}
 	return bloomFilter, writer.GetFileName(), nil
 }
 
 func CompactFiles(files []string, deleteOldFiles bool) (bloom.Filter, string, error) {
+	return CompactFilesWithOptions(files, &CompactOptions{DeleteOldFiles: deleteOldFiles})
+}
+
+func CompactFilesWithOptions(files []string, options *CompactOptions) (bloom.Filter, string, error) {
 	if len(files) == 0 {
 		return nil, "", nil
 	}
@@ -234,10 +331,13 @@ func CompactFiles(files []string, deleteOldFiles bool) (bloom.Filter, string, er
 		}
 	}
 	sort.Sort(base.SSTFileSlice(sstFiles))
-	readers, err := initSSTReaders(files)
+	readers, err := initSSTReaders(options.fs(), files)
 	if err != nil {
 		return nil, "", err
 	}
+	for _, r := range readers {
+		r.limiter = options.RateLimiter
+	}
 	defer func() {
 		for _, r := range readers {
 			if r != nil {
@@ -247,5 +347,9 @@ func CompactFiles(files []string, deleteOldFiles bool) (bloom.Filter, string, er
 	}()
 	file := sstFiles[len(sstFiles)-1]
 	dir, _ := filepath.Split(file.PathName)
-	return merge(readers, dir, uint32(maxLevel)+1, file.Ts, deleteOldFiles)
+	level := uint32(maxLevel) + 1
+	if options.OutputLevel > 0 {
+		level = options.OutputLevel
+	}
+	return merge(readers, dir, level, file.Ts, options)
 }
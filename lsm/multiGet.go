@@ -0,0 +1,127 @@
+package lsm
+
+import (
+	"fmt"
+	"sort"
+	"time"
+	"github.com/pister/yfs/lsm/base"
+	"github.com/pister/yfs/lsm/sst"
+)
+
+// MultiGet gets the values of the keys, the values and errors are in the order of the keys,
+// the value is nil if the key is not found.
+// The keys are sorted and looked up in the memory data once, then the left keys
+// are read from the sst files by batch, from the newest to the oldest.
+func (lsm *Lsm) MultiGet(keys [][]byte) ([][]byte, []error) {
+	start := time.Now()
+	defer func() {
+		lsm.stats.getLatency.record(time.Since(start))
+	}()
+	values := make([][]byte, len(keys))
+	errs := make([]error, len(keys))
+	order := make([]int, len(keys))
+	for i := range keys {
+		order[i] = i
+	}
+	comparator := lsm.options.comparator()
+	sort.Slice(order, func(i, j int) bool {
+		return comparator.Compare(keys[order[i]], keys[order[j]]) == sst.Less
+	})
+
+	// the positions of keys not found in memory, sorted by key
+	left := make([]int, 0, len(keys))
+	for _, i := range order {
+		ds, found := lsm.memMap.Get(keys[i])
+		if !found {
+			left = append(left, i)
+			continue
+		}
+		bd := ds.(*base.BlockData)
+		if bd.Deleted != base.Deleted {
+			values[i] = bd.Value
+		}
+	}
+	if len(left) == 0 {
+		return values, errs
+	}
+
+	var found []*base.BlockData
+	var findErrs []error
+	var openSuccess bool
+	// try 3 times, when compact
+	for i := 0; i < 3; i++ {
+		found, openSuccess, findErrs = lsm.multiFindBlockDataFromSSTables(keys, left)
+		if openSuccess {
+			break
+		}
+	}
+	for n, i := range left {
+		if !openSuccess {
+			errs[i] = fmt.Errorf("open sst fail")
+			continue
+		}
+		if findErrs[n] != nil {
+			errs[i] = findErrs[n]
+			continue
+		}
+		bd := found[n]
+		if bd == nil || bd.Deleted == base.Deleted {
+			continue
+		}
+		if bd.ValueType == base.ValueTypeBlobRef {
+			values[i], errs[i] = lsm.blobReaders.read(keys[i], bd.Value)
+		} else {
+			values[i] = bd.Value
+		}
+	}
+	return values, errs
+}
+
+// find the data of keys at the positions, the results and errors are in the order of positions.
+// When a sst fails, the error is only for the keys which are not found in the newer ssts.
+func (lsm *Lsm) multiFindBlockDataFromSSTables(keys [][]byte, positions []int) ([]*base.BlockData, bool, []error) {
+	results := make([]*base.BlockData, len(positions))
+	errs := make([]error, len(positions))
+	// the indexes of results which are not found yet
+	left := make([]int, len(positions))
+	for n := range positions {
+		left[n] = n
+	}
+	var resultOpenSuccess = true
+	lsm.sstReaders.Foreach(func(item interface{}) (bool, error) {
+		sstReader := item.(*sst.SSTableReader)
+		batch := make([][]byte, len(left))
+		for j, n := range left {
+			batch[j] = keys[positions[n]]
+		}
+		found, trackers, openSuccess, err := sstReader.GetByKeysWithTrack(batch)
+		if err != nil {
+			// the keys left may be in the failed sst, they can not be found in the older ones
+			for _, n := range left {
+				errs[n] = err
+			}
+			return true, nil
+		}
+		if !openSuccess {
+			resultOpenSuccess = false
+			return true, nil
+		}
+		notFound := left[:0]
+		for j, n := range left {
+			// the same as the bloom stats of Get
+			if trackers[j].BloomHit {
+				lsm.stats.bloomUseful.Increment()
+			} else if found[j] == nil {
+				lsm.stats.bloomUseless.Increment()
+			}
+			if found[j] != nil {
+				results[n] = found[j]
+			} else {
+				notFound = append(notFound, n)
+			}
+		}
+		left = notFound
+		return len(left) == 0, nil
+	})
+	return results, resultOpenSuccess, errs
+}
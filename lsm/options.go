@@ -0,0 +1,72 @@
+package lsm
+
+import (
+	"github.com/pister/yfs/common/bloom"
+	"github.com/pister/yfs/lsm/sst"
+	"github.com/pister/yfs/common/ratelimit"
+	"github.com/pister/yfs/common/vfs"
+)
+
+const (
+	defaultBlobGCLiveRate    = 0.5
+	defaultCompactionThreads = 1
+)
+
+type Options struct {
+	// the values longer than it are written to the blob files when flushing,
+	// and only the references are kept in the sst files. 0 means disabled.
+	BlobValueThreshold int
+	// the blob file is rewritten when the rate of its live data is less than it.
+	BlobGCLiveRate float64
+	// the bits of bloom filter for each key in sst
+	BloomBitsPerKey float64
+	// the bits per key is computed from it if it is set
+	BloomFalsePositiveRate float64
+	// the listeners registered when opening
+	EventListeners []EventListener
+	// the prefix bloom filter is written to sst files if it is set,
+	// the prefix iterators skip the files which can not contain the prefix
+	PrefixExtractor sst.PrefixExtractor
+	// the order of keys, nil means sst.BytewiseComparator. The sst files are checked
+	// when opening, so it can not be changed for an existing lsm.
+	Comparator sst.Comparator
+	// the max count of background compactions running at the same time
+	CompactionThreads int
+	// it limits the writing of flush and compaction and the reading of compaction,
+	// the writing of wal is counted but never waits. nil means no limit.
+	// The rate can be changed at runtime by it.
+	RateLimiter *ratelimit.RateLimiter
+	// all the files are accessed by it, nil means vfs.Default.
+	// It can be vfs.NewMemFS() for tests, or vfs.NewFaultFS() to inject faults.
+	FS vfs.FS
+}
+
+func DefaultOptions() *Options {
+	options := new(Options)
+	options.BlobValueThreshold = 0
+	options.BlobGCLiveRate = defaultBlobGCLiveRate
+	options.BloomBitsPerKey = sst.DefaultBloomBitsPerKey
+	options.CompactionThreads = defaultCompactionThreads
+	return options
+}
+
+func (options *Options) comparator() sst.Comparator {
+	if options.Comparator == nil {
+		return sst.BytewiseComparator
+	}
+	return options.Comparator
+}
+
+func (options *Options) fs() vfs.FS {
+	if options.FS == nil {
+		return vfs.Default
+	}
+	return options.FS
+}
+
+func (options *Options) bloomBitsPerKey() float64 {
+	if options.BloomFalsePositiveRate > 0 {
+		return bloom.BitsPerKeyForFalsePositiveRate(options.BloomFalsePositiveRate)
+	}
+	return options.BloomBitsPerKey
+}
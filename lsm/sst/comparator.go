@@ -0,0 +1,52 @@
+package sst
+
+// Comparator orders the keys in memory, sst files and merging. The name is saved in the
+// properties of the sst and checked when the sst is opened, so it must not be changed
+// after any data has been written by it.
+type Comparator interface {
+	Name() string
+	// it must return one of Less, Equals and Greater
+	Compare(a, b []byte) KeyCompareResult
+}
+
+// the sst files without properties are ordered by it
+const BytewiseComparatorName = "bytewise"
+
+type bytewiseComparator struct {
+}
+
+func (c *bytewiseComparator) Name() string {
+	return BytewiseComparatorName
+}
+
+func (c *bytewiseComparator) Compare(a, b []byte) KeyCompareResult {
+	return KeyCompare(a, b)
+}
+
+// BytewiseComparator orders the keys by bytes, it is the default one
+var BytewiseComparator Comparator = new(bytewiseComparator)
+
+type reverseComparator struct {
+	comparator Comparator
+}
+
+// NewReverseComparator orders the keys reversely of the comparator, such as
+// the newest first of the keys ending with timestamps.
+func NewReverseComparator(comparator Comparator) Comparator {
+	return &reverseComparator{comparator: comparator}
+}
+
+func (c *reverseComparator) Name() string {
+	return "reverse:" + c.comparator.Name()
+}
+
+func (c *reverseComparator) Compare(a, b []byte) KeyCompareResult {
+	return c.comparator.Compare(b, a)
+}
+
+// the comparator function of the tree map of memory data
+func TreeComparator(comparator Comparator) func(a, b []byte) int {
+	return func(a, b []byte) int {
+		return int(comparator.Compare(a, b))
+	}
+}
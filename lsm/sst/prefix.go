@@ -0,0 +1,56 @@
+package sst
+
+import (
+	"fmt"
+	"bytes"
+)
+
+// PrefixExtractor gets the prefix of keys for the prefix bloom filter,
+// the name is saved in the sst, the filter is used only if the names are the same.
+type PrefixExtractor interface {
+	Name() string
+	// the prefix of the key, false if the key has no prefix
+	Transform(key []byte) ([]byte, bool)
+}
+
+type fixedPrefixExtractor struct {
+	length int
+}
+
+// NewFixedPrefixExtractor uses the first length bytes as the prefix
+func NewFixedPrefixExtractor(length int) PrefixExtractor {
+	return &fixedPrefixExtractor{length: length}
+}
+
+func (extractor *fixedPrefixExtractor) Name() string {
+	return fmt.Sprintf("fixed:%d", extractor.length)
+}
+
+func (extractor *fixedPrefixExtractor) Transform(key []byte) ([]byte, bool) {
+	if len(key) < extractor.length {
+		return nil, false
+	}
+	return key[:extractor.length], true
+}
+
+type delimiterPrefixExtractor struct {
+	delimiter byte
+}
+
+// NewDelimiterPrefixExtractor uses the bytes until the first delimiter as the prefix, the delimiter
+// is included, such as "bucket/" of "bucket/object".
+func NewDelimiterPrefixExtractor(delimiter byte) PrefixExtractor {
+	return &delimiterPrefixExtractor{delimiter: delimiter}
+}
+
+func (extractor *delimiterPrefixExtractor) Name() string {
+	return fmt.Sprintf("delimiter:%d", extractor.delimiter)
+}
+
+func (extractor *delimiterPrefixExtractor) Transform(key []byte) ([]byte, bool) {
+	pos := bytes.IndexByte(key, extractor.delimiter)
+	if pos < 0 {
+		return nil, false
+	}
+	return key[:pos+1], true
+}
@@ -0,0 +1,111 @@
+package sst
+
+import (
+	"fmt"
+	"github.com/pister/yfs/common/vfs"
+	"github.com/pister/yfs/lsm/base"
+)
+
+// SSTFileBuilder builds a self-contained sst file out of any lsm, such as for bulk loading,
+// the keys must be added in strictly increasing order. The file can be added to an lsm by Lsm.IngestFiles.
+type SSTFileBuilder struct {
+	writer     *SSTableWriter
+	lastKey    []byte
+	finished   bool
+	comparator Comparator
+}
+
+func NewSSTFileBuilder(fileName string) (*SSTFileBuilder, error) {
+	return NewSSTFileBuilderWithFS(vfs.Default, fileName)
+}
+
+func NewSSTFileBuilderWithFS(fs vfs.FS, fileName string) (*SSTFileBuilder, error) {
+	writer, err := newSSTableWriterWithFileName(fs, fileName, 0)
+	if err != nil {
+		return nil, err
+	}
+	builder := new(SSTFileBuilder)
+	builder.writer = writer
+	builder.comparator = BytewiseComparator
+	return builder, nil
+}
+
+// the keys are ordered by the comparator, it must be the same as the lsm which the file is ingested to.
+// It must be called before adding any data.
+func (builder *SSTFileBuilder) SetComparator(comparator Comparator) {
+	builder.comparator = comparator
+	builder.writer.SetComparator(comparator)
+}
+
+func (builder *SSTFileBuilder) Put(key []byte, value []byte) error {
+	if value == nil {
+		return fmt.Errorf("value can not be nil")
+	}
+	return builder.add(key, value, base.Normal)
+}
+
+func (builder *SSTFileBuilder) Delete(key []byte) error {
+	return builder.add(key, nil, base.Deleted)
+}
+
+func (builder *SSTFileBuilder) add(key []byte, value []byte, deleted base.DeletedFlag) error {
+	if builder.finished {
+		return fmt.Errorf("the sst builder has finished")
+	}
+	if len(key) == 0 || len(key) > base.MaxKeyLen {
+		return fmt.Errorf("invalidate key length: %d", len(key))
+	}
+	if len(value) > base.MaxValueLen {
+		return fmt.Errorf("too big value length: %d", len(value))
+	}
+	if builder.lastKey != nil && builder.comparator.Compare(key, builder.lastKey) != Greater {
+		return fmt.Errorf("the keys must be added in increasing order")
+	}
+	data := new(base.BlockData)
+	data.Deleted = deleted
+	// the data take the ts of the file given when ingesting, so the file can be linked to the lsm
+	data.Ts = FileDataTs
+	data.Value = value
+	if err := builder.writer.Append(key, data); err != nil {
+		return err
+	}
+	builder.lastKey = key
+	return nil
+}
+
+func (builder *SSTFileBuilder) GetFileName() string {
+	return builder.writer.GetFileName()
+}
+
+// write the index data and rename the file to the final name
+func (builder *SSTFileBuilder) Finish() error {
+	if builder.finished {
+		return fmt.Errorf("the sst builder has finished")
+	}
+	builder.finished = true
+	if builder.writer.GetDataCount() == 0 {
+		builder.writer.Abort()
+		return fmt.Errorf("no data in sst builder")
+	}
+	if _, err := builder.writer.Finish(); err != nil {
+		builder.writer.Abort()
+		return err
+	}
+	if err := builder.writer.Sync(); err != nil {
+		builder.writer.Abort()
+		return err
+	}
+	if err := builder.writer.Close(); err != nil {
+		return err
+	}
+	return builder.writer.Commit()
+}
+
+// give up the building, nothing will be left
+func (builder *SSTFileBuilder) Abort() error {
+	if builder.finished {
+		return nil
+	}
+	builder.finished = true
+	return builder.writer.Abort()
+}
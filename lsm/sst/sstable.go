@@ -15,13 +15,15 @@ package sst
 	...
 	data-index-N
 	bloom-filter-data 		<- bloom-filter-position
+	prefix-bloom-filter-data	<- optional, only when the prefix extractor is set
+	properties			<- optional, not exist in the old sst files
 	footer:data-index-start-position, bloom-filter-position
 
 details:
 
 block-data layout:
 2 - bytes magic code
-1 - byte delete flag
+1 - byte delete flag in low 4 bits, value type in high 4 bits
 1 - byte block type
 4 - bytes data sum
 8 - bytes ts
@@ -39,12 +41,34 @@ data-index layout:
 
 bloom-filter-position layout:
 2 - bytes magic code
-1 - byte not used
+1 - byte hash count of the blocked bloom filter, 0 for the legacy filter
 1 - byte block type
 4 - bit set length
 4 - bloom filter data length
 ...bytes for bloom filter
 
+prefix-bloom-filter layout:
+2 - bytes magic code
+1 - byte hash count
+1 - byte block type
+4 - bit set length
+4 - bloom filter data length
+2 - bytes prefix extractor name length
+2 - bytes not used
+...bytes for prefix extractor name
+...bytes for bloom filter
+
+properties layout:
+2 - bytes magic code
+1 - byte not used
+1 - byte block type
+4 - bytes properties data length
+...bytes for properties, repeated of:
+	2 - bytes name length
+	2 - bytes value length
+	...bytes for name
+	...bytes for value
+
 footer layout:
 2 - bytes magic code
 1 - byte not used
@@ -60,6 +84,10 @@ const (
 	dataIndexMagicCode2   = 'X'
 	bloomFilterMagicCode1 = 'B'
 	bloomFilterMagicCode2 = 'F'
+	prefixBloomMagicCode1 = 'P'
+	prefixBloomMagicCode2 = 'B'
+	propertiesMagicCode1  = 'P'
+	propertiesMagicCode2  = 'R'
 	footerMagicCode1      = 'F'
 	footerMagicCode2      = 'T'
 
@@ -69,22 +97,20 @@ const (
 	BlockTypeData         = 1
 	BlockTypeDataIndex    = 2
 	BlockTypeBloomFilter  = 3
+	BlockTypePrefixBloom  = 4
+	BlockTypeProperties   = 5
 	BlockTypeFooter       = 8
 )
 
 
-func bloomBitSizeFromLevel(level uint32) uint32 {
-	if level < 10 {
-		return 2 * 1024 * 1024
-	}
-	if level < 20 {
-		return 3 * 1024 * 1024
-	}
-	if level < 100 {
-		return 10 * 1024 * 1024
-	}
-	return 20 * 1024 * 1024
-}
+// the bits of bloom filter for each key, the false positive rate is about 1% for it
+const DefaultBloomBitsPerKey = 10
+
+// the length of the block-data header before the key
+const DataHeaderLength = 24
+
+// the name of the property of the comparator
+const PropertyComparator = "comparator"
 
 /*
 
@@ -0,0 +1,166 @@
+package sst
+
+import (
+	"io"
+	"fmt"
+	"github.com/pister/yfs/common/bytesutil"
+	"github.com/pister/yfs/common/hashutil"
+	"github.com/pister/yfs/lsm/base"
+	"github.com/pister/yfs/common/vfs"
+)
+
+// SSTableIterator reads the data of an sst in key order by its own file handle,
+// so it still works after the sst is closed or deleted by compacting.
+type SSTableIterator struct {
+	file        vfs.File
+	fileSize    int64
+	ts          uint64
+	dataIndexes []uint32
+	index       int
+	key         []byte
+	data        *base.BlockData
+	comparator  Comparator
+}
+
+// the iterator is not valid until Seek or SeekToFirst is called,
+// the comparator must be the one which the sst is written by.
+func OpenSSTableIterator(fs vfs.FS, sstFile string, comparator Comparator) (*SSTableIterator, error) {
+	file, err := fs.Open(sstFile)
+	if err != nil {
+		return nil, err
+	}
+	it := new(SSTableIterator)
+	it.file = file
+	it.ts = FileTs(sstFile)
+	it.comparator = comparator
+	if err := it.loadDataIndexes(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	it.index = len(it.dataIndexes)
+	return it, nil
+}
+
+func (it *SSTableIterator) loadDataIndexes() error {
+	fi, err := it.file.Stat()
+	if err != nil {
+		return err
+	}
+	it.fileSize = fi.Size()
+	if it.fileSize < 12 {
+		return fmt.Errorf("too small sst file: %s", it.file.Name())
+	}
+	footer := make([]byte, 12)
+	if _, err := it.file.ReadAt(footer, it.fileSize-12); err != nil {
+		return err
+	}
+	if footer[0] != footerMagicCode1 || footer[1] != footerMagicCode2 || footer[3] != BlockTypeFooter {
+		return fmt.Errorf("footer not match")
+	}
+	dataIndexStartPosition := bytesutil.GetUint32FromBytes(footer, 4)
+	bloomFilterPosition := bytesutil.GetUint32FromBytes(footer, 8)
+	if bloomFilterPosition < dataIndexStartPosition {
+		return fmt.Errorf("bad footer of sst")
+	}
+	buf := make([]byte, bloomFilterPosition-dataIndexStartPosition)
+	if _, err := it.file.ReadAt(buf, int64(dataIndexStartPosition)); err != nil {
+		return err
+	}
+	it.dataIndexes = make([]uint32, 0, len(buf)/8)
+	for i := 0; i+8 <= len(buf); i += 8 {
+		if buf[i+3] != BlockTypeDataIndex {
+			break
+		}
+		if buf[i] != dataIndexMagicCode1 || buf[i+1] != dataIndexMagicCode2 {
+			return fmt.Errorf("data index magic code not match")
+		}
+		it.dataIndexes = append(it.dataIndexes, bytesutil.GetUint32FromBytes(buf, i+4))
+	}
+	return nil
+}
+
+func (it *SSTableIterator) readHeader(index int) (*base.BlockDataHeader, io.Reader, error) {
+	reader := io.NewSectionReader(it.file, int64(it.dataIndexes[index]), it.fileSize-int64(it.dataIndexes[index]))
+	header, err := ReadDataHeader(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	if header == nil || header.MagicCode1 != dataMagicCode1 || header.MagicCode2 != dataMagicCode2 {
+		return nil, nil, fmt.Errorf("data magic code not match")
+	}
+	return header, reader, nil
+}
+
+func (it *SSTableIterator) load() error {
+	it.key = nil
+	it.data = nil
+	if it.index >= len(it.dataIndexes) {
+		return nil
+	}
+	header, reader, err := it.readHeader(it.index)
+	if err != nil {
+		return err
+	}
+	value := make([]byte, header.ValueLength)
+	if _, err := io.ReadFull(reader, value); err != nil {
+		return err
+	}
+	if hashutil.SumHash32(value) != header.DataSum {
+		return fmt.Errorf("sum not match")
+	}
+	it.key = header.Key
+	it.data = new(base.BlockData)
+	it.data.Value = value
+	it.data.Deleted = header.Deleted
+	it.data.ValueType = header.ValueType
+	it.data.Ts = DataTs(header.Ts, it.ts)
+	return nil
+}
+
+func (it *SSTableIterator) SeekToFirst() error {
+	it.index = 0
+	return it.load()
+}
+
+// Seek moves to the first key which is not less than the key
+func (it *SSTableIterator) Seek(key []byte) error {
+	low := 0
+	high := len(it.dataIndexes)
+	for low < high {
+		middle := (low + high) / 2
+		header, _, err := it.readHeader(middle)
+		if err != nil {
+			return err
+		}
+		if it.comparator.Compare(header.Key, key) == Less {
+			low = middle + 1
+		} else {
+			high = middle
+		}
+	}
+	it.index = low
+	return it.load()
+}
+
+func (it *SSTableIterator) Valid() bool {
+	return it.key != nil
+}
+
+func (it *SSTableIterator) Key() []byte {
+	return it.key
+}
+
+func (it *SSTableIterator) Value() *base.BlockData {
+	return it.data
+}
+
+func (it *SSTableIterator) Next() error {
+	if it.index < len(it.dataIndexes) {
+		it.index++
+	}
+	return it.load()
+}
+
+func (it *SSTableIterator) Close() error {
+	return it.file.Close()
+}
@@ -6,20 +6,35 @@ import (
 	"github.com/pister/yfs/common/bloom"
 	"github.com/pister/yfs/common/fileutil"
 	"io"
+	"io/ioutil"
 	"path"
 	"strings"
 	"github.com/pister/yfs/common/hashutil"
 	"github.com/pister/yfs/common/bitset"
 	"github.com/pister/yfs/lsm/base"
 	"strconv"
+	"sync"
+	"github.com/pister/yfs/common/vfs"
 )
 
+// the count of file handles of a reader
+const readerConcurrentSize = 3
+
+// the keys of GetByKeys are read in parallel when there are at least so many keys per group
+const minKeysPerReadGroup = 16
+
 type SSTableReader struct {
 	filter   bloom.Filter
 	reader   *fileutil.ConcurrentReadFile
 	fileSize int64
 	level    uint32
 	fileName string
+	ts       uint64
+	// nil if the sst has no prefix bloom filter
+	prefixFilter        bloom.Filter
+	prefixExtractorName string
+	properties          map[string]string
+	comparator          Comparator
 }
 
 func OpenSSTableReader(sstFile string) (*SSTableReader, error) {
@@ -27,6 +42,15 @@ func OpenSSTableReader(sstFile string) (*SSTableReader, error) {
 }
 
 func OpenSSTableReaderWithBloomFilter(sstFile string, filter bloom.Filter) (*SSTableReader, error) {
+	return OpenSSTableReaderWithComparator(sstFile, filter, BytewiseComparator)
+}
+
+// the sst must be written by the same comparator, filter can be nil
+func OpenSSTableReaderWithComparator(sstFile string, filter bloom.Filter, comparator Comparator) (*SSTableReader, error) {
+	return OpenSSTableReaderWithFS(vfs.Default, sstFile, filter, comparator)
+}
+
+func OpenSSTableReaderWithFS(fs vfs.FS, sstFile string, filter bloom.Filter, comparator Comparator) (*SSTableReader, error) {
 	_, name := path.Split(sstFile)
 	parts := strings.Split(name, "_")
 	if len(parts) < 3 {
@@ -36,7 +60,11 @@ func OpenSSTableReaderWithBloomFilter(sstFile string, filter bloom.Filter) (*SST
 	if err != nil {
 		return nil, err
 	}
-	r, err := fileutil.OpenAsConcurrentReadFile(sstFile, 3)
+	ts, err := strconv.ParseUint(parts[2], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	r, err := fileutil.OpenAsConcurrentReadFileWithFS(fs, sstFile, readerConcurrentSize)
 	if err != nil {
 		return nil, err
 	}
@@ -50,19 +78,53 @@ func OpenSSTableReaderWithBloomFilter(sstFile string, filter bloom.Filter) (*SST
 			return nil, err
 		}
 	}
+	blocks, err := readOptionalBlocks(r)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	if err := blocks.checkComparator(sstFile, comparator); err != nil {
+		r.Close()
+		return nil, err
+	}
 	reader := new(SSTableReader)
 	reader.filter = filter
+	reader.prefixFilter = blocks.prefixFilter
+	reader.prefixExtractorName = blocks.prefixExtractorName
+	reader.properties = blocks.properties
+	reader.comparator = comparator
 	reader.reader = r
 	reader.level = uint32(level)
 	reader.fileName = sstFile
+	reader.ts = ts
 	reader.fileSize = r.GetInitFileSize()
 	return reader, nil
 }
 
+// check the footer, bloom filter and comparator of the sst file, the name of it can be any.
+func CheckSSTFile(fs vfs.FS, sstFile string, comparator Comparator) error {
+	r, err := fileutil.OpenAsConcurrentReadFileWithFS(fs, sstFile, 1)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if r.GetInitFileSize() < 12 {
+		return fmt.Errorf("too small sst file: %s", sstFile)
+	}
+	if _, err = readBloomFilter(r); err != nil {
+		return err
+	}
+	blocks, err := readOptionalBlocks(r)
+	if err != nil {
+		return err
+	}
+	return blocks.checkComparator(sstFile, comparator)
+}
+
 func readBloomFilter(r *fileutil.ConcurrentReadFile) (bloom.Filter, error) {
 	/*
 		2 - bytes magic code
-		1 - byte not used
+		1 - byte hash count of the blocked bloom filter, 0 for the legacy filter
 		1 - byte block type
 		4 - bit set length
 		4 - bloom filter data length
@@ -73,10 +135,11 @@ func readBloomFilter(r *fileutil.ConcurrentReadFile) (bloom.Filter, error) {
 		return nil, err
 	}
 	var bitSize uint32 = 0
+	var hashCount uint32 = 0
 	var bitBuf []byte
 	openSuccess, err := r.SeekForReading(int64(bloomFilterPosition), func(reader io.Reader) error {
 		header := make([]byte, 12)
-		if _, err := reader.Read(header); err != nil {
+		if _, err := io.ReadFull(reader, header); err != nil {
 			return err
 		}
 		if header[0] != bloomFilterMagicCode1 || header[1] != bloomFilterMagicCode2 {
@@ -85,10 +148,11 @@ func readBloomFilter(r *fileutil.ConcurrentReadFile) (bloom.Filter, error) {
 		if header[3] != BlockTypeBloomFilter {
 			return fmt.Errorf("type not match for bloom filter data")
 		}
+		hashCount = uint32(header[2])
 		bitSize = bytesutil.GetUint32FromBytes(header, 4)
 		dataSize := bytesutil.GetUint32FromBytes(header, 8)
 		bitBuf = make([]byte, dataSize)
-		_, err := reader.Read(bitBuf)
+		_, err := io.ReadFull(reader, bitBuf)
 		if err != nil {
 			return err
 		}
@@ -100,7 +164,118 @@ func readBloomFilter(r *fileutil.ConcurrentReadFile) (bloom.Filter, error) {
 	if !openSuccess {
 		return nil, fmt.Errorf("open error")
 	}
-	return bloom.NewUnsafeBloomFilterWithBitSize(bitset.NewBitSetWithInitData(bitSize, bitBuf)), nil
+	if hashCount == 0 {
+		return bloom.NewUnsafeBloomFilterWithBitSize(bitset.NewBitSetWithInitData(bitSize, bitBuf)), nil
+	}
+	return bloom.NewBlockedBloomFilterWithBitSet(bitset.NewBitSetWithInitData(bitSize, bitBuf), hashCount), nil
+}
+
+type optionalBlocks struct {
+	// nil if not exist
+	prefixFilter        bloom.Filter
+	prefixExtractorName string
+	properties          map[string]string
+}
+
+// the optional blocks are between the bloom filter and the footer
+func readOptionalBlocks(r *fileutil.ConcurrentReadFile) (*optionalBlocks, error) {
+	_, bloomFilterPosition, err := readFooter(r)
+	if err != nil {
+		return nil, err
+	}
+	blocks := new(optionalBlocks)
+	blocks.properties = make(map[string]string)
+	footerPosition := r.GetInitFileSize() - 12
+	openSuccess, err := r.SeekForReading(int64(bloomFilterPosition), func(reader io.Reader) error {
+		header := make([]byte, 16)
+		if _, err := io.ReadFull(reader, header[:12]); err != nil {
+			return err
+		}
+		bloomDataSize := int64(bytesutil.GetUint32FromBytes(header, 8))
+		if _, err := io.CopyN(ioutil.Discard, reader, bloomDataSize); err != nil {
+			return err
+		}
+		position := int64(bloomFilterPosition) + 12 + bloomDataSize
+		for position+8 <= footerPosition {
+			if _, err := io.ReadFull(reader, header[:8]); err != nil {
+				return err
+			}
+			switch header[3] {
+			case BlockTypePrefixBloom:
+				if header[0] != prefixBloomMagicCode1 || header[1] != prefixBloomMagicCode2 {
+					return fmt.Errorf("prefix bloom filter magic code not match")
+				}
+				if _, err := io.ReadFull(reader, header[8:16]); err != nil {
+					return err
+				}
+				hashCount := uint32(header[2])
+				bitSize := bytesutil.GetUint32FromBytes(header, 4)
+				dataSize := bytesutil.GetUint32FromBytes(header, 8)
+				nameBuf := make([]byte, bytesutil.GetUint16FromBytes(header, 12))
+				if _, err := io.ReadFull(reader, nameBuf); err != nil {
+					return err
+				}
+				bitBuf := make([]byte, dataSize)
+				if _, err := io.ReadFull(reader, bitBuf); err != nil {
+					return err
+				}
+				blocks.prefixFilter = bloom.NewBlockedBloomFilterWithBitSet(bitset.NewBitSetWithInitData(bitSize, bitBuf), hashCount)
+				blocks.prefixExtractorName = string(nameBuf)
+				position += 16 + int64(len(nameBuf)) + int64(dataSize)
+			case BlockTypeProperties:
+				if header[0] != propertiesMagicCode1 || header[1] != propertiesMagicCode2 {
+					return fmt.Errorf("properties magic code not match")
+				}
+				data := make([]byte, bytesutil.GetUint32FromBytes(header, 4))
+				if _, err := io.ReadFull(reader, data); err != nil {
+					return err
+				}
+				if err := parseProperties(data, blocks.properties); err != nil {
+					return err
+				}
+				position += 8 + int64(len(data))
+			default:
+				return fmt.Errorf("unknown block type: %d", header[3])
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !openSuccess {
+		return nil, fmt.Errorf("open error")
+	}
+	return blocks, nil
+}
+
+// the old sst files without the property are ordered by bytes
+func (blocks *optionalBlocks) checkComparator(sstFile string, comparator Comparator) error {
+	comparatorName, ok := blocks.properties[PropertyComparator]
+	if !ok {
+		comparatorName = BytewiseComparatorName
+	}
+	if comparatorName != comparator.Name() {
+		return fmt.Errorf("sst %s is ordered by comparator %s, not %s", sstFile, comparatorName, comparator.Name())
+	}
+	return nil
+}
+
+func parseProperties(data []byte, properties map[string]string) error {
+	for pos := 0; pos < len(data); {
+		if pos+4 > len(data) {
+			return fmt.Errorf("bad properties data")
+		}
+		nameLength := int(bytesutil.GetUint16FromBytes(data, pos))
+		valueLength := int(bytesutil.GetUint16FromBytes(data, pos+2))
+		pos += 4
+		if pos+nameLength+valueLength > len(data) {
+			return fmt.Errorf("bad properties data")
+		}
+		properties[string(data[pos:pos+nameLength])] = string(data[pos+nameLength:pos+nameLength+valueLength])
+		pos += nameLength + valueLength
+	}
+	return nil
 }
 
 func readFooter(r *fileutil.ConcurrentReadFile) (uint32, uint32, error) {
@@ -144,6 +319,71 @@ func (reader *SSTableReader) GetFileName() string {
 	return reader.fileName
 }
 
+func (reader *SSTableReader) GetFileSize() int64 {
+	return reader.fileSize
+}
+
+// the min and max keys of the sst, they are nil if the sst is empty
+func (reader *SSTableReader) GetKeyRange() ([]byte, []byte, error) {
+	dataIndexes, err := reader.getDataIndexes()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(dataIndexes) == 0 {
+		return nil, nil, nil
+	}
+	minKey, err := reader.readKey(dataIndexes[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	maxKey, err := reader.readKey(dataIndexes[len(dataIndexes)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+	return minKey, maxKey, nil
+}
+
+func (reader *SSTableReader) readKey(dataIndex uint32) ([]byte, error) {
+	var key []byte
+	openSuccess, err := reader.reader.SeekForReading(int64(dataIndex), func(r io.Reader) error {
+		header, err := ReadDataHeader(r)
+		if err != nil {
+			return err
+		}
+		if header == nil || header.MagicCode1 != dataMagicCode1 || header.MagicCode2 != dataMagicCode2 {
+			return fmt.Errorf("data magic code not match")
+		}
+		key = header.Key
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !openSuccess {
+		return nil, fmt.Errorf("open fail")
+	}
+	return key, nil
+}
+
+// the property saved in the sst, false if not exist
+func (reader *SSTableReader) GetProperty(name string) (string, bool) {
+	value, ok := reader.properties[name]
+	return value, ok
+}
+
+// MayContainPrefix returns false only if there are no keys with the prefix in the sst,
+// it is always true if the sst has no prefix bloom filter of the extractor.
+func (reader *SSTableReader) MayContainPrefix(prefix []byte, extractor PrefixExtractor) bool {
+	if extractor == nil || reader.prefixFilter == nil || reader.prefixExtractorName != extractor.Name() {
+		return true
+	}
+	p, ok := extractor.Transform(prefix)
+	if !ok {
+		return true
+	}
+	return reader.prefixFilter.Hit(p)
+}
+
 func (reader *SSTableReader) getDataIndexes() ([]uint32, error) {
 	dataIndexStartPosition, _, err := readFooter(reader.reader)
 	if err != nil {
@@ -227,16 +467,43 @@ func KeyCompare(me, other []byte) KeyCompareResult {
 	}
 }
 
+// the data written by ingestion has no ts of its own and takes the ts of the file,
+// so the ingested file can be given its ts by renaming after it is written.
+const FileDataTs = 0
+
+// the ts of the data read from the sst file whose ts is fileTs
+func DataTs(dataTs uint64, fileTs uint64) uint64 {
+	if dataTs == FileDataTs {
+		return fileTs
+	}
+	return dataTs
+}
+
+// the ts in the name of the sst file, 0 if it is not the name of an sst
+func FileTs(sstFile string) uint64 {
+	_, name := path.Split(sstFile)
+	parts := strings.Split(name, "_")
+	if len(parts) < 3 {
+		return 0
+	}
+	ts, err := strconv.ParseUint(parts[2], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return ts
+}
+
 func ReadDataHeader(reader io.Reader) (*base.BlockDataHeader, error) {
 	var blockDataHeader = new(base.BlockDataHeader)
-	header := make([]byte, 24)
+	header := make([]byte, DataHeaderLength)
 	if _, err := reader.Read(header); err != nil {
 		return nil, err
 	}
 	blockDataHeader.MagicCode1 = header[0]
 	blockDataHeader.MagicCode2 = header[1]
 	blockDataHeader.BlockType = header[3]
-	blockDataHeader.Deleted = base.DeletedFlag(header[2]) // delete flag
+	blockDataHeader.Deleted = base.DeletedFlag(header[2] & 0x0f) // delete flag
+	blockDataHeader.ValueType = base.ValueType(header[2] >> 4)
 	blockDataHeader.DataSum = bytesutil.GetUint32FromBytes(header, 4)
 	blockDataHeader.Ts = bytesutil.GetUint64FromBytes(header, 8)
 	keyLength := bytesutil.GetUint32FromBytes(header, 16)
@@ -260,7 +527,7 @@ func ReadDataHeader(reader io.Reader) (*base.BlockDataHeader, error) {
 	return blockDataHeader, nil
 }
 
-func readByDataIndexAndCompareByKey(reader io.ReadSeeker, dataIndex uint32, key []byte) (*base.BlockData, KeyCompareResult, error) {
+func readByDataIndexAndCompareByKey(reader io.ReadSeeker, dataIndex uint32, key []byte, comparator Comparator) (*base.BlockData, KeyCompareResult, error) {
 	var blockData = new(base.BlockData)
 	var compareResult KeyCompareResult
 	if _, err := reader.Seek(int64(dataIndex), 0); err != nil {
@@ -279,7 +546,7 @@ func readByDataIndexAndCompareByKey(reader io.ReadSeeker, dataIndex uint32, key
 	if dataHeader.BlockType != BlockTypeData {
 		return nil, compareResult, fmt.Errorf("block type not match")
 	}
-	compareResult = KeyCompare(key, dataHeader.Key)
+	compareResult = comparator.Compare(key, dataHeader.Key)
 	if compareResult != Equals {
 		return nil, compareResult, nil
 	}
@@ -292,6 +559,9 @@ func readByDataIndexAndCompareByKey(reader io.ReadSeeker, dataIndex uint32, key
 		return nil, compareResult, fmt.Errorf("sum not match")
 	}
 	blockData.Value = valueBuf
+	blockData.Deleted = dataHeader.Deleted
+	blockData.ValueType = dataHeader.ValueType
+	blockData.Ts = dataHeader.Ts
 	if compareResult != Equals {
 		return nil, compareResult, nil
 	} else {
@@ -344,6 +614,7 @@ func (reader *SSTableReader) getByDataIndexAndCompareByKey(dataIndex uint32, key
 
 func (reader *SSTableReader) searchByKey(key []byte, dataIndexes []uint32, tracker *base.ReaderTracker) (*base.BlockData, /*open success*/ bool, error) {
 	var resultBlockData *base.BlockData = nil
+	comparator := reader.comparator
 	openSuccess, err := reader.reader.ReadSeeker(func(reader io.ReadSeeker) error {
 		lowBound := 0
 		upBound := len(dataIndexes)
@@ -359,7 +630,7 @@ func (reader *SSTableReader) searchByKey(key []byte, dataIndexes []uint32, track
 			pos = newPos
 			dataIndex := dataIndexes[pos]
 			tracker.SearchCount += 1
-			blockData, compareResult, err := readByDataIndexAndCompareByKey(reader, dataIndex, key)
+			blockData, compareResult, err := readByDataIndexAndCompareByKey(reader, dataIndex, key, comparator)
 			if err != nil {
 				return err
 			}
@@ -388,6 +659,9 @@ func (reader *SSTableReader) searchByKey(key []byte, dataIndexes []uint32, track
 	if !openSuccess {
 		return nil, openSuccess, nil
 	}
+	if resultBlockData != nil {
+		resultBlockData.Ts = DataTs(resultBlockData.Ts, reader.ts)
+	}
 	return resultBlockData, true, nil
 }
 
@@ -409,3 +683,99 @@ func (reader *SSTableReader) GetByKeyWithTrack(key []byte) (*base.BlockData, boo
 	data, success, err := reader.searchByKey(key, dataIndexes, &tracker)
 	return data, success, tracker, err
 }
+
+// search the key from the lowBound, return the data and the lower bound position of the key
+func searchByKeyFrom(reader io.ReadSeeker, key []byte, dataIndexes []uint32, lowBound int, comparator Comparator, tracker *base.ReaderTracker) (*base.BlockData, int, error) {
+	upBound := len(dataIndexes)
+	for lowBound < upBound {
+		pos := (lowBound + upBound) / 2
+		tracker.SearchCount += 1
+		blockData, compareResult, err := readByDataIndexAndCompareByKey(reader, dataIndexes[pos], key, comparator)
+		if err != nil {
+			return nil, lowBound, err
+		}
+		switch compareResult {
+		case Equals:
+			return blockData, pos, nil
+		case Greater:
+			lowBound = pos + 1
+		default:
+			upBound = pos
+		}
+	}
+	return nil, lowBound, nil
+}
+
+// GetByKeys finds the sorted keys, the results are nil for the keys not found.
+// The bloom filter is tested for all keys first, the data indexes are read once, and the
+// left keys are split into groups which are read in parallel by different file handles.
+// In one group the search of a key starts from the position of the key before.
+func (reader *SSTableReader) GetByKeys(keys [][]byte) ([]*base.BlockData, /*open success*/ bool, error) {
+	results, _, success, err := reader.GetByKeysWithTrack(keys)
+	return results, success, err
+}
+
+// the same as GetByKeys, and the trackers of the keys are returned in the order of keys
+func (reader *SSTableReader) GetByKeysWithTrack(keys [][]byte) ([]*base.BlockData, []base.ReaderTracker, /*open success*/ bool, error) {
+	results := make([]*base.BlockData, len(keys))
+	trackers := make([]base.ReaderTracker, len(keys))
+	hits := make([]int, 0, len(keys))
+	for i, key := range keys {
+		trackers[i].FileName = reader.fileName
+		if reader.filter.Hit(key) {
+			hits = append(hits, i)
+		} else {
+			trackers[i].BloomHit = true
+		}
+	}
+	if len(hits) == 0 {
+		return results, trackers, true, nil
+	}
+	dataIndexes, err := reader.getDataIndexes()
+	if err != nil {
+		return nil, trackers, false, err
+	}
+	groupCount := (len(hits) + minKeysPerReadGroup - 1) / minKeysPerReadGroup
+	if groupCount > readerConcurrentSize {
+		groupCount = readerConcurrentSize
+	}
+	groupSize := (len(hits) + groupCount - 1) / groupCount
+	openSuccesses := make([]bool, groupCount)
+	errs := make([]error, groupCount)
+	var wg sync.WaitGroup
+	for g := 0; g < groupCount; g++ {
+		end := (g + 1) * groupSize
+		if end > len(hits) {
+			end = len(hits)
+		}
+		wg.Add(1)
+		go func(g int, group []int) {
+			defer wg.Done()
+			openSuccesses[g], errs[g] = reader.reader.ReadSeeker(func(r io.ReadSeeker) error {
+				lowBound := 0
+				for _, i := range group {
+					blockData, pos, err := searchByKeyFrom(r, keys[i], dataIndexes, lowBound, reader.comparator, &trackers[i])
+					if err != nil {
+						return err
+					}
+					if blockData != nil {
+						blockData.Ts = DataTs(blockData.Ts, reader.ts)
+					}
+					results[i] = blockData
+					lowBound = pos
+				}
+				return nil
+			})
+		}(g, hits[g*groupSize:end])
+	}
+	wg.Wait()
+	for g := 0; g < groupCount; g++ {
+		if errs[g] != nil {
+			return nil, trackers, openSuccesses[g], errs[g]
+		}
+		if !openSuccesses[g] {
+			return nil, trackers, false, nil
+		}
+	}
+	return results, trackers, true, nil
+}
@@ -1,20 +1,31 @@
 package sst
 
 import (
-	"os"
+	"bytes"
 	"github.com/pister/yfs/common/bytesutil"
 	"github.com/pister/yfs/common/hashutil"
 	"fmt"
 	"path/filepath"
 	"github.com/pister/yfs/common/bloom"
 	"github.com/pister/yfs/lsm/base"
+	"github.com/pister/yfs/common/ratelimit"
+	"github.com/pister/yfs/common/vfs"
 )
 
 type SSTableWriter struct {
-	file         *os.File
+	fs           vfs.FS
+	file         vfs.File
 	position     uint32
 	fileName     string
 	tempFileName string
+	level        uint32
+	dataIndexes  []*base.DataIndex
+	// the bloom filter is made when finishing, by the count of keys
+	bloomBitsPerKey float64
+	prefixExtractor PrefixExtractor
+	comparator      Comparator
+	// nil means no limit
+	limiter *ratelimit.RateLimiter
 }
 
 func (writer *SSTableWriter) GetFileName() string {
@@ -22,21 +33,60 @@ func (writer *SSTableWriter) GetFileName() string {
 }
 
 func NewSSTableWriter(dir string, level uint32, ts int64) (*SSTableWriter, error) {
-	ssTableWriter := new(SSTableWriter)
+	return NewSSTableWriterWithFS(vfs.Default, dir, level, ts)
+}
+
+func NewSSTableWriterWithFS(fs vfs.FS, dir string, level uint32, ts int64) (*SSTableWriter, error) {
 	fileName := filepath.Join(dir, fmt.Sprintf("%s_%d_%d", "sst", level, ts))
+	return newSSTableWriterWithFileName(fs, fileName, level)
+}
+
+func newSSTableWriterWithFileName(fs vfs.FS, fileName string, level uint32) (*SSTableWriter, error) {
+	ssTableWriter := new(SSTableWriter)
 	tempFileName := fileName + "_tmp"
-	file, err := os.OpenFile(tempFileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	file, err := fs.Create(tempFileName)
 	if err != nil {
 		return nil, err
 	}
+	ssTableWriter.fs = fs
 	ssTableWriter.fileName = fileName
 	ssTableWriter.tempFileName = tempFileName
 	ssTableWriter.file = file
 	ssTableWriter.position = 0
+	ssTableWriter.level = level
+	ssTableWriter.bloomBitsPerKey = DefaultBloomBitsPerKey
+	ssTableWriter.comparator = BytewiseComparator
+	ssTableWriter.dataIndexes = make([]*base.DataIndex, 0, 64)
 	return ssTableWriter, nil
 }
 
+// it must be called before Finish
+func (writer *SSTableWriter) SetBloomBitsPerKey(bitsPerKey float64) {
+	if bitsPerKey > 0 {
+		writer.bloomBitsPerKey = bitsPerKey
+	}
+}
+
+// the prefix bloom filter is written if it is set, it must be called before Finish
+func (writer *SSTableWriter) SetPrefixExtractor(extractor PrefixExtractor) {
+	writer.prefixExtractor = extractor
+}
+
+// the data must be written in the order of the comparator, its name is saved in the properties.
+// It must be called before Finish
+func (writer *SSTableWriter) SetComparator(comparator Comparator) {
+	if comparator != nil {
+		writer.comparator = comparator
+	}
+}
+
+// the writing is limited by the limiter as the background writing
+func (writer *SSTableWriter) SetRateLimiter(limiter *ratelimit.RateLimiter) {
+	writer.limiter = limiter
+}
+
 func (writer *SSTableWriter) write(buf []byte) (uint32, error) {
+	writer.limiter.Request(int64(len(buf)), ratelimit.PriorityLow)
 	position := writer.position
 	_, err := writer.file.Write(buf)
 	if err != nil {
@@ -81,10 +131,10 @@ func (writer *SSTableWriter) WriteDataIndex(key []byte, dataIndex uint32) (uint3
 	return writer.write(buf)
 }
 
-func (writer *SSTableWriter) WriteBloomFilterData(data []byte, bitLength uint32) (uint32, error) {
+func (writer *SSTableWriter) WriteBloomFilterData(data []byte, bitLength uint32, hashCount uint32) (uint32, error) {
 	/*
 	2 - bytes magic code
-	1 - byte not used
+	1 - byte hash count of the blocked bloom filter, 0 for the legacy filter
 	1 - byte block type
 	4 - bit set length
 	4 - bloom filter data length
@@ -93,7 +143,7 @@ func (writer *SSTableWriter) WriteBloomFilterData(data []byte, bitLength uint32)
 	buf := make([]byte, 12)
 	buf[0] = bloomFilterMagicCode1
 	buf[1] = bloomFilterMagicCode2
-	buf[2] = 0
+	buf[2] = byte(hashCount)
 	buf[3] = BlockTypeBloomFilter
 	bytesutil.CopyUint32ToBytes(bitLength, buf, 4)
 	bytesutil.CopyUint32ToBytes(uint32(len(data)), buf, 8)
@@ -107,10 +157,73 @@ func (writer *SSTableWriter) WriteBloomFilterData(data []byte, bitLength uint32)
 	return pos, nil
 }
 
+func (writer *SSTableWriter) WritePrefixBloomFilterData(extractorName string, data []byte, bitLength uint32, hashCount uint32) (uint32, error) {
+	/*
+	2 - bytes magic code
+	1 - byte hash count
+	1 - byte block type
+	4 - bit set length
+	4 - bloom filter data length
+	2 - bytes prefix extractor name length
+	2 - bytes not used
+	...bytes for prefix extractor name
+	...bytes for bloom filter
+	*/
+	buf := make([]byte, 16+len(extractorName))
+	buf[0] = prefixBloomMagicCode1
+	buf[1] = prefixBloomMagicCode2
+	buf[2] = byte(hashCount)
+	buf[3] = BlockTypePrefixBloom
+	bytesutil.CopyUint32ToBytes(bitLength, buf, 4)
+	bytesutil.CopyUint32ToBytes(uint32(len(data)), buf, 8)
+	bytesutil.CopyUint16ToBytes(uint16(len(extractorName)), buf, 12)
+	copy(buf[16:], extractorName)
+	pos, err := writer.write(buf)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := writer.write(data); err != nil {
+		return 0, err
+	}
+	return pos, nil
+}
+
+func (writer *SSTableWriter) WriteProperties(properties map[string]string) (uint32, error) {
+	/*
+	2 - bytes magic code
+	1 - byte not used
+	1 - byte block type
+	4 - bytes properties data length
+	...bytes for properties
+	*/
+	data := make([]byte, 0, 64)
+	for name, value := range properties {
+		buf := make([]byte, 4)
+		bytesutil.CopyUint16ToBytes(uint16(len(name)), buf, 0)
+		bytesutil.CopyUint16ToBytes(uint16(len(value)), buf, 2)
+		data = append(data, buf...)
+		data = append(data, name...)
+		data = append(data, value...)
+	}
+	buf := make([]byte, 8)
+	buf[0] = propertiesMagicCode1
+	buf[1] = propertiesMagicCode2
+	buf[3] = BlockTypeProperties
+	bytesutil.CopyUint32ToBytes(uint32(len(data)), buf, 4)
+	pos, err := writer.write(buf)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := writer.write(data); err != nil {
+		return 0, err
+	}
+	return pos, nil
+}
+
 func (writer *SSTableWriter) WriteDataBlock(key []byte, data *base.BlockData) (uint32, error) {
 	/*
 	2 - bytes magic code
-	1 - byte delete flag
+	1 - byte delete flag in low 4 bits, value type in high 4 bits
 	1 - byte block type
 	4 - bytes data sum
 	8 - bytes ts
@@ -122,7 +235,7 @@ func (writer *SSTableWriter) WriteDataBlock(key []byte, data *base.BlockData) (u
 	headerAndKey := make([]byte, 24+len(key))
 	headerAndKey[0] = dataMagicCode1
 	headerAndKey[1] = dataMagicCode2
-	headerAndKey[2] = byte(data.Deleted)
+	headerAndKey[2] = byte(data.Deleted) | byte(data.ValueType)<<4
 	headerAndKey[3] = BlockTypeData
 	dataSum := hashutil.SumHash32(data.Value)
 	bytesutil.CopyUint32ToBytes(dataSum, headerAndKey, 4)
@@ -132,23 +245,48 @@ func (writer *SSTableWriter) WriteDataBlock(key []byte, data *base.BlockData) (u
 	bytesutil.CopyDataToBytes(key, 0, headerAndKey, 24, len(key))
 	dataIndex, err := writer.write(headerAndKey)
 	if err != nil {
-		return 0, nil
+		return 0, err
 	}
 	_, err = writer.write(data.Value)
 	if err != nil {
-		return 0, nil
+		return 0, err
 	}
 	return dataIndex, nil
 }
 
+// the name of the file before committing
+func (writer *SSTableWriter) GetTempFileName() string {
+	return writer.tempFileName
+}
+
+func (writer *SSTableWriter) Sync() error {
+	return writer.file.Sync()
+}
+
 func (writer *SSTableWriter) Close() error {
 	return writer.file.Close()
 }
 
+func (writer *SSTableWriter) Abort() error {
+	writer.file.Close()
+	return writer.fs.Remove(writer.tempFileName)
+}
+
 func (writer *SSTableWriter) Commit() error {
-	if err := os.Rename(writer.tempFileName, writer.fileName); err != nil {
+	if err := writer.fs.Rename(writer.tempFileName, writer.fileName); err != nil {
+		return err
+	}
+	return nil
+}
+
+// commit the sst with the name of the ts instead of the one given when creating it
+func (writer *SSTableWriter) CommitWithTs(ts int64) error {
+	dir, _ := filepath.Split(writer.fileName)
+	fileName := filepath.Join(dir, fmt.Sprintf("%s_%d_%d", "sst", writer.level, ts))
+	if err := writer.fs.Rename(writer.tempFileName, fileName); err != nil {
 		return err
 	}
+	writer.fileName = fileName
 	return nil
 }
 
@@ -157,43 +295,67 @@ type ForeachAble interface {
 }
 
 func (writer *SSTableWriter) WriteFullData(level uint32, memMap ForeachAble) (bloom.Filter, error) {
-	// size
-	bloomFilter := bloom.NewUnsafeBloomFilter(bloomBitSizeFromLevel(level))
 	var err error
 	// 1, write data
-	dataIndexes := make([]*base.DataIndex, 0, 64)
-	memMap.Foreach(func(key []byte, value interface{}) bool {
-		data := value.(*base.BlockData)
-		index, e := writer.WriteDataBlock(key, data)
-		if e != nil {
+	foreachErr := memMap.Foreach(func(key []byte, value interface{}) bool {
+		if e := writer.Append(key, value.(*base.BlockData)); e != nil {
 			err = e
 			return true
 		}
-		bloomFilter.Add(key)
-		dataIndexes = append(dataIndexes, &base.DataIndex{Key: key, DataIndex: index})
 		return false
 	})
+	if err == nil {
+		err = foreachErr
+	}
 	if err != nil {
 		return nil, err
 	}
+	return writer.Finish()
+}
 
+// the keys must be appended in order, and Finish must be called after all the data appended.
+func (writer *SSTableWriter) Append(key []byte, data *base.BlockData) error {
+	index, err := writer.WriteDataBlock(key, data)
+	if err != nil {
+		return err
+	}
+	writer.dataIndexes = append(writer.dataIndexes, &base.DataIndex{Key: key, DataIndex: index})
+	return nil
+}
+
+func (writer *SSTableWriter) GetDataCount() int {
+	return len(writer.dataIndexes)
+}
+
+// write the data index, bloom filter and footer after the data
+func (writer *SSTableWriter) Finish() (bloom.Filter, error) {
 	// 2, write data index
-	keyIndexes := make([]uint32, 0, 64)
-	for _, di := range dataIndexes {
-		keyIndex, err := writer.WriteDataIndex(di.Key, di.DataIndex)
-		if err != nil {
+	dataIndexStartPosition := writer.position
+	for _, di := range writer.dataIndexes {
+		if _, err := writer.WriteDataIndex(di.Key, di.DataIndex); err != nil {
 			return nil, err
 		}
-		keyIndexes = append(keyIndexes, keyIndex)
 	}
-	dataIndexStartPosition := keyIndexes[0]
 
 	// 3 write bloom filter
+	bloomFilter := bloom.NewBlockedBloomFilter(len(writer.dataIndexes), writer.bloomBitsPerKey)
+	for _, di := range writer.dataIndexes {
+		bloomFilter.Add(di.Key)
+	}
 	bloomData, bitLength := bloomFilter.GetBitData()
-	bloomFilterPosition, err := writer.WriteBloomFilterData(bloomData, bitLength)
+	bloomFilterPosition, err := writer.WriteBloomFilterData(bloomData, bitLength, bloomFilter.GetHashCount())
 	if err != nil {
 		return nil, err
 	}
+	if writer.prefixExtractor != nil {
+		if err := writer.writePrefixBloomFilter(); err != nil {
+			return nil, err
+		}
+	}
+	properties := map[string]string{PropertyComparator: writer.comparator.Name()}
+	if _, err := writer.WriteProperties(properties); err != nil {
+		return nil, err
+	}
 
 	// 4,  writer footer
 	if err := writer.WriteFooter(dataIndexStartPosition, bloomFilterPosition); err != nil {
@@ -201,3 +363,23 @@ func (writer *SSTableWriter) WriteFullData(level uint32, memMap ForeachAble) (bl
 	}
 	return bloomFilter, nil
 }
+
+func (writer *SSTableWriter) writePrefixBloomFilter() error {
+	prefixes := make([][]byte, 0, 16)
+	var lastPrefix []byte
+	for _, di := range writer.dataIndexes {
+		prefix, ok := writer.prefixExtractor.Transform(di.Key)
+		if !ok || (lastPrefix != nil && bytes.Equal(prefix, lastPrefix)) {
+			continue
+		}
+		prefixes = append(prefixes, prefix)
+		lastPrefix = prefix
+	}
+	filter := bloom.NewBlockedBloomFilter(len(prefixes), writer.bloomBitsPerKey)
+	for _, prefix := range prefixes {
+		filter.Add(prefix)
+	}
+	data, bitLength := filter.GetBitData()
+	_, err := writer.WritePrefixBloomFilterData(writer.prefixExtractor.Name(), data, bitLength, filter.GetHashCount())
+	return err
+}
@@ -0,0 +1,324 @@
+package lsm
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"sort"
+	"bytes"
+	"strings"
+	"strconv"
+	"github.com/pister/yfs/common/atomicutil"
+	"github.com/pister/yfs/lsm/sst"
+)
+
+// the upper bound of the last bucket is 2^histogramBuckets microseconds, the bigger ones are in the last bucket
+const histogramBuckets = 26
+
+// Histogram is the snapshot of the latencies, the upper bound of bucket i is 2^i microseconds.
+type Histogram struct {
+	Count   uint64
+	Sum     time.Duration
+	Max     time.Duration
+	Buckets [histogramBuckets + 1]uint64
+}
+
+func BucketUpperBound(i int) time.Duration {
+	return time.Duration(int64(1)<<uint(i)) * time.Microsecond
+}
+
+func (h Histogram) Average() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// the upper bound of the bucket which the p percent data are in, p is in [0, 100]
+func (h Histogram) Percentile(p float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	threshold := uint64(float64(h.Count) * p / 100)
+	var count uint64
+	for i, c := range h.Buckets {
+		count += c
+		if count >= threshold && count > 0 {
+			if i == histogramBuckets {
+				return h.Max
+			}
+			return BucketUpperBound(i)
+		}
+	}
+	return h.Max
+}
+
+func (h Histogram) String() string {
+	return fmt.Sprintf("count:%d avg:%s p50:%s p99:%s max:%s", h.Count, h.Average(), h.Percentile(50), h.Percentile(99), h.Max)
+}
+
+type histogram struct {
+	mutex sync.Mutex
+	data  Histogram
+}
+
+func (h *histogram) record(d time.Duration) {
+	i := 0
+	for i < histogramBuckets && d > BucketUpperBound(i) {
+		i++
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.data.Count++
+	h.data.Sum += d
+	if d > h.data.Max {
+		h.data.Max = d
+	}
+	h.data.Buckets[i]++
+}
+
+func (h *histogram) snapshot() Histogram {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.data
+}
+
+type LevelStats struct {
+	Level     uint32
+	FileCount int
+	Bytes     int64
+}
+
+// Stats is the snapshot of the statistics of the lsm
+type Stats struct {
+	MemEntries          int
+	MemBytes            int64
+	ImmutableMemEntries int
+	ImmutableMemBytes   int64
+	WalBytes            int64
+
+	SSTCount int
+	SSTBytes int64
+	Levels   []LevelStats
+
+	BlobCount        int
+	BlobBytes        int64
+	BlobGarbageBytes int64
+
+	// the bloom filter is useful when it filters the key out,
+	// and useless when it passes the key but the key is not in the sst
+	BloomUseful  uint64
+	BloomUseless uint64
+
+	CompactionCount       uint64
+	CompactionInputBytes  uint64
+	CompactionOutputBytes uint64
+	CompactionLatency     Histogram
+
+	FlushCount   uint64
+	FlushBytes   uint64
+	FlushLatency Histogram
+
+	StallCount uint64
+	StallTime  time.Duration
+
+	GetCount     uint64
+	PutCount     uint64
+	DeleteCount  uint64
+	GetLatency   Histogram
+	WriteLatency Histogram
+}
+
+func (stats *Stats) String() string {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "mem: entries:%d bytes:%d, immutable entries:%d bytes:%d, wal bytes:%d\n",
+		stats.MemEntries, stats.MemBytes, stats.ImmutableMemEntries, stats.ImmutableMemBytes, stats.WalBytes)
+	fmt.Fprintf(buf, "sst: count:%d bytes:%d\n", stats.SSTCount, stats.SSTBytes)
+	for _, level := range stats.Levels {
+		fmt.Fprintf(buf, "  level %d: count:%d bytes:%d\n", level.Level, level.FileCount, level.Bytes)
+	}
+	fmt.Fprintf(buf, "blob: count:%d bytes:%d garbage:%d\n", stats.BlobCount, stats.BlobBytes, stats.BlobGarbageBytes)
+	fmt.Fprintf(buf, "bloom: useful:%d useless:%d\n", stats.BloomUseful, stats.BloomUseless)
+	fmt.Fprintf(buf, "compaction: input bytes:%d output bytes:%d %s\n", stats.CompactionInputBytes, stats.CompactionOutputBytes, stats.CompactionLatency)
+	fmt.Fprintf(buf, "flush: bytes:%d %s\n", stats.FlushBytes, stats.FlushLatency)
+	fmt.Fprintf(buf, "stall: count:%d time:%s\n", stats.StallCount, stats.StallTime)
+	fmt.Fprintf(buf, "get: %s\n", stats.GetLatency)
+	fmt.Fprintf(buf, "write: put:%d delete:%d %s\n", stats.PutCount, stats.DeleteCount, stats.WriteLatency)
+	return buf.String()
+}
+
+// the counters of the running lsm
+type lsmStats struct {
+	immutableMemBytes     *atomicutil.AtomicInt64
+	bloomUseful           *atomicutil.AtomicUint64
+	bloomUseless          *atomicutil.AtomicUint64
+	compactionInputBytes  *atomicutil.AtomicUint64
+	compactionOutputBytes *atomicutil.AtomicUint64
+	flushBytes            *atomicutil.AtomicUint64
+	stallCount            *atomicutil.AtomicUint64
+	stallTime             *atomicutil.AtomicInt64
+	putCount              *atomicutil.AtomicUint64
+	deleteCount           *atomicutil.AtomicUint64
+	compactionLatency     histogram
+	flushLatency          histogram
+	getLatency            histogram
+	writeLatency          histogram
+}
+
+func newLsmStats() *lsmStats {
+	stats := new(lsmStats)
+	stats.immutableMemBytes = atomicutil.NewAtomicInt64(0)
+	stats.bloomUseful = atomicutil.NewAtomicUint64(0)
+	stats.bloomUseless = atomicutil.NewAtomicUint64(0)
+	stats.compactionInputBytes = atomicutil.NewAtomicUint64(0)
+	stats.compactionOutputBytes = atomicutil.NewAtomicUint64(0)
+	stats.flushBytes = atomicutil.NewAtomicUint64(0)
+	stats.stallCount = atomicutil.NewAtomicUint64(0)
+	stats.stallTime = atomicutil.NewAtomicInt64(0)
+	stats.putCount = atomicutil.NewAtomicUint64(0)
+	stats.deleteCount = atomicutil.NewAtomicUint64(0)
+	return stats
+}
+
+func (stats *lsmStats) recordStall(d time.Duration) {
+	stats.stallCount.Increment()
+	stats.stallTime.Add(int64(d))
+}
+
+func (lsm *Lsm) Stats() *Stats {
+	stats := new(Stats)
+	stats.MemEntries = lsm.memMap.MainLength()
+	stats.ImmutableMemEntries = lsm.memMap.SwitchingLength()
+	stats.ImmutableMemBytes = lsm.stats.immutableMemBytes.Get()
+	if !lsm.readOnly {
+		_, stats.WalBytes = lsm.currentWal()
+		stats.MemBytes = stats.WalBytes
+	}
+
+	levels := make(map[uint32]*LevelStats)
+	for _, reader := range lsm.getReaders() {
+		level, exist := levels[reader.GetLevel()]
+		if !exist {
+			level = &LevelStats{Level: reader.GetLevel()}
+			levels[reader.GetLevel()] = level
+		}
+		level.FileCount++
+		level.Bytes += reader.GetFileSize()
+		stats.SSTCount++
+		stats.SSTBytes += reader.GetFileSize()
+	}
+	for _, level := range levels {
+		stats.Levels = append(stats.Levels, *level)
+	}
+	sort.Slice(stats.Levels, func(i, j int) bool {
+		return stats.Levels[i].Level < stats.Levels[j].Level
+	})
+
+	if lsm.manifest != nil {
+		for _, stat := range lsm.manifest.getBlobFiles() {
+			stats.BlobCount++
+			stats.BlobBytes += stat.totalSize
+			stats.BlobGarbageBytes += stat.garbageSize
+		}
+	}
+
+	stats.BloomUseful = lsm.stats.bloomUseful.Get()
+	stats.BloomUseless = lsm.stats.bloomUseless.Get()
+	stats.CompactionInputBytes = lsm.stats.compactionInputBytes.Get()
+	stats.CompactionOutputBytes = lsm.stats.compactionOutputBytes.Get()
+	stats.CompactionLatency = lsm.stats.compactionLatency.snapshot()
+	stats.CompactionCount = stats.CompactionLatency.Count
+	stats.FlushBytes = lsm.stats.flushBytes.Get()
+	stats.FlushLatency = lsm.stats.flushLatency.snapshot()
+	stats.FlushCount = stats.FlushLatency.Count
+	stats.StallCount = lsm.stats.stallCount.Get()
+	stats.StallTime = time.Duration(lsm.stats.stallTime.Get())
+	stats.GetLatency = lsm.stats.getLatency.snapshot()
+	stats.GetCount = stats.GetLatency.Count
+	stats.WriteLatency = lsm.stats.writeLatency.snapshot()
+	stats.PutCount = lsm.stats.putCount.Get()
+	stats.DeleteCount = lsm.stats.deleteCount.Get()
+	return stats
+}
+
+const (
+	PropertyStats               = "lsm.stats"
+	PropertyMemEntries          = "lsm.mem-entries"
+	PropertyMemBytes            = "lsm.mem-bytes"
+	PropertyImmutableMemEntries = "lsm.immutable-mem-entries"
+	PropertyWalBytes            = "lsm.wal-bytes"
+	PropertySSTCount            = "lsm.sst-count"
+	PropertySSTBytes            = "lsm.sst-bytes"
+	PropertyBlobCount           = "lsm.blob-count"
+	PropertyBlobGarbageBytes    = "lsm.blob-garbage-bytes"
+	PropertyBloomUseful         = "lsm.bloom-useful"
+	PropertyBloomUseless        = "lsm.bloom-useless"
+	PropertyCompactionCount     = "lsm.compaction-count"
+	PropertyFlushCount          = "lsm.flush-count"
+	PropertyStallMicros         = "lsm.stall-micros"
+	// the level number is appended, such as lsm.num-files-at-level0
+	PropertyNumFilesAtLevelPrefix = "lsm.num-files-at-level"
+	PropertyBytesAtLevelPrefix    = "lsm.bytes-at-level"
+)
+
+// Property returns the value of the property by name, false if the name is unknown.
+func (lsm *Lsm) Property(name string) (string, bool) {
+	stats := lsm.Stats()
+	if strings.HasPrefix(name, PropertyNumFilesAtLevelPrefix) || strings.HasPrefix(name, PropertyBytesAtLevelPrefix) {
+		filesProperty := strings.HasPrefix(name, PropertyNumFilesAtLevelPrefix)
+		levelString := strings.TrimPrefix(strings.TrimPrefix(name, PropertyNumFilesAtLevelPrefix), PropertyBytesAtLevelPrefix)
+		level, err := strconv.ParseUint(levelString, 10, 32)
+		if err != nil {
+			return "", false
+		}
+		for _, l := range stats.Levels {
+			if l.Level != uint32(level) {
+				continue
+			}
+			if filesProperty {
+				return strconv.Itoa(l.FileCount), true
+			}
+			return strconv.FormatInt(l.Bytes, 10), true
+		}
+		return "0", true
+	}
+	switch name {
+	case PropertyStats:
+		return stats.String(), true
+	case PropertyMemEntries:
+		return strconv.Itoa(stats.MemEntries), true
+	case PropertyMemBytes:
+		return strconv.FormatInt(stats.MemBytes, 10), true
+	case PropertyImmutableMemEntries:
+		return strconv.Itoa(stats.ImmutableMemEntries), true
+	case PropertyWalBytes:
+		return strconv.FormatInt(stats.WalBytes, 10), true
+	case PropertySSTCount:
+		return strconv.Itoa(stats.SSTCount), true
+	case PropertySSTBytes:
+		return strconv.FormatInt(stats.SSTBytes, 10), true
+	case PropertyBlobCount:
+		return strconv.Itoa(stats.BlobCount), true
+	case PropertyBlobGarbageBytes:
+		return strconv.FormatInt(stats.BlobGarbageBytes, 10), true
+	case PropertyBloomUseful:
+		return strconv.FormatUint(stats.BloomUseful, 10), true
+	case PropertyBloomUseless:
+		return strconv.FormatUint(stats.BloomUseless, 10), true
+	case PropertyCompactionCount:
+		return strconv.FormatUint(stats.CompactionCount, 10), true
+	case PropertyFlushCount:
+		return strconv.FormatUint(stats.FlushCount, 10), true
+	case PropertyStallMicros:
+		return strconv.FormatInt(int64(stats.StallTime/time.Microsecond), 10), true
+	}
+	return "", false
+}
+
+func sumFileSize(readers []*sst.SSTableReader) int64 {
+	var size int64
+	for _, reader := range readers {
+		size += reader.GetFileSize()
+	}
+	return size
+}
@@ -0,0 +1,67 @@
+package lsm
+
+import (
+	"testing"
+	"os"
+	"fmt"
+	"github.com/pister/yfs/common/fileutil"
+)
+
+func TestStats(t *testing.T) {
+	tempDir := "/Users/songlihuang/temp/temp3/lsm_stats_test"
+	os.RemoveAll(tempDir)
+	fileutil.MkDirs(tempDir)
+	defer os.RemoveAll(tempDir)
+	lsm, err := OpenLsm(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	for i := 0; i < 10; i++ {
+		lsm.Put([]byte(fmt.Sprintf("name-%d", i)), []byte(fmt.Sprintf("value-%d", i)))
+	}
+	lsm.Delete([]byte("name-0"))
+	stats := lsm.Stats()
+	if stats.MemEntries != 10 || stats.WalBytes == 0 || stats.PutCount != 10 || stats.DeleteCount != 1 {
+		t.Fatal("mem stats not match", stats)
+	}
+	lsm.Flush()
+	lsm.flushLocker.Lock()
+	lsm.flushLocker.Unlock()
+	for i := 0; i < 20; i++ {
+		lsm.Get([]byte(fmt.Sprintf("name-%d", i)))
+	}
+	stats = lsm.Stats()
+	if stats.SSTCount != 1 || stats.SSTBytes == 0 || len(stats.Levels) != 1 || stats.Levels[0].FileCount != 1 {
+		t.Fatal("sst stats not match", stats)
+	}
+	if stats.FlushCount != 1 || stats.FlushBytes == 0 || stats.MemEntries != 0 || stats.ImmutableMemBytes != 0 {
+		t.Fatal("flush stats not match", stats)
+	}
+	if stats.GetCount != 20 || stats.BloomUseful+stats.BloomUseless != 10 {
+		t.Fatal("get stats not match", stats)
+	}
+	// the bloom stats of MultiGet are the same as Get
+	keys := make([][]byte, 0, 20)
+	for i := 0; i < 20; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("name-%d", i)))
+	}
+	lsm.MultiGet(keys)
+	if multiStats := lsm.Stats(); multiStats.BloomUseful+multiStats.BloomUseless != 20 ||
+		multiStats.BloomUseful < stats.BloomUseful*2 {
+		t.Fatal("multi get stats not match", multiStats)
+	}
+	if stats.GetLatency.Percentile(99) <= 0 || stats.GetLatency.Percentile(50) > stats.GetLatency.Percentile(99) {
+		t.Fatal("histogram not match", stats.GetLatency)
+	}
+	if v, ok := lsm.Property(PropertySSTCount); !ok || v != "1" {
+		t.Fatal("property not match", v)
+	}
+	if v, ok := lsm.Property(PropertyNumFilesAtLevelPrefix + "0"); !ok || v != "1" {
+		t.Fatal("level property not match", v)
+	}
+	if _, ok := lsm.Property("lsm.unknown"); ok {
+		t.Fatal("unknown property found")
+	}
+	t.Log(lsm.Property(PropertyStats))
+}
@@ -6,26 +6,56 @@ import (
 	"github.com/pister/yfs/common/maputil"
 	"github.com/pister/yfs/common/fileutil"
 	"io"
+	"fmt"
 	"github.com/pister/yfs/lsm/base"
+	"github.com/pister/yfs/common/vfs"
 )
 
 type AheadLog struct {
-	file     *os.File
+	fs       vfs.FS
+	file     vfs.File
 	closed   bool
+	readOnly bool
 	filename string
 	dataSize *atomicutil.AtomicInt64
 }
 
 func OpenAheadLog(filename string) (*AheadLog, error) {
+	return OpenAheadLogWithFS(vfs.Default, filename)
+}
+
+func OpenAheadLogWithFS(fs vfs.FS, filename string) (*AheadLog, error) {
 	wal := new(AheadLog)
+	wal.fs = fs
 	if err := wal.openFile(filename); err != nil {
 		return nil, err
 	}
 	return wal, nil
 }
 
+// open the wal file only for reading, it will never be written or deleted
+func OpenAheadLogReadOnly(fs vfs.FS, filename string) (*AheadLog, error) {
+	file, err := fs.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	wal := new(AheadLog)
+	wal.fs = fs
+	wal.file = file
+	wal.closed = false
+	wal.readOnly = true
+	wal.filename = filename
+	wal.dataSize = atomicutil.NewAtomicInt64(fi.Size())
+	return wal, nil
+}
+
 func (wal *AheadLog) openFile(filename string) error {
-	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	file, err := wal.fs.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
 		return err
 	}
@@ -72,6 +102,9 @@ func (wal *AheadLog) GetDataSize() int64 {
 }
 
 func (wal *AheadLog) Append(action *Action) error {
+	if wal.readOnly {
+		return fmt.Errorf("wal %s is opened read only", wal.filename)
+	}
 	wLen, err := action.WriteTo(wal.file)
 	if err != nil {
 		return err
@@ -92,10 +125,13 @@ func (wal *AheadLog) Close() error {
 }
 
 func (wal *AheadLog) DeleteFile() error {
+	if wal.readOnly {
+		return fmt.Errorf("wal %s is opened read only", wal.filename)
+	}
 	if err := wal.file.Close(); err != nil {
 		return err
 	}
-	if err := fileutil.DeleteFile(wal.filename); err != nil {
+	if err := fileutil.DeleteFileWithFS(wal.fs, wal.filename); err != nil {
 		return err
 	}
 	return nil
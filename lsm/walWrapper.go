@@ -1,7 +1,6 @@
 package lsm
 
 import (
-	"path"
 	"strings"
 	"strconv"
 	"github.com/pister/yfs/common/maputil"
@@ -13,6 +12,7 @@ import (
 	"github.com/pister/yfs/common/bloom"
 	"github.com/pister/yfs/lsm/base"
 	"github.com/pister/yfs/lsm/sst"
+	"github.com/pister/yfs/common/vfs"
 )
 
 var walNamePattern *regexp.Regexp
@@ -31,20 +31,22 @@ type walWrapper struct {
 	ts       int64
 }
 
-func getWalFileNames(dir string) ([]base.TsFileName, error) {
+func getWalFileNames(fs vfs.FS, dir string) ([]base.TsFileName, error) {
+	names, err := fs.List(dir)
+	if err != nil {
+		return nil, err
+	}
 	walFiles := make([]base.TsFileName, 0, 3)
-	filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
-		_, name := path.Split(file)
+	for _, name := range names {
 		if walNamePattern.MatchString(name) {
 			post := strings.LastIndex(name, "_")
 			ts, err := strconv.ParseInt(name[post+1:], 10, 64)
 			if err != nil {
-				return err
+				return nil, err
 			}
-			walFiles = append(walFiles, base.TsFileName{file, ts})
+			walFiles = append(walFiles, base.TsFileName{filepath.Join(dir, name), ts})
 		}
-		return nil
-	})
+	}
 	if len(walFiles) <= 0 {
 		return nil, nil
 	}
@@ -52,11 +54,11 @@ func getWalFileNames(dir string) ([]base.TsFileName, error) {
 	return walFiles, nil
 }
 
-func newWalWrapper(dir string) (*walWrapper, error) {
+func newWalWrapper(fs vfs.FS, dir string) (*walWrapper, error) {
 	ww := new(walWrapper)
 	ts := base.GetCurrentTs()
 	walFileName := fmt.Sprintf("%s%c%s_%d", dir, filepath.Separator, "wal", ts)
-	wal, err := OpenAheadLog(walFileName)
+	wal, err := OpenAheadLogWithFS(fs, walFileName)
 	if err != nil {
 		return nil, err
 	}
@@ -66,55 +68,138 @@ func newWalWrapper(dir string) (*walWrapper, error) {
 	return ww, nil
 }
 
-func createOrOpenFirstWalWrapper(dir string) (*walWrapper, error) {
-	walFiles, err := getWalFileNames(dir)
+func createOrOpenFirstWalWrapper(fs vfs.FS, dir string, comparator sst.Comparator) (*walWrapper, error) {
+	walFiles, err := getWalFileNames(fs, dir)
 	if err != nil {
 		return nil, err
 	}
 	if len(walFiles) == 0 {
-		wal, err := newWalWrapper(dir)
+		wal, err := newWalWrapper(fs, dir)
 		if err != nil {
 			return nil, err
 		}
+		wal.memMap = maputil.NewSafeTreeMap(sst.TreeComparator(comparator))
 		return wal, nil
 	} else {
-		return openWalWrapperByTsFile(walFiles[0])
+		return openWalWrapperByTsFile(fs, walFiles[0], comparator)
 	}
 }
 
-func openWalWrapperByTsFile(walFile base.TsFileName) (*walWrapper, error) {
+func openWalWrapperByTsFile(fs vfs.FS, walFile base.TsFileName, comparator sst.Comparator) (*walWrapper, error) {
 	ww := new(walWrapper)
-	wal, err := OpenAheadLog(walFile.PathName)
+	wal, err := OpenAheadLogWithFS(fs, walFile.PathName)
 	if err != nil {
 		return nil, err
 	}
-	ww.memMap = maputil.NewSafeTreeMap()
+	ww.memMap = maputil.NewSafeTreeMap(sst.TreeComparator(comparator))
 	wal.initToMemMap(ww.memMap)
 	ww.aheadLog = wal
 	ww.ts = walFile.Ts
 	return ww, nil
 }
 
-func WalFileToSSTable(dir string, ww *walWrapper) (string, bloom.Filter, error) {
-	writer, err := sst.NewSSTableWriter(dir, 0, ww.ts)
+// replay all wal files from the oldest to the newest into one mem map,
+// the wal files will not be written or deleted.
+func loadWalFilesReadOnly(fs vfs.FS, dir string, comparator sst.Comparator) (*maputil.SafeTreeMap, error) {
+	walFiles, err := getWalFileNames(fs, dir)
 	if err != nil {
-		return "", nil, err
+		return nil, err
 	}
-	dataLength := ww.memMap.Length()
-	if dataLength == 0 {
-		return "", nil, nil
+	memMap := maputil.NewSafeTreeMap(sst.TreeComparator(comparator))
+	for i := len(walFiles) - 1; i >= 0; i-- {
+		wal, err := OpenAheadLogReadOnly(fs, walFiles[i].PathName)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// it has been flushed to sst by the writer
+				continue
+			}
+			return nil, err
+		}
+		if err := wal.initToMemMap(memMap); err != nil {
+			// the tail of the wal may be writing by the writer now
+			log.Info("replay wal %s stopped: %s", walFiles[i].PathName, err)
+		}
+		wal.Close()
 	}
-	bloomFilter, err := writer.WriteFullData(0, ww.memMap)
-	if err := writer.Close(); err != nil {
+	return memMap, nil
+}
+
+func WalFileToSSTable(dir string, ww *walWrapper) (string, bloom.Filter, error) {
+	files, err := walFileToSSTableWithoutDelete(dir, ww, DefaultOptions())
+	if err != nil {
 		return "", nil, err
 	}
 	// delete WAL log
 	if err := ww.aheadLog.DeleteFile(); err != nil {
 		return "", nil, err
 	}
-	// rename
+	return files.sstFile, files.filter, nil
+}
+
+// the files written by flushing one wal, the sst file is empty if there is no data
+type flushedFiles struct {
+	sstFile  string
+	filter   bloom.Filter
+	blobFile string
+	blobSize int64
+}
+
+// the edits of the flushed files, they must be logged in one record
+func (files *flushedFiles) edits() []versionEdit {
+	edits := newAddFileEdits(files.sstFile)
+	if len(files.blobFile) > 0 {
+		_, name := filepath.Split(files.blobFile)
+		edits = append(edits, versionEdit{editType: editTypeAddBlob, name: name, size: files.blobSize})
+	}
+	return edits
+}
+
+// the values which are longer than options.BlobValueThreshold are written to a blob file.
+func walFileToSSTableWithoutDelete(dir string, ww *walWrapper, options *Options) (*flushedFiles, error) {
+	files := new(flushedFiles)
+	dataLength := ww.memMap.Length()
+	if dataLength == 0 {
+		return files, nil
+	}
+	writer, err := sst.NewSSTableWriterWithFS(options.fs(), dir, 0, ww.ts)
+	if err != nil {
+		return nil, err
+	}
+	writer.SetBloomBitsPerKey(options.bloomBitsPerKey())
+	writer.SetPrefixExtractor(options.PrefixExtractor)
+	writer.SetComparator(options.comparator())
+	writer.SetRateLimiter(options.RateLimiter)
+	var data sst.ForeachAble = ww.memMap
+	var blobMap *blobSeparatingMap
+	if options.BlobValueThreshold > 0 {
+		blobMap = newBlobSeparatingMap(options.fs(), ww.memMap, options.BlobValueThreshold, dir, ww.ts)
+		blobMap.limiter = options.RateLimiter
+		data = blobMap
+	}
+	bloomFilter, err := writer.WriteFullData(0, data)
+	if err != nil {
+		writer.Abort()
+		if blobMap != nil {
+			blobMap.abort()
+		}
+		return nil, err
+	}
+	// the blob file must be committed before the sst which refers to it
+	if blobMap != nil {
+		if err := blobMap.commit(); err != nil {
+			writer.Abort()
+			return nil, err
+		}
+		files.blobFile, files.blobSize = blobMap.blobFile()
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	// rename before deleting the wal, so the data can always be found in the sst or the wal
 	if err := writer.Commit(); err != nil {
-		return "", nil, err
+		return nil, err
 	}
-	return writer.GetFileName(), bloomFilter, nil
+	files.sstFile = writer.GetFileName()
+	files.filter = bloomFilter
+	return files, nil
 }
@@ -7,20 +7,50 @@ import (
 	"github.com/pister/yfs/common/base64util"
 )
 
+const (
+	// the legacy name without cookie
+	nameLengthV1 = 12
+	nameVersion2 = 2
+	nameLengthV2 = 21
+)
+
 // naming 长度 12 字节， base64转成字符串的时候不需要额外填充，转成后长度为16字节
+// the name with cookie is 21 bytes, 28 bytes after base64 encoding
 type Name struct {
 	NamePosition uint32
 	NameBlockId  uint32
 	RegionId     uint16
+	// the random cookie stored in the name block, the name can not be guessed by the position.
+	// 0 means the legacy name without cookie
+	Cookie uint64
 }
 
 func (name *Name) String() string {
-	buf := make([]byte, 12, 12)
-	bytesutil.CopyUint32ToBytes(name.NamePosition, buf, 0)
-	bytesutil.CopyUint32ToBytes(name.NameBlockId, buf, 4)
-	bytesutil.CopyUint16ToBytes(name.RegionId, buf, 8)
-	sumValue := hashutil.SumHash16(buf[:10])
-	bytesutil.CopyUint16ToBytes(sumValue, buf, 10)
+	if name.Cookie == 0 {
+		buf := make([]byte, nameLengthV1, nameLengthV1)
+		bytesutil.CopyUint32ToBytes(name.NamePosition, buf, 0)
+		bytesutil.CopyUint32ToBytes(name.NameBlockId, buf, 4)
+		bytesutil.CopyUint16ToBytes(name.RegionId, buf, 8)
+		sumValue := hashutil.SumHash16(buf[:10])
+		bytesutil.CopyUint16ToBytes(sumValue, buf, 10)
+		return base64util.EncodeBase64ToString(buf)
+	}
+	// =================== V2 FORMAT START ==================
+	// 1 byte version
+	// 4 bytes name position
+	// 4 bytes name block id
+	// 2 bytes region id
+	// 8 bytes cookie
+	// 2 bytes sum16 of the above
+	// =================== V2 FORMAT END ====================
+	buf := make([]byte, nameLengthV2, nameLengthV2)
+	buf[0] = nameVersion2
+	bytesutil.CopyUint32ToBytes(name.NamePosition, buf, 1)
+	bytesutil.CopyUint32ToBytes(name.NameBlockId, buf, 5)
+	bytesutil.CopyUint16ToBytes(name.RegionId, buf, 9)
+	bytesutil.CopyUint64ToBytes(name.Cookie, buf, 11)
+	sumValue := hashutil.SumHash16(buf[:19])
+	bytesutil.CopyUint16ToBytes(sumValue, buf, 19)
 	return base64util.EncodeBase64ToString(buf)
 }
 
@@ -29,6 +59,25 @@ func ParseNameFromString(strName string) (*Name, error) {
 	if err != nil {
 		return nil, err
 	}
+	if len(data) == nameLengthV2 && data[0] == nameVersion2 {
+		sumValueFromCal := hashutil.SumHash16(data[:19])
+		sumValueFromData := bytesutil.GetUint16FromBytes(data, 19)
+		if sumValueFromCal != sumValueFromData {
+			return nil, fmt.Errorf("sum validate fail")
+		}
+		name := new(Name)
+		name.NamePosition = bytesutil.GetUint32FromBytes(data, 1)
+		name.NameBlockId = bytesutil.GetUint32FromBytes(data, 5)
+		name.RegionId = bytesutil.GetUint16FromBytes(data, 9)
+		name.Cookie = bytesutil.GetUint64FromBytes(data, 11)
+		if name.Cookie == 0 {
+			return nil, fmt.Errorf("invalidate name cookie")
+		}
+		return name, nil
+	}
+	if len(data) != nameLengthV1 {
+		return nil, fmt.Errorf("invalidate name length: %d", len(data))
+	}
 	sumValueFromCal := hashutil.SumHash16(data[:10])
 	sumValueFromData := bytesutil.GetUint16FromBytes(data, 10)
 	if sumValueFromCal != sumValueFromData {
@@ -3,12 +3,13 @@ package naming
 import (
 	"testing"
 	"fmt"
+	"github.com/pister/yfs/common/base64util"
 )
 
 func TestNewNameFromValue(t *testing.T) {
 	n := new(Name)
-	n.Index = 1234
-	n.BlockId = 55
+	n.NamePosition = 1234
+	n.NameBlockId = 55
 	n.RegionId = 42
 	s := n.String()
 	fmt.Println(s)
@@ -16,9 +17,45 @@ func TestNewNameFromValue(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if n1.Index != n.Index ||
-		n1.BlockId != n.BlockId ||
+	if n1.NamePosition != n.NamePosition ||
+		n1.NameBlockId != n.NameBlockId ||
 		n1.RegionId != n.RegionId {
 			t.Fatal("fail")
 	}
-}
\ No newline at end of file
+}
+
+func TestNameWithCookie(t *testing.T) {
+	n := new(Name)
+	n.NamePosition = 1234
+	n.NameBlockId = 55
+	n.RegionId = 42
+	legacy := n.String()
+	n.Cookie = 0x1234567890abcdef
+	s := n.String()
+	if len(legacy) != 16 || len(s) != 28 {
+		t.Fatal("length not match", legacy, s)
+	}
+	n1, err := ParseNameFromString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *n1 != *n {
+		t.Fatal("name not match", n1)
+	}
+	n1, err = ParseNameFromString(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n1.Cookie != 0 || n1.NamePosition != n.NamePosition {
+		t.Fatal("legacy name not match", n1)
+	}
+	// the cookie is covered by the sum
+	data, _ := base64util.DecodeBase64fromString(s)
+	data[15]++
+	if _, err := ParseNameFromString(base64util.EncodeBase64ToString(data)); err == nil {
+		t.Fatal("the tampered name should fail")
+	}
+	if _, err := ParseNameFromString("AAAA"); err == nil {
+		t.Fatal("the short name should fail")
+	}
+}
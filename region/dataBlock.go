@@ -4,10 +4,11 @@ import (
 	"sync"
 	"fmt"
 	"io"
-	"github.com/pister/yfs/common/bloom"
 	"github.com/pister/yfs/common/bytesutil"
 	"github.com/pister/yfs/common/hashutil"
 	"github.com/pister/yfs/common/fileutil"
+	"github.com/pister/yfs/common/vfs"
+	"github.com/pister/yfs/common/atomicutil"
 )
 
 const (
@@ -23,6 +24,36 @@ const (
 	dataIndexFileName   = "block_index"
 )
 
+const (
+	// the data is the content of a blob
+	dataTypeNormal = 0
+	// the data is the manifest of a chunked blob
+	dataTypeManifest = 1
+	// the data is the meta of a blob, it refers to the body
+	dataTypeMeta = 2
+	// the flag in the data type byte, the data is followed by the sumHash of every segment
+	dataTypeSegmented = 0x80
+	// the size of the segment for verifying the partial reading
+	dataSegmentSize = 64 * 1024
+)
+
+// the length of the sumHashes of the segments
+func segmentSumsLength(dataLen int64) int64 {
+	return (dataLen + dataSegmentSize - 1) / dataSegmentSize * 4
+}
+
+// the length of the whole record of the data in the data file
+func dataRecordLength(dataLen int64, dataType byte) int64 {
+	if dataType&dataTypeSegmented != 0 {
+		return dataHeaderLength + dataLen + segmentSumsLength(dataLen)
+	}
+	return dataHeaderLength + dataLen
+}
+
+func dataRecordLengthOfHeader(header []byte) int64 {
+	return dataRecordLength(int64(bytesutil.GetUint32FromBytes(header, 2)), header[7])
+}
+
 type DataIndex struct {
 	blockId  uint32
 	position uint32
@@ -49,30 +80,37 @@ func (header *dataHeader) isDeleted() bool {
 // 删除逻辑，只要data和index中其中有一个标记为deleted，就表示已经删除
 type DataBlock struct {
 	blockId   uint32
-	dataFile  *fileutil.PositionWriteFile
-	indexFile *fileutil.PositionWriteFile
+	dataFile  *fileutil.ReadWriteFile
+	indexFile *fileutil.ReadWriteFile
 	mutex     sync.Mutex
-	// mapped cache may be very big, we will use bloom-filter instead in future
-	// positionCache map[uint32]uint32 // dataPosition-> dataPosition fileChan's indexPosition
-	positionFilter bloom.Filter
+	// the max size of the data file
+	maxSize int64
+	// no data can be added, it is set when vacuuming
+	readOnly bool
+	// the bytes of the deleted data, include the headers
+	deletedBytes *atomicutil.AtomicInt64
+	// the live records, it is updated on adding and deleting
+	positions *positionBitmap
 }
 
-func processForLoadIndex(buf []byte, filter bloom.Filter, dataFile *fileutil.PositionWriteFile) error {
+// returns the deleted bytes of the data
+func processForLoadIndex(buf []byte, positions *positionBitmap, dataFile *fileutil.ReadWriteFile) (int64, error) {
 	if buf[0] != dataIndexMagicCode1 || buf[1] != dataIndexMagicCode2 {
-		return fmt.Errorf("magic not match")
+		return 0, fmt.Errorf("magic not match")
 	}
 	sumFromData := buf[3]
 	sumFromCal := hashutil.SumHash8(buf[4:8])
 	if sumFromData != sumFromCal {
-		return fmt.Errorf("hash sum not match")
+		return 0, fmt.Errorf("hash sum not match")
 	}
 	if buf[2] == dataFlagDeleted {
 		// deleted
-		return nil
+		return 0, nil
 	}
 	position := bytesutil.GetUint32FromBytes(buf, 4)
 
 	var normal = false
+	var deletedBytes int64 = 0
 	// if not delete, to find at block
 	dataFile.SeekForReading(int64(position), func(reader io.Reader) error {
 		dataBuf := make([]byte, 12)
@@ -86,64 +124,134 @@ func processForLoadIndex(buf []byte, filter bloom.Filter, dataFile *fileutil.Pos
 		}
 		if !dataHeader.isDeleted() {
 			normal = true
+		} else {
+			deletedBytes = dataRecordLengthOfHeader(dataBuf)
 		}
 		return nil
 	})
 	if normal {
-		filter.Add(buf[4:8])
+		positions.set(position, true)
 	}
-	return nil
+	return deletedBytes, nil
 }
 
-func reloadIndexCache(dataFile *fileutil.ReadWriteFile, indexFile *fileutil.ReadWriteFile) (bloom.Filter, error) {
-	filter := bloom.NewSafeBloomFilter(1024 * 100)
+func reloadIndexCache(blockId uint32, dataFile *fileutil.ReadWriteFile, indexFile *fileutil.ReadWriteFile) (*positionBitmap, int64, error) {
+	positions := newPositionBitmap()
+	var deletedBytes int64 = 0
+	broken := false
 	// load cache
-	err := indexFile.SeekForReading(0, func(reader io.Reader) error {
+	_, err := indexFile.SeekForReading(0, func(reader io.Reader) error {
 		buf := make([]byte, 8)
 		for {
-			_, err := reader.Read(buf)
+			_, err := io.ReadFull(reader, buf)
 			if err != nil {
 				if err == io.EOF {
 					return nil
+				} else if err == io.ErrUnexpectedEOF {
+					broken = true
+					return nil
 				} else {
 					return err
 				}
 			} else {
 				// process
-				err := processForLoadIndex(buf, filter, dataFile)
+				n, err := processForLoadIndex(buf, positions, dataFile)
 				if err != nil {
-					return err
+					// the broken entry is skipped
+					broken = true
+					continue
 				}
+				deletedBytes += n
 			}
 		}
 		return nil
 	})
-	return filter, err
+	if err != nil {
+		return nil, 0, err
+	}
+	if broken {
+		// the data file is the truth, the records are found from it
+		log.Info("the index of data block[%d] is broken, load the index from the data file", blockId)
+		deletedBytes = 0
+		length, err := scanDataRecords(dataFile, dataFile.GetFileLength(), func(position int64, header []byte) error {
+			if header[6] == dataFlagDeleted {
+				deletedBytes += dataRecordLengthOfHeader(header)
+			} else {
+				positions.set(uint32(position), true)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		if length < dataFile.GetFileLength() {
+			log.Info("the data of data block[%d] is broken at %d", blockId, length)
+		}
+	}
+	return positions, deletedBytes, nil
 }
 
-
+// walks the headers of the records in the length of the data file, it stops at the first invalidate header,
+// and returns the length of the records walked.
+func scanDataRecords(dataFile *fileutil.ReadWriteFile, length int64, callback func(position int64, header []byte) error) (int64, error) {
+	header := make([]byte, dataHeaderLength)
+	position := int64(0)
+	for position < length {
+		_, n, err := dataFile.SeekAndReadData(position, header)
+		if err != nil && err != io.EOF {
+			return position, err
+		}
+		if n < dataHeaderLength || header[0] != dataMagicCode0 || header[1] != dataMagicCode1 {
+			return position, nil
+		}
+		recordLen := dataRecordLengthOfHeader(header)
+		if position+recordLen > length {
+			return position, nil
+		}
+		if err := callback(position, header); err != nil {
+			return position, err
+		}
+		position += recordLen
+	}
+	return position, nil
+}
 
 func OpenDataBlock(dataDir string, blockId uint32, concurrentSize int) (*DataBlock, error) {
-	dataBlock := new(DataBlock)
-	dataBlock.blockId = blockId
+	return OpenDataBlockWithFS(vfs.Default, dataDir, blockId, concurrentSize)
+}
+
+func OpenDataBlockWithFS(fs vfs.FS, dataDir string, blockId uint32, concurrentSize int) (*DataBlock, error) {
+	dataPath, indexPath := dataBlockPaths(dataDir, blockId)
+	return openDataBlockFiles(fs, dataPath, indexPath, blockId, concurrentSize)
+}
+
+func dataBlockPaths(dataDir string, blockId uint32) (string, string) {
 	dataPath := fmt.Sprintf("%s/%s_%d", dataDir, dataBlockFileName, blockId)
 	indexPath := fmt.Sprintf("%s/%s_%d", dataDir, dataIndexFileName, blockId)
-	dataFile, err := fileutil.OpenReadWriteFile(dataPath, concurrentSize)
+	return dataPath, indexPath
+}
+
+func openDataBlockFiles(fs vfs.FS, dataPath string, indexPath string, blockId uint32, concurrentSize int) (*DataBlock, error) {
+	dataBlock := new(DataBlock)
+	dataBlock.blockId = blockId
+	dataBlock.maxSize = dataMaxBlockSize
+	dataFile, err := fileutil.OpenReadWriteFileWithFS(fs, dataPath, concurrentSize)
 	if err != nil {
 		return nil, err
 	}
-	indexFile, err := fileutil.OpenReadWriteFile(indexPath, 1)
+	indexFile, err := fileutil.OpenReadWriteFileWithFS(fs, indexPath, 1)
 	if err != nil {
 		dataFile.Close()
 		return nil, err
 	}
 	dataBlock.dataFile = dataFile
 	dataBlock.indexFile = indexFile
-	filter, err := reloadIndexCache(dataFile, indexFile)
+	positions, deletedBytes, err := reloadIndexCache(blockId, dataFile, indexFile)
 	if err != nil {
 		return nil, err
 	}
-	dataBlock.positionFilter = filter
+	dataBlock.positions = positions
+	dataBlock.deletedBytes = atomicutil.NewAtomicInt64(deletedBytes)
 	return dataBlock, nil
 }
 
@@ -153,18 +261,43 @@ func (dataBlock *DataBlock) Close() error {
 	return nil
 }
 
-func (dataBlock *DataBlock) testPositionMayExist(position uint32) bool {
-	data := bytesutil.Uint32ToBytes(position)
-	return dataBlock.positionFilter.Hit(data)
+func (dataBlock *DataBlock) testPositionExist(position uint32) bool {
+	return dataBlock.positions.get(position)
 }
 
 func (dataBlock *DataBlock) AvailableRate() float32 {
-	return (dataMaxBlockSize - float32(dataBlock.dataFile.GetFileLength())) / dataMaxBlockSize
+	return float32(dataBlock.maxSize-dataBlock.dataFile.GetFileLength()) / float32(dataBlock.maxSize)
+}
+
+// the rate of the deleted bytes in the data file
+func (dataBlock *DataBlock) DeadRate() float32 {
+	length := dataBlock.dataFile.GetFileLength()
+	if length <= 0 {
+		return 0
+	}
+	return float32(dataBlock.deletedBytes.Get()) / float32(length)
+}
+
+func (dataBlock *DataBlock) isReadOnly() bool {
+	dataBlock.mutex.Lock()
+	defer dataBlock.mutex.Unlock()
+	return dataBlock.readOnly
+}
+
+func (dataBlock *DataBlock) setReadOnly(readOnly bool) {
+	dataBlock.mutex.Lock()
+	defer dataBlock.mutex.Unlock()
+	dataBlock.readOnly = readOnly
+}
+
+// the data of the length can be added
+func (dataBlock *DataBlock) hasRoomFor(dataLen int) bool {
+	return dataRecordLength(int64(dataLen), dataTypeSegmented)+dataBlock.dataFile.GetFileLength() <= dataBlock.maxSize
 }
 
 func (dataBlock *DataBlock) isDataDeleted(position uint32) (bool, error) {
 	buf := make([]byte, 12)
-	_, err := dataBlock.dataFile.SeekAndReadData(int64(position), buf)
+	_, _, err := dataBlock.dataFile.SeekAndReadData(int64(position), buf)
 	if err != nil {
 		return false, err
 	}
@@ -174,23 +307,25 @@ func (dataBlock *DataBlock) isDataDeleted(position uint32) (bool, error) {
 	return buf[6] == dataFlagDeleted, nil
 }
 
-func (dataBlock *DataBlock) writeData(data []byte) (DataIndex, error) {
+func (dataBlock *DataBlock) writeData(data []byte, dataType byte) (DataIndex, error) {
 	dataLen := len(data)
-	fullLen := dataLen + dataHeaderLength
-	if int64(fullLen)+dataBlock.dataFile.GetFileLength() > dataMaxBlockSize {
+	dataType |= dataTypeSegmented
+	fullLen := int(dataRecordLength(int64(dataLen), dataType))
+	if int64(fullLen)+dataBlock.dataFile.GetFileLength() > dataBlock.maxSize {
 		return DataIndex{}, fmt.Errorf("not enough size for this data block[%d]", dataBlock.blockId)
 	}
 	dataSum := hashutil.SumHash32(data)
 	// =================== DATA FORMAT START ==================
-	// TOTAL 12 + len(data) bytes:
+	// TOTAL 12 + len(data) + 4 * segments bytes:
 	// 2 bytes magic code
 	// 4 bytes data len
 	// 1 bytes delete flag
-	// 1 bytes reserved
+	// 1 bytes data type
 	// 4 bytes sumHash
 	// the real data begin ...
 	// ----
 	// the real data finish ...
+	// 4 bytes sumHash of every 64K segment of the data, only if the segmented flag is in the data type
 	// =================== DATA FORMAT END  ====================
 	buf := make([]byte, fullLen)
 	// magic code
@@ -200,10 +335,19 @@ func (dataBlock *DataBlock) writeData(data []byte) (DataIndex, error) {
 	bytesutil.CopyUint32ToBytes(uint32(dataLen), buf, 2)
 	// delete flag
 	buf[6] = dataFlagNormal
-	// reserved
-	buf[7] = 0
+	// data type
+	buf[7] = dataType
 	bytesutil.CopyUint32ToBytes(dataSum, buf, 8)
 	bytesutil.CopyDataToBytes(data, 0, buf, 12, dataLen)
+	pos := dataHeaderLength + dataLen
+	for start := 0; start < dataLen; start += dataSegmentSize {
+		end := start + dataSegmentSize
+		if end > dataLen {
+			end = dataLen
+		}
+		bytesutil.CopyUint32ToBytes(hashutil.SumHash32(data[start:end]), buf, pos)
+		pos += 4
+	}
 	dataPosition, err := dataBlock.dataFile.Append(buf)
 	if err != nil {
 		return DataIndex{}, err
@@ -219,22 +363,25 @@ func (dataBlock *DataBlock) writeIndex(di DataIndex) error {
 	// 1 bytes hash-sum
 	// 4 bytes data position
 	// =================== INDEX FORMAT END   ==================
-	buf := make([]byte, 8)
-	buf[0] = dataIndexMagicCode1
-	buf[1] = dataIndexMagicCode2
-	buf[2] = dataFlagNormal
-	bytesutil.CopyUint32ToBytes(di.position, buf, 4)
-	buf[3] = hashutil.SumHash8(buf[4:8]) // hash-sum
-
-	_, err := dataBlock.indexFile.Append(buf)
+	_, err := dataBlock.indexFile.Append(encodeDataIndex(di.position))
 	if err != nil {
 		// rollback data ?
 		return err
 	}
-	dataBlock.positionFilter.Add(bytesutil.Uint32ToBytes(di.position))
+	dataBlock.positions.set(di.position, true)
 	return nil
 }
 
+func encodeDataIndex(position uint32) []byte {
+	buf := make([]byte, 8)
+	buf[0] = dataIndexMagicCode1
+	buf[1] = dataIndexMagicCode2
+	buf[2] = dataFlagNormal
+	bytesutil.CopyUint32ToBytes(position, buf, 4)
+	buf[3] = hashutil.SumHash8(buf[4:8]) // hash-sum
+	return buf
+}
+
 func (dataBlock *DataBlock) rollbackData(di DataIndex) error {
 	_, err := dataBlock.dataFile.Seek(int64(di.position))
 	if err != nil {
@@ -244,23 +391,47 @@ func (dataBlock *DataBlock) rollbackData(di DataIndex) error {
 }
 
 func (dataBlock *DataBlock) deleteData(di DataIndex) error {
-	if !dataBlock.testPositionMayExist(di.position) {
+	if !dataBlock.testPositionExist(di.position) {
 		// not exist
 		return nil
 	}
+	header := make([]byte, dataHeaderLength)
+	_, _, err := dataBlock.dataFile.SeekAndReadData(int64(di.position), header)
+	if err != nil {
+		return err
+	}
+	if header[0] != dataMagicCode0 || header[1] != dataMagicCode1 {
+		return fmt.Errorf("magic code not match")
+	}
+	if header[6] == dataFlagDeleted {
+		return nil
+	}
 	// here not update delete flag in index file, because of update index file is very slow
 	// delete data
-	return dataBlock.dataFile.UpdateByteAt(int64(di.position+6), dataFlagDeleted)
+	err = dataBlock.dataFile.UpdateByteAt(int64(di.position+6), dataFlagDeleted)
+	if err != nil {
+		return err
+	}
+	dataBlock.positions.set(di.position, false)
+	dataBlock.deletedBytes.Add(dataRecordLengthOfHeader(header))
+	return nil
 }
 
 func (dataBlock *DataBlock) Add(data []byte) (DataIndex, error) {
+	return dataBlock.addWithType(data, dataTypeNormal)
+}
+
+func (dataBlock *DataBlock) addWithType(data []byte, dataType byte) (DataIndex, error) {
 	if data == nil {
 		return DataIndex{}, fmt.Errorf("data is empty")
 	}
 	dataBlock.mutex.Lock()
 	defer dataBlock.mutex.Unlock()
 
-	di, err := dataBlock.writeData(data)
+	if dataBlock.readOnly {
+		return DataIndex{}, fmt.Errorf("data block[%d] is read only", dataBlock.blockId)
+	}
+	di, err := dataBlock.writeData(data, dataType)
 	if err != nil {
 		return di, err
 	}
@@ -269,7 +440,7 @@ func (dataBlock *DataBlock) Add(data []byte) (DataIndex, error) {
 		// rollback data
 		dataBlock.rollbackData(di)
 		// ignore result
-		return DataIndex{}, nil
+		return DataIndex{}, err
 	}
 	return di, nil
 }
@@ -278,7 +449,7 @@ func (dataBlock *DataBlock) Delete(di DataIndex) error {
 	if dataBlock.blockId != di.blockId {
 		return fmt.Errorf("blockId is not match")
 	}
-	if di.position >= dataMaxBlockSize-dataHeaderLength {
+	if int64(di.position) >= dataBlock.maxSize-dataHeaderLength {
 		return fmt.Errorf("invalidate dataPosition")
 	}
 
@@ -292,23 +463,47 @@ func (dataBlock *DataBlock) Delete(di DataIndex) error {
 	return nil
 }
 
+func (dataBlock *DataBlock) readType(di DataIndex) (byte, error) {
+	dataType, _, err := dataBlock.readTypeAndLength(di)
+	return dataType, err
+}
+
+// only the header of the data is read
+func (dataBlock *DataBlock) readTypeAndLength(di DataIndex) (byte, int64, error) {
+	header := make([]byte, dataHeaderLength)
+	_, _, err := dataBlock.dataFile.SeekAndReadData(int64(di.position), header)
+	if err != nil {
+		return 0, 0, err
+	}
+	if header[0] != dataMagicCode0 || header[1] != dataMagicCode1 {
+		return 0, 0, fmt.Errorf("magic code not match")
+	}
+	return header[7] &^ dataTypeSegmented, int64(bytesutil.GetUint32FromBytes(header, 2)), nil
+}
+
 func (dataBlock *DataBlock) Get(di DataIndex) ([]byte, error) {
-	if !dataBlock.testPositionMayExist(di.position) {
+	data, _, err := dataBlock.read(di)
+	return data, err
+}
+
+// returns the data and the type of it
+func (dataBlock *DataBlock) read(di DataIndex) ([]byte, byte, error) {
+	if !dataBlock.testPositionExist(di.position) {
 		// not exist
-		return nil, fmt.Errorf("not exist")
+		return nil, 0, fmt.Errorf("not exist")
 	}
 	if dataBlock.blockId != di.blockId {
-		return nil, fmt.Errorf("blockId is not match")
+		return nil, 0, fmt.Errorf("blockId is not match")
 	}
-	if di.position >= dataMaxBlockSize-dataHeaderLength {
-		return nil, fmt.Errorf("invalidate dataPosition")
+	if int64(di.position) >= dataBlock.maxSize-dataHeaderLength {
+		return nil, 0, fmt.Errorf("invalidate dataPosition")
 	}
 	dataBlock.mutex.Lock()
 	defer dataBlock.mutex.Unlock()
 
 	header := make([]byte, dataHeaderLength)
 	var theData []byte
-	dataBlock.dataFile.SeekForReading(int64(di.position), func(reader io.Reader) error {
+	_, err := dataBlock.dataFile.SeekForReading(int64(di.position), func(reader io.Reader) error {
 		n, err := reader.Read(header)
 		if err != nil {
 			return err
@@ -320,7 +515,7 @@ func (dataBlock *DataBlock) Get(di DataIndex) ([]byte, error) {
 			return fmt.Errorf("invalidate dataPosition by check magic code fail")
 		}
 		dataLen := bytesutil.GetUint32FromBytes(header, 2)
-		if dataLen > dataMaxBlockSize-di.position-4 {
+		if int64(dataLen) > dataBlock.maxSize-int64(di.position)-4 {
 			return fmt.Errorf("invalidate data length")
 		}
 		deleteFlag := header[6]
@@ -330,7 +525,7 @@ func (dataBlock *DataBlock) Get(di DataIndex) ([]byte, error) {
 		sumHashFromData := bytesutil.GetUint32FromBytes(header, 8)
 		// include read sum hash
 		data := make([]byte, dataLen)
-		n, err = reader.Read(data)
+		n, err = io.ReadFull(reader, data)
 		if err != nil {
 			return err
 		}
@@ -344,12 +539,117 @@ func (dataBlock *DataBlock) Get(di DataIndex) ([]byte, error) {
 		}
 		return nil
 	})
-	return theData, nil
+	if err != nil {
+		return nil, 0, err
+	}
+	return theData, header[7] &^ dataTypeSegmented, nil
+}
+
+// verifies the sumHashes of the record with the header, the index is not used,
+// so the data without index can be verified. It returns false if the data is broken.
+func (dataBlock *DataBlock) verifyRecord(position int64, header []byte) (bool, error) {
+	dataLen := int64(bytesutil.GetUint32FromBytes(header, 2))
+	record := make([]byte, dataRecordLengthOfHeader(header)-dataHeaderLength)
+	_, err := dataBlock.dataFile.SeekForReading(position+dataHeaderLength, func(reader io.Reader) error {
+		_, err := io.ReadFull(reader, record)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	if hashutil.SumHash32(record[:dataLen]) != bytesutil.GetUint32FromBytes(header, 8) {
+		return false, nil
+	}
+	if header[7]&dataTypeSegmented == 0 {
+		return true, nil
+	}
+	for start, pos := int64(0), dataLen; start < dataLen; start, pos = start+dataSegmentSize, pos+4 {
+		end := start + dataSegmentSize
+		if end > dataLen {
+			end = dataLen
+		}
+		if hashutil.SumHash32(record[start:end]) != bytesutil.GetUint32FromBytes(record, int(pos)) {
+			return false, nil
+		}
+	}
+	return true, nil
 }
 
+// the data exists and is not deleted, no file is read
 func (dataBlock *DataBlock) Exist(di DataIndex) (bool, error) {
-	dataBlock.mutex.Lock()
-	defer dataBlock.mutex.Unlock()
-	// TODO
-	return false, nil
+	if dataBlock.blockId != di.blockId {
+		return false, fmt.Errorf("blockId is not match")
+	}
+	return dataBlock.testPositionExist(di.position), nil
+}
+
+// reads the length bytes from the offset of the data, only the segments which are read are verified.
+// The returned data is shorter if it reaches the end of the data.
+func (dataBlock *DataBlock) readAt(di DataIndex, offset int64, length int) ([]byte, error) {
+	if dataBlock.blockId != di.blockId {
+		return nil, fmt.Errorf("blockId is not match")
+	}
+	header := make([]byte, dataHeaderLength)
+	_, n, err := dataBlock.dataFile.SeekAndReadData(int64(di.position), header)
+	if err != nil {
+		return nil, err
+	}
+	if n < dataHeaderLength || header[0] != dataMagicCode0 || header[1] != dataMagicCode1 {
+		return nil, fmt.Errorf("invalidate dataPosition by check magic code fail")
+	}
+	if header[6] == dataFlagDeleted {
+		return nil, fmt.Errorf("data not exist")
+	}
+	dataLen := int64(bytesutil.GetUint32FromBytes(header, 2))
+	if offset < 0 || offset > dataLen || length < 0 {
+		return nil, fmt.Errorf("invalidate range: %d, %d", offset, length)
+	}
+	if int64(length) > dataLen-offset {
+		length = int(dataLen - offset)
+	}
+	if length == 0 {
+		return []byte{}, nil
+	}
+	if header[7]&dataTypeSegmented == 0 {
+		// the old data has only one sumHash
+		data, _, err := dataBlock.read(di)
+		if err != nil {
+			return nil, err
+		}
+		return data[offset : offset+int64(length)], nil
+	}
+	firstSegment := offset / dataSegmentSize
+	lastSegment := (offset + int64(length) - 1) / dataSegmentSize
+	start := firstSegment * dataSegmentSize
+	end := (lastSegment + 1) * dataSegmentSize
+	if end > dataLen {
+		end = dataLen
+	}
+	dataPosition := int64(di.position) + dataHeaderLength
+	data := make([]byte, end-start)
+	sums := make([]byte, (lastSegment-firstSegment+1)*4)
+	_, err = dataBlock.dataFile.SeekForReading(dataPosition+start, func(reader io.Reader) error {
+		_, err := io.ReadFull(reader, data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, err = dataBlock.dataFile.SeekForReading(dataPosition+dataLen+firstSegment*4, func(reader io.Reader) error {
+		_, err := io.ReadFull(reader, sums)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i*dataSegmentSize < len(data); i++ {
+		segmentEnd := (i + 1) * dataSegmentSize
+		if segmentEnd > len(data) {
+			segmentEnd = len(data)
+		}
+		if hashutil.SumHash32(data[i*dataSegmentSize:segmentEnd]) != bytesutil.GetUint32FromBytes(sums, i*4) {
+			return nil, fmt.Errorf("check sum fail of segment %d", firstSegment+int64(i))
+		}
+	}
+	return data[offset-start : offset-start+int64(length)], nil
 }
@@ -4,6 +4,8 @@ import (
 	"testing"
 	"fmt"
 	"sync"
+	"github.com/pister/yfs/common/vfs"
+	"github.com/pister/yfs/common/fileutil"
 )
 
 func TestOpenBlockStore(t *testing.T) {
@@ -99,3 +101,51 @@ func TestBlockStore_Delete(t *testing.T) {
 	}
 	fmt.Println(data)
 }
+
+func TestDataBlockExist(t *testing.T) {
+	fs := vfs.NewMemFS()
+	if err := fileutil.MkDirsWithFS(fs, "/exist_test"); err != nil {
+		t.Fatal(err)
+	}
+	dataBlock, err := OpenDataBlockWithFS(fs, "/exist_test", 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// more than the bloom filter could hold
+	dis := make([]DataIndex, 0, 20000)
+	for i := 0; i < 20000; i++ {
+		di, err := dataBlock.Add([]byte(fmt.Sprintf("v%d", i%3)[:i%3]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dis = append(dis, di)
+	}
+	for i := 0; i < len(dis); i += 2 {
+		if err := dataBlock.Delete(dis[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func() {
+		for i, di := range dis {
+			exist, err := dataBlock.Exist(di)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if exist != (i%2 == 1) {
+				t.Fatal("exist not match", i, exist)
+			}
+		}
+		if exist, _ := dataBlock.Exist(DataIndex{blockId: 1, position: uint32(dataBlock.dataFile.GetFileLength())}); exist {
+			t.Fatal("the data after the end must not exist")
+		}
+	}
+	check()
+	dataBlock.Close()
+
+	dataBlock, err = OpenDataBlockWithFS(fs, "/exist_test", 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dataBlock.Close()
+	check()
+}
@@ -0,0 +1,194 @@
+package region
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"github.com/pister/yfs/lsm"
+	"github.com/pister/yfs/naming"
+	"github.com/pister/yfs/common/bytesutil"
+	"github.com/pister/yfs/common/fileutil"
+)
+
+// the content index of the deduplication is a lsm in the region dir, it has two kinds of keys:
+// 'h' + sha256 of the data -> 4 bytes block id + 4 bytes position of the data
+// 'r' + 4 bytes block id + 4 bytes position -> sha256 of the data + 4 bytes reference count
+const (
+	dedupDirName       = "dedup"
+	dedupHashKeyPrefix = 'h'
+	dedupRefKeyPrefix  = 'r'
+)
+
+func dedupHashKey(sum []byte) []byte {
+	key := make([]byte, 1+sha256.Size)
+	key[0] = dedupHashKeyPrefix
+	copy(key[1:], sum)
+	return key
+}
+
+func dedupRefKey(di DataIndex) []byte {
+	key := make([]byte, 9)
+	key[0] = dedupRefKeyPrefix
+	bytesutil.CopyUint32ToBytes(di.blockId, key, 1)
+	bytesutil.CopyUint32ToBytes(di.position, key, 5)
+	return key
+}
+
+func encodeDedupRef(sum []byte, count uint32) []byte {
+	value := make([]byte, sha256.Size+4)
+	copy(value, sum)
+	bytesutil.CopyUint32ToBytes(count, value, sha256.Size)
+	return value
+}
+
+func decodeDedupRef(value []byte) ([]byte, uint32, error) {
+	if len(value) != sha256.Size+4 {
+		return nil, 0, fmt.Errorf("invalidate dedup reference")
+	}
+	return value[:sha256.Size], bytesutil.GetUint32FromBytes(value, sha256.Size), nil
+}
+
+// the index is opened if the dedup is enabled or it is enabled before
+func openDedupIndex(options *Options, regionPath string) (*lsm.Lsm, error) {
+	fs := options.fs()
+	dir := filepath.Join(regionPath, dedupDirName)
+	exist, err := fileutil.PathExistsWithFS(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	if !exist && !options.Dedup {
+		return nil, nil
+	}
+	if err := fileutil.MkDirsWithFS(fs, dir); err != nil {
+		return nil, err
+	}
+	lsmOptions := lsm.DefaultOptions()
+	lsmOptions.FS = fs
+	return lsm.OpenLsmWithOptions(dir, lsmOptions)
+}
+
+// the data is stored once, it must be called with the blockLock read locked
+func (region *Region) addDedup(data []byte) (*naming.Name, error) {
+	sum := sha256.Sum256(data)
+	region.dedupMutex.Lock()
+	defer region.dedupMutex.Unlock()
+
+	value, err := region.dedupIndex.Get(dedupHashKey(sum[:]))
+	if err != nil {
+		return nil, err
+	}
+	if value != nil {
+		di := DataIndex{blockId: bytesutil.GetUint32FromBytes(value, 0), position: bytesutil.GetUint32FromBytes(value, 4)}
+		name, err := region.addReference(di)
+		if err != nil || name != nil {
+			return name, err
+		}
+	}
+	name, di, err := region.addData(data, dataTypeNormal)
+	if err != nil {
+		return nil, err
+	}
+	// the data is not shared if it crashes before indexing
+	if err := region.dedupIndex.Put(dedupRefKey(di), encodeDedupRef(sum[:], 1)); err != nil {
+		return nil, err
+	}
+	hashValue := make([]byte, 8)
+	bytesutil.CopyUint32ToBytes(di.blockId, hashValue, 0)
+	bytesutil.CopyUint32ToBytes(di.position, hashValue, 4)
+	if err := region.dedupIndex.Put(dedupHashKey(sum[:]), hashValue); err != nil {
+		return nil, err
+	}
+	return name, nil
+}
+
+// adds a name to the existing data, the name is nil if the data does not exist any more.
+// The count is increased before adding the name, so the data may be leaked but never lost if it crashes.
+func (region *Region) addReference(di DataIndex) (*naming.Name, error) {
+	refKey := dedupRefKey(di)
+	refValue, err := region.dedupIndex.Get(refKey)
+	if err != nil || refValue == nil {
+		return nil, err
+	}
+	if _, exist := region.dataBlocks.Get(di.blockId); !exist {
+		return nil, nil
+	}
+	sum, count, err := decodeDedupRef(refValue)
+	if err != nil {
+		return nil, err
+	}
+	nameBlock, err := region.getNameBlockToWrite()
+	if err != nil {
+		return nil, err
+	}
+	if err := region.dedupIndex.Put(refKey, encodeDedupRef(sum, count+1)); err != nil {
+		return nil, err
+	}
+	name, err := nameBlock.Add(di)
+	if err != nil {
+		region.dedupIndex.Put(refKey, encodeDedupRef(sum, count))
+		// ignore put error
+		return nil, err
+	}
+	return name, nil
+}
+
+// decreases the reference count of the data, it returns whether the data is still referenced by other names.
+// The data which is not in the index is not referenced.
+func (region *Region) releaseDedup(di DataIndex) (bool, error) {
+	region.dedupMutex.Lock()
+	defer region.dedupMutex.Unlock()
+
+	refKey := dedupRefKey(di)
+	refValue, err := region.dedupIndex.Get(refKey)
+	if err != nil || refValue == nil {
+		return false, err
+	}
+	sum, count, err := decodeDedupRef(refValue)
+	if err != nil {
+		return false, err
+	}
+	if count > 1 {
+		return true, region.dedupIndex.Put(refKey, encodeDedupRef(sum, count-1))
+	}
+	if err := region.dedupIndex.Delete(dedupHashKey(sum)); err != nil {
+		return false, err
+	}
+	return false, region.dedupIndex.Delete(refKey)
+}
+
+// moves the references of the vacuumed data, it can be done again after crashing
+func (region *Region) rewriteDedup(oldBlockId uint32, newBlockId uint32, positions map[uint32]uint32) error {
+	if region.dedupIndex == nil {
+		return nil
+	}
+	region.dedupMutex.Lock()
+	defer region.dedupMutex.Unlock()
+
+	for oldPosition, newPosition := range positions {
+		oldKey := dedupRefKey(DataIndex{blockId: oldBlockId, position: oldPosition})
+		refValue, err := region.dedupIndex.Get(oldKey)
+		if err != nil {
+			return err
+		}
+		if refValue == nil {
+			continue
+		}
+		sum, _, err := decodeDedupRef(refValue)
+		if err != nil {
+			return err
+		}
+		if err := region.dedupIndex.Put(dedupRefKey(DataIndex{blockId: newBlockId, position: newPosition}), refValue); err != nil {
+			return err
+		}
+		hashValue := make([]byte, 8)
+		bytesutil.CopyUint32ToBytes(newBlockId, hashValue, 0)
+		bytesutil.CopyUint32ToBytes(newPosition, hashValue, 4)
+		if err := region.dedupIndex.Put(dedupHashKey(sum), hashValue); err != nil {
+			return err
+		}
+		if err := region.dedupIndex.Delete(oldKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package region
+
+import (
+	"testing"
+	"bytes"
+	"github.com/pister/yfs/naming"
+	"github.com/pister/yfs/common/vfs"
+)
+
+func dataFilesLength(region *Region) int64 {
+	var length int64 = 0
+	region.dataBlocks.Foreach(func(key interface{}, value interface{}) (stop bool) {
+		length += value.(*DataBlock).dataFile.GetFileLength()
+		return false
+	})
+	return length
+}
+
+func TestDedup(t *testing.T) {
+	options := DefaultOptions()
+	options.FS = vfs.NewMemFS()
+	options.Dedup = true
+	region, err := OpenRegionWithOptions(1, "/dedup_test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := bytes.Repeat([]byte("image"), 1000)
+	names := make([]*naming.Name, 0)
+	for i := 0; i < 10; i++ {
+		name, err := region.Add(image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	other, err := region.Add([]byte("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if length := dataFilesLength(region); length > int64(len(image))*2 {
+		t.Fatal("the data is not deduplicated", length)
+	}
+	// the names are different, and refer to the same data
+	if names[0].String() == names[1].String() {
+		t.Fatal("the names should be different")
+	}
+	for i := 0; i < 9; i++ {
+		if err := region.Delete(names[i]); err != nil {
+			t.Fatal(err)
+		}
+		if data, _ := region.Get(names[i]); data != nil {
+			t.Fatal("the name should be deleted")
+		}
+	}
+	data, err := region.Get(names[9])
+	if err != nil || !bytes.Equal(data, image) {
+		t.Fatal("the shared data should not be deleted", err)
+	}
+	region.Close()
+
+	// the index is used after disabling the dedup
+	options.Dedup = false
+	region, err = OpenRegionWithOptions(1, "/dedup_test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extra, err := region.Add(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	region.Close()
+	options.Dedup = true
+	region, err = OpenRegionWithOptions(1, "/dedup_test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer region.Close()
+	again, err := region.Add(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the data of names[9] and again are moved by the vacuum
+	if err := region.Delete(extra); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := region.Vacuum(0.01); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []*naming.Name{names[9], again} {
+		data, err := region.Get(name)
+		if err != nil || !bytes.Equal(data, image) {
+			t.Fatal("data not match after vacuuming", err)
+		}
+	}
+	if data, err := region.Get(other); err != nil || string(data) != "other" {
+		t.Fatal("data not match after vacuuming", err)
+	}
+	if err := region.Delete(names[9]); err != nil {
+		t.Fatal(err)
+	}
+	// hit the moved data
+	another, err := region.Add(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := region.Delete(again); err != nil {
+		t.Fatal(err)
+	}
+	data, err = region.Get(another)
+	if err != nil || !bytes.Equal(data, image) {
+		t.Fatal("the shared data should not be deleted", err)
+	}
+	if err := region.Delete(another); err != nil {
+		t.Fatal(err)
+	}
+	deadBytes := int64(0)
+	region.dataBlocks.Foreach(func(key interface{}, value interface{}) (stop bool) {
+		deadBytes += value.(*DataBlock).deletedBytes.Get()
+		return false
+	})
+	if deadBytes < int64(len(image)) {
+		t.Fatal("the data should be deleted at last", deadBytes)
+	}
+}
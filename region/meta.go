@@ -0,0 +1,254 @@
+package region
+
+import (
+	"fmt"
+	"io"
+	"bytes"
+	"time"
+	"github.com/pister/yfs/naming"
+	"github.com/pister/yfs/common/bytesutil"
+)
+
+// the optional meta of a blob
+type Meta struct {
+	ContentType string
+	// the original file name
+	FileName string
+	// zero means the time of adding
+	CreateTime time.Time
+	// zero means the create time
+	ModifyTime time.Time
+	Attributes map[string]string
+}
+
+type BlobStat struct {
+	Size int64
+	// the blob is split into chunks
+	Chunked bool
+	// nil if the blob is added without meta
+	Meta *Meta
+}
+
+// the blob with meta is stored as a meta record which refers to the body by name,
+// so the body can be a chunked blob and can be moved by the vacuum.
+type blobMeta struct {
+	body *naming.Name
+	meta *Meta
+}
+
+func putString16(buf *bytes.Buffer, value string) {
+	lenBuf := make([]byte, 2)
+	bytesutil.CopyUint16ToBytes(uint16(len(value)), lenBuf, 0)
+	buf.Write(lenBuf)
+	buf.WriteString(value)
+}
+
+func (blobMeta *blobMeta) encode() []byte {
+	// =================== META FORMAT START ==================
+	// 4 bytes name block id, 4 bytes name position, 8 bytes cookie of the body
+	// 8 bytes create time, 8 bytes modify time, unix nano
+	// 2 bytes length + content type
+	// 2 bytes length + file name
+	// 2 bytes count of attributes
+	// every attribute: 2 bytes length + key, 4 bytes length + value
+	// =================== META FORMAT END  ====================
+	meta := blobMeta.meta
+	buf := new(bytes.Buffer)
+	fixed := make([]byte, 32)
+	bytesutil.CopyUint32ToBytes(blobMeta.body.NameBlockId, fixed, 0)
+	bytesutil.CopyUint32ToBytes(blobMeta.body.NamePosition, fixed, 4)
+	bytesutil.CopyUint64ToBytes(blobMeta.body.Cookie, fixed, 8)
+	bytesutil.CopyUint64ToBytes(uint64(meta.CreateTime.UnixNano()), fixed, 16)
+	bytesutil.CopyUint64ToBytes(uint64(meta.ModifyTime.UnixNano()), fixed, 24)
+	buf.Write(fixed)
+	putString16(buf, meta.ContentType)
+	putString16(buf, meta.FileName)
+	countBuf := make([]byte, 2)
+	bytesutil.CopyUint16ToBytes(uint16(len(meta.Attributes)), countBuf, 0)
+	buf.Write(countBuf)
+	for key, value := range meta.Attributes {
+		putString16(buf, key)
+		valueLenBuf := make([]byte, 4)
+		bytesutil.CopyUint32ToBytes(uint32(len(value)), valueLenBuf, 0)
+		buf.Write(valueLenBuf)
+		buf.WriteString(value)
+	}
+	return buf.Bytes()
+}
+
+type metaDecoder struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (decoder *metaDecoder) next(n int) []byte {
+	if decoder.err != nil {
+		return nil
+	}
+	if decoder.pos+n > len(decoder.data) {
+		decoder.err = fmt.Errorf("invalidate blob meta")
+		return nil
+	}
+	b := decoder.data[decoder.pos : decoder.pos+n]
+	decoder.pos += n
+	return b
+}
+
+func (decoder *metaDecoder) uint16() int {
+	b := decoder.next(2)
+	if b == nil {
+		return 0
+	}
+	return int(bytesutil.GetUint16FromBytes(b, 0))
+}
+
+func (decoder *metaDecoder) uint32() int {
+	b := decoder.next(4)
+	if b == nil {
+		return 0
+	}
+	return int(bytesutil.GetUint32FromBytes(b, 0))
+}
+
+func (decoder *metaDecoder) uint64() int64 {
+	b := decoder.next(8)
+	if b == nil {
+		return 0
+	}
+	return int64(bytesutil.GetUint64FromBytes(b, 0))
+}
+
+func decodeBlobMeta(regionId uint16, data []byte) (*blobMeta, error) {
+	decoder := &metaDecoder{data: data}
+	blobMeta := new(blobMeta)
+	blobMeta.body = new(naming.Name)
+	blobMeta.body.RegionId = regionId
+	blobMeta.body.NameBlockId = uint32(decoder.uint32())
+	blobMeta.body.NamePosition = uint32(decoder.uint32())
+	blobMeta.body.Cookie = uint64(decoder.uint64())
+	meta := new(Meta)
+	meta.CreateTime = time.Unix(0, decoder.uint64())
+	meta.ModifyTime = time.Unix(0, decoder.uint64())
+	meta.ContentType = string(decoder.next(decoder.uint16()))
+	meta.FileName = string(decoder.next(decoder.uint16()))
+	count := decoder.uint16()
+	meta.Attributes = make(map[string]string, count)
+	for i := 0; i < count; i++ {
+		key := string(decoder.next(decoder.uint16()))
+		meta.Attributes[key] = string(decoder.next(decoder.uint32()))
+	}
+	if decoder.err != nil {
+		return nil, decoder.err
+	}
+	if decoder.pos != len(data) {
+		return nil, fmt.Errorf("invalidate blob meta")
+	}
+	blobMeta.meta = meta
+	return blobMeta, nil
+}
+
+func checkMeta(meta *Meta) error {
+	if meta == nil {
+		return fmt.Errorf("meta is nil")
+	}
+	if len(meta.ContentType) > 0xffff || len(meta.FileName) > 0xffff || len(meta.Attributes) > 0xffff {
+		return fmt.Errorf("meta is too large")
+	}
+	for key := range meta.Attributes {
+		if len(key) > 0xffff {
+			return fmt.Errorf("the key of attribute is too large: %d bytes", len(key))
+		}
+	}
+	return nil
+}
+
+// AddWithMeta adds the data with the meta, the meta can be read by Stat without reading the data.
+func (region *Region) AddWithMeta(data []byte, meta *Meta) (*naming.Name, error) {
+	return region.AddReaderWithMeta(bytes.NewReader(data), int64(len(data)), meta)
+}
+
+// AddReaderWithMeta is the same as AddReader, and the meta is added with the blob.
+func (region *Region) AddReaderWithMeta(reader io.Reader, size int64, meta *Meta) (*naming.Name, error) {
+	if err := checkMeta(meta); err != nil {
+		return nil, err
+	}
+	body, err := region.AddReader(reader, size)
+	if err != nil {
+		return nil, err
+	}
+	blobMeta := new(blobMeta)
+	blobMeta.body = body
+	blobMeta.meta = new(Meta)
+	*blobMeta.meta = *meta
+	if blobMeta.meta.CreateTime.IsZero() {
+		blobMeta.meta.CreateTime = time.Now()
+	}
+	if blobMeta.meta.ModifyTime.IsZero() {
+		blobMeta.meta.ModifyTime = blobMeta.meta.CreateTime
+	}
+	region.blockLock.RLock()
+	name, err := region.add(blobMeta.encode(), dataTypeMeta)
+	region.blockLock.RUnlock()
+	if err != nil {
+		region.Delete(body)
+		// ignore delete error
+		return nil, err
+	}
+	return name, nil
+}
+
+// Stat returns the size and the meta of the blob, the data of it is not read.
+func (region *Region) Stat(name *naming.Name) (*BlobStat, error) {
+	region.blockLock.RLock()
+	defer region.blockLock.RUnlock()
+	return region.stat(name)
+}
+
+// it must be called with the blockLock read locked
+func (region *Region) stat(name *naming.Name) (*BlobStat, error) {
+	dataBlock, di, err := region.locate(name)
+	if err != nil {
+		return nil, err
+	}
+	if dataBlock == nil {
+		return nil, fmt.Errorf("blob %s not found", name.String())
+	}
+	dataType, dataLen, err := dataBlock.readTypeAndLength(di)
+	if err != nil {
+		return nil, err
+	}
+	stat := new(BlobStat)
+	switch dataType {
+	case dataTypeMeta:
+		data, err := dataBlock.Get(di)
+		if err != nil {
+			return nil, err
+		}
+		blobMeta, err := decodeBlobMeta(region.regionId, data)
+		if err != nil {
+			return nil, err
+		}
+		bodyStat, err := region.stat(blobMeta.body)
+		if err != nil {
+			return nil, err
+		}
+		stat.Size = bodyStat.Size
+		stat.Chunked = bodyStat.Chunked
+		stat.Meta = blobMeta.meta
+	case dataTypeManifest:
+		data, err := dataBlock.Get(di)
+		if err != nil {
+			return nil, err
+		}
+		manifest, err := decodeBlobManifest(region.regionId, data)
+		if err != nil {
+			return nil, err
+		}
+		stat.Size = manifest.size
+		stat.Chunked = true
+	default:
+		stat.Size = dataLen
+	}
+	return stat, nil
+}
@@ -0,0 +1,109 @@
+package region
+
+import (
+	"testing"
+	"bytes"
+	"time"
+	"io/ioutil"
+	"github.com/pister/yfs/common/vfs"
+)
+
+func TestAddWithMetaAndStat(t *testing.T) {
+	options := DefaultOptions()
+	options.FS = vfs.NewMemFS()
+	options.ChunkSize = 1000
+	region, err := OpenRegionWithOptions(1, "/meta_test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := new(Meta)
+	meta.ContentType = "image/png"
+	meta.FileName = "avatar.png"
+	meta.Attributes = map[string]string{"owner": "u1", "empty": ""}
+	name, err := region.AddWithMeta([]byte("png data"), meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := region.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size != 8 || stat.Chunked || stat.Meta == nil {
+		t.Fatal("stat not match", stat)
+	}
+	if stat.Meta.ContentType != "image/png" || stat.Meta.FileName != "avatar.png" || len(stat.Meta.Attributes) != 2 ||
+		stat.Meta.Attributes["owner"] != "u1" {
+		t.Fatal("meta not match", stat.Meta)
+	}
+	if stat.Meta.CreateTime.IsZero() || !stat.Meta.ModifyTime.Equal(stat.Meta.CreateTime) {
+		t.Fatal("time not match", stat.Meta.CreateTime, stat.Meta.ModifyTime)
+	}
+	data, err := region.Get(name)
+	if err != nil || string(data) != "png data" {
+		t.Fatal("data not match", string(data), err)
+	}
+
+	// chunked body
+	blob := bytes.Repeat([]byte("0123456789"), 500)
+	meta = new(Meta)
+	meta.FileName = "video.mp4"
+	meta.ModifyTime = time.Unix(1000, 0)
+	chunked, err := region.AddReaderWithMeta(bytes.NewReader(blob), int64(len(blob)), meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err = region.Stat(chunked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size != int64(len(blob)) || !stat.Chunked || stat.Meta.FileName != "video.mp4" || stat.Meta.ModifyTime.Unix() != 1000 {
+		t.Fatal("stat not match", stat)
+	}
+	reader, err := region.Open(chunked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = ioutil.ReadAll(reader)
+	reader.Close()
+	if !bytes.Equal(data, blob) {
+		t.Fatal("data not match")
+	}
+	data, err = region.ReadAt(chunked, 995, 10)
+	if err != nil || !bytes.Equal(data, blob[995:1005]) {
+		t.Fatal("data not match", err)
+	}
+
+	// the blob without meta
+	plain, _ := region.Add([]byte("plain"))
+	stat, err = region.Stat(plain)
+	if err != nil || stat.Size != 5 || stat.Meta != nil {
+		t.Fatal("stat not match", stat, err)
+	}
+
+	// the body is deleted with the meta
+	if err := region.Delete(chunked); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := region.Stat(chunked); err == nil {
+		t.Fatal("the blob should be deleted")
+	}
+	region.Close()
+
+	region, err = OpenRegionWithOptions(1, "/meta_test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer region.Close()
+	stat, err = region.Stat(name)
+	if err != nil || stat.Meta.FileName != "avatar.png" {
+		t.Fatal("stat not match after reopening", stat, err)
+	}
+	deadBytes := int64(0)
+	region.dataBlocks.Foreach(func(key interface{}, value interface{}) (stop bool) {
+		deadBytes += value.(*DataBlock).deletedBytes.Get()
+		return false
+	})
+	if deadBytes < int64(len(blob)) {
+		t.Fatal("the chunks are not deleted", deadBytes)
+	}
+}
@@ -7,16 +7,23 @@ import (
 	"github.com/pister/yfs/common/bytesutil"
 	"github.com/pister/yfs/common/hashutil"
 	"io"
-	"github.com/pister/yfs/common/maputil"
 	"github.com/pister/yfs/common/fileutil"
+	"github.com/pister/yfs/common/vfs"
+	"crypto/rand"
+	"bufio"
+	"io/ioutil"
 )
 
 type NameBlock struct {
-	blockId   uint32
-	regionId  uint16
-	mutex     sync.Mutex
-	file      *fileutil.ReadWriteFile
-	readCache *maputil.SafeMap // map[index]block
+	blockId  uint32
+	regionId uint16
+	mutex    sync.RWMutex
+	// the max size of the name file
+	maxSize int64
+	file    *fileutil.ReadWriteFile
+	// the legacy entries without cookie are at the head of the file,
+	// the entries are read from the file by the position, so nothing is cached.
+	legacyLength int64
 }
 
 const (
@@ -26,69 +33,232 @@ const (
 	nameFlagNormal    = 0
 	nameFlagDeleted   = 1
 	nameBlockFileName = "name_block"
+	// the legacy length of the name block is saved in this file once it is scanned
+	nameLegacyFileName = "name_legacy"
 )
 
-func initReadCache(nameBlockId uint32, file *fileutil.ReadWriteFile) (*maputil.SafeMap, error) {
-	m := maputil.NewSafeMap()
-	err := file.SeekForReading(0, func(reader io.Reader) error {
-		namePosition := 0
-		buf := make([]byte, 12)
-		for ; ; namePosition += 12 {
-			_, err := reader.Read(buf)
+// the entry with cookie
+const (
+	nameCookieMagicCode  = 'C'
+	nameCookieItemLength = 20
+)
+
+// checks the magic code and the sum of the entry, the deleted entry is never read, so it is not checked
+func checkNameEntry(entry []byte) error {
+	if entry[1] == nameFlagDeleted {
+		return nil
+	}
+	if (len(entry) == nameItemLength && entry[0] != nameMagicCode) || (len(entry) == nameCookieItemLength && entry[0] != nameCookieMagicCode) {
+		return fmt.Errorf("magic code not match")
+	}
+	if bytesutil.GetUint16FromBytes(entry, 2) != hashutil.SumHash16(entry[4:]) {
+		return fmt.Errorf("sum not match")
+	}
+	return nil
+}
+
+// the length of the legacy entries at the head of the file, only the legacy file is scanned
+// until the first entry with cookie, the new entries are never legacy.
+// The broken legacy entries are counted, so the following entries are still found.
+func scanLegacyLength(file *fileutil.ReadWriteFile) (int64, error) {
+	var legacyLength int64 = 0
+	_, err := file.SeekForReading(0, func(reader io.Reader) error {
+		buf := make([]byte, nameItemLength)
+		reader = bufio.NewReader(reader)
+		for {
+			_, err := io.ReadFull(reader, buf)
 			if err != nil {
-				if err == io.EOF {
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
 					return nil
-				} else {
-					return err
-				}
-			} else {
-				if buf[0] != nameMagicCode {
-					return fmt.Errorf("magic code not match")
-				}
-				if buf[1] == nameFlagDeleted {
-					continue
 				}
-				sumFromData := bytesutil.GetUint16FromBytes(buf, 2)
-				sumByCal := hashutil.SumHash16(buf[4:12])
-				if sumFromData != sumByCal {
-					return fmt.Errorf("sum not match")
-				}
-				blockId := bytesutil.GetUint32FromBytes(buf, 4)
-				positionId := bytesutil.GetUint32FromBytes(buf, 8)
-				cacheKey := fmt.Sprintf("%d-%d", nameBlockId, namePosition)
-				cacheValue := DataIndex{blockId: blockId, position: positionId}
-				m.Put(cacheKey, cacheValue)
+				return err
+			}
+			if buf[0] == nameCookieMagicCode {
+				return nil
 			}
+			legacyLength += nameItemLength
 		}
-		return nil
 	})
+	if err != nil {
+		return 0, err
+	}
+	return legacyLength, nil
+}
+
+// the legacy length is saved as 8 bytes length and 4 bytes sum32 of the length,
+// the broken or missing file is scanned again.
+func loadLegacyLength(fs vfs.FS, path string, file *fileutil.ReadWriteFile) (int64, error) {
+	if buf, err := readLegacyLength(fs, path); err == nil && len(buf) == 12 {
+		legacyLength := int64(bytesutil.GetUint64FromBytes(buf, 0))
+		if bytesutil.GetUint32FromBytes(buf, 8) == hashutil.SumHash32(buf[0:8]) &&
+			legacyLength%nameItemLength == 0 && legacyLength <= file.GetFileLength() {
+			return legacyLength, nil
+		}
+	}
+	legacyLength, err := scanLegacyLength(file)
+	if err != nil {
+		return 0, err
+	}
+	// the new name blocks have no legacy entries, so nothing is saved for them
+	if legacyLength == 0 {
+		return 0, nil
+	}
+	buf := make([]byte, 12)
+	bytesutil.CopyUint64ToBytes(uint64(legacyLength), buf, 0)
+	bytesutil.CopyUint32ToBytes(hashutil.SumHash32(buf[0:8]), buf, 8)
+	if err := saveLegacyLength(fs, path, buf); err != nil {
+		// it is scanned again at the next open
+		log.Info("save the legacy length of %s failed: %s", path, err)
+	}
+	return legacyLength, nil
+}
+
+func readLegacyLength(fs vfs.FS, path string) ([]byte, error) {
+	f, err := fs.Open(path)
 	if err != nil {
 		return nil, err
 	}
-	return m, err
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+func saveLegacyLength(fs vfs.FS, path string, buf []byte) error {
+	tempPath := path + "_tmp"
+	f, err := fs.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return fs.Rename(tempPath, path)
 }
 
 func OpenNameBlock(regionId uint16, dataDir string, blockId uint32, concurrentSize int) (*NameBlock, error) {
+	return OpenNameBlockWithFS(vfs.Default, regionId, dataDir, blockId, concurrentSize)
+}
+
+func OpenNameBlockWithFS(fs vfs.FS, regionId uint16, dataDir string, blockId uint32, concurrentSize int) (*NameBlock, error) {
 	nameBlock := new(NameBlock)
 	nameBlock.regionId = regionId
 	nameBlock.blockId = blockId
+	nameBlock.maxSize = nameMaxBlockSize
 	namePath := fmt.Sprintf("%s/%s_%d", dataDir, nameBlockFileName, blockId)
-	nameFile, err := fileutil.OpenReadWriteFile(namePath, concurrentSize)
+	nameFile, err := fileutil.OpenReadWriteFileWithFS(fs, namePath, concurrentSize)
 	if err != nil {
 		return nil, err
 	}
 	nameBlock.file = nameFile
-	readCache, err := initReadCache(blockId, nameBlock.file)
+	legacyLength, err := loadLegacyLength(fs, fmt.Sprintf("%s/%s_%d", dataDir, nameLegacyFileName, blockId), nameBlock.file)
 	if err != nil {
 		nameBlock.file.Close()
 		return nil, err
 	}
-	nameBlock.readCache = readCache
+	nameBlock.legacyLength = legacyLength
 	return nameBlock, nil
 }
 
+// reads the entry at the position into the buf, it returns the length of the entry,
+// or 0 if no entry starts at the position. The buf must be nameCookieItemLength bytes.
+func (nameBlock *NameBlock) readEntryAt(position int64, buf []byte) (int, error) {
+	entryLen := nameCookieItemLength
+	if position < nameBlock.legacyLength {
+		if position%nameItemLength != 0 {
+			return 0, nil
+		}
+		entryLen = nameItemLength
+	} else if (position-nameBlock.legacyLength)%nameCookieItemLength != 0 {
+		return 0, nil
+	}
+	if position+int64(entryLen) > nameBlock.file.GetFileLength() {
+		return 0, nil
+	}
+	_, err := nameBlock.file.SeekForReading(position, func(reader io.Reader) error {
+		_, err := io.ReadFull(reader, buf[:entryLen])
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := checkNameEntry(buf[:entryLen]); err != nil {
+		return 0, err
+	}
+	return entryLen, nil
+}
+
+// the length of the entry at the position
+func (nameBlock *NameBlock) entryLengthAt(position int64) int {
+	if position < nameBlock.legacyLength {
+		return nameItemLength
+	}
+	return nameCookieItemLength
+}
+
+// walks the entries between the positions, the broken entry is passed to the callback with the error of checking,
+// and the scanning goes on. The from position must be the start of an entry.
+func (nameBlock *NameBlock) scan(from int64, to int64, callback func(position int64, entry []byte, err error) error) error {
+	_, err := nameBlock.file.SeekForReading(from, func(reader io.Reader) error {
+		buf := make([]byte, nameCookieItemLength)
+		reader = bufio.NewReader(reader)
+		for position := from; ; {
+			entry := buf[:nameBlock.entryLengthAt(position)]
+			if position+int64(len(entry)) > to {
+				return nil
+			}
+			if _, err := io.ReadFull(reader, entry); err != nil {
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					return nil
+				}
+				return err
+			}
+			if err := callback(position, entry, checkNameEntry(entry)); err != nil {
+				return err
+			}
+			position += int64(len(entry))
+		}
+	})
+	return err
+}
+
+// reads the entry of the name, the entry is not exist if it is deleted or the cookie is not match
+func (nameBlock *NameBlock) readEntry(name *naming.Name) (DataIndex, bool, error) {
+	if nameBlock.blockId != name.NameBlockId {
+		return DataIndex{}, false, nil
+	}
+	buf := make([]byte, nameCookieItemLength)
+	entryLen, err := nameBlock.readEntryAt(int64(name.NamePosition), buf)
+	if err != nil || entryLen == 0 {
+		return DataIndex{}, false, err
+	}
+	if buf[1] == nameFlagDeleted {
+		return DataIndex{}, false, nil
+	}
+	var cookie uint64 = 0
+	if entryLen == nameCookieItemLength {
+		cookie = bytesutil.GetUint64FromBytes(buf, 12)
+	}
+	// the name with wrong cookie is the same as not exist
+	if cookie != name.Cookie {
+		return DataIndex{}, false, nil
+	}
+	return DataIndex{blockId: bytesutil.GetUint32FromBytes(buf, 4), position: bytesutil.GetUint32FromBytes(buf, 8)}, true, nil
+}
+
 func (nameBlock *NameBlock) AvailableRate() float32 {
-	return (nameMaxBlockSize - float32(nameBlock.file.GetFileLength())) / nameMaxBlockSize
+	return float32(nameBlock.maxSize-nameBlock.file.GetFileLength()) / float32(nameBlock.maxSize)
+}
+
+// one more name can be added
+func (nameBlock *NameBlock) hasRoom() bool {
+	return nameCookieItemLength+nameBlock.file.GetFileLength() <= nameBlock.maxSize
 }
 
 func (nameBlock *NameBlock) Close() error {
@@ -100,30 +270,39 @@ func (nameBlock *NameBlock) Add(di DataIndex) (*naming.Name, error) {
 	nameBlock.mutex.Lock()
 	defer nameBlock.mutex.Unlock()
 
-	if nameItemLength+nameBlock.file.GetFileLength() > nameMaxBlockSize {
+	if !nameBlock.hasRoom() {
 		return nil, fmt.Errorf("not enough size for this name block[%d]", nameBlock.blockId)
 	}
 
+	cookie, err := newNameCookie()
+	if err != nil {
+		return nil, err
+	}
+
 	// =================== FORMAT START ==================
-	// total 12 bytes:
+	// total 20 bytes:
 	// 1 bytes magic code
 	// 1 bytes delete flag
-	// 2 bytes sum16 of (data-region-id and data-dataPosition)
+	// 2 bytes sum16 of (data-region-id, data-dataPosition and cookie)
 	// 4 bytes data-region-id
 	// 4 bytes data-dataPosition
+	// 8 bytes cookie
+	// the legacy entry is 12 bytes without cookie, its magic code is 'N'
 	// =================== FORMAT END ====================
 
-	buf := make([]byte, nameItemLength, nameItemLength)
+	buf := make([]byte, nameCookieItemLength, nameCookieItemLength)
 	// magic code
-	buf[0] = nameMagicCode
+	buf[0] = nameCookieMagicCode
 	// delete flag
 	buf[1] = nameFlagNormal
 	// data region id
 	bytesutil.CopyUint32ToBytes(uint32(di.blockId), buf, 4)
 	// data dataPosition
 	bytesutil.CopyUint32ToBytes(uint32(di.position), buf, 8)
-	// sum16 of (data-region-id and data-dataPosition)
-	sumVal := hashutil.SumHash16(buf[4:12])
+	// cookie
+	bytesutil.CopyUint64ToBytes(cookie, buf, 12)
+	// sum16 of (data-region-id, data-dataPosition and cookie)
+	sumVal := hashutil.SumHash16(buf[4:nameCookieItemLength])
 	bytesutil.CopyUint16ToBytes(sumVal, buf, 2)
 
 	namePosition, err := nameBlock.file.Append(buf)
@@ -134,24 +313,15 @@ func (nameBlock *NameBlock) Add(di DataIndex) (*naming.Name, error) {
 	name.NameBlockId = nameBlock.blockId
 	name.NamePosition = uint32(namePosition)
 	name.RegionId = nameBlock.regionId
-
-	// for read readCache
-	cacheKey := fmt.Sprintf("%d-%d", name.NameBlockId, name.NamePosition)
-	cacheValue := di
-	nameBlock.readCache.Put(cacheKey, cacheValue)
+	name.Cookie = cookie
 	return name, nil
 }
 
 func (nameBlock *NameBlock) Get(name *naming.Name) (DataIndex, bool, error) {
-	nameBlock.mutex.Lock()
-	defer nameBlock.mutex.Unlock()
+	nameBlock.mutex.RLock()
+	defer nameBlock.mutex.RUnlock()
 
-	cacheKey := fmt.Sprintf("%d-%d", name.NameBlockId, name.NamePosition)
-	value, exist := nameBlock.readCache.Get(cacheKey)
-	if exist {
-		return value.(DataIndex), true, nil
-	}
-	return DataIndex{}, false, nil
+	return nameBlock.readEntry(name)
 }
 
 func (nameBlock *NameBlock) Delete(name *naming.Name) error {
@@ -165,15 +335,103 @@ func (nameBlock *NameBlock) Delete(name *naming.Name) error {
 	nameBlock.mutex.Lock()
 	defer nameBlock.mutex.Unlock()
 
-	if name.NamePosition >= nameMaxBlockSize-nameItemLength {
+	if int64(name.NamePosition) > nameBlock.maxSize-nameItemLength {
 		return fmt.Errorf("invalidate dataPosition")
 	}
-	err := nameBlock.file.UpdateByteAt(int64(name.NamePosition+1), nameFlagDeleted)
+	buf := make([]byte, nameCookieItemLength)
+	entryLen, err := nameBlock.readEntryAt(int64(name.NamePosition), buf)
 	if err != nil {
 		return err
 	}
-	// remove from cache
-	cacheKey := fmt.Sprintf("%d-%d", name.NameBlockId, name.NamePosition)
-	nameBlock.readCache.Delete(cacheKey)
-	return nil
+	if entryLen == 0 || buf[1] == nameFlagDeleted {
+		// deleted or never added
+		return nil
+	}
+	var cookie uint64 = 0
+	if entryLen == nameCookieItemLength {
+		cookie = bytesutil.GetUint64FromBytes(buf, 12)
+	}
+	if cookie != name.Cookie {
+		return fmt.Errorf("cookie not match")
+	}
+	return nameBlock.file.UpdateByteAt(int64(name.NamePosition+1), nameFlagDeleted)
+}
+
+// deletes the entry at the position without checking it, the broken entry can be deleted
+func (nameBlock *NameBlock) deleteAt(position int64) error {
+	nameBlock.mutex.Lock()
+	defer nameBlock.mutex.Unlock()
+	return nameBlock.file.UpdateByteAt(position+1, nameFlagDeleted)
+}
+
+// finds the positions of the names in [from, to) which point to the old positions of the data block,
+// the names are not locked, so the found ones must be checked again when rewriting.
+func (nameBlock *NameBlock) findDataIndex(oldBlockId uint32, positions map[uint32]uint32, from int64, to int64) ([]int64, error) {
+	namePositions := make([]int64, 0)
+	err := nameBlock.scan(from, to, func(position int64, entry []byte, err error) error {
+		// the broken entries are skipped
+		if err != nil || entry[1] == nameFlagDeleted {
+			return nil
+		}
+		if bytesutil.GetUint32FromBytes(entry, 4) != oldBlockId {
+			return nil
+		}
+		if _, exist := positions[bytesutil.GetUint32FromBytes(entry, 8)]; exist {
+			namePositions = append(namePositions, position)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return namePositions, nil
+}
+
+// points the names at the name positions to the new data block, the positions maps the old data positions to the new ones.
+// It returns the count of the rewritten names, the names which are deleted or not in the positions now are not changed.
+func (nameBlock *NameBlock) rewriteDataIndex(oldBlockId uint32, newBlockId uint32, positions map[uint32]uint32, namePositions []int64) (int, error) {
+	nameBlock.mutex.Lock()
+	defer nameBlock.mutex.Unlock()
+
+	count := 0
+	buf := make([]byte, nameCookieItemLength)
+	for _, namePosition := range namePositions {
+		entryLen, err := nameBlock.readEntryAt(namePosition, buf)
+		if err != nil {
+			return count, err
+		}
+		if entryLen == 0 {
+			return count, fmt.Errorf("name entry at %d not found", namePosition)
+		}
+		if buf[1] == nameFlagDeleted || bytesutil.GetUint32FromBytes(buf, 4) != oldBlockId {
+			continue
+		}
+		newPosition, exist := positions[bytesutil.GetUint32FromBytes(buf, 8)]
+		if !exist {
+			continue
+		}
+		bytesutil.CopyUint32ToBytes(newBlockId, buf, 4)
+		bytesutil.CopyUint32ToBytes(newPosition, buf, 8)
+		bytesutil.CopyUint16ToBytes(hashutil.SumHash16(buf[4:entryLen]), buf, 2)
+		// the magic code, the delete flag and the cookie are not changed
+		err = nameBlock.file.UpdateAt(namePosition+2, buf[2:nameItemLength])
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// the cookie is never 0, which means the legacy entry
+func newNameCookie() (uint64, error) {
+	buf := make([]byte, 8)
+	for {
+		if _, err := rand.Read(buf); err != nil {
+			return 0, err
+		}
+		if cookie := bytesutil.GetUint64FromBytes(buf, 0); cookie != 0 {
+			return cookie, nil
+		}
+	}
 }
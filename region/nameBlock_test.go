@@ -4,6 +4,10 @@ import (
 	"testing"
 	"fmt"
 	"github.com/pister/yfs/naming"
+	"github.com/pister/yfs/common/vfs"
+	"github.com/pister/yfs/common/bytesutil"
+	"github.com/pister/yfs/common/hashutil"
+	"github.com/pister/yfs/common/fileutil"
 )
 
 func TestNameBlock1(t *testing.T) {
@@ -46,4 +50,153 @@ func TestOpenNameBlock(t *testing.T) {
 		t.Fatal("must be exists!")
 	}
 	fmt.Println(di)
-}
\ No newline at end of file
+}
+func TestNameBlockCookie(t *testing.T) {
+	fs := vfs.NewMemFS()
+	if err := fileutil.MkDirsWithFS(fs, "/name_cookie_test"); err != nil {
+		t.Fatal(err)
+	}
+	nameBlock, err := OpenNameBlockWithFS(fs, 1, "/name_cookie_test", 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the legacy entry without cookie
+	buf := make([]byte, nameItemLength)
+	buf[0] = nameMagicCode
+	buf[1] = nameFlagNormal
+	bytesutil.CopyUint32ToBytes(1, buf, 4)
+	bytesutil.CopyUint32ToBytes(100, buf, 8)
+	bytesutil.CopyUint16ToBytes(hashutil.SumHash16(buf[4:12]), buf, 2)
+	legacyPosition, err := nameBlock.file.Append(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, err := nameBlock.Add(DataIndex{1, 211})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name.Cookie == 0 {
+		t.Fatal("the name must have a cookie")
+	}
+	nameBlock.Close()
+
+	nameBlock, err = OpenNameBlockWithFS(fs, 1, "/name_cookie_test", 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nameBlock.Close()
+	parsed, err := naming.ParseNameFromString(name.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	di, exist, err := nameBlock.Get(parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exist || di.position != 211 {
+		t.Fatal("the name with cookie must be exists", di)
+	}
+	legacy := &naming.Name{RegionId: 1, NameBlockId: 1, NamePosition: uint32(legacyPosition)}
+	di, exist, err = nameBlock.Get(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exist || di.position != 100 {
+		t.Fatal("the legacy name must be exists", di)
+	}
+	// the legacy length is saved, and it is not scanned at the next open
+	if exist, _ := fileutil.PathExistsWithFS(fs, "/name_cookie_test/name_legacy_1"); !exist {
+		t.Fatal("the legacy length must be saved")
+	}
+	reopened, err := OpenNameBlockWithFS(fs, 1, "/name_cookie_test", 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if reopened.legacyLength != nameItemLength {
+		t.Fatal("the legacy length must be loaded", reopened.legacyLength)
+	}
+	di, exist, err = reopened.Get(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exist || di.position != 100 {
+		t.Fatal("the legacy name must be exists", di)
+	}
+	// the guessed names
+	guessed := *name
+	guessed.Cookie++
+	if _, exist, _ := nameBlock.Get(&guessed); exist {
+		t.Fatal("the name with wrong cookie must not be exists")
+	}
+	guessed.Cookie = 0
+	if _, exist, _ := nameBlock.Get(&guessed); exist {
+		t.Fatal("the name without cookie must not be exists")
+	}
+	if err := nameBlock.Delete(&guessed); err == nil {
+		t.Fatal("the name with wrong cookie must not be deleted")
+	}
+	if err := nameBlock.Delete(name); err != nil {
+		t.Fatal(err)
+	}
+	if _, exist, _ := nameBlock.Get(name); exist {
+		t.Fatal("the name must be deleted")
+	}
+}
+
+func TestNameBlockReadThrough(t *testing.T) {
+	fs := vfs.NewMemFS()
+	if err := fileutil.MkDirsWithFS(fs, "/name_read_test"); err != nil {
+		t.Fatal(err)
+	}
+	nameBlock, err := OpenNameBlockWithFS(fs, 1, "/name_read_test", 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]*naming.Name, 0, 100)
+	for i := 0; i < 100; i++ {
+		name, err := nameBlock.Add(DataIndex{3, uint32(i * 10)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	for i := 0; i < 100; i += 3 {
+		if err := nameBlock.Delete(names[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nameBlock.Close()
+
+	nameBlock, err = OpenNameBlockWithFS(fs, 1, "/name_read_test", 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nameBlock.Close()
+	for i, name := range names {
+		di, exist, err := nameBlock.Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exist != (i%3 != 0) {
+			t.Fatal("the name exists not match", i, exist)
+		}
+		if exist && (di.blockId != 3 || di.position != uint32(i*10)) {
+			t.Fatal("the data index not match", i, di)
+		}
+	}
+	// no entry starts at the positions
+	for _, position := range []uint32{4, 12, 21, 2000, 1 << 30} {
+		name := *names[1]
+		name.NamePosition = position
+		if _, exist, err := nameBlock.Get(&name); exist || err != nil {
+			t.Fatal("the entry must not exist", position, err)
+		}
+	}
+	// the name of other block
+	name := *names[1]
+	name.NameBlockId = 1
+	if _, exist, _ := nameBlock.Get(&name); exist {
+		t.Fatal("the name of other block must not exist")
+	}
+}
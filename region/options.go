@@ -0,0 +1,75 @@
+package region
+
+import (
+	"github.com/pister/yfs/common/vfs"
+	"github.com/pister/yfs/common/ratelimit"
+)
+
+const (
+	defaultMaxDataBlocks = 256
+	defaultMaxNameBlocks = 64
+	defaultChunkSize     = 4 * 1024 * 1024
+)
+
+type Options struct {
+	// the max count of data blocks, the region is full when all of them are full
+	MaxDataBlocks int
+	// the max count of name blocks
+	MaxNameBlocks int
+	// the max size of a data block file, 0 means 128M, not greater than math.MaxUint32. It must not be decreased for an existing region.
+	DataBlockSize int64
+	// the max size of a name block file, 0 means 24M, not greater than math.MaxUint32. It must not be decreased for an existing region.
+	NameBlockSize int64
+	// the blobs added by AddReader are split into chunks of the size, 0 means 4M.
+	// It is not bigger than the data block.
+	ChunkSize int
+	// the same data added by Add and AddReader is stored once, the names refer to it with a reference count.
+	// The content index is kept after disabling it, so the shared data is still deleted correctly.
+	Dedup bool
+	// nil means vfs.Default
+	FS vfs.FS
+	// it limits the reading of vacuum, nil means no limit
+	VacuumRateLimiter *ratelimit.RateLimiter
+	// it is called during vacuuming a data block, and once more when it is finished
+	VacuumProgress func(progress VacuumProgress)
+}
+
+func DefaultOptions() *Options {
+	options := new(Options)
+	options.MaxDataBlocks = defaultMaxDataBlocks
+	options.MaxNameBlocks = defaultMaxNameBlocks
+	return options
+}
+
+func (options *Options) fs() vfs.FS {
+	if options.FS == nil {
+		return vfs.Default
+	}
+	return options.FS
+}
+
+func (options *Options) dataBlockSize() int64 {
+	if options.DataBlockSize <= 0 {
+		return dataMaxBlockSize
+	}
+	return options.DataBlockSize
+}
+
+func (options *Options) nameBlockSize() int64 {
+	if options.NameBlockSize <= 0 {
+		return nameMaxBlockSize
+	}
+	return options.NameBlockSize
+}
+
+func (options *Options) chunkSize() int {
+	chunkSize := options.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+	blockSize := options.dataBlockSize()
+	if maxChunkSize := blockSize - dataHeaderLength - segmentSumsLength(blockSize); int64(chunkSize) > maxChunkSize {
+		chunkSize = int(maxChunkSize)
+	}
+	return chunkSize
+}
@@ -0,0 +1,48 @@
+package region
+
+import (
+	"sync"
+	"github.com/pister/yfs/common/bitset"
+)
+
+const positionBitmapInitSlots = 1024
+
+// the positions of the live records in a data file. A record is at least dataHeaderLength bytes,
+// so at most one record starts in every slot of dataHeaderLength bytes, and a bit of the slot is enough.
+// It grows with the data file, about 1 bit for 12 bytes of the data.
+type positionBitmap struct {
+	mutex sync.RWMutex
+	bits  *bitset.BitSet
+}
+
+func newPositionBitmap() *positionBitmap {
+	bitmap := new(positionBitmap)
+	bitmap.bits = bitset.NewBitSet(positionBitmapInitSlots)
+	return bitmap
+}
+
+func (bitmap *positionBitmap) set(position uint32, live bool) {
+	slot := position / dataHeaderLength
+	bitmap.mutex.Lock()
+	defer bitmap.mutex.Unlock()
+	if slot >= bitmap.bits.Length() {
+		if !live {
+			return
+		}
+		length := bitmap.bits.Length() * 2
+		if length <= slot {
+			length = slot + 1
+		}
+		data := make([]byte, (length+7)/8)
+		copy(data, bitmap.bits.GetRawData())
+		bitmap.bits = bitset.NewBitSetWithInitData(length, data)
+	}
+	bitmap.bits.Set(slot, live)
+}
+
+// the record at the position is live, the position must be the start of a record, as the ones in the names
+func (bitmap *positionBitmap) get(position uint32) bool {
+	bitmap.mutex.RLock()
+	defer bitmap.mutex.RUnlock()
+	return bitmap.bits.Get(position / dataHeaderLength)
+}
@@ -5,13 +5,18 @@ import (
 	"fmt"
 	"github.com/pister/yfs/common/fileutil"
 	"path/filepath"
-	"os"
-	"path"
 	"regexp"
 	"strings"
 	"strconv"
 	"math/rand"
 	"github.com/pister/yfs/common/maputil"
+	"github.com/pister/yfs/common/vfs"
+	lg "github.com/pister/yfs/log"
+	"github.com/pister/yfs/common/lockutil"
+	"sync"
+	"github.com/pister/yfs/lsm"
+	"io"
+	"math"
 )
 
 const (
@@ -23,93 +28,194 @@ const (
 	regionNameMayGrowThresholdForGroup = 0.2
 )
 
+// the region dir is locked while the region is opened
+const regionLockFileName = "region_lock"
+
+var log lg.Logger
+
+func init() {
+	l, err := lg.NewLogger("region")
+	if err != nil {
+		panic(err)
+	}
+	log = l
+}
+
 type Region struct {
+	fs         vfs.FS
+	options    *Options
 	regionId   uint16
 	rootPath   string
 	regionPath string
 
 	nameBlocks *maputil.SafeMap // map[index-block-id]*
 	dataBlocks *maputil.SafeMap // map[data-block-id]*
+
+	// held while adding new blocks
+	dataGrowLocker  lockutil.TryLocker
+	nameGrowLocker  lockutil.TryLocker
+	nextDataBlockId uint32
+	nextNameBlockId uint32
+	// Add, Get and Delete hold the read lock, the vacuum holds the write lock when switching the data blocks
+	blockLock sync.RWMutex
+	// only one vacuum runs at the same time
+	vacuumMutex sync.Mutex
+	// the content index for the deduplication, nil if it is never enabled
+	dedupIndex *lsm.Lsm
+	dedupMutex sync.Mutex
+	dirLocker  io.Closer
 }
 
 func OpenRegion(regionId uint16, path string) (*Region, error) {
-	err := fileutil.MkDirs(path)
+	return OpenRegionWithOptions(regionId, path, DefaultOptions())
+}
+
+func OpenRegionWithFS(fs vfs.FS, regionId uint16, path string) (*Region, error) {
+	options := DefaultOptions()
+	options.FS = fs
+	return OpenRegionWithOptions(regionId, path, options)
+}
+
+func OpenRegionWithOptions(regionId uint16, path string, options *Options) (*Region, error) {
+	if options.MaxDataBlocks <= 0 || options.MaxNameBlocks <= 0 {
+		return nil, fmt.Errorf("the max data blocks and max name blocks must be positive")
+	}
+	// the positions in the blocks are uint32
+	if options.DataBlockSize > math.MaxUint32 || options.NameBlockSize > math.MaxUint32 {
+		return nil, fmt.Errorf("the data block size and name block size must not be greater than %d", uint32(math.MaxUint32))
+	}
+	fs := options.fs()
+	err := fileutil.MkDirsWithFS(fs, path)
 	if err != nil {
 		return nil, err
 	}
 	regionPath := fmt.Sprintf("%s%cregion-%d", path, filepath.Separator, regionId)
-	err = fileutil.MkDirs(regionPath)
+	err = fileutil.MkDirsWithFS(fs, regionPath)
+	if err != nil {
+		return nil, err
+	}
+	dirLocker, err := fs.Lock(filepath.Join(regionPath, regionLockFileName))
 	if err != nil {
 		return nil, err
 	}
 
-	dataBlocks, err := initDataBlocks(regionPath)
+	dataBlocks, err := initDataBlocks(options, regionPath)
 	if err != nil {
+		dirLocker.Close()
 		return nil, err
 	}
-	nameBlocks, err := initNameBlocks(regionId, regionPath)
+	nameBlocks, err := initNameBlocks(options, regionId, regionPath)
 	if err != nil {
-		dataBlocks.Foreach(func(key interface{}, value interface{}) (stop bool) {
-			value.(*NameBlock).Close()
-			return false
-		})
+		closeDataBlocks(dataBlocks)
+		dirLocker.Close()
 		return nil, err
 	}
 
 	region := new(Region)
+	region.fs = fs
+	region.options = options
 	region.rootPath = path
 	region.regionPath = regionPath
 	region.regionId = regionId
+	region.dirLocker = dirLocker
 
 	region.dataBlocks = dataBlocks
 	region.nameBlocks = nameBlocks
+	region.dataGrowLocker = lockutil.NewTryLocker()
+	region.nameGrowLocker = lockutil.NewTryLocker()
+	dedupIndex, err := openDedupIndex(options, regionPath)
+	if err != nil {
+		region.Close()
+		return nil, err
+	}
+	region.dedupIndex = dedupIndex
+	if err := region.recoverVacuum(); err != nil {
+		region.Close()
+		return nil, err
+	}
+	region.nextDataBlockId = nextBlockId(region.dataBlocks)
+	region.nextNameBlockId = nextBlockId(nameBlocks)
 
+	// create init blocks
+	if dataBlocks.Length() <= 0 {
+		if _, err := region.addDataBlocks(regionDataGrowSize); err != nil {
+			region.Close()
+			return nil, err
+		}
+	}
+	if nameBlocks.Length() <= 0 {
+		if _, err := region.addNameBlocks(regionNameGrowSize); err != nil {
+			region.Close()
+			return nil, err
+		}
+	}
 	return region, nil
 }
 
-func initNameBlocks(regionId uint16, regionPath string) (*maputil.SafeMap, error) {
+func nextBlockId(blocks *maputil.SafeMap) uint32 {
+	var next uint32 = 0
+	blocks.Foreach(func(key interface{}, value interface{}) (stop bool) {
+		if blockId := key.(uint32); blockId >= next {
+			next = blockId + 1
+		}
+		return false
+	})
+	return next
+}
+
+func closeDataBlocks(dataBlocks *maputil.SafeMap) {
+	dataBlocks.Foreach(func(key interface{}, value interface{}) (stop bool) {
+		value.(*DataBlock).Close()
+		return false
+	})
+}
+
+func closeNameBlocks(nameBlocks *maputil.SafeMap) {
+	nameBlocks.Foreach(func(key interface{}, value interface{}) (stop bool) {
+		value.(*NameBlock).Close()
+		return false
+	})
+}
+
+func initNameBlocks(options *Options, regionId uint16, regionPath string) (*maputil.SafeMap, error) {
+	fs := options.fs()
 	nameBlocNamePattern, err := regexp.Compile(`name_block_\d+`)
 	if err != nil {
 		return nil, err
 	}
+	names, err := fs.List(regionPath)
+	if err != nil {
+		return nil, err
+	}
 	nameBlockFiles := maputil.NewSafeMap()
-	err = filepath.Walk(regionPath, func(file string, info os.FileInfo, err error) error {
-		_, name := path.Split(file)
-		if nameBlocNamePattern.MatchString(name) {
+	err = func() error {
+		for _, name := range names {
+			if !nameBlocNamePattern.MatchString(name) {
+				continue
+			}
 			post := strings.LastIndex(name, "_")
 			blockId, err := strconv.Atoi(name[post+1:])
 			if err != nil {
 				return err
 			}
-			nameBlockFile, err := OpenNameBlock(regionId, regionPath, uint32(blockId), regionNameBlockConcurrentReadSize)
+			nameBlockFile, err := OpenNameBlockWithFS(fs, regionId, regionPath, uint32(blockId), regionNameBlockConcurrentReadSize)
 			if err != nil {
 				return err
 			}
+			nameBlockFile.maxSize = options.nameBlockSize()
 			nameBlockFiles.Put(uint32(blockId), nameBlockFile)
 		}
 		return nil
-	})
+	}()
 	if err != nil {
-		nameBlockFiles.Foreach(func(key interface{}, value interface{}) (stop bool) {
-			value.(*NameBlock).Close()
-			return false
-		})
+		closeNameBlocks(nameBlockFiles)
 		return nil, err
 	}
-	if nameBlockFiles.Length() <= 0 {
-		// create init data
-		for blockId := 0; blockId < regionNameGrowSize; blockId++ {
-			nameBlock, err := OpenNameBlock(regionId, regionPath, uint32(blockId), regionDataBlockConcurrentReadSize)
-			if err != nil {
-				return nil, err
-			}
-			nameBlockFiles.Put(blockId, nameBlock)
-		}
-	}
 	return nameBlockFiles, nil
 }
 
-func initDataBlocks(regionPath string) (*maputil.SafeMap, error) {
+func initDataBlocks(options *Options, regionPath string) (*maputil.SafeMap, error) {
+	fs := options.fs()
 	blockDataNamePattern, err := regexp.Compile(`block_data_\d+`)
 	if err != nil {
 		return nil, err
@@ -118,29 +224,28 @@ func initDataBlocks(regionPath string) (*maputil.SafeMap, error) {
 	if err != nil {
 		return nil, err
 	}
+	names, err := fs.List(regionPath)
+	if err != nil {
+		return nil, err
+	}
 	blockDataNames := make(map[uint32]string)
 	blockIndexNames := make(map[uint32]string)
-	err = filepath.Walk(regionPath, func(file string, info os.FileInfo, err error) error {
-		_, name := path.Split(file)
+	for _, name := range names {
 		if blockDataNamePattern.MatchString(name) {
 			post := strings.LastIndex(name, "_")
 			blockId, err := strconv.Atoi(name[post+1:])
 			if err != nil {
-				return err
+				return nil, err
 			}
-			blockDataNames[uint32(blockId)] = file
+			blockDataNames[uint32(blockId)] = filepath.Join(regionPath, name)
 		} else if blockIndexNamePattern.MatchString(name) {
 			post := strings.LastIndex(name, "_")
 			blockId, err := strconv.Atoi(name[post+1:])
 			if err != nil {
-				return err
+				return nil, err
 			}
-			blockIndexNames[uint32(blockId)] = file
+			blockIndexNames[uint32(blockId)] = filepath.Join(regionPath, name)
 		}
-		return nil
-	})
-	if err != nil {
-		return nil, err
 	}
 	dataBlocks := maputil.NewSafeMap()
 	for blockId := range blockDataNames {
@@ -148,123 +253,340 @@ func initDataBlocks(regionPath string) (*maputil.SafeMap, error) {
 		if !exist {
 			continue
 		}
-		bs, err := OpenDataBlock(regionPath, blockId, regionDataBlockConcurrentReadSize)
+		bs, err := OpenDataBlockWithFS(fs, regionPath, blockId, regionDataBlockConcurrentReadSize)
 		if err != nil {
+			closeDataBlocks(dataBlocks)
 			return nil, err
 		}
+		bs.maxSize = options.dataBlockSize()
 		dataBlocks.Put(blockId, bs)
 	}
-	if dataBlocks.Length() <= 0 {
-		// create init data
-		for blockId := 0; blockId < regionDataGrowSize; blockId++ {
-			dataBlock, err := OpenDataBlock(regionPath, uint32(blockId), regionDataBlockConcurrentReadSize)
-			if err != nil {
-				return nil, err
-			}
-			dataBlocks.Put(blockId, dataBlock)
+	return dataBlocks, nil
+}
+
+// adds count new data blocks and returns the last one, it must be called with the dataGrowLocker held.
+// it stops adding when the region reaches the max data blocks, and fails if no block is added.
+func (region *Region) addDataBlocks(count int) (*DataBlock, error) {
+	var last *DataBlock
+	for i := 0; i < count; i++ {
+		if region.dataBlocks.Length() >= region.options.MaxDataBlocks {
+			break
+		}
+		blockId := region.nextDataBlockId
+		dataBlock, err := OpenDataBlockWithFS(region.fs, region.regionPath, blockId, regionDataBlockConcurrentReadSize)
+		if err != nil {
+			return last, fmt.Errorf("create data block[%d] of region[%d] failed: %s", blockId, region.regionId, err)
 		}
+		dataBlock.maxSize = region.options.dataBlockSize()
+		region.dataBlocks.Put(blockId, dataBlock)
+		region.nextDataBlockId = blockId + 1
+		last = dataBlock
+		log.Info("region[%d] data block[%d] created", region.regionId, blockId)
 	}
-	return dataBlocks, nil
+	if last == nil {
+		return nil, fmt.Errorf("region[%d] is full, all of the %d data blocks are used", region.regionId, region.options.MaxDataBlocks)
+	}
+	return last, nil
 }
 
+// adds count new name blocks and returns the last one, it must be called with the nameGrowLocker held.
+func (region *Region) addNameBlocks(count int) (*NameBlock, error) {
+	var last *NameBlock
+	for i := 0; i < count; i++ {
+		if region.nameBlocks.Length() >= region.options.MaxNameBlocks {
+			break
+		}
+		blockId := region.nextNameBlockId
+		nameBlock, err := OpenNameBlockWithFS(region.fs, region.regionId, region.regionPath, blockId, regionNameBlockConcurrentReadSize)
+		if err != nil {
+			return last, fmt.Errorf("create name block[%d] of region[%d] failed: %s", blockId, region.regionId, err)
+		}
+		nameBlock.maxSize = region.options.nameBlockSize()
+		region.nameBlocks.Put(blockId, nameBlock)
+		region.nextNameBlockId = blockId + 1
+		last = nameBlock
+		log.Info("region[%d] name block[%d] created", region.regionId, blockId)
+	}
+	if last == nil {
+		return nil, fmt.Errorf("region[%d] is full, all of the %d name blocks are used", region.regionId, region.options.MaxNameBlocks)
+	}
+	return last, nil
+}
+
+// grows the data blocks in background, it does nothing if a growing is running or the region reaches the max.
 func (region *Region) growUpDataBlock() {
-	// TODO
-	// async task
+	if region.dataBlocks.Length() >= region.options.MaxDataBlocks {
+		return
+	}
+	if !region.dataGrowLocker.TryLock() {
+		return
+	}
+	go func() {
+		defer region.dataGrowLocker.Unlock()
+		if _, err := region.addDataBlocks(regionDataGrowSize); err != nil {
+			log.Info("grow up data blocks of region[%d] failed: %s", region.regionId, err)
+		}
+	}()
 }
 
 func (region *Region) growUpNameBlock() {
-	// TODO
-	// async task
+	if region.nameBlocks.Length() >= region.options.MaxNameBlocks {
+		return
+	}
+	if !region.nameGrowLocker.TryLock() {
+		return
+	}
+	go func() {
+		defer region.nameGrowLocker.Unlock()
+		if _, err := region.addNameBlocks(regionNameGrowSize); err != nil {
+			log.Info("grow up name blocks of region[%d] failed: %s", region.regionId, err)
+		}
+	}()
 }
 
-func (region *Region) getNameBlockToWrite() *NameBlock {
+// returns the best and the other name blocks which have room
+func (region *Region) nameBlocksToWrite() ([]*NameBlock, []*NameBlock) {
 	bestAvailableBlocks := make([]*NameBlock, 0, 2)
+	fitBlocks := make([]*NameBlock, 0, 2)
 	region.nameBlocks.Foreach(func(key interface{}, value interface{}) (stop bool) {
 		nameBlock := value.(*NameBlock)
+		if !nameBlock.hasRoom() {
+			return false
+		}
 		if nameBlock.AvailableRate() > regionNameMayGrowThresholdForGroup {
 			bestAvailableBlocks = append(bestAvailableBlocks, nameBlock)
+		} else {
+			fitBlocks = append(fitBlocks, nameBlock)
 		}
 		return false
 	})
+	return bestAvailableBlocks, fitBlocks
+}
+
+func (region *Region) getNameBlockToWrite() (*NameBlock, error) {
+	bestAvailableBlocks, fitBlocks := region.nameBlocksToWrite()
 	if len(bestAvailableBlocks) < regionNameGrowSize {
-		// grow up
+		// grow up before all blocks are full
 		region.growUpNameBlock()
 	}
-	nLen := int32(len(bestAvailableBlocks))
-	return bestAvailableBlocks[rand.Int31n(nLen)]
+	if len(bestAvailableBlocks) > 0 {
+		return bestAvailableBlocks[rand.Intn(len(bestAvailableBlocks))], nil
+	}
+	if len(fitBlocks) > 0 {
+		return fitBlocks[rand.Intn(len(fitBlocks))], nil
+	}
+	// all blocks are full, wait for the growing
+	region.nameGrowLocker.Lock()
+	defer region.nameGrowLocker.Unlock()
+	bestAvailableBlocks, fitBlocks = region.nameBlocksToWrite()
+	if len(bestAvailableBlocks) > 0 {
+		return bestAvailableBlocks[rand.Intn(len(bestAvailableBlocks))], nil
+	}
+	if len(fitBlocks) > 0 {
+		return fitBlocks[rand.Intn(len(fitBlocks))], nil
+	}
+	return region.addNameBlocks(1)
 }
 
-func (region *Region) getDataBlockToWrite(data []byte) (*DataBlock) {
+// returns the best and the other data blocks which have room for the data
+func (region *Region) dataBlocksToWrite(data []byte) ([]*DataBlock, []*DataBlock) {
 	bestAvailableBlocks := make([]*DataBlock, 0, 4)
+	fitBlocks := make([]*DataBlock, 0, 4)
 	region.dataBlocks.Foreach(func(key interface{}, value interface{}) (stop bool) {
 		dataBlock := value.(*DataBlock)
+		if dataBlock.isReadOnly() || !dataBlock.hasRoomFor(len(data)) {
+			return false
+		}
 		if dataBlock.AvailableRate() > regionDataMayGrowThresholdForGroup {
 			bestAvailableBlocks = append(bestAvailableBlocks, dataBlock)
+		} else {
+			fitBlocks = append(fitBlocks, dataBlock)
 		}
 		return false
 	})
+	return bestAvailableBlocks, fitBlocks
+}
 
+func (region *Region) getDataBlockToWrite(data []byte) (*DataBlock, error) {
+	if dataRecordLength(int64(len(data)), dataTypeSegmented) > region.options.dataBlockSize() {
+		return nil, fmt.Errorf("the data is too large: %d bytes", len(data))
+	}
+	bestAvailableBlocks, fitBlocks := region.dataBlocksToWrite(data)
 	if len(bestAvailableBlocks) < regionDataGrowSize {
-		// grow up
+		// grow up before all blocks are full
 		region.growUpDataBlock()
 	}
-	nLen := int32(len(bestAvailableBlocks))
-	dataBlock := bestAvailableBlocks[rand.Int31n(nLen)]
-	return dataBlock
+	if len(bestAvailableBlocks) > 0 {
+		return bestAvailableBlocks[rand.Intn(len(bestAvailableBlocks))], nil
+	}
+	if len(fitBlocks) > 0 {
+		return fitBlocks[rand.Intn(len(fitBlocks))], nil
+	}
+	// all blocks are full, wait for the growing
+	region.dataGrowLocker.Lock()
+	defer region.dataGrowLocker.Unlock()
+	bestAvailableBlocks, fitBlocks = region.dataBlocksToWrite(data)
+	if len(bestAvailableBlocks) > 0 {
+		return bestAvailableBlocks[rand.Intn(len(bestAvailableBlocks))], nil
+	}
+	if len(fitBlocks) > 0 {
+		return fitBlocks[rand.Intn(len(fitBlocks))], nil
+	}
+	return region.addDataBlocks(1)
 }
 
 func (region *Region) Close() error {
-	defer func() {
-		region.dataBlocks.Foreach(func(key interface{}, value interface{}) (stop bool) {
-			value.(*DataBlock).Close()
-			return false
-		})
-	}()
-	defer func() {
-		region.nameBlocks.Foreach(func(key interface{}, value interface{}) (stop bool) {
-			value.(*NameBlock).Close()
-			return false
-		})
-	}()
-	return nil
+	// wait for the vacuum and the growing
+	region.vacuumMutex.Lock()
+	defer region.vacuumMutex.Unlock()
+	region.dataGrowLocker.Lock()
+	defer region.dataGrowLocker.Unlock()
+	region.nameGrowLocker.Lock()
+	defer region.nameGrowLocker.Unlock()
+	closeDataBlocks(region.dataBlocks)
+	closeNameBlocks(region.nameBlocks)
+	var err error
+	if region.dedupIndex != nil {
+		err = region.dedupIndex.Close()
+	}
+	region.dirLocker.Close()
+	return err
 }
 
 func (region *Region) Add(data []byte) (*naming.Name, error) {
-	dataBlock := region.getDataBlockToWrite(data)
-	nameBlock := region.getNameBlockToWrite()
-	di, err := dataBlock.Add(data)
+	region.blockLock.RLock()
+	defer region.blockLock.RUnlock()
+	if region.options.Dedup {
+		return region.addDedup(data)
+	}
+	return region.add(data, dataTypeNormal)
+}
+
+// it must be called with the blockLock read locked
+func (region *Region) add(data []byte, dataType byte) (*naming.Name, error) {
+	name, _, err := region.addData(data, dataType)
+	return name, err
+}
+
+func (region *Region) addData(data []byte, dataType byte) (*naming.Name, DataIndex, error) {
+	dataBlock, err := region.getDataBlockToWrite(data)
 	if err != nil {
-		return nil, err
+		return nil, DataIndex{}, err
+	}
+	nameBlock, err := region.getNameBlockToWrite()
+	if err != nil {
+		return nil, DataIndex{}, err
+	}
+	di, err := dataBlock.addWithType(data, dataType)
+	if err != nil {
+		return nil, DataIndex{}, err
 	}
 	name, err := nameBlock.Add(di)
 	if err != nil {
 		dataBlock.Delete(di)
 		// ignore delete error
-		return nil, err
+		return nil, DataIndex{}, err
 	}
-	return name, nil
+	return name, di, nil
 }
 
+// Get returns the whole blob, the chunked blob is read into the memory too, Open is better for it.
 func (region *Region) Get(name *naming.Name) ([]byte, error) {
+	region.blockLock.RLock()
+	defer region.blockLock.RUnlock()
+	return region.get(name)
+}
+
+// Exists checks the blob of the name exists, the data is not read, so it is cheap.
+func (region *Region) Exists(name *naming.Name) (bool, error) {
+	if name.RegionId != region.regionId {
+		return false, nil
+	}
+	region.blockLock.RLock()
+	defer region.blockLock.RUnlock()
+	if _, exist := region.nameBlocks.Get(name.NameBlockId); !exist {
+		return false, nil
+	}
+	dataBlock, di, err := region.locate(name)
+	if err != nil || dataBlock == nil {
+		return false, err
+	}
+	return dataBlock.Exist(di)
+}
+
+// it must be called with the blockLock read locked
+func (region *Region) get(name *naming.Name) ([]byte, error) {
+	data, dataType, err := region.read(name)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	if dataType == dataTypeMeta {
+		meta, err := decodeBlobMeta(region.regionId, data)
+		if err != nil {
+			return nil, err
+		}
+		return region.get(meta.body)
+	}
+	if dataType != dataTypeManifest {
+		return data, nil
+	}
+	manifest, err := decodeBlobManifest(region.regionId, data)
+	if err != nil {
+		return nil, err
+	}
+	blob := make([]byte, 0, manifest.size)
+	for _, chunkName := range manifest.chunks {
+		chunk, _, err := region.read(chunkName)
+		if err != nil {
+			return nil, err
+		}
+		if chunk == nil {
+			return nil, fmt.Errorf("chunk %s of the blob not found", chunkName.String())
+		}
+		blob = append(blob, chunk...)
+	}
+	return blob, nil
+}
+
+// returns the data and the type of it, the data is nil if it is not found.
+// It must be called with the blockLock read locked
+func (region *Region) read(name *naming.Name) ([]byte, byte, error) {
+	dataBlock, bi, err := region.locate(name)
+	if err != nil || dataBlock == nil {
+		return nil, 0, err
+	}
+	return dataBlock.read(bi)
+}
+
+// returns the data block and the index of the name, the data block is nil if it is not found.
+// It must be called with the blockLock read locked
+func (region *Region) locate(name *naming.Name) (*DataBlock, DataIndex, error) {
 	nameBlock, exist := region.nameBlocks.Get(name.NameBlockId)
 	if !exist {
-		return nil, fmt.Errorf("index block not found")
+		return nil, DataIndex{}, fmt.Errorf("index block not found")
 	}
 	bi, exist, err := nameBlock.(*NameBlock).Get(name)
 	if err != nil {
-		return nil, err
+		return nil, DataIndex{}, err
 	}
 	if !exist {
-		return nil, nil
+		return nil, DataIndex{}, nil
 	}
 	dataBlock, exist := region.dataBlocks.Get(bi.blockId)
 	if !exist {
-		return nil, nil
+		return nil, DataIndex{}, nil
 	}
-	return dataBlock.(*DataBlock).Get(bi)
+	return dataBlock.(*DataBlock), bi, nil
 }
 
 func (region *Region) Delete(name *naming.Name) error {
+	region.blockLock.RLock()
+	defer region.blockLock.RUnlock()
+	return region.delete(name)
+}
+
+// it must be called with the blockLock read locked
+func (region *Region) delete(name *naming.Name) error {
 	nameBlock, exist := region.nameBlocks.Get(name.NameBlockId)
 	if !exist {
 		return nil
@@ -281,6 +603,50 @@ func (region *Region) Delete(name *naming.Name) error {
 	if !exist {
 		return nil
 	}
+	dataType, err := dataBlock.(*DataBlock).readType(bi)
+	if err != nil {
+		return err
+	}
+	if dataType == dataTypeManifest {
+		// the chunks are deleted before the manifest
+		data, err := dataBlock.(*DataBlock).Get(bi)
+		if err != nil {
+			return err
+		}
+		manifest, err := decodeBlobManifest(region.regionId, data)
+		if err != nil {
+			return err
+		}
+		for _, chunkName := range manifest.chunks {
+			if err := region.delete(chunkName); err != nil {
+				return err
+			}
+		}
+	} else if dataType == dataTypeMeta {
+		// the body is deleted before the meta
+		data, err := dataBlock.(*DataBlock).Get(bi)
+		if err != nil {
+			return err
+		}
+		meta, err := decodeBlobMeta(region.regionId, data)
+		if err != nil {
+			return err
+		}
+		if err := region.delete(meta.body); err != nil {
+			return err
+		}
+	} else if region.dedupIndex != nil {
+		// the name is deleted before releasing the reference, the data may be leaked but never lost if it crashes
+		err = nameBlock.(*NameBlock).Delete(name)
+		if err != nil {
+			return err
+		}
+		referenced, err := region.releaseDedup(bi)
+		if err != nil || referenced {
+			return err
+		}
+		return dataBlock.(*DataBlock).Delete(bi)
+	}
 	err = dataBlock.(*DataBlock).Delete(bi)
 	if err != nil {
 		return err
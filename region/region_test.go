@@ -7,6 +7,9 @@ import (
 	"path"
 	"fmt"
 	"github.com/pister/yfs/naming"
+	"github.com/pister/yfs/common/vfs"
+	"strings"
+	"math"
 )
 
 func TestWalk(t *testing.T) {
@@ -52,4 +55,117 @@ func TestOpenRegion2(t *testing.T) {
 		t.Fatal(err)
 	}
 	fmt.Println(string(data))
-}
\ No newline at end of file
+}
+func TestRegionGrowUp(t *testing.T) {
+	options := DefaultOptions()
+	options.FS = vfs.NewMemFS()
+	options.DataBlockSize = 1024
+	options.NameBlockSize = 1024
+	options.MaxDataBlocks = 8
+	options.MaxNameBlocks = 4
+	region, err := OpenRegionWithOptions(1, "/region_test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 100)
+	names := make([]*naming.Name, 0, 64)
+	for {
+		name, err := region.Add(data)
+		if err != nil {
+			if !strings.Contains(err.Error(), "is full") {
+				t.Fatal(err)
+			}
+			break
+		}
+		names = append(names, name)
+	}
+	if region.dataBlocks.Length() != options.MaxDataBlocks {
+		t.Fatal("data blocks not grown", region.dataBlocks.Length())
+	}
+	if len(names) < 8*8 {
+		t.Fatal("the region is not filled", len(names))
+	}
+	for i := 0; i < options.MaxDataBlocks; i++ {
+		if _, err := options.FS.Stat(fmt.Sprintf("/region_test/region-1/block_data_%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range names {
+		got, err := region.Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(data) {
+			t.Fatal("data not match")
+		}
+	}
+	region.Close()
+
+	// reopen the full region
+	region, err = OpenRegionWithOptions(1, "/region_test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer region.Close()
+	if region.nextDataBlockId != uint32(options.MaxDataBlocks) {
+		t.Fatal("next data block id not match", region.nextDataBlockId)
+	}
+	if _, err := region.Add(data); err == nil {
+		t.Fatal("the region should be full")
+	}
+	got, err := region.Get(names[len(names)-1])
+	if err != nil || len(got) != len(data) {
+		t.Fatal("data not match", err)
+	}
+}
+
+func TestRegionBlockSizeLimit(t *testing.T) {
+	options := DefaultOptions()
+	options.FS = vfs.NewMemFS()
+	options.DataBlockSize = math.MaxUint32 + 1
+	if _, err := OpenRegionWithOptions(1, "/block_size_test", options); err == nil {
+		t.Fatal("the data block size is too big")
+	}
+	options.DataBlockSize = 0
+	options.NameBlockSize = math.MaxUint32 + 1
+	if _, err := OpenRegionWithOptions(1, "/block_size_test", options); err == nil {
+		t.Fatal("the name block size is too big")
+	}
+}
+
+func TestRegionExists(t *testing.T) {
+	options := DefaultOptions()
+	options.FS = vfs.NewMemFS()
+	region, err := OpenRegionWithOptions(1, "/exists_test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer region.Close()
+	name, err := region.Add([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exist, err := region.Exists(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exist {
+		t.Fatal("the blob must exist")
+	}
+	guessed := *name
+	guessed.Cookie++
+	if exist, err := region.Exists(&guessed); exist || err != nil {
+		t.Fatal("the guessed name must not exist", err)
+	}
+	guessed = *name
+	guessed.NameBlockId = 1000
+	if exist, err := region.Exists(&guessed); exist || err != nil {
+		t.Fatal("the name of unknown block must not exist", err)
+	}
+	if err := region.Delete(name); err != nil {
+		t.Fatal(err)
+	}
+	if exist, err := region.Exists(name); exist || err != nil {
+		t.Fatal("the deleted blob must not exist", err)
+	}
+}
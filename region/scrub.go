@@ -0,0 +1,588 @@
+package region
+
+import (
+	"fmt"
+	"io"
+	"bufio"
+	"sort"
+	"path/filepath"
+	"github.com/pister/yfs/common/bytesutil"
+	"github.com/pister/yfs/common/hashutil"
+	"github.com/pister/yfs/common/fileutil"
+	"github.com/pister/yfs/common/maputil"
+	"os"
+	"encoding/hex"
+	"github.com/pister/yfs/common/lockutil"
+)
+
+const rebuildIndexFileName = "rebuild_index"
+
+// the names deleted by Fsck are saved in it, so they can be restored by hand
+const quarantineFileName = "quarantine_names"
+
+type ScrubProblemKind int
+
+const (
+	// the name entry is broken
+	ScrubBadName ScrubProblemKind = iota
+	// the name refers to the data which does not exist
+	ScrubDanglingName
+	// the data record is broken
+	ScrubBadData
+	// the data is not referred by any name
+	ScrubOrphanedData
+	// the index entry is broken or refers to no data
+	ScrubBadIndex
+	// the data has no index entry, so it can not be read
+	ScrubMissingIndex
+)
+
+var scrubProblemKindNames = []string{"bad name", "dangling name", "bad data", "orphaned data", "bad index", "missing index"}
+
+func (kind ScrubProblemKind) String() string {
+	if int(kind) < len(scrubProblemKindNames) {
+		return scrubProblemKindNames[kind]
+	}
+	return fmt.Sprintf("unknown(%d)", int(kind))
+}
+
+type ScrubProblem struct {
+	Kind ScrubProblemKind
+	// the name block of the name problems, or the data block of the others
+	BlockId uint32
+	// the position of the entry or the record in the file of the block
+	Position int64
+	Message  string
+	// it is repaired by Fsck, the repaired names are saved in the quarantine file before deleted
+	Repaired bool
+}
+
+func (problem *ScrubProblem) String() string {
+	return fmt.Sprintf("%s in block[%d] at %d: %s", problem.Kind, problem.BlockId, problem.Position, problem.Message)
+}
+
+type ScrubReport struct {
+	// the count of the live names and data which are scrubbed
+	Names    int64
+	Data     int64
+	Problems []*ScrubProblem
+}
+
+func (report *ScrubReport) add(kind ScrubProblemKind, blockId uint32, position int64, format string, args ...interface{}) {
+	problem := new(ScrubProblem)
+	problem.Kind = kind
+	problem.BlockId = blockId
+	problem.Position = position
+	problem.Message = fmt.Sprintf(format, args...)
+	report.Problems = append(report.Problems, problem)
+}
+
+// the records of a data block found by the scrub
+type scrubDataBlock struct {
+	dataBlock *DataBlock
+	// the length of the data file when it is scrubbed, the newer data is not scrubbed
+	length int64
+	// the start positions of the records in order
+	positions  []uint32
+	deleted    []bool
+	indexed    []bool
+	referenced []bool
+}
+
+// returns the index of the record at the position, or -1 if no record starts at the position
+func (state *scrubDataBlock) find(position uint32) int {
+	i := sort.Search(len(state.positions), func(i int) bool {
+		return state.positions[i] >= position
+	})
+	if i < len(state.positions) && state.positions[i] == position {
+		return i
+	}
+	return -1
+}
+
+// the name which refers to no data when it is scanned
+type scrubName struct {
+	nameBlock *NameBlock
+	position  int64
+}
+
+func sortedBlockIds(blocks *maputil.SafeMap) []uint32 {
+	blockIds := make([]uint32, 0, blocks.Length())
+	blocks.Foreach(func(key interface{}, value interface{}) (stop bool) {
+		blockIds = append(blockIds, key.(uint32))
+		return false
+	})
+	sort.Slice(blockIds, func(i, j int) bool {
+		return blockIds[i] < blockIds[j]
+	})
+	return blockIds
+}
+
+// Scrub verifies the magic codes and the sumHashes of all the names, the data and the index entries,
+// and checks that every name refers to a live data and every live data is referred by a name.
+// It runs with the region online, the blocks are locked only when the problems found are checked again,
+// so the data being added or deleted is not reported. The problems are only reported, Fsck repairs them.
+func (region *Region) Scrub() (*ScrubReport, error) {
+	// the vacuum moves the data
+	region.vacuumMutex.Lock()
+	defer region.vacuumMutex.Unlock()
+
+	report := new(ScrubReport)
+	region.blockLock.RLock()
+	states, nameLengths, danglingNames, err := region.scrubBlocks(report)
+	region.blockLock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	region.blockLock.Lock()
+	defer region.blockLock.Unlock()
+	if err := region.checkDanglingNames(report, states, danglingNames); err != nil {
+		return nil, err
+	}
+	if err := region.checkOrphanedData(report, states, nameLengths); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// it must be called with the blockLock read locked
+func (region *Region) scrubBlocks(report *ScrubReport) (map[uint32]*scrubDataBlock, map[uint32]int64, []scrubName, error) {
+	states := make(map[uint32]*scrubDataBlock)
+	for _, blockId := range sortedBlockIds(region.dataBlocks) {
+		value, exist := region.dataBlocks.Get(blockId)
+		if !exist {
+			continue
+		}
+		state, err := scrubData(report, value.(*DataBlock))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		states[blockId] = state
+	}
+	nameLengths := make(map[uint32]int64)
+	danglingNames := make([]scrubName, 0)
+	for _, blockId := range sortedBlockIds(region.nameBlocks) {
+		value, exist := region.nameBlocks.Get(blockId)
+		if !exist {
+			continue
+		}
+		nameBlock := value.(*NameBlock)
+		nameBlock.mutex.Lock()
+		nameLength := nameBlock.file.GetFileLength()
+		nameBlock.mutex.Unlock()
+		nameLengths[blockId] = nameLength
+		err := nameBlock.scan(0, nameLength, func(position int64, entry []byte, err error) error {
+			if err != nil {
+				report.add(ScrubBadName, blockId, position, "%s", err)
+				return nil
+			}
+			if entry[1] == nameFlagDeleted {
+				return nil
+			}
+			report.Names++
+			if !scrubReference(states, entry) {
+				danglingNames = append(danglingNames, scrubName{nameBlock: nameBlock, position: position})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return states, nameLengths, danglingNames, nil
+}
+
+// verifies the records and the index entries of the data block
+func scrubData(report *ScrubReport, dataBlock *DataBlock) (*scrubDataBlock, error) {
+	state := new(scrubDataBlock)
+	state.dataBlock = dataBlock
+	// the data and the index entry are added with the mutex held
+	dataBlock.mutex.Lock()
+	state.length = dataBlock.dataFile.GetFileLength()
+	indexLength := dataBlock.indexFile.GetFileLength()
+	dataBlock.mutex.Unlock()
+
+	length, err := scanDataRecords(dataBlock.dataFile, state.length, func(position int64, header []byte) error {
+		deleted := header[6] == dataFlagDeleted
+		state.positions = append(state.positions, uint32(position))
+		state.deleted = append(state.deleted, deleted)
+		if deleted {
+			return nil
+		}
+		report.Data++
+		valid, err := dataBlock.verifyRecord(position, header)
+		if err != nil {
+			return err
+		}
+		if !valid {
+			report.add(ScrubBadData, dataBlock.blockId, position, "check sum fail")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if length < state.length {
+		report.add(ScrubBadData, dataBlock.blockId, length, "invalidate data header, the following %d bytes can not be scrubbed", state.length-length)
+	}
+	state.indexed = make([]bool, len(state.positions))
+	state.referenced = make([]bool, len(state.positions))
+
+	_, err = dataBlock.indexFile.SeekForReading(0, func(reader io.Reader) error {
+		reader = bufio.NewReader(reader)
+		buf := make([]byte, 8)
+		for indexPosition := int64(0); indexPosition+8 <= indexLength; indexPosition += 8 {
+			if _, err := io.ReadFull(reader, buf); err != nil {
+				return err
+			}
+			if buf[0] != dataIndexMagicCode1 || buf[1] != dataIndexMagicCode2 || buf[3] != hashutil.SumHash8(buf[4:8]) {
+				report.add(ScrubBadIndex, dataBlock.blockId, indexPosition, "broken index entry")
+				continue
+			}
+			if buf[2] == dataFlagDeleted {
+				continue
+			}
+			position := bytesutil.GetUint32FromBytes(buf, 4)
+			if i := state.find(position); i >= 0 {
+				state.indexed[i] = true
+			} else if int64(position) < length {
+				// the records after the broken header are unknown
+				report.add(ScrubBadIndex, dataBlock.blockId, indexPosition, "index entry refers to no data at %d", position)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if indexLength%8 != 0 {
+		report.add(ScrubBadIndex, dataBlock.blockId, indexLength/8*8, "broken index entry")
+	}
+	for i, position := range state.positions {
+		if !state.deleted[i] && !state.indexed[i] {
+			report.add(ScrubMissingIndex, dataBlock.blockId, int64(position), "data has no index entry")
+		}
+	}
+	return state, nil
+}
+
+// marks the record referred by the name entry, it returns false if the record is not found
+func scrubReference(states map[uint32]*scrubDataBlock, entry []byte) bool {
+	state, exist := states[bytesutil.GetUint32FromBytes(entry, 4)]
+	if !exist {
+		return false
+	}
+	i := state.find(bytesutil.GetUint32FromBytes(entry, 8))
+	if i < 0 || state.deleted[i] {
+		return false
+	}
+	state.referenced[i] = true
+	return true
+}
+
+// the data exists now, the states can be nil. It must be called with the blockLock held
+func (region *Region) scrubDataExists(states map[uint32]*scrubDataBlock, di DataIndex) (bool, error) {
+	value, exist := region.dataBlocks.Get(di.blockId)
+	if !exist {
+		return false, nil
+	}
+	dataBlock := value.(*DataBlock)
+	state, exist := states[di.blockId]
+	if exist && int64(di.position) < state.length && state.find(di.position) < 0 {
+		return false, nil
+	}
+	// the record is added after scanning
+	if int64(di.position)+dataHeaderLength > dataBlock.dataFile.GetFileLength() {
+		return false, nil
+	}
+	header := make([]byte, dataHeaderLength)
+	_, _, err := dataBlock.dataFile.SeekAndReadData(int64(di.position), header)
+	if err != nil {
+		return false, err
+	}
+	return header[0] == dataMagicCode0 && header[1] == dataMagicCode1 && header[6] != dataFlagDeleted, nil
+}
+
+// checks the dangling names again, the names being deleted are not reported.
+// It must be called with the blockLock held
+func (region *Region) checkDanglingNames(report *ScrubReport, states map[uint32]*scrubDataBlock, danglingNames []scrubName) error {
+	buf := make([]byte, nameCookieItemLength)
+	for _, danglingName := range danglingNames {
+		entryLen, err := danglingName.nameBlock.readEntryAt(danglingName.position, buf)
+		if err != nil || entryLen == 0 || buf[1] == nameFlagDeleted {
+			continue
+		}
+		di := DataIndex{blockId: bytesutil.GetUint32FromBytes(buf, 4), position: bytesutil.GetUint32FromBytes(buf, 8)}
+		exist, err := region.scrubDataExists(states, di)
+		if err != nil {
+			return err
+		}
+		if !exist {
+			report.add(ScrubDanglingName, danglingName.nameBlock.blockId, danglingName.position, "name refers to data[%d] at %d which does not exist", di.blockId, di.position)
+		}
+	}
+	return nil
+}
+
+// checks the data which is not referred when scanning, the names added after scanning are scanned,
+// and the data deleted after scanning is not reported. It must be called with the blockLock held
+func (region *Region) checkOrphanedData(report *ScrubReport, states map[uint32]*scrubDataBlock, nameLengths map[uint32]int64) error {
+	var err error
+	region.nameBlocks.Foreach(func(key interface{}, value interface{}) (stop bool) {
+		nameBlock := value.(*NameBlock)
+		err = nameBlock.scan(nameLengths[key.(uint32)], nameBlock.file.GetFileLength(), func(position int64, entry []byte, err error) error {
+			if err == nil && entry[1] != nameFlagDeleted {
+				scrubReference(states, entry)
+			}
+			return nil
+		})
+		return err != nil
+	})
+	if err != nil {
+		return err
+	}
+	blockIds := make([]uint32, 0, len(states))
+	for blockId := range states {
+		blockIds = append(blockIds, blockId)
+	}
+	sort.Slice(blockIds, func(i, j int) bool {
+		return blockIds[i] < blockIds[j]
+	})
+	for _, blockId := range blockIds {
+		state := states[blockId]
+		for i, position := range state.positions {
+			if state.deleted[i] || state.referenced[i] {
+				continue
+			}
+			deleted, err := state.dataBlock.isDataDeleted(position)
+			if err != nil {
+				return err
+			}
+			if !deleted {
+				report.add(ScrubOrphanedData, blockId, int64(position), "data is not referred by any name")
+			}
+		}
+	}
+	return nil
+}
+
+// Fsck scrubs the region and repairs it if repair is true, it fails if the region is opened by others:
+// the broken and the dangling names are moved into the quarantine file, and the index files with problems
+// are rebuilt from the data files. The broken data and the orphaned data are only reported, so they can
+// be recovered by hand. Nothing in the region is changed if repair is false.
+func Fsck(regionId uint16, path string, options *Options, repair bool) (*ScrubReport, error) {
+	regionPath := fmt.Sprintf("%s%cregion-%d", path, filepath.Separator, regionId)
+	exist, err := fileutil.PathExistsWithFS(options.fs(), regionPath)
+	if err != nil {
+		return nil, err
+	}
+	if !exist {
+		return nil, fmt.Errorf("region[%d] not found in %s", regionId, path)
+	}
+	if !repair {
+		region, err := openRegionForCheck(regionId, path, options)
+		if err != nil {
+			return nil, err
+		}
+		defer region.Close()
+		return region.Scrub()
+	}
+	region, err := OpenRegionWithOptions(regionId, path, options)
+	if err != nil {
+		return nil, err
+	}
+	defer region.Close()
+	report, err := region.Scrub()
+	if err != nil {
+		return report, err
+	}
+	return report, region.repair(report)
+}
+
+// opens the blocks of the region for scrubbing only, the unfinished vacuum is not recovered,
+// and no block or dedup index is created, so nothing in the region is changed.
+func openRegionForCheck(regionId uint16, path string, options *Options) (*Region, error) {
+	fs := options.fs()
+	regionPath := fmt.Sprintf("%s%cregion-%d", path, filepath.Separator, regionId)
+	dirLocker, err := fs.Lock(filepath.Join(regionPath, regionLockFileName))
+	if err != nil {
+		return nil, err
+	}
+	dataBlocks, err := initDataBlocks(options, regionPath)
+	if err != nil {
+		dirLocker.Close()
+		return nil, err
+	}
+	nameBlocks, err := initNameBlocks(options, regionId, regionPath)
+	if err != nil {
+		closeDataBlocks(dataBlocks)
+		dirLocker.Close()
+		return nil, err
+	}
+	names, err := fs.List(regionPath)
+	if err != nil {
+		closeDataBlocks(dataBlocks)
+		closeNameBlocks(nameBlocks)
+		dirLocker.Close()
+		return nil, err
+	}
+	for _, name := range names {
+		if vacuumFilePattern.MatchString(name) {
+			log.Info("region[%d] has the unfinished vacuum %s, the problems of it may be reported", regionId, name)
+		}
+	}
+	region := new(Region)
+	region.fs = fs
+	region.options = options
+	region.rootPath = path
+	region.regionPath = regionPath
+	region.regionId = regionId
+	region.dirLocker = dirLocker
+	region.dataBlocks = dataBlocks
+	region.nameBlocks = nameBlocks
+	region.dataGrowLocker = lockutil.NewTryLocker()
+	region.nameGrowLocker = lockutil.NewTryLocker()
+	region.nextDataBlockId = nextBlockId(dataBlocks)
+	region.nextNameBlockId = nextBlockId(nameBlocks)
+	return region, nil
+}
+
+func (region *Region) repair(report *ScrubReport) error {
+	region.vacuumMutex.Lock()
+	defer region.vacuumMutex.Unlock()
+
+	rebuilt := make(map[uint32]bool)
+	for _, problem := range report.Problems {
+		switch problem.Kind {
+		case ScrubBadName, ScrubDanglingName:
+			repaired, err := region.repairName(problem)
+			if err != nil {
+				return err
+			}
+			problem.Repaired = repaired
+		case ScrubBadIndex, ScrubMissingIndex:
+			if !rebuilt[problem.BlockId] {
+				if err := region.rebuildDataIndex(problem.BlockId); err != nil {
+					return err
+				}
+				rebuilt[problem.BlockId] = true
+			}
+			problem.Repaired = true
+		}
+	}
+	return nil
+}
+
+// moves the name into the quarantine file if it is still broken or dangling, the name may be changed after scrubbing
+func (region *Region) repairName(problem *ScrubProblem) (bool, error) {
+	region.blockLock.Lock()
+	defer region.blockLock.Unlock()
+	value, exist := region.nameBlocks.Get(problem.BlockId)
+	if !exist {
+		return false, nil
+	}
+	nameBlock := value.(*NameBlock)
+	buf := make([]byte, nameCookieItemLength)
+	entryLen, err := nameBlock.readEntryAt(problem.Position, buf)
+	if problem.Kind == ScrubBadName {
+		// the broken entry fails to be read, it is not broken if it is deleted
+		if err == nil {
+			return false, nil
+		}
+	} else {
+		if err != nil || entryLen == 0 || buf[1] == nameFlagDeleted {
+			return false, nil
+		}
+		di := DataIndex{blockId: bytesutil.GetUint32FromBytes(buf, 4), position: bytesutil.GetUint32FromBytes(buf, 8)}
+		exist, err := region.scrubDataExists(nil, di)
+		if err != nil || exist {
+			return false, err
+		}
+	}
+	entry := buf[:nameBlock.entryLengthAt(problem.Position)]
+	if _, _, err := nameBlock.file.SeekAndReadData(problem.Position, entry); err != nil {
+		return false, err
+	}
+	if err := region.quarantineName(problem, entry); err != nil {
+		return false, err
+	}
+	if err := nameBlock.deleteAt(problem.Position); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// =================== QUARANTINE FILE FORMAT START ==================
+// one line for a name: the problem kind, the name block id, the position and the entry in hex,
+// the entry can be written back to the position to restore the name.
+// =================== QUARANTINE FILE FORMAT END  ====================
+func (region *Region) quarantineName(problem *ScrubProblem, entry []byte) error {
+	file, err := region.fs.OpenFile(filepath.Join(region.regionPath, quarantineFileName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	line := fmt.Sprintf("%d %d %d %s\n", int(problem.Kind), problem.BlockId, problem.Position, hex.EncodeToString(entry))
+	if _, err := file.Write([]byte(line)); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// rebuilds the index file of the data block from the data file, and reopens the data block
+func (region *Region) rebuildDataIndex(blockId uint32) error {
+	region.blockLock.Lock()
+	defer region.blockLock.Unlock()
+	value, exist := region.dataBlocks.Get(blockId)
+	if !exist {
+		return fmt.Errorf("data block[%d] not found", blockId)
+	}
+	dataBlock := value.(*DataBlock)
+	_, indexPath := dataBlockPaths(region.regionPath, blockId)
+	tempPath := filepath.Join(region.regionPath, fmt.Sprintf("%s_%d", rebuildIndexFileName, blockId))
+	file, err := region.fs.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	count := 0
+	_, err = scanDataRecords(dataBlock.dataFile, dataBlock.dataFile.GetFileLength(), func(position int64, header []byte) error {
+		if header[6] == dataFlagDeleted {
+			return nil
+		}
+		count++
+		_, err := writer.Write(encodeDataIndex(uint32(position)))
+		return err
+	})
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		region.fs.Remove(tempPath)
+		return err
+	}
+	// the old block is still registered if the renaming or the reopening fails
+	if err := region.fs.Rename(tempPath, indexPath); err != nil {
+		region.fs.Remove(tempPath)
+		return err
+	}
+	newBlock, err := OpenDataBlockWithFS(region.fs, region.regionPath, blockId, regionDataBlockConcurrentReadSize)
+	if err != nil {
+		return err
+	}
+	newBlock.maxSize = region.options.dataBlockSize()
+	region.dataBlocks.Put(blockId, newBlock)
+	dataBlock.Close()
+	log.Info("region[%d] index of data block[%d] rebuilt, %d data", region.regionId, blockId, count)
+	return nil
+}
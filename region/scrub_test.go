@@ -0,0 +1,246 @@
+package region
+
+import (
+	"testing"
+	"github.com/pister/yfs/common/vfs"
+	"io/ioutil"
+	"strings"
+	"path/filepath"
+	"fmt"
+)
+
+func countProblems(report *ScrubReport) map[ScrubProblemKind]int {
+	counts := make(map[ScrubProblemKind]int)
+	for _, problem := range report.Problems {
+		counts[problem.Kind]++
+	}
+	return counts
+}
+
+func TestScrubAndFsck(t *testing.T) {
+	options := DefaultOptions()
+	options.FS = vfs.NewMemFS()
+	region, err := OpenRegionWithOptions(1, "/scrub_test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, values := addForVacuum(t, region, 40)
+	report, err := region.Scrub()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 0 || report.Names != 40 || report.Data != 40 {
+		t.Fatal("the region should be clean", report.Names, report.Data, report.Problems)
+	}
+
+	// dangling name
+	dataBlock, di, err := region.locate(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dataBlock.Delete(di); err != nil {
+		t.Fatal(err)
+	}
+	// bad data
+	dataBlock, di, err = region.locate(names[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dataBlock.dataFile.UpdateByteAt(int64(di.position)+dataHeaderLength, 'w'); err != nil {
+		t.Fatal(err)
+	}
+	// bad name, the data of it is orphaned
+	value, _ := region.nameBlocks.Get(names[2].NameBlockId)
+	if err := value.(*NameBlock).file.UpdateByteAt(int64(names[2].NamePosition)+4, 0xff); err != nil {
+		t.Fatal(err)
+	}
+	// orphaned data
+	if _, err := dataBlock.Add([]byte("orphan")); err != nil {
+		t.Fatal(err)
+	}
+	// bad index, the data of it has no index
+	target := -1
+	for i := 3; i < len(names); i++ {
+		dataBlock, di, err = region.locate(names[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if di.position == 0 {
+			target = i
+			break
+		}
+	}
+	if target < 0 {
+		t.Fatal("no data at the head of a block")
+	}
+	if err := dataBlock.indexFile.UpdateByteAt(0, 'X'); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = region.Scrub()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := countProblems(report)
+	if counts[ScrubDanglingName] != 1 || counts[ScrubBadData] != 1 || counts[ScrubBadName] != 1 ||
+		counts[ScrubOrphanedData] != 2 || counts[ScrubBadIndex] != 1 || counts[ScrubMissingIndex] != 1 {
+		t.Fatal("problems not match", report.Problems)
+	}
+	region.Close()
+
+	// the region with the broken index can be opened
+	report, err = Fsck(1, "/scrub_test", options, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, problem := range report.Problems {
+		repairable := problem.Kind != ScrubBadData && problem.Kind != ScrubOrphanedData
+		if problem.Repaired != repairable {
+			t.Fatal("repaired not match", problem)
+		}
+	}
+	// the dangling name and the bad name are saved
+	file, err := options.FS.Open("/scrub_test/region-1/" + quarantineFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quarantined, err := ioutil.ReadAll(file)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(quarantined)), "\n"); len(lines) != 2 {
+		t.Fatal("quarantined names not match", lines)
+	}
+	report, err = Fsck(1, "/scrub_test", options, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts = countProblems(report)
+	if len(report.Problems) != 3 || counts[ScrubBadData] != 1 || counts[ScrubOrphanedData] != 2 || report.Names != 38 {
+		t.Fatal("problems not match after repairing", report.Problems)
+	}
+
+	region, err = OpenRegionWithOptions(1, "/scrub_test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer region.Close()
+	for i := 3; i < len(names); i++ {
+		data, err := region.Get(names[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != values[i] {
+			t.Fatal("data not match", i)
+		}
+	}
+	if _, err := Fsck(2, "/scrub_test", options, false); err == nil {
+		t.Fatal("the region not exists")
+	}
+}
+
+func TestFsckRepairCheckAgain(t *testing.T) {
+	options := DefaultOptions()
+	options.FS = vfs.NewMemFS()
+	region, err := OpenRegionWithOptions(1, "/fsck_test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, _ := addForVacuum(t, region, 10)
+	if _, err := Fsck(1, "/fsck_test", options, true); err == nil {
+		t.Fatal("the region opened can not be fscked")
+	}
+
+	for _, name := range names[:2] {
+		dataBlock, di, err := region.locate(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := dataBlock.Delete(di); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report, err := region.Scrub()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts := countProblems(report); len(report.Problems) != 2 || counts[ScrubDanglingName] != 2 {
+		t.Fatal("problems not match", report.Problems)
+	}
+	// the name deleted after scrubbing is not repaired
+	value, _ := region.nameBlocks.Get(names[0].NameBlockId)
+	if err := value.(*NameBlock).Delete(names[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := region.repair(report); err != nil {
+		t.Fatal(err)
+	}
+	for _, problem := range report.Problems {
+		if problem.Repaired != (problem.BlockId == names[1].NameBlockId && problem.Position == int64(names[1].NamePosition)) {
+			t.Fatal("repaired not match", problem)
+		}
+	}
+	region.Close()
+
+	report, err = Fsck(1, "/fsck_test", options, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 0 || report.Names != 8 {
+		t.Fatal("the region should be clean", report.Names, report.Problems)
+	}
+}
+
+// the paths and sizes of the files in the dir and its sub dirs
+func listFileSizes(t *testing.T, fs vfs.FS, dir string, sizes map[string]int64) map[string]int64 {
+	names, err := fs.List(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		fi, err := fs.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.IsDir() {
+			listFileSizes(t, fs, path, sizes)
+		} else {
+			sizes[path] = fi.Size()
+		}
+	}
+	return sizes
+}
+
+func TestFsckCheckOnly(t *testing.T) {
+	options := DefaultOptions()
+	options.FS = vfs.NewMemFS()
+	options.Dedup = true
+	region, err := OpenRegionWithOptions(1, "/fsck_check_test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, _ := addForVacuum(t, region, 10)
+	dataBlock, di, err := region.locate(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dataBlock.Delete(di); err != nil {
+		t.Fatal(err)
+	}
+	region.Close()
+
+	before := listFileSizes(t, options.FS, "/fsck_check_test", make(map[string]int64))
+	report, err := Fsck(1, "/fsck_check_test", options, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts := countProblems(report); counts[ScrubDanglingName] != 1 {
+		t.Fatal("problems not match", report.Problems)
+	}
+	after := listFileSizes(t, options.FS, "/fsck_check_test", make(map[string]int64))
+	if fmt.Sprint(before) != fmt.Sprint(after) {
+		t.Fatal("the region is changed by checking", before, after)
+	}
+}
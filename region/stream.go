@@ -0,0 +1,306 @@
+package region
+
+import (
+	"fmt"
+	"io"
+	"github.com/pister/yfs/naming"
+	"github.com/pister/yfs/common/bytesutil"
+)
+
+const (
+	blobManifestHeaderLength = 16
+	blobManifestChunkLength  = 16
+)
+
+// the blob bigger than the chunk size is split into chunks, every chunk has its own name,
+// so the vacuum can move them. The name of the blob refers to the manifest.
+type blobManifest struct {
+	size      int64
+	chunkSize int
+	chunks    []*naming.Name
+}
+
+func (manifest *blobManifest) encode() []byte {
+	// =================== MANIFEST FORMAT START ==================
+	// 8 bytes blob size
+	// 4 bytes chunk size
+	// 4 bytes count of chunks
+	// 16 bytes * count: 4 bytes name block id, 4 bytes name position, 8 bytes cookie of the chunk
+	// =================== MANIFEST FORMAT END  ====================
+	buf := make([]byte, blobManifestHeaderLength+len(manifest.chunks)*blobManifestChunkLength)
+	bytesutil.CopyUint64ToBytes(uint64(manifest.size), buf, 0)
+	bytesutil.CopyUint32ToBytes(uint32(manifest.chunkSize), buf, 8)
+	bytesutil.CopyUint32ToBytes(uint32(len(manifest.chunks)), buf, 12)
+	pos := blobManifestHeaderLength
+	for _, chunk := range manifest.chunks {
+		bytesutil.CopyUint32ToBytes(chunk.NameBlockId, buf, pos)
+		bytesutil.CopyUint32ToBytes(chunk.NamePosition, buf, pos+4)
+		bytesutil.CopyUint64ToBytes(chunk.Cookie, buf, pos+8)
+		pos += blobManifestChunkLength
+	}
+	return buf
+}
+
+func decodeBlobManifest(regionId uint16, data []byte) (*blobManifest, error) {
+	if len(data) < blobManifestHeaderLength {
+		return nil, fmt.Errorf("invalidate blob manifest")
+	}
+	manifest := new(blobManifest)
+	manifest.size = int64(bytesutil.GetUint64FromBytes(data, 0))
+	manifest.chunkSize = int(bytesutil.GetUint32FromBytes(data, 8))
+	count := int(bytesutil.GetUint32FromBytes(data, 12))
+	if len(data) != blobManifestHeaderLength+count*blobManifestChunkLength || manifest.chunkSize <= 0 ||
+		int64(count) != (manifest.size+int64(manifest.chunkSize)-1)/int64(manifest.chunkSize) {
+		return nil, fmt.Errorf("invalidate blob manifest")
+	}
+	manifest.chunks = make([]*naming.Name, 0, count)
+	for pos := blobManifestHeaderLength; pos < len(data); pos += blobManifestChunkLength {
+		chunk := new(naming.Name)
+		chunk.RegionId = regionId
+		chunk.NameBlockId = bytesutil.GetUint32FromBytes(data, pos)
+		chunk.NamePosition = bytesutil.GetUint32FromBytes(data, pos+4)
+		chunk.Cookie = bytesutil.GetUint64FromBytes(data, pos+8)
+		manifest.chunks = append(manifest.chunks, chunk)
+	}
+	return manifest, nil
+}
+
+// AddReader adds the blob of the size from the reader, the blob bigger than the chunk size
+// is split into chunks, so it can be bigger than a data block and is never held in the memory.
+func (region *Region) AddReader(reader io.Reader, size int64) (*naming.Name, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("invalidate blob size: %d", size)
+	}
+	chunkSize := region.options.chunkSize()
+	if size <= int64(chunkSize) {
+		data := make([]byte, size)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return region.Add(data)
+	}
+	manifest := new(blobManifest)
+	manifest.size = size
+	manifest.chunkSize = chunkSize
+	buf := make([]byte, chunkSize)
+	for remain := size; remain > 0; {
+		n := chunkSize
+		if remain < int64(n) {
+			n = int(remain)
+		}
+		if _, err := io.ReadFull(reader, buf[:n]); err != nil {
+			region.deleteChunks(manifest.chunks)
+			return nil, err
+		}
+		chunk, err := region.Add(buf[:n])
+		if err != nil {
+			region.deleteChunks(manifest.chunks)
+			return nil, err
+		}
+		manifest.chunks = append(manifest.chunks, chunk)
+		remain -= int64(n)
+	}
+	region.blockLock.RLock()
+	name, err := region.add(manifest.encode(), dataTypeManifest)
+	region.blockLock.RUnlock()
+	if err != nil {
+		region.deleteChunks(manifest.chunks)
+		return nil, err
+	}
+	return name, nil
+}
+
+// the errors are ignored, the chunks are garbage if they are not deleted
+func (region *Region) deleteChunks(chunks []*naming.Name) {
+	for _, chunk := range chunks {
+		region.Delete(chunk)
+	}
+}
+
+// Open returns the reader of the blob, only one chunk is held in the memory,
+// and the checksum of every chunk is verified when it is read.
+func (region *Region) Open(name *naming.Name) (io.ReadSeekCloser, error) {
+	region.blockLock.RLock()
+	data, dataType, err := region.read(name)
+	region.blockLock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, fmt.Errorf("blob %s not found", name.String())
+	}
+	if dataType == dataTypeMeta {
+		meta, err := decodeBlobMeta(region.regionId, data)
+		if err != nil {
+			return nil, err
+		}
+		return region.Open(meta.body)
+	}
+	reader := new(blobReader)
+	reader.region = region
+	if dataType != dataTypeManifest {
+		reader.size = int64(len(data))
+		reader.chunkSize = len(data)
+		reader.chunks = []*naming.Name{name}
+		reader.chunk = data
+		reader.chunkIndex = 0
+		return reader, nil
+	}
+	manifest, err := decodeBlobManifest(region.regionId, data)
+	if err != nil {
+		return nil, err
+	}
+	reader.size = manifest.size
+	reader.chunkSize = manifest.chunkSize
+	reader.chunks = manifest.chunks
+	reader.chunkIndex = -1
+	return reader, nil
+}
+
+func (region *Region) readChunk(chunkName *naming.Name) ([]byte, error) {
+	region.blockLock.RLock()
+	defer region.blockLock.RUnlock()
+	chunk, _, err := region.read(chunkName)
+	if err != nil {
+		return nil, err
+	}
+	if chunk == nil {
+		return nil, fmt.Errorf("chunk %s of the blob not found", chunkName.String())
+	}
+	return chunk, nil
+}
+
+type blobReader struct {
+	region    *Region
+	size      int64
+	chunkSize int
+	chunks    []*naming.Name
+	offset    int64
+	// the current chunk
+	chunkIndex int
+	chunk      []byte
+	closed     bool
+}
+
+func (reader *blobReader) Read(p []byte) (int, error) {
+	if reader.closed {
+		return 0, fmt.Errorf("blob reader is closed")
+	}
+	if reader.offset >= reader.size {
+		return 0, io.EOF
+	}
+	index := int(reader.offset / int64(reader.chunkSize))
+	if index != reader.chunkIndex {
+		chunk, err := reader.region.readChunk(reader.chunks[index])
+		if err != nil {
+			return 0, err
+		}
+		chunkLen := reader.size - int64(index)*int64(reader.chunkSize)
+		if chunkLen > int64(reader.chunkSize) {
+			chunkLen = int64(reader.chunkSize)
+		}
+		if int64(len(chunk)) != chunkLen {
+			return 0, fmt.Errorf("the length of chunk %d not match", index)
+		}
+		reader.chunk = chunk
+		reader.chunkIndex = index
+	}
+	n := copy(p, reader.chunk[reader.offset-int64(index)*int64(reader.chunkSize):])
+	reader.offset += int64(n)
+	return n, nil
+}
+
+func (reader *blobReader) Seek(offset int64, whence int) (int64, error) {
+	if reader.closed {
+		return 0, fmt.Errorf("blob reader is closed")
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += reader.offset
+	case io.SeekEnd:
+		offset += reader.size
+	default:
+		return 0, fmt.Errorf("invalidate whence: %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position: %d", offset)
+	}
+	reader.offset = offset
+	return offset, nil
+}
+
+func (reader *blobReader) Close() error {
+	reader.closed = true
+	reader.chunk = nil
+	return nil
+}
+
+// ReadAt reads the length bytes from the offset of the blob, only the chunks and the segments
+// in the range are read and verified. The returned data is shorter if it reaches the end of the blob.
+func (region *Region) ReadAt(name *naming.Name, offset int64, length int) ([]byte, error) {
+	region.blockLock.RLock()
+	defer region.blockLock.RUnlock()
+	return region.readAt(name, offset, length)
+}
+
+// it must be called with the blockLock read locked
+func (region *Region) readAt(name *naming.Name, offset int64, length int) ([]byte, error) {
+	dataBlock, di, err := region.locate(name)
+	if err != nil {
+		return nil, err
+	}
+	if dataBlock == nil {
+		return nil, fmt.Errorf("blob %s not found", name.String())
+	}
+	dataType, err := dataBlock.readType(di)
+	if err != nil {
+		return nil, err
+	}
+	if dataType != dataTypeManifest && dataType != dataTypeMeta {
+		return dataBlock.readAt(di, offset, length)
+	}
+	data, err := dataBlock.Get(di)
+	if err != nil {
+		return nil, err
+	}
+	if dataType == dataTypeMeta {
+		meta, err := decodeBlobMeta(region.regionId, data)
+		if err != nil {
+			return nil, err
+		}
+		return region.readAt(meta.body, offset, length)
+	}
+	manifest, err := decodeBlobManifest(region.regionId, data)
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 || offset > manifest.size || length < 0 {
+		return nil, fmt.Errorf("invalidate range: %d, %d", offset, length)
+	}
+	if int64(length) > manifest.size-offset {
+		length = int(manifest.size - offset)
+	}
+	result := make([]byte, 0, length)
+	for length > 0 {
+		index := offset / int64(manifest.chunkSize)
+		chunkBlock, chunkIndex, err := region.locate(manifest.chunks[index])
+		if err != nil {
+			return nil, err
+		}
+		if chunkBlock == nil {
+			return nil, fmt.Errorf("chunk %s of the blob not found", manifest.chunks[index].String())
+		}
+		chunk, err := chunkBlock.readAt(chunkIndex, offset-index*int64(manifest.chunkSize), length)
+		if err != nil {
+			return nil, err
+		}
+		if len(chunk) == 0 {
+			return nil, fmt.Errorf("the length of chunk %d not match", index)
+		}
+		result = append(result, chunk...)
+		offset += int64(len(chunk))
+		length -= len(chunk)
+	}
+	return result, nil
+}
@@ -0,0 +1,196 @@
+package region
+
+import (
+	"testing"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"github.com/pister/yfs/common/vfs"
+)
+
+func TestAddReaderAndOpen(t *testing.T) {
+	options := DefaultOptions()
+	options.FS = vfs.NewMemFS()
+	options.DataBlockSize = 64 * 1024
+	options.ChunkSize = 1000
+	region, err := OpenRegionWithOptions(1, "/stream_test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// bigger than a data block
+	blob := make([]byte, 200*1024+123)
+	for i := range blob {
+		blob[i] = byte(i * 7)
+	}
+	name, err := region.AddReader(bytes.NewReader(blob), int64(len(blob)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	small, err := region.AddReader(bytes.NewReader([]byte("hello")), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := region.AddReader(bytes.NewReader(blob[:100]), 2000); err == nil {
+		t.Fatal("the reader is too short")
+	}
+
+	reader, err := region.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, blob) {
+		t.Fatal("data not match")
+	}
+	// seek across the chunks
+	if _, err := reader.Seek(-1500, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, blob[len(blob)-1500:]) {
+		t.Fatal("data not match after seeking")
+	}
+	reader.Seek(2500, io.SeekStart)
+	reader.Seek(10, io.SeekCurrent)
+	io.ReadFull(reader, buf[:10])
+	if !bytes.Equal(buf[:10], blob[2510:2520]) {
+		t.Fatal("data not match after seeking")
+	}
+	reader.Close()
+
+	data, err = region.Get(name)
+	if err != nil || !bytes.Equal(data, blob) {
+		t.Fatal("data not match", err)
+	}
+	reader, err = region.Open(small)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = ioutil.ReadAll(reader)
+	if string(data) != "hello" {
+		t.Fatal("data not match", string(data))
+	}
+
+	// the chunks are deleted with the blob
+	if err := region.Delete(name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := region.Open(name); err == nil {
+		t.Fatal("the blob should be deleted")
+	}
+	count, err := region.Vacuum(0.9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count == 0 {
+		t.Fatal("the chunks should be vacuumed")
+	}
+	region.Close()
+}
+
+func TestOpenChunkCorrupted(t *testing.T) {
+	options := DefaultOptions()
+	options.FS = vfs.NewMemFS()
+	options.ChunkSize = 100
+	region, err := OpenRegionWithOptions(1, "/stream_test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer region.Close()
+	blob := bytes.Repeat([]byte("0123456789"), 100)
+	name, err := region.AddReader(bytes.NewReader(blob), int64(len(blob)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// corrupt a chunk
+	data, _, err := region.read(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := decodeBlobManifest(region.regionId, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := manifest.chunks[5]
+	nameBlock, _ := region.nameBlocks.Get(chunk.NameBlockId)
+	di, _, _ := nameBlock.(*NameBlock).Get(chunk)
+	dataBlock, _ := region.dataBlocks.Get(di.blockId)
+	dataBlock.(*DataBlock).dataFile.UpdateByteAt(int64(di.position)+dataHeaderLength, 'x')
+	reader, err := region.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if _, err := ioutil.ReadAll(reader); err == nil {
+		t.Fatal("the checksum should fail")
+	}
+}
+
+func TestReadAt(t *testing.T) {
+	options := DefaultOptions()
+	options.FS = vfs.NewMemFS()
+	options.ChunkSize = 300 * 1024
+	region, err := OpenRegionWithOptions(1, "/stream_test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer region.Close()
+	blob := make([]byte, 1000*1024+17)
+	for i := range blob {
+		blob[i] = byte(i * 13)
+	}
+	chunked, err := region.AddReader(bytes.NewReader(blob), int64(len(blob)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := region.Add(blob[:200*1024])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranges := [][]int{{0, 10}, {65530, 20}, {300*1024 - 5, 10}, {len(blob) - 100, 100}, {len(blob) - 10, 100}, {len(blob), 10}, {1000, 0}}
+	for _, r := range ranges {
+		data, err := region.ReadAt(chunked, int64(r[0]), r[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		end := r[0] + r[1]
+		if end > len(blob) {
+			end = len(blob)
+		}
+		if !bytes.Equal(data, blob[r[0]:end]) {
+			t.Fatal("data not match", r)
+		}
+		if r[0] > 200*1024 {
+			continue
+		}
+		data, err = region.ReadAt(plain, int64(r[0]), r[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if end > 200*1024 {
+			end = 200 * 1024
+		}
+		if !bytes.Equal(data, blob[r[0]:end]) {
+			t.Fatal("data not match", r)
+		}
+	}
+	if _, err := region.ReadAt(plain, 200*1024+1, 1); err == nil {
+		t.Fatal("the offset is out of range")
+	}
+
+	// only the segments read are verified
+	dataBlock, di, _ := region.locate(plain)
+	dataBlock.dataFile.UpdateByteAt(int64(di.position)+dataHeaderLength+dataSegmentSize+1, 'x')
+	if _, err := region.ReadAt(plain, 0, dataSegmentSize); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := region.ReadAt(plain, dataSegmentSize-1, 2); err == nil {
+		t.Fatal("the checksum should fail")
+	}
+}
@@ -0,0 +1,450 @@
+package region
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"io/ioutil"
+	"github.com/pister/yfs/common/bytesutil"
+	"github.com/pister/yfs/common/hashutil"
+	"github.com/pister/yfs/common/ratelimit"
+)
+
+// the vacuum copies the live data of a data block into a new block, and then points the names to the new block.
+// The steps are:
+// 1, the data is copied into the vacuum_data_N and vacuum_index_N files, the old block is read only now.
+// 2, the positions of the copied data are saved in the vacuum_M file, M is the old block id.
+// 3, the vacuum files are renamed to the block files, and the names are rewritten.
+// 4, the old block files and the vacuum_M file are removed.
+// If it crashes before 2, the vacuum files are removed when opening, otherwise the steps after 2 are done again.
+const (
+	vacuumFileName      = "vacuum"
+	vacuumDataFileName  = "vacuum_data"
+	vacuumIndexFileName = "vacuum_index"
+	// the progress is reported after scanning the bytes
+	vacuumProgressBytes = 1024 * 1024
+)
+
+var vacuumFilePattern = regexp.MustCompile(`^vacuum_(\d+)$`)
+var vacuumTempFilePattern = regexp.MustCompile(`^vacuum_(data|index)_\d+$|^vacuum_\d+_tmp$`)
+
+type VacuumProgress struct {
+	BlockId    uint32
+	NewBlockId uint32
+	// the size of the old data file
+	TotalBytes   int64
+	ScannedBytes int64
+	// the bytes of the live data copied into the new block
+	CopiedBytes int64
+	Finished    bool
+}
+
+func (region *Region) reportVacuumProgress(progress VacuumProgress) {
+	if region.options.VacuumProgress != nil {
+		region.options.VacuumProgress(progress)
+	}
+}
+
+// Vacuum vacuums all the data blocks whose dead rate is not less than minDeadRate,
+// it returns the count of the vacuumed blocks.
+func (region *Region) Vacuum(minDeadRate float32) (int, error) {
+	blockIds := make([]uint32, 0)
+	region.dataBlocks.Foreach(func(key interface{}, value interface{}) (stop bool) {
+		dataBlock := value.(*DataBlock)
+		if dataBlock.deletedBytes.Get() > 0 && dataBlock.DeadRate() >= minDeadRate {
+			blockIds = append(blockIds, key.(uint32))
+		}
+		return false
+	})
+	for i, blockId := range blockIds {
+		if err := region.VacuumBlock(blockId); err != nil {
+			return i, err
+		}
+	}
+	return len(blockIds), nil
+}
+
+// VacuumBlock copies the live data of the data block into a new block and removes the old one,
+// the names of the data are still valid.
+func (region *Region) VacuumBlock(blockId uint32) error {
+	region.vacuumMutex.Lock()
+	defer region.vacuumMutex.Unlock()
+
+	value, exist := region.dataBlocks.Get(blockId)
+	if !exist {
+		return fmt.Errorf("data block[%d] not found", blockId)
+	}
+	oldBlock := value.(*DataBlock)
+
+	// no more data is added to the old block after the adding ones finish
+	region.blockLock.Lock()
+	oldBlock.setReadOnly(true)
+	region.blockLock.Unlock()
+
+	region.dataGrowLocker.Lock()
+	newBlockId := region.nextDataBlockId
+	region.nextDataBlockId++
+	region.dataGrowLocker.Unlock()
+
+	log.Info("region[%d] start vacuuming data block[%d] into [%d]", region.regionId, blockId, newBlockId)
+	positions, err := region.copyLiveData(oldBlock, newBlockId)
+	if err != nil {
+		oldBlock.setReadOnly(false)
+		region.removeVacuumTempFiles(newBlockId)
+		return err
+	}
+
+	// the names are found before locking, only the names added after it are scanned with the blockLock held
+	names := make(map[uint32]*vacuumNames)
+	if err := region.findNames(oldBlock.blockId, positions, names); err != nil {
+		oldBlock.setReadOnly(false)
+		region.removeVacuumTempFiles(newBlockId)
+		return err
+	}
+
+	region.blockLock.Lock()
+	err = region.switchDataBlock(oldBlock, newBlockId, positions, names)
+	region.blockLock.Unlock()
+	if err != nil {
+		return err
+	}
+	log.Info("region[%d] data block[%d] vacuumed into [%d], %d live data", region.regionId, blockId, newBlockId, len(positions))
+	return region.removeVacuumedBlock(blockId)
+}
+
+// returns the positions of the old data to the new ones
+func (region *Region) copyLiveData(oldBlock *DataBlock, newBlockId uint32) (map[uint32]uint32, error) {
+	dataPath := filepath.Join(region.regionPath, fmt.Sprintf("%s_%d", vacuumDataFileName, newBlockId))
+	indexPath := filepath.Join(region.regionPath, fmt.Sprintf("%s_%d", vacuumIndexFileName, newBlockId))
+	newBlock, err := openDataBlockFiles(region.fs, dataPath, indexPath, newBlockId, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer newBlock.Close()
+	newBlock.maxSize = region.options.dataBlockSize()
+
+	progress := VacuumProgress{BlockId: oldBlock.blockId, NewBlockId: newBlockId}
+	progress.TotalBytes = oldBlock.dataFile.GetFileLength()
+	positions := make(map[uint32]uint32)
+	header := make([]byte, dataHeaderLength)
+	var reported int64 = 0
+	for progress.ScannedBytes < progress.TotalBytes {
+		position := progress.ScannedBytes
+		_, n, err := oldBlock.dataFile.SeekAndReadData(position, header)
+		if err != nil {
+			return nil, err
+		}
+		if n < dataHeaderLength || header[0] != dataMagicCode0 || header[1] != dataMagicCode1 {
+			return nil, fmt.Errorf("invalidate data header at %d of data block[%d]", position, oldBlock.blockId)
+		}
+		dataLen := int64(bytesutil.GetUint32FromBytes(header, 2))
+		recordLen := dataRecordLengthOfHeader(header)
+		region.options.VacuumRateLimiter.Request(recordLen, ratelimit.PriorityLow)
+		if header[6] != dataFlagDeleted {
+			data := make([]byte, dataLen)
+			_, n, err := oldBlock.dataFile.SeekAndReadData(position+dataHeaderLength, data)
+			if err != nil {
+				return nil, err
+			}
+			if int64(n) < dataLen || bytesutil.GetUint32FromBytes(header, 8) != hashutil.SumHash32(data) {
+				return nil, fmt.Errorf("check sum fail at %d of data block[%d]", position, oldBlock.blockId)
+			}
+			di, err := newBlock.addWithType(data, header[7]&^dataTypeSegmented)
+			if err != nil {
+				return nil, err
+			}
+			positions[uint32(position)] = di.position
+			progress.CopiedBytes += recordLen
+		}
+		progress.ScannedBytes += recordLen
+		if progress.ScannedBytes-reported >= vacuumProgressBytes {
+			reported = progress.ScannedBytes
+			region.reportVacuumProgress(progress)
+		}
+	}
+	progress.Finished = true
+	region.reportVacuumProgress(progress)
+	return positions, nil
+}
+
+// it must be called with the blockLock held
+func (region *Region) switchDataBlock(oldBlock *DataBlock, newBlockId uint32, positions map[uint32]uint32, names map[uint32]*vacuumNames) error {
+	// the data deleted after copying
+	deleted := make([]uint32, 0)
+	for oldPosition, newPosition := range positions {
+		isDeleted, err := oldBlock.isDataDeleted(oldPosition)
+		if err != nil {
+			return err
+		}
+		if isDeleted {
+			deleted = append(deleted, newPosition)
+			delete(positions, oldPosition)
+		}
+	}
+	// the deleted ones are saved too, so they are deleted again when recovering
+	if err := region.writeVacuumFile(oldBlock.blockId, newBlockId, positions, deleted); err != nil {
+		return err
+	}
+	newBlock, err := region.openVacuumedBlock(newBlockId)
+	if err != nil {
+		return err
+	}
+	for _, newPosition := range deleted {
+		if err := newBlock.Delete(DataIndex{blockId: newBlockId, position: newPosition}); err != nil {
+			newBlock.Close()
+			return err
+		}
+	}
+	region.dataBlocks.Put(newBlockId, newBlock)
+	if err := region.findNames(oldBlock.blockId, positions, names); err != nil {
+		return err
+	}
+	if err := region.rewriteNames(oldBlock.blockId, newBlockId, positions, names); err != nil {
+		return err
+	}
+	return region.rewriteDedup(oldBlock.blockId, newBlockId, positions)
+}
+
+// renames the vacuum files to the block files if they are not renamed, and opens the block
+func (region *Region) openVacuumedBlock(newBlockId uint32) (*DataBlock, error) {
+	dataPath, indexPath := dataBlockPaths(region.regionPath, newBlockId)
+	renames := [][]string{
+		{filepath.Join(region.regionPath, fmt.Sprintf("%s_%d", vacuumDataFileName, newBlockId)), dataPath},
+		{filepath.Join(region.regionPath, fmt.Sprintf("%s_%d", vacuumIndexFileName, newBlockId)), indexPath},
+	}
+	for _, rename := range renames {
+		if _, err := region.fs.Stat(rename[0]); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		if err := region.fs.Rename(rename[0], rename[1]); err != nil {
+			return nil, err
+		}
+	}
+	newBlock, err := OpenDataBlockWithFS(region.fs, region.regionPath, newBlockId, regionDataBlockConcurrentReadSize)
+	if err != nil {
+		return nil, err
+	}
+	newBlock.maxSize = region.options.dataBlockSize()
+	return newBlock, nil
+}
+
+// the names of a name block which point to the vacuuming data block
+type vacuumNames struct {
+	namePositions []int64
+	// the entries before it are scanned
+	scanned int64
+}
+
+// finds the names which point to the old positions of the data block, the entries scanned before are skipped
+func (region *Region) findNames(oldBlockId uint32, positions map[uint32]uint32, names map[uint32]*vacuumNames) error {
+	var err error
+	region.nameBlocks.Foreach(func(key interface{}, value interface{}) (stop bool) {
+		nameBlock := value.(*NameBlock)
+		found, exist := names[nameBlock.blockId]
+		if !exist {
+			found = new(vacuumNames)
+			names[nameBlock.blockId] = found
+		}
+		to := nameBlock.file.GetFileLength()
+		var namePositions []int64
+		namePositions, err = nameBlock.findDataIndex(oldBlockId, positions, found.scanned, to)
+		if err != nil {
+			return true
+		}
+		found.namePositions = append(found.namePositions, namePositions...)
+		found.scanned = to
+		return false
+	})
+	return err
+}
+
+func (region *Region) rewriteNames(oldBlockId uint32, newBlockId uint32, positions map[uint32]uint32, names map[uint32]*vacuumNames) error {
+	var err error
+	region.nameBlocks.Foreach(func(key interface{}, value interface{}) (stop bool) {
+		nameBlock := value.(*NameBlock)
+		if found, exist := names[nameBlock.blockId]; exist {
+			_, err = nameBlock.rewriteDataIndex(oldBlockId, newBlockId, positions, found.namePositions)
+		}
+		return err != nil
+	})
+	return err
+}
+
+// closes and removes the old block, and the vacuum file at last
+func (region *Region) removeVacuumedBlock(oldBlockId uint32) error {
+	region.blockLock.Lock()
+	value, exist := region.dataBlocks.Get(oldBlockId)
+	region.dataBlocks.Delete(oldBlockId)
+	region.blockLock.Unlock()
+	if exist {
+		value.(*DataBlock).Close()
+	}
+	dataPath, indexPath := dataBlockPaths(region.regionPath, oldBlockId)
+	for _, path := range []string{dataPath, indexPath, region.vacuumFilePath(oldBlockId)} {
+		if err := region.fs.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (region *Region) removeVacuumTempFiles(newBlockId uint32) {
+	region.fs.Remove(filepath.Join(region.regionPath, fmt.Sprintf("%s_%d", vacuumDataFileName, newBlockId)))
+	region.fs.Remove(filepath.Join(region.regionPath, fmt.Sprintf("%s_%d", vacuumIndexFileName, newBlockId)))
+}
+
+func (region *Region) vacuumFilePath(oldBlockId uint32) string {
+	return filepath.Join(region.regionPath, fmt.Sprintf("%s_%d", vacuumFileName, oldBlockId))
+}
+
+// =================== VACUUM FILE FORMAT START ==================
+// 4 bytes new block id
+// 4 bytes count of positions
+// 8 bytes * count: 4 bytes old position, 4 bytes new position
+// 4 bytes count of deleted positions
+// 4 bytes * count: new position of the data deleted after copying
+// 4 bytes sumHash of the above
+// the old files have no deleted positions
+// =================== VACUUM FILE FORMAT END  ====================
+func (region *Region) writeVacuumFile(oldBlockId uint32, newBlockId uint32, positions map[uint32]uint32, deleted []uint32) error {
+	buf := make([]byte, 8+len(positions)*8+4+len(deleted)*4+4)
+	bytesutil.CopyUint32ToBytes(newBlockId, buf, 0)
+	bytesutil.CopyUint32ToBytes(uint32(len(positions)), buf, 4)
+	pos := 8
+	for oldPosition, newPosition := range positions {
+		bytesutil.CopyUint32ToBytes(oldPosition, buf, pos)
+		bytesutil.CopyUint32ToBytes(newPosition, buf, pos+4)
+		pos += 8
+	}
+	bytesutil.CopyUint32ToBytes(uint32(len(deleted)), buf, pos)
+	pos += 4
+	for _, newPosition := range deleted {
+		bytesutil.CopyUint32ToBytes(newPosition, buf, pos)
+		pos += 4
+	}
+	bytesutil.CopyUint32ToBytes(hashutil.SumHash32(buf[:pos]), buf, pos)
+
+	fileName := region.vacuumFilePath(oldBlockId)
+	tempFileName := fileName + "_tmp"
+	file, err := region.fs.Create(tempFileName)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(buf); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return region.fs.Rename(tempFileName, fileName)
+}
+
+// returns the new block id, the positions and the deleted new positions
+func (region *Region) readVacuumFile(oldBlockId uint32) (uint32, map[uint32]uint32, []uint32, error) {
+	file, err := region.fs.Open(region.vacuumFilePath(oldBlockId))
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer file.Close()
+	buf, err := ioutil.ReadAll(file)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if len(buf) < 12 {
+		return 0, nil, nil, fmt.Errorf("vacuum file of data block[%d] is broken", oldBlockId)
+	}
+	count := int(bytesutil.GetUint32FromBytes(buf, 4))
+	deletedCount := 0
+	if len(buf) != 8+count*8+4 {
+		if len(buf) < 8+count*8+4+4 {
+			return 0, nil, nil, fmt.Errorf("vacuum file of data block[%d] is broken", oldBlockId)
+		}
+		deletedCount = int(bytesutil.GetUint32FromBytes(buf, 8+count*8))
+		if len(buf) != 8+count*8+4+deletedCount*4+4 {
+			return 0, nil, nil, fmt.Errorf("vacuum file of data block[%d] is broken", oldBlockId)
+		}
+	}
+	if bytesutil.GetUint32FromBytes(buf, len(buf)-4) != hashutil.SumHash32(buf[:len(buf)-4]) {
+		return 0, nil, nil, fmt.Errorf("vacuum file of data block[%d] is broken", oldBlockId)
+	}
+	positions := make(map[uint32]uint32, count)
+	pos := 8
+	for i := 0; i < count; i++ {
+		positions[bytesutil.GetUint32FromBytes(buf, pos)] = bytesutil.GetUint32FromBytes(buf, pos+4)
+		pos += 8
+	}
+	deleted := make([]uint32, 0, deletedCount)
+	for i := 0; i < deletedCount; i++ {
+		deleted = append(deleted, bytesutil.GetUint32FromBytes(buf, pos+4+i*4))
+	}
+	return bytesutil.GetUint32FromBytes(buf, 0), positions, deleted, nil
+}
+
+// finishes the vacuums which are interrupted after the vacuum files are written, and removes the others
+func (region *Region) recoverVacuum() error {
+	names, err := region.fs.List(region.regionPath)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		matches := vacuumFilePattern.FindStringSubmatch(name)
+		if matches == nil {
+			continue
+		}
+		oldBlockId, err := strconv.Atoi(matches[1])
+		if err != nil {
+			return err
+		}
+		newBlockId, positions, deleted, err := region.readVacuumFile(uint32(oldBlockId))
+		if err != nil {
+			return err
+		}
+		log.Info("region[%d] recover the vacuum of data block[%d] into [%d]", region.regionId, oldBlockId, newBlockId)
+		value, exist := region.dataBlocks.Get(newBlockId)
+		if !exist {
+			newBlock, err := region.openVacuumedBlock(newBlockId)
+			if err != nil {
+				return err
+			}
+			region.dataBlocks.Put(newBlockId, newBlock)
+			value = newBlock
+		}
+		// the data deleted while copying may be live again if the vacuum was interrupted before deleting them
+		for _, newPosition := range deleted {
+			if err := value.(*DataBlock).Delete(DataIndex{blockId: newBlockId, position: newPosition}); err != nil {
+				return err
+			}
+		}
+		names := make(map[uint32]*vacuumNames)
+		if err := region.findNames(uint32(oldBlockId), positions, names); err != nil {
+			return err
+		}
+		if err := region.rewriteNames(uint32(oldBlockId), newBlockId, positions, names); err != nil {
+			return err
+		}
+		if err := region.rewriteDedup(uint32(oldBlockId), newBlockId, positions); err != nil {
+			return err
+		}
+		if err := region.removeVacuumedBlock(uint32(oldBlockId)); err != nil {
+			return err
+		}
+	}
+	for _, name := range names {
+		if vacuumTempFilePattern.MatchString(name) {
+			if err := region.fs.Remove(filepath.Join(region.regionPath, name)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+package region
+
+import (
+	"testing"
+	"fmt"
+	"github.com/pister/yfs/naming"
+	"github.com/pister/yfs/common/vfs"
+	"github.com/pister/yfs/common/bytesutil"
+)
+
+func addForVacuum(t *testing.T, region *Region, count int) ([]*naming.Name, []string) {
+	names := make([]*naming.Name, 0, count)
+	values := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		value := fmt.Sprintf("value-%d-%s", i, "0123456789abcdefghijklmnopqrstuvwxyz")
+		name, err := region.Add([]byte(value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+		values = append(values, value)
+	}
+	return names, values
+}
+
+func TestVacuum(t *testing.T) {
+	options := DefaultOptions()
+	options.FS = vfs.NewMemFS()
+	progresses := make([]VacuumProgress, 0)
+	options.VacuumProgress = func(progress VacuumProgress) {
+		progresses = append(progresses, progress)
+	}
+	region, err := OpenRegionWithOptions(1, "/vacuum_test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, values := addForVacuum(t, region, 200)
+	for i, name := range names {
+		if i%10 < 7 {
+			if err := region.Delete(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	blockIds := make(map[uint32]bool)
+	region.dataBlocks.Foreach(func(key interface{}, value interface{}) (stop bool) {
+		if rate := value.(*DataBlock).DeadRate(); rate < 0.4 {
+			t.Fatal("dead rate not match", rate)
+		}
+		blockIds[key.(uint32)] = true
+		return false
+	})
+	count, err := region.Vacuum(0.4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(blockIds) {
+		t.Fatal("vacuumed count not match", count)
+	}
+	if len(progresses) == 0 || !progresses[len(progresses)-1].Finished {
+		t.Fatal("progress not reported")
+	}
+	region.dataBlocks.Foreach(func(key interface{}, value interface{}) (stop bool) {
+		if blockIds[key.(uint32)] {
+			t.Fatal("the old block is not removed", key)
+		}
+		if rate := value.(*DataBlock).DeadRate(); rate != 0 {
+			t.Fatal("dead rate not match", rate)
+		}
+		return false
+	})
+	for blockId := range blockIds {
+		dataPath, _ := dataBlockPaths(region.regionPath, blockId)
+		if _, err := options.FS.Stat(dataPath); err == nil {
+			t.Fatal("the old block file is not removed", dataPath)
+		}
+	}
+	check := func(region *Region) {
+		for i, name := range names {
+			data, err := region.Get(name)
+			if i%10 < 7 {
+				if err == nil && data != nil {
+					t.Fatal("the deleted data should not exist", i)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != values[i] {
+				t.Fatal("data not match", i, string(data))
+			}
+		}
+	}
+	check(region)
+	// add after vacuuming
+	newNames, newValues := addForVacuum(t, region, 10)
+	region.Close()
+
+	region, err = OpenRegionWithOptions(1, "/vacuum_test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer region.Close()
+	check(region)
+	for i, name := range newNames {
+		data, err := region.Get(name)
+		if err != nil || string(data) != newValues[i] {
+			t.Fatal("data not match", i, err)
+		}
+	}
+}
+
+func TestVacuumRecover(t *testing.T) {
+	fs := vfs.NewFaultFS(vfs.NewMemFS())
+	options := DefaultOptions()
+	options.FS = fs
+	region, err := OpenRegionWithOptions(1, "/vacuum_test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, values := addForVacuum(t, region, 40)
+	for i, name := range names {
+		if i%2 == 0 {
+			region.Delete(name)
+		}
+	}
+	// fails after the vacuum file is written
+	fs.Inject(vfs.Fault{Op: vfs.OpRename, PathContains: "vacuum_index"})
+	blockId := uint32(0)
+	region.dataBlocks.Foreach(func(key interface{}, value interface{}) (stop bool) {
+		if value.(*DataBlock).deletedBytes.Get() > 0 {
+			blockId = key.(uint32)
+			return true
+		}
+		return false
+	})
+	if err := region.VacuumBlock(blockId); err == nil {
+		t.Fatal("the vacuum should fail")
+	}
+	region.Close()
+	fs.Reset()
+
+	region, err = OpenRegionWithOptions(1, "/vacuum_test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer region.Close()
+	if _, exist := region.dataBlocks.Get(blockId); exist {
+		t.Fatal("the old block should be removed")
+	}
+	fileNames, _ := fs.List(region.regionPath)
+	for _, fileName := range fileNames {
+		if vacuumFilePattern.MatchString(fileName) || vacuumTempFilePattern.MatchString(fileName) {
+			t.Fatal("the vacuum file should be removed", fileName)
+		}
+	}
+	for i, name := range names {
+		if i%2 == 0 {
+			continue
+		}
+		data, err := region.Get(name)
+		if err != nil || string(data) != values[i] {
+			t.Fatal("data not match", i, err)
+		}
+	}
+}
+
+func TestVacuumRecoverDeletedWhileCopying(t *testing.T) {
+	fs := vfs.NewFaultFS(vfs.NewMemFS())
+	options := DefaultOptions()
+	options.FS = fs
+	region, err := OpenRegionWithOptions(1, "/vacuum_deleted_test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, values := addForVacuum(t, region, 40)
+	for i, name := range names {
+		if i%2 == 0 {
+			region.Delete(name)
+		}
+	}
+	// the data is deleted after copying, and the vacuum fails after the vacuum file is written
+	region.options.VacuumProgress = func(progress VacuumProgress) {
+		if progress.Finished {
+			if err := region.Delete(names[1]); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	fs.Inject(vfs.Fault{Op: vfs.OpRename, PathContains: "vacuum_index"})
+	_, di, err := region.locate(names[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := region.VacuumBlock(di.blockId); err == nil {
+		t.Fatal("the vacuum should fail")
+	}
+	region.Close()
+	fs.Reset()
+
+	options.VacuumProgress = nil
+	region, err = OpenRegionWithOptions(1, "/vacuum_deleted_test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer region.Close()
+	// only the data deleted while copying is dead in the new block
+	newBlockId := di.blockId
+	for i := 3; i < len(names); i += 2 {
+		_, newDi, err := region.locate(names[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if newDi.blockId > newBlockId {
+			newBlockId = newDi.blockId
+		}
+	}
+	value, exist := region.dataBlocks.Get(newBlockId)
+	if !exist || newBlockId == di.blockId {
+		t.Fatal("the new block not found")
+	}
+	if value.(*DataBlock).deletedBytes.Get() == 0 {
+		t.Fatal("the data deleted while copying must be deleted again")
+	}
+	if data, _ := region.Get(names[1]); data != nil {
+		t.Fatal("the deleted data must not be found")
+	}
+	for i, name := range names {
+		if i%2 == 0 || i == 1 {
+			continue
+		}
+		data, err := region.Get(name)
+		if err != nil || string(data) != values[i] {
+			t.Fatal("data not match", i, err)
+		}
+	}
+}
+
+func TestVacuumFindNamesAgain(t *testing.T) {
+	options := DefaultOptions()
+	options.FS = vfs.NewMemFS()
+	region, err := OpenRegionWithOptions(1, "/vacuum_find_test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer region.Close()
+	names, _ := addForVacuum(t, region, 20)
+	_, di, err := region.locate(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	positions := map[uint32]uint32{di.position: 1234}
+	found := make(map[uint32]*vacuumNames)
+	if err := region.findNames(di.blockId, positions, found); err != nil {
+		t.Fatal(err)
+	}
+
+	// the name added and the name deleted after finding
+	value, _ := region.nameBlocks.Get(names[0].NameBlockId)
+	nameBlock := value.(*NameBlock)
+	added, err := nameBlock.Add(di)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := nameBlock.Delete(names[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := region.findNames(di.blockId, positions, found); err != nil {
+		t.Fatal(err)
+	}
+	if err := region.rewriteNames(di.blockId, 99, positions, found); err != nil {
+		t.Fatal(err)
+	}
+	newDi, exist, err := nameBlock.readEntry(added)
+	if err != nil || !exist {
+		t.Fatal("the added name not found", err)
+	}
+	if newDi.blockId != 99 || newDi.position != 1234 {
+		t.Fatal("the added name not rewritten", newDi)
+	}
+	buf := make([]byte, nameCookieItemLength)
+	if _, err := nameBlock.readEntryAt(int64(names[0].NamePosition), buf); err != nil {
+		t.Fatal(err)
+	}
+	if bytesutil.GetUint32FromBytes(buf, 4) != di.blockId {
+		t.Fatal("the deleted name should not be rewritten")
+	}
+}